@@ -0,0 +1,236 @@
+package boltstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"dtpc"
+	"dtpc/testsuite/example"
+)
+
+var (
+	// ErrInsufficientFunds is returned when a decrement would not leave a positive balance.
+	ErrInsufficientFunds = dtpc.ErrInsufficientFunds
+	// ErrPendingTransactionIDNotFound is returned by Rollback when the account has no such pending transaction.
+	ErrPendingTransactionIDNotFound = errors.New("pending transaction id not found")
+
+	// errAlreadyPending aborts an Update of an account that already holds the transaction.
+	errAlreadyPending = errors.New("transaction already pending")
+
+	accountsBucket = []byte("accounts")
+)
+
+// AccountStore is a bbolt implementation of the dtpc.AccountHandler interface.
+// bbolt serialises write transactions, so every operation reads and writes an account atomically without retries.
+//
+// AccountStore stores example.AccountDoc documents, expects example.Item transaction data and mirrors the semantics of example.HandlerImpl:
+//   - a decrement requires the balance to stay above zero;
+//   - Put replaces an account and clears its pending transactions;
+//   - Update of a transaction that is already pending succeeds without applying it again;
+//   - Commit of an unknown transaction ID succeeds;
+//   - Rollback of an unknown transaction ID returns ErrPendingTransactionIDNotFound.
+type AccountStore struct {
+	db *bolt.DB
+}
+
+// NewAccountStore initialises a new AccountStore and creates its bucket if necessary.
+func NewAccountStore(db *bolt.DB) (*AccountStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accountsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AccountStore{
+		db: db,
+	}, nil
+}
+
+// Get retrieves an account into retval, which must be an *example.AccountDoc.
+func (as *AccountStore) Get(ctx context.Context, accountID string, retval dtpc.Account) error {
+	doc, ok := retval.(*example.AccountDoc)
+	if !ok {
+		return fmt.Errorf("unsupported account type %T", retval)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return as.db.View(func(tx *bolt.Tx) error {
+		ad, err := getAccount(tx, accountID)
+		if err != nil {
+			return err
+		}
+		*doc = *ad
+		return nil
+	})
+}
+
+// Put inserts an example.AccountDoc, replacing any account with the same ID.
+func (as *AccountStore) Put(ctx context.Context, doc dtpc.Account) error {
+	var ad example.AccountDoc
+	switch d := doc.(type) {
+	case example.AccountDoc:
+		ad = d
+	case *example.AccountDoc:
+		ad = *d
+	default:
+		return fmt.Errorf("unsupported account type %T", doc)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ad.PendingTransactions = []string{}
+	if ad.Resources == nil {
+		ad.Resources = make(map[string]example.Item)
+	}
+	return as.db.Update(func(tx *bolt.Tx) error {
+		return putAccount(tx, &ad)
+	})
+}
+
+// Update updates an account by applying a transaction and adding the ID of the transaction to its pending transactions.
+func (as *AccountStore) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	item, err := example.ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := example.Decrement
+	if accountID == tr.Destination {
+		method = example.Increment
+	}
+
+	err = as.modify(ctx, accountID, func(ad *example.AccountDoc) error {
+		for _, pt := range ad.PendingTransactions {
+			if pt == transactionID {
+				return errAlreadyPending
+			}
+		}
+		if err := apply(ad, item, method, false); err != nil {
+			return err
+		}
+		ad.PendingTransactions = append([]string{transactionID}, ad.PendingTransactions...)
+		return nil
+	})
+	if err == errAlreadyPending {
+		return nil
+	}
+	return err
+}
+
+// Commit removes a transaction ID from the pending transactions of an account.
+func (as *AccountStore) Commit(ctx context.Context, accountID, transactionID string) error {
+	err := as.modify(ctx, accountID, func(ad *example.AccountDoc) error {
+		return removePending(ad, transactionID)
+	})
+	if err == ErrPendingTransactionIDNotFound {
+		return nil
+	}
+	return err
+}
+
+// Rollback recovers a failed transaction by applying the opposite logic of Update
+// and removes the transaction ID from the pending transactions of an account.
+func (as *AccountStore) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	item, err := example.ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := example.Increment
+	if accountID == tr.Destination {
+		method = example.Decrement
+	}
+
+	return as.modify(ctx, accountID, func(ad *example.AccountDoc) error {
+		if err := removePending(ad, transactionID); err != nil {
+			return err
+		}
+		return apply(ad, item, method, true)
+	})
+}
+
+// IsErrorPendingTransactionIDNotFound checks if a given error matches ErrPendingTransactionIDNotFound.
+func (as *AccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return err == ErrPendingTransactionIDNotFound
+}
+
+// IsErrorInsufficientFunds checks if a given error matches ErrInsufficientFunds.
+func (as *AccountStore) IsErrorInsufficientFunds(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds)
+}
+
+// modify reads an account, applies f and writes it back with an incremented version in a single bbolt transaction.
+func (as *AccountStore) modify(ctx context.Context, accountID string, f func(ad *example.AccountDoc) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return as.db.Update(func(tx *bolt.Tx) error {
+		ad, err := getAccount(tx, accountID)
+		if err != nil {
+			return err
+		}
+		if err := f(ad); err != nil {
+			return err
+		}
+		ad.Version++
+		return putAccount(tx, ad)
+	})
+}
+
+// apply applies an item to an account. A decrement must leave a positive balance, except for the rollback of a
+// credit, which may take the balance down to zero.
+func apply(ad *example.AccountDoc, item example.Item, method example.TransactionMethod, rollback bool) error {
+	resource, ok := ad.Resources[item.ID]
+	if !ok {
+		return fmt.Errorf("account %s has no resource with ID %s", ad.ID, item.ID)
+	}
+	switch method {
+	case example.Increment:
+		resource.Amount += item.Amount
+	case example.Decrement:
+		if resource.Amount < item.Amount || resource.Amount == item.Amount && !rollback {
+			return ErrInsufficientFunds
+		}
+		resource.Amount -= item.Amount
+	default:
+		return fmt.Errorf("unsupported transaction method %d", method)
+	}
+	ad.Resources[item.ID] = resource
+	return nil
+}
+
+func removePending(ad *example.AccountDoc, transactionID string) error {
+	for i, pt := range ad.PendingTransactions {
+		if pt == transactionID {
+			ad.PendingTransactions = append(ad.PendingTransactions[:i], ad.PendingTransactions[i+1:]...)
+			return nil
+		}
+	}
+	return ErrPendingTransactionIDNotFound
+}
+
+func getAccount(tx *bolt.Tx, accountID string) (*example.AccountDoc, error) {
+	v := tx.Bucket(accountsBucket).Get([]byte(accountID))
+	if v == nil {
+		return nil, errAccountNotFound
+	}
+	ad := &example.AccountDoc{}
+	if err := json.Unmarshal(v, ad); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+func putAccount(tx *bolt.Tx, ad *example.AccountDoc) error {
+	v, err := json.Marshal(ad)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(accountsBucket).Put([]byte(ad.ID), v)
+}
@@ -0,0 +1,211 @@
+package boltstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"dtpc"
+	"dtpc/testsuite/example"
+)
+
+func openStores(t *testing.T, path string) (*bolt.DB, *TransactionStore, *AccountStore) {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewTransactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := NewAccountStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, ts, as
+}
+
+func putAccounts(t *testing.T, as *AccountStore, amount int, ids ...string) {
+	for _, id := range ids {
+		doc := example.AccountDoc{
+			ID:        id,
+			Resources: map[string]example.Item{"item1": {ID: "item1", Amount: amount}},
+		}
+		if err := as.Put(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func mustGetAccount(t *testing.T, as *AccountStore, accountID string) example.AccountDoc {
+	ad := example.AccountDoc{}
+	if err := as.Get(context.Background(), accountID, &ad); err != nil {
+		t.Fatal(err)
+	}
+	return ad
+}
+
+func getTransactionRequest(source, destination string, amount int) dtpc.Request {
+	return dtpc.Request{
+		Source:      source,
+		Destination: destination,
+		Reference:   source + ":" + destination,
+		Data:        example.Item{ID: "item1", Amount: amount},
+	}
+}
+
+func TestStateIndex(t *testing.T) {
+	ctx := context.Background()
+	db, ts, _ := openStores(t, filepath.Join(t.TempDir(), "dtpc.db"))
+	defer db.Close()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := ts.Insert(ctx, "account1", "account2", fmt.Sprintf("account1:account2:%d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := ts.Insert(ctx, "account2", "account1", "account2:account1:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.UpdateState(ctx, ids[1], dtpc.Done); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := ts.GetTransactionsInState(ctx, dtpc.Pending, "account1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != ids[0] || pending[1].ID != ids[2] {
+		t.Fatalf("unexpected pending transactions %v", pending)
+	}
+	all, err := ts.GetAllTransactionsInState(ctx, dtpc.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("expected 3 pending transactions but got %d", len(all))
+	}
+	done, err := ts.GetAllTransactionsInState(ctx, dtpc.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].ID != ids[1] || done[0].TransactionState != dtpc.Done {
+		t.Fatalf("unexpected done transactions %v", done)
+	}
+
+	if _, err := ts.GetTransaction(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+}
+
+func TestStartTransaction(t *testing.T) {
+	ctx := context.Background()
+	db, ts, as := openStores(t, filepath.Join(t.TempDir(), "dtpc.db"))
+	defer db.Close()
+	putAccounts(t, as, 100, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	if _, err := srv.StartTransaction(ctx, getTransactionRequest("account1", "account2", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.StartTransaction(ctx, getTransactionRequest("account1", "account2", 90)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", ErrInsufficientFunds, err)
+	}
+
+	if ad := mustGetAccount(t, as, "account1"); ad.Resources["item1"].Amount != 90 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+	if ad := mustGetAccount(t, as, "account2"); ad.Resources["item1"].Amount != 110 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
+
+func TestUpdateIdempotent(t *testing.T) {
+	ctx := context.Background()
+	db, _, as := openStores(t, filepath.Join(t.TempDir(), "dtpc.db"))
+	defer db.Close()
+	putAccounts(t, as, 100, "account1", "account2")
+	req := getTransactionRequest("account1", "account2", 10)
+
+	for i := 0; i < 2; i++ {
+		if err := as.Update(ctx, "account1", "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ad := mustGetAccount(t, as, "account1"); ad.Resources["item1"].Amount != 90 || len(ad.PendingTransactions) != 1 || ad.Version != 1 {
+		t.Fatalf("expected a single update to be applied but got %+v", ad)
+	}
+}
+
+func TestRecoverTransactionsAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dtpc.db")
+	db, ts, as := openStores(t, path)
+	putAccounts(t, as, 30, "account1", "account2")
+
+	// Leave one transaction Applied and one Pending, as if the process died half way.
+	req := getTransactionRequest("account1", "account2", 10)
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := ts.Insert(ctx, req.Source, req.Destination, req.Reference, req.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, accountID := range []string{"account1", "account2"} {
+			if err := as.Update(ctx, accountID, id, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, id)
+	}
+	if _, err := ts.UpdateState(ctx, ids[0], dtpc.Applied); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, ts, as = openStores(t, path)
+	defer db.Close()
+	srv := dtpc.NewService(ts, as)
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]dtpc.TransactionState{
+		ids[0]: dtpc.Done,
+		ids[1]: dtpc.Cancelled,
+	}
+	for id, state := range expected {
+		tr, err := ts.GetTransaction(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.TransactionState != state {
+			t.Fatalf("expected transaction state to be %d but got %d", state, tr.TransactionState)
+		}
+	}
+	for _, s := range []dtpc.TransactionState{dtpc.Pending, dtpc.Applied, dtpc.Canceling} {
+		trs, err := ts.GetAllTransactionsInState(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trs) > 0 {
+			t.Fatalf("expected no transactions in state %d but got %d", s, len(trs))
+		}
+	}
+	if ad := mustGetAccount(t, as, "account1"); ad.Resources["item1"].Amount != 20 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+	if ad := mustGetAccount(t, as, "account2"); ad.Resources["item1"].Amount != 40 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
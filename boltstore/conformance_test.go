@@ -0,0 +1,26 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"dtpc"
+	"dtpc/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+		db, _, as := openStores(t, filepath.Join(t.TempDir(), "dtpc.db"))
+		t.Cleanup(func() {
+			db.Close()
+		})
+		return conformance.ExampleAccountFixture(as)
+	})
+	conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+		db, ts, _ := openStores(t, filepath.Join(t.TempDir(), "dtpc.db"))
+		t.Cleanup(func() {
+			db.Close()
+		})
+		return ts
+	})
+}
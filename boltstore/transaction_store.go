@@ -0,0 +1,197 @@
+// Package boltstore provides implementations of the dtpc handler interfaces backed by an embedded bbolt file,
+// for single-node deployments without a database server.
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+
+	"dtpc"
+)
+
+var (
+	// ErrNotFound is returned when a transaction or an account does not exist.
+	// The errors also match dtpc.ErrTransactionNotFound or dtpc.ErrAccountNotFound.
+	ErrNotFound = errors.New("not found")
+
+	errTransactionNotFound = dtpc.WrapError(dtpc.ErrTransactionNotFound, ErrNotFound)
+	errAccountNotFound     = dtpc.WrapError(dtpc.ErrAccountNotFound, ErrNotFound)
+
+	transactionsBucket = []byte("transactions")
+	// stateIndexBucket emulates the state-index GSI of the DynamoDB TransactionStore.
+	// Keys are <state>\x00<reference>\x00<id> and values are empty.
+	stateIndexBucket = []byte("state-index")
+)
+
+// Open opens or creates a bbolt file that can be shared by a TransactionStore and an AccountStore.
+func Open(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// TransactionStore is a bbolt implementation of the dtpc.TransactionHandler interface.
+// Every write is a single bbolt transaction that updates the transaction and the state index together,
+// so that the index stays consistent after a process crash.
+type TransactionStore struct {
+	db *bolt.DB
+}
+
+// NewTransactionStore initialises a new TransactionStore and creates its buckets if necessary.
+func NewTransactionStore(db *bolt.DB) (*TransactionStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{transactionsBucket, stateIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionStore{
+		db: db,
+	}, nil
+}
+
+// Insert adds a transaction in Pending state.
+func (ts *TransactionStore) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
+	return ts.InsertWithExpiry(ctx, source, destination, reference, data, time.Time{})
+}
+
+// InsertWithExpiry adds a transaction with a deadline in Pending state.
+func (ts *TransactionStore) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
+	id := uuid.New().String()
+	if err := ctx.Err(); err != nil {
+		return id, err
+	}
+
+	t := dtpc.NewTransaction(id, source, destination, reference, data, expiresAt)
+
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		return putTransaction(tx, t)
+	})
+	return id, err
+}
+
+// UpdateState updates the state of a transaction and moves it to the new state in the state index.
+// The state of a finished transaction can only be set again to the same state, and the new state must be able to
+// follow the current state.
+func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState dtpc.TransactionState) (*dtpc.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var t *dtpc.Transaction
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getTransaction(tx, id)
+		if err != nil {
+			return err
+		}
+		if !t.TransactionState.CanChangeTo(newState) {
+			return dtpc.TransitionError(id, t.TransactionState, newState)
+		}
+		if err := tx.Bucket(stateIndexBucket).Delete(stateIndexKey(t.TransactionState, t.TransactionReference, t.ID)); err != nil {
+			return err
+		}
+		t.TransactionState = newState
+		t.LastModified = time.Now()
+		return putTransaction(tx, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTransaction retrieves a transaction by its ID value.
+func (ts *TransactionStore) GetTransaction(ctx context.Context, id string) (*dtpc.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var t *dtpc.Transaction
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getTransaction(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTransactionsInState gets all transactions of a given state whose reference starts with query.
+func (ts *TransactionStore) GetTransactionsInState(ctx context.Context, state dtpc.TransactionState, query string) ([]*dtpc.Transaction, error) {
+	return ts.scan(ctx, append(statePrefix(state), query...))
+}
+
+// GetAllTransactionsInState gets all transactions of a given state.
+// GetAllTransactionsInState is used for recovering all incomplete/failed transactions.
+func (ts *TransactionStore) GetAllTransactionsInState(ctx context.Context, state dtpc.TransactionState) ([]*dtpc.Transaction, error) {
+	return ts.scan(ctx, statePrefix(state))
+}
+
+// scan returns the transactions of all state index entries starting with prefix, ordered by reference and ID.
+func (ts *TransactionStore) scan(ctx context.Context, prefix []byte) ([]*dtpc.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	transactions := []*dtpc.Transaction{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(stateIndexBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id := k[bytes.LastIndexByte(k, 0)+1:]
+			t, err := getTransaction(tx, string(id))
+			if err != nil {
+				return err
+			}
+			transactions = append(transactions, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func getTransaction(tx *bolt.Tx, id string) (*dtpc.Transaction, error) {
+	v := tx.Bucket(transactionsBucket).Get([]byte(id))
+	if v == nil {
+		return nil, errTransactionNotFound
+	}
+	t := &dtpc.Transaction{}
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func putTransaction(tx *bolt.Tx, t *dtpc.Transaction) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(transactionsBucket).Put([]byte(t.ID), v); err != nil {
+		return err
+	}
+	return tx.Bucket(stateIndexBucket).Put(stateIndexKey(t.TransactionState, t.TransactionReference, t.ID), []byte{})
+}
+
+func statePrefix(state dtpc.TransactionState) []byte {
+	return []byte(fmt.Sprintf("%d\x00", state))
+}
+
+func stateIndexKey(state dtpc.TransactionState, reference, id string) []byte {
+	return append(statePrefix(state), reference+"\x00"+id...)
+}
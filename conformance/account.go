@@ -0,0 +1,300 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"dtpc"
+)
+
+// concurrency is the number of concurrent calls of the concurrency test cases.
+const concurrency = 10
+
+// RunAccountHandlerSuite verifies that an AccountHandler behaves as dtpc.Service expects:
+//   - Put and Get round trip account documents, and Get of an unknown account fails with dtpc.ErrAccountNotFound;
+//   - Update decrements the source, increments the destination and adds the transaction to the pending list;
+//   - a repeated Update of a transaction is a no-op;
+//   - Update of a source with insufficient funds fails with dtpc.ErrInsufficientFunds without changing the account;
+//   - Commit removes the transaction from the pending list and is idempotent;
+//   - Rollback reverts Update, and Rollback of an unknown transaction fails with an error recognised by
+//     IsErrorPendingTransactionIDNotFound;
+//   - Rollback of a transaction may take the balance of the destination down to zero, and Rollback of a transaction
+//     whose amount the destination has spent fails with dtpc.ErrInsufficientFunds;
+//   - concurrent Updates and Commits of an account are all applied.
+//
+// Errors match the dtpc errors with errors.Is. Insufficient funds may instead be recognised by the
+// IsErrorInsufficientFunds method of handlers implementing InsufficientFundsChecker.
+func RunAccountHandlerSuite(t *testing.T, factory AccountHandlerFactory) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, s *accountSuite)
+	}{
+		{"PutGet", testPutGet},
+		{"GetUnknownAccount", testGetUnknownAccount},
+		{"Update", testUpdate},
+		{"UpdateRepeated", testUpdateRepeated},
+		{"UpdateInsufficientFunds", testUpdateInsufficientFunds},
+		{"Commit", testCommit},
+		{"Rollback", testRollback},
+		{"RollbackUnknownTransaction", testRollbackUnknownTransaction},
+		{"RollbackToZero", testRollbackToZero},
+		{"RollbackSpentDestination", testRollbackSpentDestination},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, &accountSuite{AccountFixture: factory(t)})
+		})
+	}
+}
+
+type accountSuite struct {
+	AccountFixture
+}
+
+func (s *accountSuite) put(t *testing.T, balance int, names ...string) []string {
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = uniqueName(t, name)
+		if err := s.Handler.Put(context.Background(), s.NewAccount(ids[i], balance)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func (s *accountSuite) get(t *testing.T, id string) dtpc.Account {
+	doc := s.EmptyAccount()
+	if err := s.Handler.Get(context.Background(), id, doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// expect checks the balance and the pending transactions of an account.
+func (s *accountSuite) expect(t *testing.T, id string, balance int, pending ...string) {
+	t.Helper()
+	doc := s.get(t, id)
+	if b := s.Balance(doc); b != balance {
+		t.Fatalf("expected account %s to have a balance of %d but got %d", id, balance, b)
+	}
+	pts := doc.GetPendingTransactions()
+	if len(pts) != len(pending) {
+		t.Fatalf("expected account %s to have pending transactions %v but got %v", id, pending, pts)
+	}
+	for _, p := range pending {
+		if !contains(pts, p) {
+			t.Fatalf("expected account %s to have pending transactions %v but got %v", id, pending, pts)
+		}
+	}
+}
+
+func (s *accountSuite) request(source, destination string, amount int) dtpc.Request {
+	return dtpc.Request{
+		Source:      source,
+		Destination: destination,
+		Reference:   source + ":" + destination,
+		Data:        s.Data(amount),
+	}
+}
+
+func (s *accountSuite) isErrorInsufficientFunds(err error) bool {
+	if errors.Is(err, dtpc.ErrInsufficientFunds) {
+		return true
+	}
+	c, ok := s.Handler.(InsufficientFundsChecker)
+	return ok && c.IsErrorInsufficientFunds(err)
+}
+
+func testPutGet(t *testing.T, s *accountSuite) {
+	ids := s.put(t, 100, "account")
+	doc := s.get(t, ids[0])
+	if doc.GetID() != ids[0] {
+		t.Fatalf("expected account %s but got %s", ids[0], doc.GetID())
+	}
+	s.expect(t, ids[0], 100)
+}
+
+func testGetUnknownAccount(t *testing.T, s *accountSuite) {
+	err := s.Handler.Get(context.Background(), uniqueName(t, "unknown"), s.EmptyAccount())
+	if !errors.Is(err, dtpc.ErrAccountNotFound) {
+		t.Fatalf("expected Get of an unknown account to fail with %v but got %v", dtpc.ErrAccountNotFound, err)
+	}
+}
+
+func testUpdate(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 100, "source", "destination")
+	req := s.request(ids[0], ids[1], 10)
+
+	version := s.get(t, ids[0]).GetVersion()
+	if err := s.Handler.Update(ctx, ids[0], "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Handler.Update(ctx, ids[1], "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(t, ids[0], 90, "transaction")
+	s.expect(t, ids[1], 110, "transaction")
+	if v := s.get(t, ids[0]).GetVersion(); v <= version {
+		t.Fatalf("expected the version of account %s to increase from %d but got %d", ids[0], version, v)
+	}
+}
+
+func testUpdateRepeated(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 100, "source", "destination")
+	req := s.request(ids[0], ids[1], 10)
+
+	// An Update is retried when its first attempt succeeded but the response was lost.
+	for i := 0; i < 2; i++ {
+		for _, id := range ids {
+			if err := s.Handler.Update(ctx, id, "transaction", req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.expect(t, ids[0], 90, "transaction")
+	s.expect(t, ids[1], 110, "transaction")
+}
+
+func testUpdateInsufficientFunds(t *testing.T, s *accountSuite) {
+	ids := s.put(t, 10, "source", "destination")
+	err := s.Handler.Update(context.Background(), ids[0], "transaction", s.request(ids[0], ids[1], 20))
+	if !s.isErrorInsufficientFunds(err) {
+		t.Fatalf("expected Update with insufficient funds to fail with %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+	s.expect(t, ids[0], 10)
+}
+
+func testCommit(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 100, "source", "destination")
+	req := s.request(ids[0], ids[1], 10)
+	for _, id := range ids {
+		if err := s.Handler.Update(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recovery commits transactions again after a partial commit.
+	for i := 0; i < 2; i++ {
+		for _, id := range ids {
+			if err := s.Handler.Commit(ctx, id, "transaction"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.expect(t, ids[0], 90)
+	s.expect(t, ids[1], 110)
+}
+
+func testRollback(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 100, "source", "destination")
+	req := s.request(ids[0], ids[1], 10)
+	for _, id := range ids {
+		if err := s.Handler.Update(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{ids[1], ids[0]} {
+		if err := s.Handler.Rollback(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.expect(t, ids[0], 100)
+	s.expect(t, ids[1], 100)
+
+	// Recovery rolls back transactions again after a partial rollback.
+	for _, id := range ids {
+		err := s.Handler.Rollback(ctx, id, "transaction", req)
+		if !s.Handler.IsErrorPendingTransactionIDNotFound(err) {
+			t.Fatalf("expected a repeated Rollback to fail with a pending transaction not found error but got %v", err)
+		}
+	}
+	s.expect(t, ids[0], 100)
+	s.expect(t, ids[1], 100)
+}
+
+func testRollbackUnknownTransaction(t *testing.T, s *accountSuite) {
+	ids := s.put(t, 100, "source", "destination")
+	err := s.Handler.Rollback(context.Background(), ids[0], "unknown", s.request(ids[0], ids[1], 10))
+	if !s.Handler.IsErrorPendingTransactionIDNotFound(err) {
+		t.Fatalf("expected Rollback of an unknown transaction to fail with a pending transaction not found error but got %v", err)
+	}
+	if s.Handler.IsErrorPendingTransactionIDNotFound(errors.New("other error")) {
+		t.Fatal(fmt.Errorf("expected other errors not to be recognised as pending transaction not found"))
+	}
+	s.expect(t, ids[0], 100)
+}
+
+func testRollbackToZero(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 10, "source", "destination", "other")
+	req := s.request(ids[0], ids[1], 10)
+	if err := s.Handler.Update(ctx, ids[1], "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	// The destination spends its balance before the transaction.
+	if err := s.Handler.Update(ctx, ids[1], "spend", s.request(ids[1], ids[2], 9)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Handler.Rollback(ctx, ids[1], "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(t, ids[1], 1, "spend")
+}
+
+func testRollbackSpentDestination(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 10, "source", "destination", "other")
+	req := s.request(ids[0], ids[1], 10)
+	if err := s.Handler.Update(ctx, ids[1], "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	// The destination spends the transferred amount.
+	if err := s.Handler.Update(ctx, ids[1], "spend", s.request(ids[1], ids[2], 15)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Handler.Rollback(ctx, ids[1], "transaction", req)
+	if !s.isErrorInsufficientFunds(err) {
+		t.Fatalf("expected Rollback of a spent transaction to fail with insufficient funds but got %v", err)
+	}
+	s.expect(t, ids[1], 5, "transaction", "spend")
+}
+
+func testConcurrentUpdates(t *testing.T, s *accountSuite) {
+	ctx := context.Background()
+	ids := s.put(t, 100, "source", "destination")
+	req := s.request(ids[0], ids[1], 1)
+	transactionIDs := make([]string, concurrency)
+	for i := range transactionIDs {
+		transactionIDs[i] = fmt.Sprintf("transaction%d", i)
+	}
+
+	runConcurrently(t, func(i int) error {
+		return s.Handler.Update(ctx, ids[0], transactionIDs[i], req)
+	})
+	s.expect(t, ids[0], 100-concurrency, transactionIDs...)
+
+	runConcurrently(t, func(i int) error {
+		return s.Handler.Commit(ctx, ids[0], transactionIDs[i])
+	})
+	s.expect(t, ids[0], 100-concurrency)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
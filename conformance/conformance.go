@@ -0,0 +1,86 @@
+// Package conformance contains test suites that verify AccountHandler and TransactionHandler implementations
+// behave as dtpc.Service expects.
+//
+// Call the suites from a test of the implementation:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+//			return conformance.ExampleAccountFixture(NewAccountStore(...))
+//		})
+//		conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+//			return NewTransactionStore(...)
+//		})
+//	}
+//
+// The factories are called once per test case with the *testing.T of the test case, so they can register
+// cleanups. Test cases use distinct account IDs and transaction references, so factories may also return
+// handlers of a shared store.
+package conformance
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"dtpc"
+	"dtpc/testsuite/example"
+)
+
+// AccountFixture adapts an AccountHandler and the types of its account documents and transaction data to the suite.
+type AccountFixture struct {
+	// Handler under test
+	Handler dtpc.AccountHandler
+	// NewAccount returns an account document with the given ID, a balance and no pending transactions.
+	NewAccount func(id string, balance int) dtpc.Account
+	// EmptyAccount returns a pointer to an empty account document for Get.
+	EmptyAccount func() dtpc.Account
+	// Data returns the transaction data of a transfer of amount.
+	Data func(amount int) interface{}
+	// Balance returns the balance of an account document returned by EmptyAccount.
+	Balance func(doc dtpc.Account) int
+}
+
+// InsufficientFundsChecker is implemented by AccountHandlers that report updates rejected for insufficient funds
+// with errors not matching dtpc.ErrInsufficientFunds.
+type InsufficientFundsChecker interface {
+	IsErrorInsufficientFunds(err error) bool
+}
+
+// AccountHandlerFactory returns a fixture of the AccountHandler under test.
+type AccountHandlerFactory func(t *testing.T) AccountFixture
+
+// TransactionHandlerFactory returns the TransactionHandler under test.
+type TransactionHandlerFactory func(t *testing.T) dtpc.TransactionHandler
+
+// exampleItemID is the resource transferred by fixtures of example.AccountDoc handlers.
+const exampleItemID = "item"
+
+// ExampleAccountFixture returns a fixture of an AccountHandler that stores example.AccountDoc documents
+// and expects example.Item transaction data, such as example.HandlerImpl.
+func ExampleAccountFixture(h dtpc.AccountHandler) AccountFixture {
+	return AccountFixture{
+		Handler: h,
+		NewAccount: func(id string, balance int) dtpc.Account {
+			return &example.AccountDoc{
+				ID:                  id,
+				Resources:           map[string]example.Item{exampleItemID: {ID: exampleItemID, Amount: balance}},
+				PendingTransactions: []string{},
+			}
+		},
+		EmptyAccount: func() dtpc.Account {
+			return &example.AccountDoc{}
+		},
+		Data: func(amount int) interface{} {
+			return example.Item{ID: exampleItemID, Amount: amount}
+		},
+		Balance: func(doc dtpc.Account) int {
+			return doc.(*example.AccountDoc).Resources[exampleItemID].Amount
+		},
+	}
+}
+
+// uniqueName returns a name derived from the test name that is unique across the test cases of a suite.
+func uniqueName(t *testing.T, suffix string) string {
+	name := strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	return fmt.Sprintf("%s-%s", name, suffix)
+}
@@ -0,0 +1,316 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dtpc"
+)
+
+// RunTransactionHandlerSuite verifies that a TransactionHandler behaves as dtpc.Service expects:
+//   - Insert returns unique IDs of Pending transactions with the given accounts and reference;
+//   - InsertWithExpiry also stores the deadline, if the handler implements dtpc.ExpiringInserter;
+//   - GetTransaction and UpdateState of an unknown transaction fail with dtpc.ErrTransactionNotFound;
+//   - UpdateState changes the state, advances the last modification time and is idempotent;
+//   - UpdateState of a Done or Cancelled transaction to another state fails with dtpc.ErrTransactionFinished;
+//   - UpdateState to a state that cannot follow the current state fails with dtpc.ErrInvalidTransition, in particular
+//     Applied transactions cannot be cancelled and Canceling transactions cannot be applied or committed;
+//   - GetTransactionsInState and GetAllTransactionsInState return the transactions in a state,
+//     filtered by a reference prefix;
+//   - concurrent Inserts and UpdateStates are all applied.
+//
+// Expiry times must be stored with at least millisecond precision.
+func RunTransactionHandlerSuite(t *testing.T, factory TransactionHandlerFactory) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, th dtpc.TransactionHandler)
+	}{
+		{"Insert", testInsert},
+		{"InsertWithExpiry", testInsertWithExpiry},
+		{"GetUnknownTransaction", testGetUnknownTransaction},
+		{"UpdateState", testUpdateState},
+		{"UpdateStateUnknownTransaction", testUpdateStateUnknownTransaction},
+		{"UpdateStateFinished", testUpdateStateFinished},
+		{"UpdateStateTransitions", testUpdateStateTransitions},
+		{"GetTransactionsInState", testGetTransactionsInState},
+		{"ConcurrentInserts", testConcurrentInserts},
+		{"ConcurrentUpdateStates", testConcurrentUpdateStates},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, factory(t))
+		})
+	}
+}
+
+func insert(t *testing.T, th dtpc.TransactionHandler, reference string) string {
+	id, err := th.Insert(context.Background(), "source", "destination", reference, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal(fmt.Errorf("expected Insert to return a transaction ID"))
+	}
+	return id
+}
+
+func getTransaction(t *testing.T, th dtpc.TransactionHandler, id string) *dtpc.Transaction {
+	tr, err := th.GetTransaction(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.ID != id {
+		t.Fatalf("expected transaction %s but got %+v", id, tr)
+	}
+	return tr
+}
+
+// expectIDs checks that transactions have exactly the given IDs in any order.
+func expectIDs(t *testing.T, trs []*dtpc.Transaction, ids ...string) {
+	t.Helper()
+	got := make([]string, len(trs))
+	for i, tr := range trs {
+		got[i] = tr.ID
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("expected transactions %v but got %v", ids, got)
+	}
+	for _, id := range ids {
+		if !contains(got, id) {
+			t.Fatalf("expected transactions %v but got %v", ids, got)
+		}
+	}
+}
+
+func testInsert(t *testing.T, th dtpc.TransactionHandler) {
+	reference := uniqueName(t, "reference")
+	id := insert(t, th, reference)
+	if other := insert(t, th, reference); other == id {
+		t.Fatalf("expected unique transaction IDs but got %s twice", id)
+	}
+
+	tr := getTransaction(t, th, id)
+	if tr.TransactionState != dtpc.Pending {
+		t.Fatalf("expected a pending transaction but got state %d", tr.TransactionState)
+	}
+	if tr.Source != "source" || tr.Destination != "destination" || tr.TransactionReference != reference {
+		t.Fatalf("expected transaction from source to destination with reference %s but got %+v", reference, tr)
+	}
+	if tr.LastModified.IsZero() {
+		t.Fatal(fmt.Errorf("expected Insert to set the last modification time"))
+	}
+	if !tr.ExpiresAt.IsZero() {
+		t.Fatalf("expected a transaction without expiry but got %v", tr.ExpiresAt)
+	}
+}
+
+func testInsertWithExpiry(t *testing.T, th dtpc.TransactionHandler) {
+	ei, ok := th.(dtpc.ExpiringInserter)
+	if !ok {
+		t.Skip("the transaction handler does not implement dtpc.ExpiringInserter")
+	}
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	id, err := ei.InsertWithExpiry(context.Background(), "source", "destination", uniqueName(t, "reference"), nil, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := getTransaction(t, th, id)
+	if !tr.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected the transaction to expire at %v but got %v", expiresAt, tr.ExpiresAt)
+	}
+}
+
+func testUpdateState(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	id := insert(t, th, uniqueName(t, "reference"))
+	inserted := getTransaction(t, th, id)
+
+	// Recovery changes the state again after a lost response.
+	for i := 0; i < 2; i++ {
+		tr, err := th.UpdateState(ctx, id, dtpc.Applied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.ID != id || tr.TransactionState != dtpc.Applied {
+			t.Fatalf("expected UpdateState to return the applied transaction %s but got %+v", id, tr)
+		}
+	}
+	tr := getTransaction(t, th, id)
+	if tr.TransactionState != dtpc.Applied {
+		t.Fatalf("expected an applied transaction but got state %d", tr.TransactionState)
+	}
+	if tr.LastModified.Before(inserted.LastModified) {
+		t.Fatalf("expected the last modification time to advance from %v but got %v", inserted.LastModified, tr.LastModified)
+	}
+}
+
+func testGetUnknownTransaction(t *testing.T, th dtpc.TransactionHandler) {
+	_, err := th.GetTransaction(context.Background(), uniqueName(t, "unknown"))
+	if !errors.Is(err, dtpc.ErrTransactionNotFound) {
+		t.Fatalf("expected GetTransaction of an unknown transaction to fail with %v but got %v", dtpc.ErrTransactionNotFound, err)
+	}
+}
+
+func testUpdateStateUnknownTransaction(t *testing.T, th dtpc.TransactionHandler) {
+	_, err := th.UpdateState(context.Background(), uniqueName(t, "unknown"), dtpc.Applied)
+	if !errors.Is(err, dtpc.ErrTransactionNotFound) {
+		t.Fatalf("expected UpdateState of an unknown transaction to fail with %v but got %v", dtpc.ErrTransactionNotFound, err)
+	}
+}
+
+func testUpdateStateFinished(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	for _, final := range []dtpc.TransactionState{dtpc.Done, dtpc.Cancelled} {
+		id := insert(t, th, uniqueName(t, fmt.Sprintf("reference:%d", final)))
+		if final == dtpc.Cancelled {
+			if _, err := th.UpdateState(ctx, id, dtpc.Canceling); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := th.UpdateState(ctx, id, final); err != nil {
+			t.Fatal(err)
+		}
+		// Recovery sets the final state again after a lost response.
+		if _, err := th.UpdateState(ctx, id, final); err != nil {
+			t.Fatal(err)
+		}
+		for _, state := range []dtpc.TransactionState{dtpc.Pending, dtpc.Applied, dtpc.Done, dtpc.Canceling, dtpc.Cancelled} {
+			if state == final {
+				continue
+			}
+			if _, err := th.UpdateState(ctx, id, state); !errors.Is(err, dtpc.ErrTransactionFinished) {
+				t.Fatalf("expected UpdateState of a transaction in state %d to %d to fail with %v but got %v", final, state, dtpc.ErrTransactionFinished, err)
+			}
+		}
+		if tr := getTransaction(t, th, id); tr.TransactionState != final {
+			t.Fatalf("expected the transaction to stay in state %d but got %d", final, tr.TransactionState)
+		}
+	}
+}
+
+func testUpdateStateTransitions(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	refused := map[dtpc.TransactionState][]dtpc.TransactionState{
+		dtpc.Pending:   {dtpc.Cancelled},
+		dtpc.Applied:   {dtpc.Pending, dtpc.Canceling, dtpc.Cancelled},
+		dtpc.Canceling: {dtpc.Pending, dtpc.Applied, dtpc.Done},
+	}
+	for _, current := range []dtpc.TransactionState{dtpc.Pending, dtpc.Applied, dtpc.Canceling} {
+		id := insert(t, th, uniqueName(t, fmt.Sprintf("reference:%d", current)))
+		if current != dtpc.Pending {
+			if _, err := th.UpdateState(ctx, id, current); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, state := range refused[current] {
+			if _, err := th.UpdateState(ctx, id, state); !errors.Is(err, dtpc.ErrInvalidTransition) {
+				t.Fatalf("expected UpdateState of a transaction in state %d to %d to fail with %v but got %v", current, state, dtpc.ErrInvalidTransition, err)
+			}
+		}
+		if tr := getTransaction(t, th, id); tr.TransactionState != current {
+			t.Fatalf("expected the transaction to stay in state %d but got %d", current, tr.TransactionState)
+		}
+	}
+}
+
+func testGetTransactionsInState(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	reference := uniqueName(t, "reference")
+	pending := insert(t, th, reference+":1")
+	done := insert(t, th, reference+":2")
+	other := insert(t, th, uniqueName(t, "other"))
+	for _, id := range []string{done, other} {
+		if _, err := th.UpdateState(ctx, id, dtpc.Done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trs, err := th.GetTransactionsInState(ctx, dtpc.Pending, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, trs, pending)
+	trs, err = th.GetTransactionsInState(ctx, dtpc.Done, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, trs, done)
+
+	// Other test cases may share the store, so only the transactions of this test case are checked.
+	trs, err = th.GetAllTransactionsInState(ctx, dtpc.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, tr := range trs {
+		if tr.TransactionState != dtpc.Done {
+			t.Fatalf("expected done transactions but got %+v", tr)
+		}
+		if tr.ID == done || tr.ID == other {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected transactions %s and %s to be done", done, other)
+	}
+}
+
+// runConcurrently calls f concurrently for every index and fails on the first error.
+func runConcurrently(t *testing.T, f func(i int) error) {
+	errs := make(chan error, concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- f(i)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testConcurrentInserts(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	reference := uniqueName(t, "reference")
+	ids := make([]string, concurrency)
+	runConcurrently(t, func(i int) (err error) {
+		ids[i], err = th.Insert(ctx, "source", "destination", fmt.Sprintf("%s:%d", reference, i), nil)
+		return err
+	})
+
+	trs, err := th.GetTransactionsInState(ctx, dtpc.Pending, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, trs, ids...)
+}
+
+func testConcurrentUpdateStates(t *testing.T, th dtpc.TransactionHandler) {
+	ctx := context.Background()
+	reference := uniqueName(t, "reference")
+	ids := make([]string, concurrency)
+	for i := range ids {
+		ids[i] = insert(t, th, fmt.Sprintf("%s:%d", reference, i))
+	}
+	runConcurrently(t, func(i int) error {
+		_, err := th.UpdateState(ctx, ids[i], dtpc.Done)
+		return err
+	})
+
+	trs, err := th.GetTransactionsInState(ctx, dtpc.Done, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, trs, ids...)
+}
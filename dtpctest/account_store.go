@@ -0,0 +1,309 @@
+package dtpctest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"dtpc"
+)
+
+var (
+	// ErrInsufficientFunds is returned when a decrement would not leave a positive balance.
+	ErrInsufficientFunds = dtpc.ErrInsufficientFunds
+	// ErrPendingTransactionIDNotFound is returned by Rollback when the account has no such pending transaction.
+	ErrPendingTransactionIDNotFound = errors.New("pending transaction id not found")
+)
+
+// AccountDoc is the account document stored by AccountStore.
+type AccountDoc struct {
+	// Unique ID of the account
+	ID string
+	// A map of itemID to item data
+	Resources map[string]Item
+	// The IDs of the pending transactions of the account, most recent first
+	PendingTransactions []string
+	// Version number of the account, incremented by every modification
+	Version int
+}
+
+func (a AccountDoc) GetID() string {
+	return a.ID
+}
+func (a AccountDoc) GetPendingTransactions() []string {
+	return a.PendingTransactions
+}
+func (a AccountDoc) GetVersion() int {
+	return a.Version
+}
+
+// Item is the transaction data expected by AccountStore and the resource data of an AccountDoc.
+type Item struct {
+	ID     string
+	Amount int
+}
+
+// ItemFromData converts the data of a transaction request into an Item. Besides Item values, it accepts the generic
+// map representation of transactions read back from a TransactionStore.
+func ItemFromData(data interface{}) (Item, error) {
+	switch d := data.(type) {
+	case Item:
+		return d, nil
+	case *Item:
+		return *d, nil
+	case map[string]interface{}:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return Item{}, err
+		}
+		item := Item{}
+		if err := json.Unmarshal(b, &item); err != nil {
+			return Item{}, fmt.Errorf("failed to unmarshal transaction data %v into type Item: %w", data, err)
+		}
+		return item, nil
+	default:
+		return Item{}, fmt.Errorf("unsupported transaction data %v", data)
+	}
+}
+
+// transactionMethod is the direction in which an item changes a balance.
+type transactionMethod int
+
+const (
+	increment transactionMethod = iota
+	decrement
+)
+
+// AccountStore is an in-memory implementation of the dtpc.AccountHandler interface.
+// It stores AccountDoc documents, expects Item transaction data
+// and mirrors the behaviour of ledger.Handler with the zero Policy:
+//   - a decrement requires the balance to stay above zero;
+//   - Commit of an unknown transaction ID succeeds;
+//   - Rollback of an unknown transaction ID returns ErrPendingTransactionIDNotFound.
+//
+// Failures can be injected per method through the embedded Faults.
+type AccountStore struct {
+	Faults
+
+	mu       sync.Mutex
+	accounts map[string]AccountDoc
+}
+
+// NewAccountStore initialises an empty in-memory AccountStore.
+func NewAccountStore() *AccountStore {
+	return &AccountStore{
+		accounts: make(map[string]AccountDoc),
+	}
+}
+
+// Get copies an account document into retval, which must be an *AccountDoc.
+func (as *AccountStore) Get(ctx context.Context, accountID string, retval dtpc.Account) error {
+	if err := as.check(ctx, MethodGet); err != nil {
+		return err
+	}
+	doc, ok := retval.(*AccountDoc)
+	if !ok {
+		return fmt.Errorf("unsupported account type %T", retval)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ad, ok := as.accounts[accountID]
+	if !ok {
+		return errAccountNotFound
+	}
+	*doc = copyAccountDoc(ad)
+	return nil
+}
+
+// Put stores an AccountDoc, replacing any account with the same ID.
+func (as *AccountStore) Put(ctx context.Context, doc dtpc.Account) error {
+	if err := as.check(ctx, MethodPut); err != nil {
+		return err
+	}
+	var ad AccountDoc
+	switch d := doc.(type) {
+	case AccountDoc:
+		ad = d
+	case *AccountDoc:
+		ad = *d
+	default:
+		return fmt.Errorf("unsupported account type %T", doc)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.accounts[ad.ID] = copyAccountDoc(ad)
+	return nil
+}
+
+// Update applies a transaction to an account and appends its ID to the pending transaction list. Updating an account
+// with a transaction that is already pending succeeds without applying it again.
+func (as *AccountStore) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	if err := as.check(ctx, MethodUpdate); err != nil {
+		return err
+	}
+	item, err := ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := decrement
+	if accountID == tr.Destination {
+		method = increment
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ad, ok := as.accounts[accountID]
+	if !ok {
+		return errAccountNotFound
+	}
+	if pendingTransactionIndex(ad.PendingTransactions, transactionID) >= 0 {
+		return nil
+	}
+	if err := modify(&ad, item, method, false); err != nil {
+		return err
+	}
+	ad.PendingTransactions = append([]string{transactionID}, ad.PendingTransactions...)
+	ad.Version++
+	as.accounts[accountID] = ad
+	return nil
+}
+
+// Commit removes a transaction ID from the pending transaction list of an account.
+func (as *AccountStore) Commit(ctx context.Context, accountID, transactionID string) error {
+	if err := as.check(ctx, MethodCommit); err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ad, ok := as.accounts[accountID]
+	if !ok {
+		return errAccountNotFound
+	}
+	i := pendingTransactionIndex(ad.PendingTransactions, transactionID)
+	if i < 0 {
+		return nil
+	}
+	ad.PendingTransactions = removeAt(ad.PendingTransactions, i)
+	ad.Version++
+	as.accounts[accountID] = ad
+	return nil
+}
+
+// Rollback reverts a transaction applied by Update and removes its ID from the pending transaction list.
+func (as *AccountStore) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	if err := as.check(ctx, MethodRollback); err != nil {
+		return err
+	}
+	item, err := ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := increment
+	if accountID == tr.Destination {
+		method = decrement
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ad, ok := as.accounts[accountID]
+	if !ok {
+		return errAccountNotFound
+	}
+	i := pendingTransactionIndex(ad.PendingTransactions, transactionID)
+	if i < 0 {
+		return ErrPendingTransactionIDNotFound
+	}
+	if err := modify(&ad, item, method, true); err != nil {
+		return err
+	}
+	ad.PendingTransactions = removeAt(ad.PendingTransactions, i)
+	ad.Version++
+	as.accounts[accountID] = ad
+	return nil
+}
+
+// IsErrorPendingTransactionIDNotFound checks if a given error matches ErrPendingTransactionIDNotFound.
+func (as *AccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return err == ErrPendingTransactionIDNotFound
+}
+
+// IsErrorInsufficientFunds checks if a given error matches ErrInsufficientFunds.
+func (as *AccountStore) IsErrorInsufficientFunds(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds)
+}
+
+// Account returns a copy of the account document with the given ID.
+func (as *AccountStore) Account(accountID string) (AccountDoc, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ad, ok := as.accounts[accountID]
+	if !ok {
+		return AccountDoc{}, false
+	}
+	return copyAccountDoc(ad), true
+}
+
+// Accounts returns copies of all stored account documents ordered by ID.
+func (as *AccountStore) Accounts() []AccountDoc {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	accounts := make([]AccountDoc, 0, len(as.accounts))
+	for _, ad := range as.accounts {
+		accounts = append(accounts, copyAccountDoc(ad))
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].ID < accounts[j].ID
+	})
+	return accounts
+}
+
+// modify applies an item to an account. A decrement must leave a positive balance, except for the rollback of a
+// credit, which may take the balance down to zero.
+func modify(ad *AccountDoc, item Item, method transactionMethod, rollback bool) error {
+	resource, ok := ad.Resources[item.ID]
+	if !ok {
+		return fmt.Errorf("account %s has no resource with ID %s", ad.ID, item.ID)
+	}
+	switch method {
+	case increment:
+		resource.Amount += item.Amount
+	case decrement:
+		if resource.Amount < item.Amount || resource.Amount == item.Amount && !rollback {
+			return ErrInsufficientFunds
+		}
+		resource.Amount -= item.Amount
+	default:
+		return fmt.Errorf("unsupported transaction method %d", method)
+	}
+	ad.Resources[item.ID] = resource
+	return nil
+}
+
+func copyAccountDoc(ad AccountDoc) AccountDoc {
+	c := ad
+	c.Resources = make(map[string]Item, len(ad.Resources))
+	for k, v := range ad.Resources {
+		c.Resources[k] = v
+	}
+	c.PendingTransactions = append([]string{}, ad.PendingTransactions...)
+	return c
+}
+
+func pendingTransactionIndex(pts []string, transactionID string) int {
+	for i, pt := range pts {
+		if pt == transactionID {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeAt(pts []string, i int) []string {
+	return append(append([]string{}, pts[:i]...), pts[i+1:]...)
+}
@@ -0,0 +1,31 @@
+package dtpctest
+
+import (
+	"testing"
+
+	"dtpc"
+	"dtpc/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+		return conformance.AccountFixture{
+			Handler: NewAccountStore(),
+			NewAccount: func(id string, balance int) dtpc.Account {
+				return &AccountDoc{ID: id, Resources: map[string]Item{"item": {ID: "item", Amount: balance}}}
+			},
+			EmptyAccount: func() dtpc.Account {
+				return &AccountDoc{}
+			},
+			Data: func(amount int) interface{} {
+				return Item{ID: "item", Amount: amount}
+			},
+			Balance: func(doc dtpc.Account) int {
+				return doc.(*AccountDoc).Resources["item"].Amount
+			},
+		}
+	})
+	conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+		return NewTransactionStore()
+	})
+}
@@ -0,0 +1,229 @@
+package dtpctest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dtpc"
+)
+
+func setupAccounts(t *testing.T, as *AccountStore, amount int, ids ...string) {
+	for _, id := range ids {
+		doc := AccountDoc{
+			ID: id,
+			Resources: map[string]Item{
+				"item1": {ID: "item1", Amount: amount},
+			},
+		}
+		if err := as.Put(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func getRequest(source, destination string, amount int) dtpc.Request {
+	return dtpc.Request{
+		Source:      source,
+		Destination: destination,
+		Reference:   source + ":" + destination,
+		Data:        Item{ID: "item1", Amount: amount},
+	}
+}
+
+func balance(t *testing.T, as *AccountStore, accountID string) int {
+	ad, ok := as.Account(accountID)
+	if !ok {
+		t.Fatalf("account %s does not exist", accountID)
+	}
+	return ad.Resources["item1"].Amount
+}
+
+func TestStartTransaction(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	setupAccounts(t, as, 100, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	res, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := ts.GetTransaction(ctx, res.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.TransactionState != dtpc.Done {
+		t.Fatalf("expected transaction state to be %d but got %d", dtpc.Done, tr.TransactionState)
+	}
+	if b := balance(t, as, "account1"); b != 90 {
+		t.Fatalf("expected account1 balance to be 90 but got %d", b)
+	}
+	if b := balance(t, as, "account2"); b != 110 {
+		t.Fatalf("expected account2 balance to be 110 but got %d", b)
+	}
+}
+
+func TestStartTransactionInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	setupAccounts(t, as, 10, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", ErrInsufficientFunds, err)
+	}
+	cancelled, err := ts.GetAllTransactionsInState(ctx, dtpc.Cancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 1 {
+		t.Fatalf("expected 1 cancelled transaction but got %d", len(cancelled))
+	}
+}
+
+func TestUpdateIdempotent(t *testing.T) {
+	ctx := context.Background()
+	as := NewAccountStore()
+	setupAccounts(t, as, 100, "account1", "account2")
+	req := getRequest("account1", "account2", 10)
+
+	for i := 0; i < 2; i++ {
+		if err := as.Update(ctx, "account1", "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ad, _ := as.Account("account1")
+	if ad.Resources["item1"].Amount != 90 || len(ad.PendingTransactions) != 1 || ad.Version != 1 {
+		t.Fatalf("expected a single update to be applied but got %+v", ad)
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	setupAccounts(t, as, 100, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	// The second Update is the destination account of the first transaction.
+	as.FailOn(MethodUpdate, 2, ErrInjected)
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+	if b := balance(t, as, "account1"); b != 100 {
+		t.Fatalf("expected account1 balance to be rolled back to 100 but got %d", b)
+	}
+	if n := as.Calls(MethodRollback); n != 2 {
+		t.Fatalf("expected 2 calls to Rollback but got %d", n)
+	}
+
+	ts.FailAlways(MethodInsert, ErrInjected)
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+	ts.Clear()
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.Calls(MethodInsert); n != 3 {
+		t.Fatalf("expected 3 calls to Insert but got %d", n)
+	}
+}
+
+func TestRecoverTransactions(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	setupAccounts(t, as, 100, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	// Fail the commit phase twice so that the transaction is left in Applied state.
+	ts.FailOn(MethodUpdateState, 2, ErrInjected)
+	as.FailOn(MethodCommit, 3, ErrInjected)
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+	applied, err := ts.GetAllTransactionsInState(ctx, dtpc.Applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 {
+		t.Fatalf("expected 1 applied transaction but got %d", len(applied))
+	}
+
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ts.GetTransaction(ctx, applied[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.TransactionState != dtpc.Done {
+		t.Fatalf("expected transaction state to be %d but got %d", dtpc.Done, tr.TransactionState)
+	}
+	for _, id := range []string{"account1", "account2"} {
+		ad, _ := as.Account(id)
+		if len(ad.PendingTransactions) > 0 {
+			t.Fatalf("expected no pending transactions in %s but got %v", id, ad.PendingTransactions)
+		}
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	ctx := context.Background()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	setupAccounts(t, as, 1000, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := getRequest("account1", "account2", 1)
+			if i%2 == 1 {
+				req = getRequest("account2", "account1", 2)
+			}
+			if _, err := srv.StartTransaction(ctx, req); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if b := balance(t, as, "account1"); b != 1025 {
+		t.Fatalf("expected account1 balance to be 1025 but got %d", b)
+	}
+	if b := balance(t, as, "account2"); b != 975 {
+		t.Fatalf("expected account2 balance to be 975 but got %d", b)
+	}
+	done, err := ts.GetAllTransactionsInState(ctx, dtpc.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 50 {
+		t.Fatalf("expected 50 done transactions but got %d", len(done))
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ts := NewTransactionStore()
+	as := NewAccountStore()
+	srv := dtpc.NewService(ts, as)
+
+	if _, err := srv.StartTransaction(ctx, getRequest("account1", "account2", 10)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v but got %v", context.Canceled, err)
+	}
+	if n := len(ts.Transactions()); n != 0 {
+		t.Fatalf("expected no transactions but got %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+// Package dtpctest provides in-memory implementations of dtpc.TransactionHandler and dtpc.AccountHandler
+// for unit testing code that builds on dtpc without a DynamoDB instance.
+package dtpctest
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Method names accepted by Faults.
+const (
+	MethodInsert                    = "Insert"
+	MethodUpdateState               = "UpdateState"
+	MethodGetTransaction            = "GetTransaction"
+	MethodGetTransactionsInState    = "GetTransactionsInState"
+	MethodGetAllTransactionsInState = "GetAllTransactionsInState"
+	MethodGet                       = "Get"
+	MethodPut                       = "Put"
+	MethodUpdate                    = "Update"
+	MethodRollback                  = "Rollback"
+	MethodCommit                    = "Commit"
+)
+
+var (
+	// ErrInjected is a general purpose error that can be passed to Faults.
+	ErrInjected = errors.New("injected failure")
+)
+
+// Faults counts the calls made to each method of a fake handler and returns injected errors for configured calls.
+// The zero value is ready to use and safe for concurrent use.
+type Faults struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	nth    map[string]map[int]error
+	always map[string]error
+}
+
+// FailOn makes the call-th call (starting from 1) of method return err.
+func (f *Faults) FailOn(method string, call int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nth == nil {
+		f.nth = make(map[string]map[int]error)
+	}
+	if f.nth[method] == nil {
+		f.nth[method] = make(map[int]error)
+	}
+	f.nth[method][call] = err
+}
+
+// FailAlways makes every following call of method return err until Clear is called.
+func (f *Faults) FailAlways(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.always == nil {
+		f.always = make(map[string]error)
+	}
+	f.always[method] = err
+}
+
+// Clear removes all injected failures. Call counts are kept.
+func (f *Faults) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nth = nil
+	f.always = nil
+}
+
+// Calls returns the number of calls made to method so far, including failed ones.
+func (f *Faults) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// check records a call of method and returns the injected error for it, if any.
+// The error of ctx is returned when ctx is already done.
+func (f *Faults) check(ctx context.Context, method string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[method]++
+	if err, ok := f.always[method]; ok {
+		return err
+	}
+	if err, ok := f.nth[method][f.calls[method]]; ok {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+
+	"dtpc"
+)
+
+// Invariant checks the state of a simulated system after a run.
+type Invariant func(w *World) error
+
+// DefaultInvariants are the invariants checked by Run unless the Config sets its own.
+var DefaultInvariants = []Invariant{
+	Conservation,
+	NoOrphanPendingTransactions,
+	TerminalStatesOnly,
+}
+
+// Conservation checks that the total amount of all accounts has only changed by the funding of cancellations and that
+// no balance is negative.
+func Conservation(w *World) error {
+	total := 0
+	for _, a := range w.Accounts.Accounts() {
+		amount := a.Resources[itemID].Amount
+		if amount < 0 {
+			return fmt.Errorf("account %s has a negative balance of %d", a.ID, amount)
+		}
+		total += amount
+	}
+	if expected := w.Config.Accounts*w.Config.InitialBalance + w.Funding; total != expected {
+		return fmt.Errorf("expected a total amount of %d but got %d", expected, total)
+	}
+	return nil
+}
+
+// NoOrphanPendingTransactions checks that no account references a transaction, since all transactions have been
+// completed at the end of a run.
+func NoOrphanPendingTransactions(w *World) error {
+	for _, a := range w.Accounts.Accounts() {
+		for _, id := range a.PendingTransactions {
+			t, err := w.Transactions.GetTransaction(context.Background(), id)
+			if err != nil {
+				return fmt.Errorf("account %s references unknown transaction %s: %v", a.ID, id, err)
+			}
+			return fmt.Errorf("account %s references transaction %s in state %d", a.ID, id, t.TransactionState)
+		}
+	}
+	return nil
+}
+
+// TerminalStatesOnly checks that every transaction is Done or Cancelled.
+func TerminalStatesOnly(w *World) error {
+	for _, t := range w.Transactions.Transactions() {
+		if t.TransactionState != dtpc.Done && t.TransactionState != dtpc.Cancelled {
+			return fmt.Errorf("transaction %s between %s and %s is in state %d", t.ID, t.Source, t.Destination, t.TransactionState)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"dtpc"
+	"dtpc/dtpctest"
+)
+
+// ErrCrashed is returned by all handler calls of a crashed process.
+var ErrCrashed = errors.New("sim: process crashed")
+
+type processKey struct{}
+
+// process is a goroutine running a single operation under the control of the scheduler.
+type process struct {
+	id      int
+	name    string
+	spawned time.Time
+	recover bool
+	crashed bool
+	resume  chan struct{}
+	err     error
+}
+
+type event struct {
+	p        *process
+	finished bool
+}
+
+// scheduler runs processes one at a time. A process runs until its next handler call and blocks there
+// until the scheduler resumes it, so every interleaving of handler calls is determined by the program.
+type scheduler struct {
+	events chan event
+	ready  []*process
+	nextID int
+
+	mu    sync.Mutex
+	ticks int64
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		events: make(chan event),
+	}
+}
+
+// epoch is the start of the logical clock of a simulation.
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// now returns the logical time, which advances by one nanosecond per reading.
+func (s *scheduler) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ticks++
+	return epoch.Add(time.Duration(s.ticks))
+}
+
+// spawn starts a process blocked before its first instruction.
+func (s *scheduler) spawn(name string, recover bool, f func(ctx context.Context) error) *process {
+	s.nextID++
+	p := &process{
+		id:      s.nextID,
+		name:    name,
+		spawned: s.now(),
+		recover: recover,
+		resume:  make(chan struct{}),
+	}
+	go func() {
+		<-p.resume
+		ctx := context.WithValue(context.Background(), processKey{}, p)
+		if p.crashed {
+			p.err = ErrCrashed
+		} else {
+			p.err = f(ctx)
+		}
+		s.events <- event{p: p, finished: true}
+	}()
+	s.ready = append(s.ready, p)
+	return p
+}
+
+// run resumes the ready process with the given index and waits until it blocks again or finishes.
+// It reports whether the process has finished.
+func (s *scheduler) run(i int) (*process, bool) {
+	p := s.ready[i]
+	s.ready = append(s.ready[:i], s.ready[i+1:]...)
+	p.resume <- struct{}{}
+	ev := <-s.events
+	if !ev.finished {
+		s.ready = append(s.ready, ev.p)
+		sort.Slice(s.ready, func(i, j int) bool {
+			return s.ready[i].id < s.ready[j].id
+		})
+	}
+	return ev.p, ev.finished
+}
+
+// crash stops the ready process with the given index. All its remaining handler calls fail with ErrCrashed.
+func (s *scheduler) crash(i int) *process {
+	p := s.ready[i]
+	p.crashed = true
+	s.run(i)
+	return p
+}
+
+// recoverTime returns the recover time that excludes the transactions of all live transfer processes.
+func (s *scheduler) recoverTime() time.Time {
+	t := s.now()
+	for _, p := range s.ready {
+		if !p.recover && p.spawned.Before(t) {
+			t = p.spawned
+		}
+	}
+	return t
+}
+
+// yield blocks the calling process until the scheduler resumes it.
+// Calls outside of a process, such as the setup of accounts, are not scheduled.
+func (s *scheduler) yield(ctx context.Context) error {
+	p, ok := ctx.Value(processKey{}).(*process)
+	if !ok {
+		return nil
+	}
+	if p.crashed {
+		return ErrCrashed
+	}
+	s.events <- event{p: p}
+	<-p.resume
+	if p.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// transactionHandler makes every call of a TransactionStore a scheduling point.
+type transactionHandler struct {
+	s  *scheduler
+	ts *dtpctest.TransactionStore
+}
+
+func (h *transactionHandler) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return "", err
+	}
+	return h.ts.Insert(ctx, source, destination, reference, data)
+}
+
+func (h *transactionHandler) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return "", err
+	}
+	return h.ts.InsertWithExpiry(ctx, source, destination, reference, data, expiresAt)
+}
+
+func (h *transactionHandler) UpdateState(ctx context.Context, id string, newState dtpc.TransactionState) (*dtpc.Transaction, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return nil, err
+	}
+	return h.ts.UpdateState(ctx, id, newState)
+}
+
+func (h *transactionHandler) GetTransaction(ctx context.Context, id string) (*dtpc.Transaction, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return nil, err
+	}
+	return h.ts.GetTransaction(ctx, id)
+}
+
+func (h *transactionHandler) GetTransactionsInState(ctx context.Context, state dtpc.TransactionState, query string) ([]*dtpc.Transaction, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return nil, err
+	}
+	return h.ts.GetTransactionsInState(ctx, state, query)
+}
+
+func (h *transactionHandler) GetAllTransactionsInState(ctx context.Context, state dtpc.TransactionState) ([]*dtpc.Transaction, error) {
+	if err := h.s.yield(ctx); err != nil {
+		return nil, err
+	}
+	return h.ts.GetAllTransactionsInState(ctx, state)
+}
+
+// accountHandler makes every call of an AccountStore a scheduling point.
+type accountHandler struct {
+	s  *scheduler
+	as *dtpctest.AccountStore
+}
+
+func (h *accountHandler) Get(ctx context.Context, accountID string, retval dtpc.Account) error {
+	if err := h.s.yield(ctx); err != nil {
+		return err
+	}
+	return h.as.Get(ctx, accountID, retval)
+}
+
+func (h *accountHandler) Put(ctx context.Context, doc dtpc.Account) error {
+	if err := h.s.yield(ctx); err != nil {
+		return err
+	}
+	return h.as.Put(ctx, doc)
+}
+
+func (h *accountHandler) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	if err := h.s.yield(ctx); err != nil {
+		return err
+	}
+	return h.as.Update(ctx, accountID, transactionID, tr)
+}
+
+func (h *accountHandler) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	if err := h.s.yield(ctx); err != nil {
+		return err
+	}
+	return h.as.Rollback(ctx, accountID, transactionID, tr)
+}
+
+func (h *accountHandler) Commit(ctx context.Context, accountID, transactionID string) error {
+	if err := h.s.yield(ctx); err != nil {
+		return err
+	}
+	return h.as.Commit(ctx, accountID, transactionID)
+}
+
+func (h *accountHandler) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return h.as.IsErrorPendingTransactionIDNotFound(err)
+}
+
+func (h *accountHandler) IsErrorInsufficientFunds(err error) bool {
+	return h.as.IsErrorInsufficientFunds(err)
+}
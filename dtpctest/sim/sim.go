@@ -0,0 +1,352 @@
+// Package sim runs randomized crash and recovery simulations of dtpc.Service against the in-memory handlers
+// of package dtpctest.
+//
+// A simulation executes a Program: a sequence of steps that start transfers, resume, crash or recover processes.
+// Processes only interleave at handler calls and the program decides which process runs next, so a program
+// always produces the same execution. Programs are generated from a seed, and failing programs are shrunk to a
+// minimal reproduction.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"dtpc"
+	"dtpc/dtpctest"
+)
+
+// itemID is the resource transferred between accounts.
+const itemID = "item"
+
+// Config describes the simulated system and the size of generated programs.
+type Config struct {
+	// Number of accounts. Defaults to 3.
+	Accounts int
+	// Initial amount of every account. Defaults to 100.
+	InitialBalance int
+	// Number of steps of generated programs. Defaults to 50.
+	Steps int
+	// Invariants checked at the end of every run. Defaults to DefaultInvariants.
+	Invariants []Invariant
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Accounts < 2 {
+		cfg.Accounts = 3
+	}
+	if cfg.InitialBalance <= 0 {
+		cfg.InitialBalance = 100
+	}
+	if cfg.Steps <= 0 {
+		cfg.Steps = 50
+	}
+	if cfg.Invariants == nil {
+		cfg.Invariants = DefaultInvariants
+	}
+	return cfg
+}
+
+// StepKind is the kind of a simulation step.
+type StepKind int
+
+const (
+	// Start spawns a process that transfers Amount from account Source to account Destination.
+	Start StepKind = iota
+	// Resume runs a ready process until its next handler call.
+	Resume
+	// Crash stops a ready process. All its remaining handler calls fail.
+	Crash
+	// Recover spawns a process running RecoverTransactions for the transactions of all stopped processes.
+	Recover
+)
+
+// Step is a single instruction of a Program.
+type Step struct {
+	Kind StepKind
+	// Accounts and amount of Start steps
+	Source, Destination, Amount int
+	// Ready process selected by Resume and Crash steps, modulo the number of ready processes
+	Choice int
+}
+
+func (s Step) String() string {
+	switch s.Kind {
+	case Start:
+		return fmt.Sprintf("start(%d->%d, %d)", s.Source, s.Destination, s.Amount)
+	case Resume:
+		return fmt.Sprintf("resume(%d)", s.Choice)
+	case Crash:
+		return fmt.Sprintf("crash(%d)", s.Choice)
+	case Recover:
+		return "recover"
+	default:
+		return fmt.Sprintf("unknown(%d)", s.Kind)
+	}
+}
+
+// Program is a sequence of simulation steps.
+type Program []Step
+
+func (p Program) String() string {
+	steps := make([]string, len(p))
+	for i, s := range p {
+		steps[i] = s.String()
+	}
+	return strings.Join(steps, " ")
+}
+
+// Generate returns a random program derived from seed.
+func Generate(seed int64, cfg Config) Program {
+	cfg = cfg.withDefaults()
+	rng := rand.New(rand.NewSource(seed))
+	program := make(Program, 0, cfg.Steps)
+	for i := 0; i < cfg.Steps; i++ {
+		step := Step{Choice: rng.Intn(8)}
+		switch r := rng.Intn(100); {
+		case r < 30:
+			step.Kind = Start
+			step.Source = rng.Intn(cfg.Accounts)
+			step.Destination = (step.Source + 1 + rng.Intn(cfg.Accounts-1)) % cfg.Accounts
+			step.Amount = 1 + rng.Intn(cfg.InitialBalance/2)
+		case r < 80:
+			step.Kind = Resume
+		case r < 90:
+			step.Kind = Crash
+		default:
+			step.Kind = Recover
+		}
+		program = append(program, step)
+	}
+	return program
+}
+
+// World is the state of a simulated system after a run.
+type World struct {
+	Config       Config
+	Transactions *dtpctest.TransactionStore
+	Accounts     *dtpctest.AccountStore
+	// Amount added to accounts after the final recovery to complete cancellations whose destination account has
+	// spent the transferred amount
+	Funding int
+	// Trace of the executed steps and the results of finished processes
+	Trace []string
+}
+
+// AccountID returns the ID of the account with the given index.
+func AccountID(i int) string {
+	return fmt.Sprintf("account%d", i)
+}
+
+// Run executes a program. After the program, all remaining processes run to completion, a final recovery
+// without crashes completes all stopped transactions and the invariants are checked.
+//
+// A cancellation cannot be completed while its destination account has spent the transferred amount, and the final
+// recovery fails with dtpc.ErrInsufficientFunds. Run then funds the destination accounts of the transactions left in
+// Canceling state with the missing amounts, records the total in World.Funding and recovers again.
+func Run(cfg Config, program Program) (*World, error) {
+	cfg = cfg.withDefaults()
+	s := newScheduler()
+	ids := 0
+	ts := dtpctest.NewTransactionStore()
+	ts.Now = s.now
+	ts.NewID = func() string {
+		ids++
+		return fmt.Sprintf("transaction%d", ids)
+	}
+	as := dtpctest.NewAccountStore()
+	w := &World{Config: cfg, Transactions: ts, Accounts: as}
+
+	for i := 0; i < cfg.Accounts; i++ {
+		doc := dtpctest.AccountDoc{
+			ID:        AccountID(i),
+			Resources: map[string]dtpctest.Item{itemID: {ID: itemID, Amount: cfg.InitialBalance}},
+		}
+		if err := as.Put(context.Background(), doc); err != nil {
+			return w, err
+		}
+	}
+	srv := dtpc.NewService(&transactionHandler{s, ts}, &accountHandler{s, as})
+
+	trace := func(format string, args ...interface{}) {
+		w.Trace = append(w.Trace, fmt.Sprintf(format, args...))
+	}
+	run := func(i int) {
+		if p, finished := s.run(i); finished {
+			trace("  %s finished: %v", p.name, p.err)
+		}
+	}
+	spawnRecover := func() *process {
+		recoverTime := s.recoverTime()
+		p := s.spawn("", true, func(ctx context.Context) error {
+			return srv.RecoverTransactions(ctx, recoverTime)
+		})
+		p.name = fmt.Sprintf("p%d(recover)", p.id)
+		return p
+	}
+	finalRecover := func() error {
+		p := spawnRecover()
+		for len(s.ready) > 0 {
+			run(0)
+		}
+		return p.err
+	}
+
+	for n, step := range program {
+		trace("%d: %s", n, step)
+		switch step.Kind {
+		case Start:
+			if step.Source == step.Destination || step.Source >= cfg.Accounts || step.Destination >= cfg.Accounts {
+				continue
+			}
+			req := dtpc.Request{
+				Source:      AccountID(step.Source),
+				Destination: AccountID(step.Destination),
+				Reference:   fmt.Sprintf("step%d", n),
+				Data:        dtpctest.Item{ID: itemID, Amount: step.Amount},
+			}
+			p := s.spawn("", false, func(ctx context.Context) error {
+				_, err := srv.StartTransaction(ctx, req)
+				return err
+			})
+			p.name = fmt.Sprintf("p%d(%s->%s)", p.id, req.Source, req.Destination)
+		case Resume:
+			if len(s.ready) > 0 {
+				run(step.Choice % len(s.ready))
+			}
+		case Crash:
+			if len(s.ready) > 0 {
+				p := s.crash(step.Choice % len(s.ready))
+				trace("  %s crashed", p.name)
+			}
+		case Recover:
+			spawnRecover()
+		}
+	}
+
+	trace("drain")
+	for len(s.ready) > 0 {
+		run(0)
+	}
+	trace("final recovery")
+	if err := finalRecover(); errors.Is(err, dtpc.ErrInsufficientFunds) {
+		trace("funding")
+		if err := fundCancellations(w, trace); err != nil {
+			return w, err
+		}
+		trace("recovery after funding")
+		if err := finalRecover(); err != nil {
+			return w, fmt.Errorf("recovery after funding: %w", err)
+		}
+	} else if err != nil {
+		return w, fmt.Errorf("final recovery: %w", err)
+	}
+
+	for _, inv := range cfg.Invariants {
+		if err := inv(w); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+// fundCancellations adds the missing amounts to the destination accounts of the transactions in Canceling state that
+// cannot be rolled back. The amounts of all Canceling transactions of a destination account are summed up, since all
+// of them are rolled back.
+func fundCancellations(w *World, trace func(format string, args ...interface{})) error {
+	type key struct {
+		account, item string
+	}
+	required := make(map[key]int)
+	var keys []key
+	for _, t := range w.Transactions.Transactions() {
+		if t.TransactionState != dtpc.Canceling {
+			continue
+		}
+		item, err := dtpctest.ItemFromData(t.Value)
+		if err != nil {
+			return err
+		}
+		k := key{t.Destination, item.ID}
+		if _, ok := required[k]; !ok {
+			keys = append(keys, k)
+		}
+		required[k] += item.Amount
+	}
+
+	for _, k := range keys {
+		a, ok := w.Accounts.Account(k.account)
+		if !ok {
+			return fmt.Errorf("transactions reference unknown account %s", k.account)
+		}
+		missing := required[k] - a.Resources[k.item].Amount
+		if missing <= 0 {
+			continue
+		}
+		a.Resources[k.item] = dtpctest.Item{ID: k.item, Amount: required[k]}
+		if err := w.Accounts.Put(context.Background(), a); err != nil {
+			return err
+		}
+		w.Funding += missing
+		trace("  funded %s with %d", a.ID, missing)
+	}
+	return nil
+}
+
+// Failure is a failing program with its minimal reproduction.
+type Failure struct {
+	// Seed of the generated program
+	Seed int64
+	// Shrunk program that still violates an invariant
+	Program Program
+	// Violated invariant of the shrunk program
+	Err error
+	// Trace of the run of the shrunk program
+	Trace []string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("seed %d: %v\nprogram: %s\ntrace:\n%s", f.Seed, f.Err, f.Program, strings.Join(f.Trace, "\n"))
+}
+
+// Check runs the program generated from seed and returns its shrunk reproduction if an invariant is violated.
+func Check(seed int64, cfg Config) *Failure {
+	program := Generate(seed, cfg)
+	if _, err := Run(cfg, program); err == nil {
+		return nil
+	}
+	program = Shrink(cfg, program)
+	w, err := Run(cfg, program)
+	return &Failure{
+		Seed:    seed,
+		Program: program,
+		Err:     err,
+		Trace:   w.Trace,
+	}
+}
+
+// Shrink returns a minimal subsequence of a failing program that still fails.
+// Chunks of steps are removed while the program keeps failing, down to single steps, until no step can be removed.
+func Shrink(cfg Config, program Program) Program {
+	fails := func(p Program) bool {
+		_, err := Run(cfg, p)
+		return err != nil
+	}
+	for chunk := len(program) / 2; chunk >= 1; chunk /= 2 {
+		for removed := true; removed; {
+			removed = false
+			for i := 0; i+chunk <= len(program); {
+				candidate := append(append(Program{}, program[:i]...), program[i+chunk:]...)
+				if fails(candidate) {
+					program = candidate
+					removed = true
+					continue
+				}
+				i += chunk
+			}
+		}
+	}
+	return program
+}
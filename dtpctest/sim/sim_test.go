@@ -0,0 +1,117 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"dtpc"
+	"dtpc/dtpctest"
+)
+
+func TestSimulation(t *testing.T) {
+	seeds := int64(300)
+	if testing.Short() {
+		seeds = 30
+	}
+	for seed := int64(1); seed <= seeds; seed++ {
+		if f := Check(seed, Config{}); f != nil {
+			t.Fatal(f)
+		}
+	}
+}
+
+func TestDeterministicRuns(t *testing.T) {
+	program := Generate(42, Config{Steps: 200})
+	w1, err := Run(Config{}, program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := Run(Config{}, program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w1.Trace, w2.Trace) {
+		t.Fatal(fmt.Errorf("expected identical traces of the same program"))
+	}
+	if !reflect.DeepEqual(w1.Accounts.Accounts(), w2.Accounts.Accounts()) {
+		t.Fatal(fmt.Errorf("expected identical accounts after the same program"))
+	}
+	if !reflect.DeepEqual(w1.Transactions.Transactions(), w2.Transactions.Transactions()) {
+		t.Fatal(fmt.Errorf("expected identical transactions after the same program"))
+	}
+}
+
+func TestShrink(t *testing.T) {
+	// A deliberately wrong invariant that fails as soon as any transaction has been cancelled.
+	noCancellations := func(w *World) error {
+		for _, tr := range w.Transactions.Transactions() {
+			if tr.TransactionState == dtpc.Cancelled {
+				return fmt.Errorf("transaction %s has been cancelled", tr.ID)
+			}
+		}
+		return nil
+	}
+	cfg := Config{Invariants: []Invariant{noCancellations}}
+
+	var failure *Failure
+	for seed := int64(1); seed <= 100 && failure == nil; seed++ {
+		failure = Check(seed, cfg)
+	}
+	if failure == nil {
+		t.Fatal(fmt.Errorf("expected a program with a cancelled transaction"))
+	}
+	if failure.Err == nil {
+		t.Fatal(fmt.Errorf("expected the shrunk program to fail"))
+	}
+	// A single transfer that is crashed after its insert is the minimal reproduction: start it, run it up to
+	// the insert, run the insert and crash it before the update of the source account.
+	if len(failure.Program) > 4 {
+		t.Fatalf("expected a program of at most 4 steps but got %s", failure.Program)
+	}
+	if failure.Program[0].Kind != Start {
+		t.Fatalf("expected the shrunk program to start a transfer but got %s", failure.Program)
+	}
+}
+
+func TestFundedCancellation(t *testing.T) {
+	// A transfer whose destination account spends the transferred amount before the transfer is cancelled can only be
+	// cancelled once the destination account has been funded again. Run fails unless all transfers are completed.
+	var w *World
+	for seed := int64(1); seed <= 300; seed++ {
+		var err error
+		if w, err = Run(Config{}, Generate(seed, Config{})); err != nil {
+			t.Fatal(err)
+		}
+		if w.Funding > 0 {
+			break
+		}
+	}
+	if w.Funding == 0 {
+		t.Fatal(fmt.Errorf("expected a program with a cancellation of a spent transfer"))
+	}
+}
+
+func TestFundCancellationsSumsAmounts(t *testing.T) {
+	// Both cancellations roll back the destination account, so it is funded with the sum of their amounts.
+	w := &World{Transactions: dtpctest.NewTransactionStore(), Accounts: dtpctest.NewAccountStore()}
+	doc := dtpctest.AccountDoc{ID: AccountID(1), Resources: map[string]dtpctest.Item{itemID: {ID: itemID, Amount: 5}}}
+	if err := w.Accounts.Put(context.Background(), doc); err != nil {
+		t.Fatal(err)
+	}
+	for i, amount := range []int{10, 20} {
+		tr := dtpc.NewTransaction(fmt.Sprintf("transaction%d", i), AccountID(0), AccountID(1), "reference", dtpctest.Item{ID: itemID, Amount: amount}, time.Time{})
+		tr.TransactionState = dtpc.Canceling
+		w.Transactions.Put(tr)
+	}
+
+	if err := fundCancellations(w, func(format string, args ...interface{}) {}); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := w.Accounts.Account(AccountID(1))
+	if a.Resources[itemID].Amount != 30 || w.Funding != 25 {
+		t.Fatalf("expected a balance of 30 after funding 25 but got %d after funding %d", a.Resources[itemID].Amount, w.Funding)
+	}
+}
@@ -0,0 +1,172 @@
+package dtpctest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dtpc"
+)
+
+var (
+	// ErrNotFound is returned when a transaction or an account does not exist.
+	// The errors also match dtpc.ErrTransactionNotFound or dtpc.ErrAccountNotFound.
+	ErrNotFound = errors.New("not found")
+
+	errTransactionNotFound = dtpc.WrapError(dtpc.ErrTransactionNotFound, ErrNotFound)
+	errAccountNotFound     = dtpc.WrapError(dtpc.ErrAccountNotFound, ErrNotFound)
+)
+
+// TransactionStore is an in-memory implementation of the dtpc.TransactionHandler interface.
+// Failures can be injected per method through the embedded Faults.
+type TransactionStore struct {
+	Faults
+	// Now returns the time of modifications. Defaults to time.Now.
+	Now func() time.Time
+	// NewID returns the IDs of new transactions. Defaults to random UUIDs.
+	NewID func() string
+
+	mu           sync.RWMutex
+	transactions map[string]*dtpc.Transaction
+}
+
+// NewTransactionStore initialises an empty in-memory TransactionStore.
+func NewTransactionStore() *TransactionStore {
+	return &TransactionStore{
+		transactions: make(map[string]*dtpc.Transaction),
+	}
+}
+
+// Insert stores a new transaction in Pending state.
+func (ts *TransactionStore) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
+	return ts.InsertWithExpiry(ctx, source, destination, reference, data, time.Time{})
+}
+
+// InsertWithExpiry stores a new transaction with a deadline in Pending state.
+func (ts *TransactionStore) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
+	if err := ts.check(ctx, MethodInsert); err != nil {
+		return "", err
+	}
+
+	id := uuid.New().String()
+	if ts.NewID != nil {
+		id = ts.NewID()
+	}
+	t := dtpc.NewTransaction(id, source, destination, reference, data, expiresAt)
+	t.LastModified = ts.now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.transactions[id] = t
+	return id, nil
+}
+
+func (ts *TransactionStore) now() time.Time {
+	if ts.Now != nil {
+		return ts.Now()
+	}
+	return time.Now()
+}
+
+// UpdateState updates the state of an existing transaction.
+// The state of a finished transaction can only be set again to the same state, and the new state must be able to
+// follow the current state.
+func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState dtpc.TransactionState) (*dtpc.Transaction, error) {
+	if err := ts.check(ctx, MethodUpdateState); err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.transactions[id]
+	if !ok {
+		return nil, errTransactionNotFound
+	}
+	if !t.TransactionState.CanChangeTo(newState) {
+		return nil, dtpc.TransitionError(id, t.TransactionState, newState)
+	}
+	t.TransactionState = newState
+	t.LastModified = ts.now()
+
+	c := *t
+	return &c, nil
+}
+
+// GetTransaction retrieves a transaction by its ID value.
+func (ts *TransactionStore) GetTransaction(ctx context.Context, id string) (*dtpc.Transaction, error) {
+	if err := ts.check(ctx, MethodGetTransaction); err != nil {
+		return nil, err
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, ok := ts.transactions[id]
+	if !ok {
+		return nil, errTransactionNotFound
+	}
+
+	c := *t
+	return &c, nil
+}
+
+// GetTransactionsInState gets all transactions of a given state whose reference starts with query.
+func (ts *TransactionStore) GetTransactionsInState(ctx context.Context, state dtpc.TransactionState, query string) ([]*dtpc.Transaction, error) {
+	if err := ts.check(ctx, MethodGetTransactionsInState); err != nil {
+		return nil, err
+	}
+	return ts.find(func(t *dtpc.Transaction) bool {
+		return t.TransactionState == state && strings.HasPrefix(t.TransactionReference, query)
+	}), nil
+}
+
+// GetAllTransactionsInState gets all transactions of a given state.
+func (ts *TransactionStore) GetAllTransactionsInState(ctx context.Context, state dtpc.TransactionState) ([]*dtpc.Transaction, error) {
+	if err := ts.check(ctx, MethodGetAllTransactionsInState); err != nil {
+		return nil, err
+	}
+	return ts.find(func(t *dtpc.Transaction) bool {
+		return t.TransactionState == state
+	}), nil
+}
+
+// Put stores a copy of t as is, replacing any transaction with the same ID.
+// Put is meant for seeding test data and is not subject to injected failures.
+func (ts *TransactionStore) Put(t *dtpc.Transaction) {
+	c := *t
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.transactions[t.ID] = &c
+}
+
+// Transactions returns copies of all stored transactions.
+func (ts *TransactionStore) Transactions() []*dtpc.Transaction {
+	return ts.find(func(t *dtpc.Transaction) bool {
+		return true
+	})
+}
+
+// find returns copies of the transactions matching f, ordered by reference and ID like the state-index.
+func (ts *TransactionStore) find(f func(t *dtpc.Transaction) bool) []*dtpc.Transaction {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	transactions := []*dtpc.Transaction{}
+	for _, t := range ts.transactions {
+		if f(t) {
+			c := *t
+			transactions = append(transactions, &c)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].TransactionReference != transactions[j].TransactionReference {
+			return transactions[i].TransactionReference < transactions[j].TransactionReference
+		}
+		return transactions[i].ID < transactions[j].ID
+	})
+	return transactions
+}
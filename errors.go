@@ -0,0 +1,124 @@
+package dtpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Errors returned by the Service, TransactionHandlers and AccountHandlers. Handlers may wrap them with additional
+// context, so they should be matched with errors.Is.
+var (
+	// ErrInsufficientFunds is returned when an update or a rollback would overdraw an account.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrConflict is returned when an update keeps conflicting with concurrent updates of the same document.
+	ErrConflict = errors.New("conflicting concurrent update")
+	// ErrAccountNotFound is returned when an account does not exist.
+	ErrAccountNotFound = errors.New("account not found")
+	// ErrTransactionNotFound is returned when a transaction does not exist.
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// ErrTransactionFinished is returned when the state of a Done or Cancelled transaction is changed.
+	ErrTransactionFinished = errors.New("transaction already finished")
+	// ErrInvalidTransition is returned when the state of a transaction is changed to a state that cannot follow its
+	// current state, e.g. an Applied transaction to Canceling.
+	ErrInvalidTransition = errors.New("invalid transaction state transition")
+	// ErrThrottled is returned when the data store rejects a request because of its capacity or request rate limits.
+	ErrThrottled = errors.New("request throttled")
+	// ErrTransactionExpired is returned when a transaction is not applied before its deadline.
+	ErrTransactionExpired = errors.New("transaction expired")
+)
+
+// Phase is a step of the processing of a transaction.
+type Phase string
+
+const (
+	// PhaseInsert stores the transaction document in Pending state.
+	PhaseInsert Phase = "insert"
+	// PhaseApply updates both accounts and changes the transaction state to Applied.
+	PhaseApply Phase = "apply"
+	// PhaseCommit commits both accounts and changes the transaction state to Done.
+	PhaseCommit Phase = "commit"
+	// PhaseCancel rolls back both accounts and changes the transaction state to Cancelled.
+	PhaseCancel Phase = "cancel"
+)
+
+// TransactionError is returned by StartTransaction and RecoverTransactions when a phase of a transaction fails.
+// The cause is available with errors.Is and errors.As.
+type TransactionError struct {
+	// ID of the transaction. It is empty if the transaction document could not be inserted.
+	ID string
+	// Phase that failed
+	Phase Phase
+	// Cause of the failure
+	Err error
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction %s: %s failed: %v", e.ID, e.Phase, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// transactionError wraps a non-nil error of a phase in a TransactionError, unless it is one already.
+func transactionError(id string, phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	var te *TransactionError
+	if errors.As(err, &te) {
+		return err
+	}
+	return &TransactionError{ID: id, Phase: phase, Err: err}
+}
+
+// classifiedError matches an error of this package with errors.Is while keeping the message and the chain of the
+// original error.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// WrapError returns an error with the message of err that matches both kind and err with errors.Is.
+// Handlers use it to classify their own errors, e.g. WrapError(ErrAccountNotFound, sql.ErrNoRows).
+// WrapError returns nil if err is nil.
+func WrapError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{kind: kind, err: err}
+}
+
+// WrapDynamoDBError classifies the errors of DynamoDB requests: throttled requests match ErrThrottled and
+// transaction conflicts match ErrConflict. The original error remains available with errors.As.
+// Other errors are returned unchanged.
+func WrapDynamoDBError(err error) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
+		return WrapError(ErrThrottled, err)
+	case dynamodb.ErrCodeTransactionConflictException:
+		return WrapError(ErrConflict, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,242 @@
+package faultdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"dtpc"
+	"dtpc/memdynamo"
+	"dtpc/testsuite/example"
+)
+
+// EndpointEnv names the environment variable with the endpoint of the DynamoDB instance used by the crash suite,
+// e.g. http://localhost:8000 for DynamoDB Local. The crash suite runs against an in-memory DynamoDB when it is not set.
+const EndpointEnv = "DTPC_DYNAMODB_ENDPOINT"
+
+// crashSuite contains the tables and handlers shared by all crash points of a test.
+type crashSuite struct {
+	db  *DB
+	ts  *dtpc.TransactionStore
+	ah  *example.HandlerImpl
+	srv *dtpc.Service
+}
+
+// newCrashDynamoDB returns a client of the DynamoDB instance named by EndpointEnv, or an in-memory DynamoDB.
+// newCrashDynamoDB is replaced to run the crash suite against another DynamoDB implementation.
+var newCrashDynamoDB = func(t *testing.T) dynamodbiface.DynamoDBAPI {
+	endpoint := os.Getenv(EndpointEnv)
+	if endpoint == "" {
+		return memdynamo.New()
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("ap-southeast-2"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("dtpc", "dtpc", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dynamodb.New(sess)
+}
+
+func newCrashSuite(t *testing.T) *crashSuite {
+	ctx := context.Background()
+	raw := newCrashDynamoDB(t)
+
+	suffix := time.Now().UnixNano()
+	cfg := dtpc.TablesConfig{
+		Transactions:      dtpc.DefaultTransactionStoreConfig(fmt.Sprintf("crash_transactions_%d", suffix)),
+		AccountsTableName: fmt.Sprintf("crash_accounts_%d", suffix),
+		AccountsHashKey:   "ID",
+		PollInterval:      100 * time.Millisecond,
+	}
+	if err := dtpc.EnsureTables(ctx, raw, cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Transactions.TableName, cfg.AccountsTableName} {
+			raw.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+		}
+	})
+
+	db := New(raw)
+	ts := dtpc.NewTransactionStore(db, cfg.Transactions.TableName)
+	ah := example.NewHandlerImpl(db, cfg.AccountsTableName, cfg.AccountsHashKey)
+	return &crashSuite{
+		db:  db,
+		ts:  ts,
+		ah:  ah,
+		srv: dtpc.NewService(ts, ah),
+	}
+}
+
+func (s *crashSuite) setupAccounts(t *testing.T, ids ...string) {
+	for _, id := range ids {
+		doc := &example.AccountDoc{
+			ID:                  id,
+			Resources:           map[string]example.Item{"item": {ID: "item", Amount: 100}},
+			PendingTransactions: []string{},
+		}
+		if err := s.ah.Put(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (s *crashSuite) account(t *testing.T, id string) example.AccountDoc {
+	doc := example.AccountDoc{}
+	if err := s.ah.Get(context.Background(), id, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// transactions returns all transactions with the given reference by state.
+func (s *crashSuite) transactions(t *testing.T, reference string) map[dtpc.TransactionState][]*dtpc.Transaction {
+	out := make(map[dtpc.TransactionState][]*dtpc.Transaction)
+	for _, state := range []dtpc.TransactionState{dtpc.Pending, dtpc.Applied, dtpc.Done, dtpc.Canceling, dtpc.Cancelled} {
+		trs, err := s.ts.GetTransactionsInState(context.Background(), state, reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trs) > 0 {
+			out[state] = trs
+		}
+	}
+	return out
+}
+
+// transfer starts a transaction of 10 items from source to destination.
+func (s *crashSuite) transfer(source, destination, reference string) error {
+	_, err := s.srv.StartTransaction(context.Background(), dtpc.Request{
+		Source:      source,
+		Destination: destination,
+		Reference:   reference,
+		Data:        example.Item{ID: "item", Amount: 10},
+	})
+	return err
+}
+
+// verify checks that the transaction with the given reference has reached a final state
+// and that the balances of both accounts match that state.
+func (s *crashSuite) verify(t *testing.T, source, destination, reference string) {
+	trs := s.transactions(t, reference)
+	src, dst := s.account(t, source), s.account(t, destination)
+	if len(src.PendingTransactions) > 0 || len(dst.PendingTransactions) > 0 {
+		t.Fatalf("%s: expected no pending transactions but got %v and %v", reference, src.PendingTransactions, dst.PendingTransactions)
+	}
+
+	srcAmount, dstAmount := src.Resources["item"].Amount, dst.Resources["item"].Amount
+	switch {
+	case len(trs) == 0:
+		// The insert of the transaction did not happen.
+		if srcAmount != 100 || dstAmount != 100 {
+			t.Fatalf("%s: expected unchanged balances without a transaction but got %d and %d", reference, srcAmount, dstAmount)
+		}
+	case len(trs[dtpc.Done]) == 1 && len(trs) == 1:
+		if srcAmount != 90 || dstAmount != 110 {
+			t.Fatalf("%s: expected balances 90 and 110 of a done transaction but got %d and %d", reference, srcAmount, dstAmount)
+		}
+	case len(trs[dtpc.Cancelled]) == 1 && len(trs) == 1:
+		if srcAmount != 100 || dstAmount != 100 {
+			t.Fatalf("%s: expected balances 100 and 100 of a cancelled transaction but got %d and %d", reference, srcAmount, dstAmount)
+		}
+	default:
+		t.Fatalf("%s: expected a single done or cancelled transaction but got %v", reference, trs)
+	}
+}
+
+// TestCrashPoints interrupts a transaction at every DynamoDB call and verifies that recovery converges.
+func TestCrashPoints(t *testing.T) {
+	s := newCrashSuite(t)
+
+	// Count the calls of a transaction without faults.
+	s.setupAccounts(t, "baseline-source", "baseline-destination")
+	s.db.Clear()
+	if err := s.transfer("baseline-source", "baseline-destination", "baseline"); err != nil {
+		t.Fatal(err)
+	}
+	calls := s.db.Calls("")
+	if calls == 0 {
+		t.Fatal(fmt.Errorf("expected calls to DynamoDB"))
+	}
+
+	faults := []struct {
+		name string
+		rule Rule
+	}{
+		// The process stops before the request is sent.
+		{"crash-before", Rule{Fault: Fail, Crash: true}},
+		// The process stops after the request has been applied.
+		{"crash-after", Rule{Fault: LoseResponse, Crash: true}},
+		// A single request fails and the service recovers by itself.
+		{"fail", Rule{Fault: Fail}},
+		// A single response is lost and the service recovers by itself.
+		{"lose", Rule{Fault: LoseResponse}},
+	}
+	for _, f := range faults {
+		for call := 1; call <= calls; call++ {
+			source := fmt.Sprintf("%s-%d-source", f.name, call)
+			destination := fmt.Sprintf("%s-%d-destination", f.name, call)
+			reference := fmt.Sprintf("%s-%d:", f.name, call)
+			s.db.Clear()
+			s.setupAccounts(t, source, destination)
+
+			rule := f.rule
+			rule.Call = call
+			s.db.Inject(rule)
+			s.transfer(source, destination, reference)
+
+			// Restart and recover all incomplete transactions.
+			s.db.Clear()
+			if err := s.srv.RecoverTransactions(context.Background(), time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("%s: recovery failed: %v", reference, err)
+			}
+			s.verify(t, source, destination, reference)
+		}
+	}
+}
+
+// TestCrashDuringRecovery interrupts the recovery of an applied transaction at every call.
+func TestCrashDuringRecovery(t *testing.T) {
+	s := newCrashSuite(t)
+
+	for call := 1; ; call++ {
+		source := fmt.Sprintf("recovery-%d-source", call)
+		destination := fmt.Sprintf("recovery-%d-destination", call)
+		reference := fmt.Sprintf("recovery-%d:", call)
+		s.db.Clear()
+		s.setupAccounts(t, source, destination)
+
+		// Stop the transaction right after it has been applied.
+		s.db.Inject(Rule{Operation: OperationUpdateItem, Table: s.ts.Config().TableName, Call: 1, Fault: LoseResponse, Crash: true})
+		s.transfer(source, destination, reference)
+
+		// Recovery itself stops at the given call and is restarted.
+		s.db.Clear()
+		s.db.Inject(Rule{Call: call, Fault: LoseResponse, Crash: true})
+		err := s.srv.RecoverTransactions(context.Background(), time.Now().Add(time.Second))
+		crashed := s.db.Crashed()
+		s.db.Clear()
+		if !crashed {
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.verify(t, source, destination, reference)
+			return
+		}
+		if err := s.srv.RecoverTransactions(context.Background(), time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("%s: recovery failed: %v", reference, err)
+		}
+		s.verify(t, source, destination, reference)
+	}
+}
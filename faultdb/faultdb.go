@@ -0,0 +1,361 @@
+// Package faultdb provides a DynamoDB client decorator that injects faults into requests.
+//
+// A DB wraps any dynamodbiface.DynamoDBAPI and fails, delays or drops the response of calls selected by Rules.
+// It is used to verify that the two phase commits of dtpc.Service converge after a crash at any step.
+package faultdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Operation names matched by Rule.Operation.
+const (
+	OperationGetItem            = "GetItem"
+	OperationPutItem            = "PutItem"
+	OperationUpdateItem         = "UpdateItem"
+	OperationDeleteItem         = "DeleteItem"
+	OperationQuery              = "Query"
+	OperationBatchGetItem       = "BatchGetItem"
+	OperationTransactWriteItems = "TransactWriteItems"
+)
+
+var (
+	// ErrInjected is returned by failed calls of rules without an error.
+	ErrInjected = errors.New("faultdb: injected failure")
+	// ErrResponseLost is returned by calls that were applied but whose response was dropped.
+	ErrResponseLost = errors.New("faultdb: response lost")
+	// ErrCrashed is returned by all calls after a crash rule has been triggered.
+	ErrCrashed = errors.New("faultdb: crashed")
+)
+
+// Fault is the kind of fault injected by a Rule.
+type Fault int
+
+const (
+	// Fail returns an error without sending the request.
+	Fail Fault = iota
+	// Delay waits before sending the request. The wait ends early when the context of the call is done.
+	Delay
+	// LoseResponse sends the request and returns an error instead of its response,
+	// as if the connection was lost after the request has been applied.
+	LoseResponse
+)
+
+// Rule selects calls and the fault injected into them.
+type Rule struct {
+	// Operation of matching calls, e.g. OperationPutItem. Empty matches all operations.
+	Operation string
+	// Table of matching calls. TransactWriteItems calls match if any of their items uses the table.
+	// Empty matches all tables.
+	Table string
+	// Nth matching call the fault is injected into, starting at 1. Zero injects the fault into every matching call.
+	Call int
+	// Kind of the fault
+	Fault Fault
+	// Error returned by Fail and LoseResponse faults. Defaults to ErrInjected and ErrResponseLost.
+	Err error
+	// Duration of Delay faults
+	Delay time.Duration
+	// Crash fails every call with ErrCrashed after the fault has been injected, simulating a process that stopped
+	// at this call. Use Clear to restart.
+	Crash bool
+}
+
+// DB is a DynamoDB client that injects faults into the calls of the wrapped client.
+// Operations without fault injection are passed through unchanged.
+type DB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu      sync.Mutex
+	rules   []*rule
+	calls   map[string]int
+	total   int
+	crashed bool
+}
+
+type rule struct {
+	Rule
+	matched int
+}
+
+// New wraps a DynamoDB client.
+func New(db dynamodbiface.DynamoDBAPI) *DB {
+	return &DB{
+		DynamoDBAPI: db,
+		calls:       make(map[string]int),
+	}
+}
+
+// Inject adds a rule. Rules are evaluated in the order they were added and the first selected rule applies.
+func (db *DB) Inject(r Rule) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.rules = append(db.rules, &rule{Rule: r})
+}
+
+// Clear removes all rules, recovers from a crash and resets the call counters.
+func (db *DB) Clear() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.rules = nil
+	db.calls = make(map[string]int)
+	db.total = 0
+	db.crashed = false
+}
+
+// Calls returns the number of calls of an operation since the last Clear. Empty returns the number of all calls.
+func (db *DB) Calls(operation string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if operation == "" {
+		return db.total
+	}
+	return db.calls[operation]
+}
+
+// Crashed reports whether a crash rule has been triggered since the last Clear.
+func (db *DB) Crashed() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.crashed
+}
+
+// selectRule records a call and returns the rule that applies to it, if any.
+func (db *DB) selectRule(operation string, tables ...string) (*Rule, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.total++
+	db.calls[operation]++
+	if db.crashed {
+		return nil, ErrCrashed
+	}
+
+	for _, r := range db.rules {
+		if !r.matches(operation, tables) {
+			continue
+		}
+		r.matched++
+		if r.Call != 0 && r.Call != r.matched {
+			continue
+		}
+		if r.Crash {
+			db.crashed = true
+		}
+		selected := r.Rule
+		return &selected, nil
+	}
+	return nil, nil
+}
+
+func (r *rule) matches(operation string, tables []string) bool {
+	if r.Operation != "" && r.Operation != operation {
+		return false
+	}
+	if r.Table == "" {
+		return true
+	}
+	for _, t := range tables {
+		if t == r.Table {
+			return true
+		}
+	}
+	return false
+}
+
+// call applies the selected rule, if any, around the call of the wrapped client.
+func (db *DB) call(ctx aws.Context, operation string, tables []string, send func() error) error {
+	r, err := db.selectRule(operation, tables...)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return send()
+	}
+
+	switch r.Fault {
+	case Fail:
+		if r.Err != nil {
+			return r.Err
+		}
+		return ErrInjected
+	case Delay:
+		t := time.NewTimer(r.Delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		return send()
+	case LoseResponse:
+		if err := send(); err != nil {
+			return err
+		}
+		if r.Err != nil {
+			return r.Err
+		}
+		return ErrResponseLost
+	default:
+		return send()
+	}
+}
+
+// GetItemWithContext calls GetItemWithContext of the wrapped client subject to the injected faults.
+func (db *DB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	var out *dynamodb.GetItemOutput
+	err := db.call(ctx, OperationGetItem, []string{aws.StringValue(in.TableName)}, func() (err error) {
+		out, err = db.DynamoDBAPI.GetItemWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetItem calls GetItemWithContext with a background context.
+func (db *DB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return db.GetItemWithContext(aws.BackgroundContext(), in)
+}
+
+// PutItemWithContext calls PutItemWithContext of the wrapped client subject to the injected faults.
+func (db *DB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	var out *dynamodb.PutItemOutput
+	err := db.call(ctx, OperationPutItem, []string{aws.StringValue(in.TableName)}, func() (err error) {
+		out, err = db.DynamoDBAPI.PutItemWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutItem calls PutItemWithContext with a background context.
+func (db *DB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return db.PutItemWithContext(aws.BackgroundContext(), in)
+}
+
+// UpdateItemWithContext calls UpdateItemWithContext of the wrapped client subject to the injected faults.
+func (db *DB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	var out *dynamodb.UpdateItemOutput
+	err := db.call(ctx, OperationUpdateItem, []string{aws.StringValue(in.TableName)}, func() (err error) {
+		out, err = db.DynamoDBAPI.UpdateItemWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateItem calls UpdateItemWithContext with a background context.
+func (db *DB) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return db.UpdateItemWithContext(aws.BackgroundContext(), in)
+}
+
+// DeleteItemWithContext calls DeleteItemWithContext of the wrapped client subject to the injected faults.
+func (db *DB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	var out *dynamodb.DeleteItemOutput
+	err := db.call(ctx, OperationDeleteItem, []string{aws.StringValue(in.TableName)}, func() (err error) {
+		out, err = db.DynamoDBAPI.DeleteItemWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteItem calls DeleteItemWithContext with a background context.
+func (db *DB) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return db.DeleteItemWithContext(aws.BackgroundContext(), in)
+}
+
+// QueryWithContext calls QueryWithContext of the wrapped client subject to the injected faults.
+func (db *DB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	var out *dynamodb.QueryOutput
+	err := db.call(ctx, OperationQuery, []string{aws.StringValue(in.TableName)}, func() (err error) {
+		out, err = db.DynamoDBAPI.QueryWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Query calls QueryWithContext with a background context.
+func (db *DB) Query(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return db.QueryWithContext(aws.BackgroundContext(), in)
+}
+
+// BatchGetItemWithContext calls BatchGetItemWithContext of the wrapped client subject to the injected faults.
+func (db *DB) BatchGetItemWithContext(ctx aws.Context, in *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	var out *dynamodb.BatchGetItemOutput
+	err := db.call(ctx, OperationBatchGetItem, batchGetTables(in), func() (err error) {
+		out, err = db.DynamoDBAPI.BatchGetItemWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BatchGetItem calls BatchGetItemWithContext with a background context.
+func (db *DB) BatchGetItem(in *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return db.BatchGetItemWithContext(aws.BackgroundContext(), in)
+}
+
+// batchGetTables returns the tables read by a BatchGetItem call.
+func batchGetTables(in *dynamodb.BatchGetItemInput) []string {
+	tables := make([]string, 0, len(in.RequestItems))
+	for table := range in.RequestItems {
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// TransactWriteItemsWithContext calls TransactWriteItemsWithContext of the wrapped client subject to the injected faults.
+func (db *DB) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	var out *dynamodb.TransactWriteItemsOutput
+	err := db.call(ctx, OperationTransactWriteItems, transactTables(in), func() (err error) {
+		out, err = db.DynamoDBAPI.TransactWriteItemsWithContext(ctx, in, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TransactWriteItems calls TransactWriteItemsWithContext with a background context.
+func (db *DB) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return db.TransactWriteItemsWithContext(aws.BackgroundContext(), in)
+}
+
+// transactTables returns the tables written by a TransactWriteItems call.
+func transactTables(in *dynamodb.TransactWriteItemsInput) []string {
+	tables := []string{}
+	for _, item := range in.TransactItems {
+		switch {
+		case item.ConditionCheck != nil:
+			tables = append(tables, aws.StringValue(item.ConditionCheck.TableName))
+		case item.Delete != nil:
+			tables = append(tables, aws.StringValue(item.Delete.TableName))
+		case item.Put != nil:
+			tables = append(tables, aws.StringValue(item.Put.TableName))
+		case item.Update != nil:
+			tables = append(tables, aws.StringValue(item.Update.TableName))
+		}
+	}
+	return tables
+}
@@ -0,0 +1,189 @@
+package faultdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// CountingFakeDynamoDB counts the requests that reached it.
+type CountingFakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	puts    int
+	updates int
+	gets    int
+}
+
+func (db *CountingFakeDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.puts++
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *CountingFakeDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	db.updates++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (db *CountingFakeDynamoDB) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (db *CountingFakeDynamoDB) BatchGetItemWithContext(ctx aws.Context, in *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	db.gets++
+	return &dynamodb.BatchGetItemOutput{}, nil
+}
+
+func put(db *DB, table string) error {
+	_, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(table)})
+	return err
+}
+
+func update(db *DB, table string) error {
+	_, err := db.UpdateItem(&dynamodb.UpdateItemInput{TableName: aws.String(table)})
+	return err
+}
+
+func TestFailNthCall(t *testing.T) {
+	fake := &CountingFakeDynamoDB{}
+	db := New(fake)
+	db.Inject(Rule{Call: 2, Fault: Fail})
+
+	if err := put(db, "transactions"); err != nil {
+		t.Fatal(err)
+	}
+	if err := update(db, "accounts"); err != ErrInjected {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+	if err := update(db, "accounts"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.puts != 1 || fake.updates != 1 {
+		t.Fatalf("expected the failed call not to be sent but got %d puts and %d updates", fake.puts, fake.updates)
+	}
+	if n := db.Calls(""); n != 3 {
+		t.Fatalf("expected 3 calls but got %d", n)
+	}
+	if n := db.Calls(OperationUpdateItem); n != 2 {
+		t.Fatalf("expected 2 UpdateItem calls but got %d", n)
+	}
+}
+
+func TestFailMatchingCalls(t *testing.T) {
+	fake := &CountingFakeDynamoDB{}
+	db := New(fake)
+	errThrottled := errors.New("throttled")
+	db.Inject(Rule{Operation: OperationUpdateItem, Table: "accounts", Fault: Fail, Err: errThrottled})
+
+	if err := update(db, "transactions"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(db, "accounts"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := update(db, "accounts"); err != errThrottled {
+			t.Fatalf("expected %v but got %v", errThrottled, err)
+		}
+	}
+
+	_, err := db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Update: &dynamodb.Update{TableName: aws.String("accounts")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Inject(Rule{Operation: OperationTransactWriteItems, Table: "accounts", Fault: Fail})
+	_, err = db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Update: &dynamodb.Update{TableName: aws.String("transactions")}},
+			{Update: &dynamodb.Update{TableName: aws.String("accounts")}},
+		},
+	})
+	if err != ErrInjected {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+}
+
+func TestBatchGetItem(t *testing.T) {
+	fake := &CountingFakeDynamoDB{}
+	db := New(fake)
+	db.Inject(Rule{Operation: OperationBatchGetItem, Table: "transactions", Call: 2, Fault: Fail, Crash: true})
+
+	batchGet := func() error {
+		_, err := db.BatchGetItem(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{"transactions": {}},
+		})
+		return err
+	}
+	if err := batchGet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := batchGet(); err != ErrInjected {
+		t.Fatalf("expected %v but got %v", ErrInjected, err)
+	}
+	if err := batchGet(); err != ErrCrashed {
+		t.Fatalf("expected %v but got %v", ErrCrashed, err)
+	}
+	if fake.gets != 1 {
+		t.Fatalf("expected only the first call to be sent but got %d", fake.gets)
+	}
+	if n := db.Calls(OperationBatchGetItem); n != 3 {
+		t.Fatalf("expected 3 BatchGetItem calls but got %d", n)
+	}
+}
+
+func TestLoseResponse(t *testing.T) {
+	fake := &CountingFakeDynamoDB{}
+	db := New(fake)
+	db.Inject(Rule{Operation: OperationPutItem, Call: 1, Fault: LoseResponse})
+
+	if err := put(db, "transactions"); err != ErrResponseLost {
+		t.Fatalf("expected %v but got %v", ErrResponseLost, err)
+	}
+	if fake.puts != 1 {
+		t.Fatalf("expected the request to be applied but got %d puts", fake.puts)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	db := New(&CountingFakeDynamoDB{})
+	db.Inject(Rule{Fault: Delay, Delay: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("transactions")}); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCrash(t *testing.T) {
+	fake := &CountingFakeDynamoDB{}
+	db := New(fake)
+	db.Inject(Rule{Call: 2, Fault: LoseResponse, Crash: true})
+
+	if err := put(db, "transactions"); err != nil {
+		t.Fatal(err)
+	}
+	if err := update(db, "accounts"); err != ErrResponseLost {
+		t.Fatalf("expected %v but got %v", ErrResponseLost, err)
+	}
+	if err := update(db, "accounts"); err != ErrCrashed {
+		t.Fatalf("expected %v but got %v", ErrCrashed, err)
+	}
+	if !db.Crashed() || fake.updates != 1 {
+		t.Fatalf("expected only the crashing call to be applied but got %d updates", fake.updates)
+	}
+
+	db.Clear()
+	if err := update(db, "accounts"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,8 @@ go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.34.10
-	github.com/google/uuid v1.1.1
-	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	github.com/google/uuid v1.3.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	modernc.org/sqlite v1.17.3
 )
@@ -0,0 +1,138 @@
+package ledger
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMaxAttempts   = 10
+	defaultRetryInterval = 100 * time.Millisecond
+)
+
+// Attributes contains the attribute names of account documents.
+type Attributes struct {
+	// Partition key of the account table
+	ID string
+	// Version of the storage format
+	SchemaVersion string
+	// Map of item IDs to balances
+	Balances string
+	// Map of pending transaction IDs
+	Pending string
+	// Optimistic locking counter
+	Version string
+	// Policy of items without a policy of their own
+	Policy string
+	// Map of item IDs to policies
+	Policies string
+	// Map of hold IDs to holds
+	Holds string
+	// Lifecycle status
+	Status string
+}
+
+// ItemConfig contains the decimal precision of an item.
+type ItemConfig struct {
+	// Number of decimal places of the balances and amounts of the item
+	Scale int
+	// Rounding of amounts with more decimal places than Scale. Such amounts are rejected by default.
+	Rounding RoundingMode
+}
+
+// Config contains the table schema and the retry settings of a Handler.
+// Zero values are replaced by the defaults of DefaultConfig.
+type Config struct {
+	// Name of the account table
+	TableName string
+	// Attribute names of account documents
+	Attributes Attributes
+	// Maximum number of attempts of an operation that conflicts with concurrent modifications of the account
+	MaxAttempts int
+	// Interval between two attempts
+	RetryInterval time.Duration
+	// Decimal precision by item ID. Items without a configuration are whole numbers.
+	Items map[string]ItemConfig
+	// Exchange rates used by Handler.Exchange
+	Rates RateProvider
+	// Name of the journal table, see JournalTable. Postings are not written when empty.
+	JournalTableName string
+}
+
+// DefaultConfig returns the default schema of an account table.
+func DefaultConfig(tableName string) Config {
+	return Config{
+		TableName: tableName,
+		Attributes: Attributes{
+			ID:            "id",
+			SchemaVersion: "schema_version",
+			Balances:      "balances",
+			Pending:       "pending",
+			Version:       "version",
+			Policy:        "policy",
+			Policies:      "policies",
+			Holds:         "holds",
+			Status:        "status",
+		},
+		MaxAttempts:   defaultMaxAttempts,
+		RetryInterval: defaultRetryInterval,
+	}
+}
+
+// withDefaults returns a copy of cfg with zero values replaced by defaults.
+func (cfg Config) withDefaults() Config {
+	def := DefaultConfig(cfg.TableName)
+	attrs := cfg.Attributes.all()
+	for i, d := range def.Attributes.all() {
+		if *attrs[i] == "" {
+			*attrs[i] = *d
+		}
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = def.RetryInterval
+	}
+	return cfg
+}
+
+// Validate checks that the table schema is complete and consistent.
+func (cfg Config) Validate() error {
+	if cfg.TableName == "" {
+		return fmt.Errorf("account table name is required")
+	}
+	if cfg.MaxAttempts < 1 {
+		return fmt.Errorf("maximum number of attempts must be positive")
+	}
+	if cfg.RetryInterval < 0 {
+		return fmt.Errorf("retry interval must not be negative")
+	}
+	seen := make(map[string]bool)
+	for _, a := range cfg.Attributes.all() {
+		if *a == "" {
+			return fmt.Errorf("account attribute names must not be empty: %+v", cfg.Attributes)
+		}
+		if seen[*a] {
+			return fmt.Errorf("account attribute name %s is used more than once", *a)
+		}
+		seen[*a] = true
+	}
+	if cfg.JournalTableName != "" && cfg.JournalTableName == cfg.TableName {
+		return fmt.Errorf("journal table must not be the account table %s", cfg.TableName)
+	}
+	for id, ic := range cfg.Items {
+		if ic.Scale < 0 || ic.Scale > MaxScale {
+			return fmt.Errorf("scale %d of item %s must be between 0 and %d", ic.Scale, id, MaxScale)
+		}
+		if ic.Rounding < RoundExact || ic.Rounding > RoundDown {
+			return fmt.Errorf("unsupported rounding mode %d of item %s", ic.Rounding, id)
+		}
+	}
+	return nil
+}
+
+// all returns pointers to the attribute names in the order of the Attributes fields.
+func (a *Attributes) all() []*string {
+	return []*string{&a.ID, &a.SchemaVersion, &a.Balances, &a.Pending, &a.Version, &a.Policy, &a.Policies, &a.Holds, &a.Status}
+}
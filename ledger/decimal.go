@@ -0,0 +1,307 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// MaxScale is the largest number of decimal places of a Decimal.
+const MaxScale = 18
+
+// maxExponent bounds the exponent of parsed decimals, which is far beyond the range of a Decimal.
+const maxExponent = 400
+
+var (
+	// ErrOverflow is returned when the result of an operation on decimals exceeds the range of a Decimal.
+	ErrOverflow = errors.New("decimal overflow")
+	// ErrInexact is returned when a decimal cannot be represented with the required number of decimal places
+	// without rounding.
+	ErrInexact = errors.New("decimal requires rounding")
+)
+
+// RoundingMode determines how a decimal is rounded to fewer decimal places.
+type RoundingMode int
+
+const (
+	// RoundExact does not round and fails with ErrInexact if decimal places would be lost.
+	RoundExact RoundingMode = iota
+	// RoundHalfEven rounds to the nearest neighbour and ties to the even neighbour.
+	RoundHalfEven
+	// RoundHalfUp rounds to the nearest neighbour and ties away from zero.
+	RoundHalfUp
+	// RoundDown truncates towards zero.
+	RoundDown
+)
+
+// Decimal is an exact decimal number: a coefficient of up to 18 significant digits scaled by a number of decimal
+// places. The zero value is zero. Decimals are stored as DynamoDB numbers on account documents, and as strings in
+// the JSON and DynamoDB representations of transaction data, so that they are never converted to floating point.
+type Decimal struct {
+	coef  int64
+	scale int
+}
+
+// NewDecimal returns the decimal coef × 10^-scale. It panics if the scale is not between 0 and MaxScale.
+func NewDecimal(coef int64, scale int) Decimal {
+	if scale < 0 || scale > MaxScale {
+		panic(fmt.Sprintf("ledger: decimal scale %d out of range", scale))
+	}
+	if coef == math.MinInt64 {
+		panic("ledger: decimal coefficient out of range")
+	}
+	return Decimal{coef: coef, scale: scale}
+}
+
+// ParseDecimal parses a decimal number in plain or exponent notation, e.g. "-12.50" or "1.25E+2".
+// The scale of the result is the number of decimal places of s.
+func ParseDecimal(s string) (Decimal, error) {
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e > maxExponent || e < -maxExponent {
+			return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+		}
+		mantissa, exp = s[:i], e
+	}
+	digits, scale := mantissa, 0
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		digits, scale = mantissa[:i]+mantissa[i+1:], len(mantissa)-i-1
+	}
+	coef, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	scale -= exp
+	if scale < 0 {
+		coef.Mul(coef, pow10(-scale))
+		scale = 0
+	}
+	// Trailing zeros beyond the maximum scale do not change the value.
+	ten, rem := big.NewInt(10), new(big.Int)
+	for scale > MaxScale {
+		q, r := new(big.Int).QuoRem(coef, ten, rem)
+		if r.Sign() != 0 {
+			return Decimal{}, fmt.Errorf("decimal %q has more than %d decimal places: %w", s, MaxScale, ErrInexact)
+		}
+		coef, scale = q, scale-1
+	}
+	d, err := fit(coef, scale)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("decimal %q: %w", s, err)
+	}
+	return d, nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics if s cannot be parsed.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic("ledger: " + err.Error())
+	}
+	return d
+}
+
+// Coefficient returns the unscaled value of the decimal.
+func (d Decimal) Coefficient() int64 {
+	return d.coef
+}
+
+// Scale returns the number of decimal places of the decimal.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+// Sign returns -1, 0 or 1 if the decimal is negative, zero or positive.
+func (d Decimal) Sign() int {
+	switch {
+	case d.coef < 0:
+		return -1
+	case d.coef > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// IsZero reports whether the decimal is zero at any scale.
+func (d Decimal) IsZero() bool {
+	return d.coef == 0
+}
+
+// Neg returns the negated decimal.
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: -d.coef, scale: d.scale}
+}
+
+// Cmp compares the values of two decimals regardless of their scales and returns -1, 0 or 1.
+func (d Decimal) Cmp(o Decimal) int {
+	a, b, _ := align(d, o)
+	return a.Cmp(b)
+}
+
+// Equal reports whether two decimals have the same value regardless of their scales.
+func (d Decimal) Equal(o Decimal) bool {
+	return d.Cmp(o) == 0
+}
+
+// Add returns d + o with the larger scale of both, or ErrOverflow.
+func (d Decimal) Add(o Decimal) (Decimal, error) {
+	a, b, scale := align(d, o)
+	return fit(a.Add(a, b), scale)
+}
+
+// Sub returns d - o with the larger scale of both, or ErrOverflow.
+func (d Decimal) Sub(o Decimal) (Decimal, error) {
+	a, b, scale := align(d, o)
+	return fit(a.Sub(a, b), scale)
+}
+
+// Round returns the decimal with the given number of decimal places. Additional decimal places never overflow
+// the precision but may overflow the range of a Decimal, and fewer decimal places are rounded according to mode.
+func (d Decimal) Round(scale int, mode RoundingMode) (Decimal, error) {
+	return round(big.NewInt(d.coef), d.scale, scale, mode)
+}
+
+// Mul returns d × o with the given number of decimal places, rounded according to mode, or ErrOverflow.
+func (d Decimal) Mul(o Decimal, scale int, mode RoundingMode) (Decimal, error) {
+	return round(new(big.Int).Mul(big.NewInt(d.coef), big.NewInt(o.coef)), d.scale+o.scale, scale, mode)
+}
+
+// String returns the decimal in plain notation with all of its decimal places.
+func (d Decimal) String() string {
+	s := strconv.FormatInt(d.coef, 10)
+	neg := d.coef < 0
+	if neg {
+		s = s[1:]
+	}
+	if d.scale > 0 {
+		if len(s) <= d.scale {
+			s = strings.Repeat("0", d.scale-len(s)+1) + s
+		}
+		s = s[:len(s)-d.scale] + "." + s[len(s)-d.scale:]
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// MarshalJSON encodes the decimal as a JSON string.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a decimal from a JSON string or number.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// MarshalDynamoDBAttributeValue encodes the decimal as a DynamoDB string, which is decoded without loss of
+// precision when a transaction document is read back into an interface{}.
+func (d Decimal) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.S = aws.String(d.String())
+	return nil
+}
+
+// UnmarshalDynamoDBAttributeValue decodes a decimal from a DynamoDB string or number.
+func (d *Decimal) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	var s string
+	switch {
+	case av.S != nil:
+		s = *av.S
+	case av.N != nil:
+		s = *av.N
+	default:
+		return fmt.Errorf("decimal must be a string or a number")
+	}
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// rat returns the value of the decimal as a rational number.
+func (d Decimal) rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(d.coef), pow10(d.scale))
+}
+
+// align returns the coefficients of two decimals at the larger scale of both.
+func align(a, b Decimal) (*big.Int, *big.Int, int) {
+	scale := a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+	x := new(big.Int).Mul(big.NewInt(a.coef), pow10(scale-a.scale))
+	y := new(big.Int).Mul(big.NewInt(b.coef), pow10(scale-b.scale))
+	return x, y, scale
+}
+
+// fit returns the decimal of a coefficient and a scale, or ErrOverflow if the coefficient does not fit.
+func fit(coef *big.Int, scale int) (Decimal, error) {
+	if !coef.IsInt64() || coef.Int64() == math.MinInt64 {
+		return Decimal{}, fmt.Errorf("%s×10^-%d: %w", coef, scale, ErrOverflow)
+	}
+	return Decimal{coef: coef.Int64(), scale: scale}, nil
+}
+
+// round returns the decimal coef × 10^-from with the given number of decimal places.
+func round(coef *big.Int, from, scale int, mode RoundingMode) (Decimal, error) {
+	if scale < 0 || scale > MaxScale {
+		return Decimal{}, fmt.Errorf("decimal scale %d out of range", scale)
+	}
+	if scale >= from {
+		return fit(new(big.Int).Mul(coef, pow10(scale-from)), scale)
+	}
+
+	div := pow10(from - scale)
+	q, r := new(big.Int).QuoRem(coef, div, new(big.Int))
+	if r.Sign() == 0 {
+		return fit(q, scale)
+	}
+	// Compare twice the remainder with the divisor to find the nearest neighbour.
+	half := new(big.Int).Abs(r)
+	half.Mul(half, big.NewInt(2))
+	away := false
+	switch mode {
+	case RoundExact:
+		exact := new(big.Rat).SetFrac(coef, pow10(from)).FloatString(from)
+		return Decimal{}, fmt.Errorf("%s with %d decimal places: %w", exact, scale, ErrInexact)
+	case RoundHalfEven:
+		c := half.Cmp(div)
+		away = c > 0 || c == 0 && q.Bit(0) == 1
+	case RoundHalfUp:
+		away = half.Cmp(div) >= 0
+	case RoundDown:
+	default:
+		return Decimal{}, fmt.Errorf("unsupported rounding mode %d", mode)
+	}
+	if away {
+		q.Add(q, big.NewInt(int64(coef.Sign())))
+	}
+	return fit(q, scale)
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
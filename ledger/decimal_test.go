@@ -0,0 +1,145 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+func TestParseDecimal(t *testing.T) {
+	cases := []struct {
+		in, out string
+		scale   int
+	}{
+		{"0", "0", 0},
+		{"12", "12", 0},
+		{"-12.50", "-12.50", 2},
+		{"0.001", "0.001", 3},
+		{"-.5", "-0.5", 1},
+		{"1.25E+2", "125", 0},
+		{"125e-4", "0.0125", 4},
+		{"1.000000000000000000000", "1.000000000000000000", MaxScale},
+		{"9223372036854775807", "9223372036854775807", 0},
+	}
+	for _, c := range cases {
+		d, err := ParseDecimal(c.in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.in, err)
+		}
+		if d.String() != c.out || d.Scale() != c.scale {
+			t.Fatalf("expected %s to be parsed as %s with scale %d but got %s with scale %d", c.in, c.out, c.scale, d, d.Scale())
+		}
+	}
+
+	for _, s := range []string{"", "-", "1.2.3", "1e", "1e1000", "abc", "0x10"} {
+		if _, err := ParseDecimal(s); err == nil {
+			t.Fatalf("expected %q to be invalid", s)
+		}
+	}
+	if _, err := ParseDecimal("9223372036854775808"); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+	if _, err := ParseDecimal("0.0000000000000000001"); !errors.Is(err, ErrInexact) {
+		t.Fatalf("expected %v but got %v", ErrInexact, err)
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	a, b := MustParseDecimal("10.5"), MustParseDecimal("0.25")
+	if sum, err := a.Add(b); err != nil || sum.String() != "10.75" {
+		t.Fatalf("expected 10.75 but got %s: %v", sum, err)
+	}
+	if diff, err := b.Sub(a); err != nil || diff.String() != "-10.25" {
+		t.Fatalf("expected -10.25 but got %s: %v", diff, err)
+	}
+	if p, err := a.Mul(MustParseDecimal("0.9235"), 2, RoundHalfUp); err != nil || p.String() != "9.70" {
+		t.Fatalf("expected 9.70 but got %s: %v", p, err)
+	}
+	if _, err := a.Mul(MustParseDecimal("0.9235"), 2, RoundExact); !errors.Is(err, ErrInexact) {
+		t.Fatalf("expected %v but got %v", ErrInexact, err)
+	}
+	if !MustParseDecimal("1.50").Equal(MustParseDecimal("1.5")) || a.Cmp(b) != 1 || b.Cmp(a) != -1 {
+		t.Fatal("expected decimals to be compared by value")
+	}
+
+	max := NewDecimal(math.MaxInt64, 0)
+	if _, err := max.Add(whole(1)); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+	if _, err := max.Neg().Sub(whole(1)); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+	if _, err := max.Mul(whole(2), 0, RoundExact); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+	if _, err := max.Round(1, RoundExact); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+}
+
+func TestDecimalRound(t *testing.T) {
+	cases := []struct {
+		in   string
+		mode RoundingMode
+		out  string
+	}{
+		{"1.005", RoundHalfEven, "1.00"},
+		{"1.015", RoundHalfEven, "1.02"},
+		{"1.0051", RoundHalfEven, "1.01"},
+		{"-1.005", RoundHalfEven, "-1.00"},
+		{"1.005", RoundHalfUp, "1.01"},
+		{"-1.005", RoundHalfUp, "-1.01"},
+		{"1.004", RoundHalfUp, "1.00"},
+		{"1.009", RoundDown, "1.00"},
+		{"-1.009", RoundDown, "-1.00"},
+		{"1.5", RoundExact, "1.50"},
+		{"1.500", RoundExact, "1.50"},
+	}
+	for _, c := range cases {
+		d, err := MustParseDecimal(c.in).Round(2, c.mode)
+		if err != nil {
+			t.Fatalf("%s: %v", c.in, err)
+		}
+		if d.String() != c.out {
+			t.Fatalf("expected %s to be rounded to %s but got %s", c.in, c.out, d)
+		}
+	}
+	if _, err := MustParseDecimal("1.005").Round(2, RoundExact); !errors.Is(err, ErrInexact) {
+		t.Fatalf("expected %v but got %v", ErrInexact, err)
+	}
+}
+
+func TestDecimalEncoding(t *testing.T) {
+	item := Item{ID: "usd", Amount: MustParseDecimal("0.10")}
+	b, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"ID":"usd","Amount":"0.10"}` {
+		t.Fatalf("unexpected JSON %s", b)
+	}
+	var decoded Item
+	if err := json.Unmarshal([]byte(`{"ID":"usd","Amount":0.10}`), &decoded); err != nil || decoded.Amount.String() != "0.10" {
+		t.Fatalf("expected 0.10 but got %s: %v", decoded.Amount, err)
+	}
+
+	// Transaction stores read transaction data back into an interface{}, which must not lose precision.
+	av, err := dynamodbattribute.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic interface{}
+	if err := dynamodbattribute.Unmarshal(av, &generic); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ItemFromData(generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != item {
+		t.Fatalf("expected %+v but got %+v", item, stored)
+	}
+}
@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRateNotFound is returned by a RateProvider that has no rate for a pair of items.
+var ErrRateNotFound = errors.New("exchange rate not found")
+
+// Rate is the exchange rate of a pair of items at a point in time.
+type Rate struct {
+	// ID of the item that is exchanged
+	From string
+	// ID of the item it is exchanged for
+	To string
+	// Amount of To per unit of From
+	Value Decimal
+	// Time at which the rate was quoted
+	Time time.Time
+}
+
+// RateProvider quotes exchange rates, e.g. from a market data service.
+type RateProvider interface {
+	// Rate returns the current rate of from in units of to or an error matching ErrRateNotFound.
+	Rate(ctx context.Context, from, to string) (Rate, error)
+}
+
+// StaticRates is a RateProvider with a fixed table of rates by source and target item ID.
+type StaticRates map[string]map[string]Decimal
+
+// Rate returns the rate of the table quoted at the current time.
+func (r StaticRates) Rate(ctx context.Context, from, to string) (Rate, error) {
+	v, ok := r[from][to]
+	if !ok {
+		return Rate{}, fmt.Errorf("%s to %s: %w", from, to, ErrRateNotFound)
+	}
+	return Rate{From: from, To: to, Value: v, Time: time.Now().UTC()}, nil
+}
+
+// Exchange is the data of a transaction that debits one item from the source account and credits another item to
+// the destination account, e.g. USD from the source and EUR to the destination. Exchanges are created by
+// Handler.Exchange, which resolves the rate once. The rate and both amounts are recorded on the transaction
+// document, so the transaction is applied, recovered and rolled back with the same amounts when rates change.
+type Exchange struct {
+	// Item debited from the source account
+	Debit Item
+	// Item credited to the destination account
+	Credit Item
+	// Snapshot of the rate the credit was computed with
+	Rate Rate
+}
+
+// Validate checks that both items are valid and different, and that the rate converts the debited into the credited
+// item.
+func (e Exchange) Validate() error {
+	if err := e.Debit.Validate(); err != nil {
+		return err
+	}
+	if err := e.Credit.Validate(); err != nil {
+		return err
+	}
+	if e.Debit.ID == e.Credit.ID {
+		return fmt.Errorf("exchange of item %s for itself: %w", e.Debit.ID, ErrInvalidItem)
+	}
+	if e.Rate.From != e.Debit.ID || e.Rate.To != e.Credit.ID {
+		return fmt.Errorf("rate of %s to %s does not match the exchange of %s for %s: %w",
+			e.Rate.From, e.Rate.To, e.Debit.ID, e.Credit.ID, ErrInvalidItem)
+	}
+	if e.Rate.Value.Sign() <= 0 {
+		return fmt.Errorf("rate %s of %s to %s must be positive: %w", e.Rate.Value, e.Rate.From, e.Rate.To, ErrInvalidItem)
+	}
+	return nil
+}
+
+// ExchangeFromData converts the data of a transaction request into a valid Exchange.
+// Besides Exchange values, it accepts the generic map representation that transaction stores return
+// when a transaction document is read back.
+func ExchangeFromData(data interface{}) (Exchange, error) {
+	var e Exchange
+	switch d := data.(type) {
+	case Exchange:
+		e = d
+	case *Exchange:
+		if d == nil {
+			return Exchange{}, fmt.Errorf("nil transaction data: %w", ErrInvalidItem)
+		}
+		e = *d
+	case map[string]interface{}:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return Exchange{}, err
+		}
+		if err := json.Unmarshal(b, &e); err != nil {
+			return Exchange{}, fmt.Errorf("transaction data %v: %v: %w", data, err, ErrInvalidItem)
+		}
+	default:
+		return Exchange{}, fmt.Errorf("unsupported transaction data %T: %w", data, ErrInvalidItem)
+	}
+	return e, e.Validate()
+}
+
+// legsFromData returns the items debited from the source account and credited to the destination account by the
+// data of a transaction. Both legs of an Item or a Basket are the same.
+func legsFromData(data interface{}) (debit, credit Basket, err error) {
+	if isExchange(data) {
+		e, err := ExchangeFromData(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return Basket{e.Debit}, Basket{e.Credit}, nil
+	}
+	items, err := ItemsFromData(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, items, nil
+}
+
+func isExchange(data interface{}) bool {
+	switch d := data.(type) {
+	case Exchange, *Exchange:
+		return true
+	case map[string]interface{}:
+		_, ok := d["Debit"]
+		return ok
+	default:
+		return false
+	}
+}
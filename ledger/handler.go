@@ -0,0 +1,948 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"dtpc"
+)
+
+// errVersionMismatch signals that the account has been modified concurrently and the operation must be retried.
+var errVersionMismatch = errors.New("version mismatch")
+
+// Handler is a DynamoDB implementation of the dtpc.AccountHandler interface
+// for Account documents and Item transaction data.
+//
+// Update, Rollback and Commit write accounts of SchemaVersion with a single UpdateItem without reading them first. The
+// write is conditioned on the pending transactions and the status of the account, and debits on the balances of the
+// debited items. The outcome of a transaction depends on the account when it is already pending or not pending, when
+// the account has another schema version, a policy of a debited item or insufficient funds, and for holds and postings.
+// In these cases, and for every other modification, the account is read with a consistent read and written with a
+// condition on its version, and the operation is retried when the account has been modified concurrently.
+// Operations are idempotent:
+//   - Update of a transaction that is already pending succeeds without applying it again;
+//   - Commit of a transaction that is not pending succeeds;
+//   - Rollback of a transaction that is not pending returns ErrPendingTransactionIDNotFound.
+//
+// A decrement must satisfy the Policy of the item stored on the account, which by default requires the balance
+// to stay above zero. A decrement violating the policy fails with an *InsufficientFundsError.
+//
+// Amounts are rounded to the scale of their item with its rounding mode, see Config.Items, and the rounded
+// amounts are applied by Update and reverted by Rollback. Operations whose result exceeds the range of a Decimal
+// fail with ErrOverflow.
+type Handler struct {
+	db  dynamodbiface.DynamoDBAPI
+	cfg Config
+}
+
+// New initialises a Handler for an account table with the given schema.
+func New(db dynamodbiface.DynamoDBAPI, cfg Config) (*Handler, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Handler{
+		db:  db,
+		cfg: cfg,
+	}, nil
+}
+
+// Config returns the table schema and retry settings used by the Handler.
+func (h *Handler) Config() Config {
+	return h.cfg
+}
+
+// Create adds a new account with the given balances and fails with ErrAccountExists if the account already exists.
+// Balances must not have more decimal places than the scale of their item. If a journal table is configured, the
+// balances are also written to it as the opening snapshot of the account.
+func (h *Handler) Create(ctx context.Context, accountID string, balances map[string]Decimal, opts ...CreateOption) error {
+	a := &Account{ID: accountID, Balances: balances, Status: StatusOpen}
+	for _, opt := range opts {
+		opt(a)
+	}
+	item, err := h.marshal(a)
+	if err != nil {
+		return err
+	}
+	in := &dynamodb.PutItemInput{
+		TableName:                aws.String(h.cfg.TableName),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String(h.cfg.Attributes.ID)},
+	}
+	if h.cfg.JournalTableName != "" {
+		return h.putJournal(ctx, a, in, ErrAccountExists)
+	}
+	if _, err := h.db.PutItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("account %s: %w", accountID, ErrAccountExists)
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// Account retrieves an account and fails with an error matching dtpc.ErrAccountNotFound if it does not exist.
+func (h *Handler) Account(ctx context.Context, accountID string) (*Account, error) {
+	in := &dynamodb.GetItemInput{
+		TableName:      aws.String(h.cfg.TableName),
+		Key:            h.key(accountID),
+		ConsistentRead: aws.Bool(true),
+	}
+	res, err := h.db.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, dtpc.WrapDynamoDBError(err)
+	}
+	if len(res.Item) == 0 {
+		return nil, fmt.Errorf("account %s: %w", accountID, dtpc.ErrAccountNotFound)
+	}
+	return h.unmarshal(res.Item)
+}
+
+// Get retrieves an account into retval, which must be an *Account.
+func (h *Handler) Get(ctx context.Context, accountID string, retval dtpc.Account) error {
+	doc, ok := retval.(*Account)
+	if !ok {
+		return fmt.Errorf("unsupported account document type %T", retval)
+	}
+	a, err := h.Account(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	*doc = *a
+	return nil
+}
+
+// Put creates or replaces an account, which must be an *Account. The account is stored without pending transactions,
+// and with StatusOpen if it has no status. Closed accounts cannot be replaced and Put fails with ErrAccountClosed.
+// If a journal table is configured, the balances are also written to it as a snapshot, so that the history of the
+// account continues from the balances of the replacement.
+func (h *Handler) Put(ctx context.Context, doc dtpc.Account) error {
+	a, ok := doc.(*Account)
+	if !ok {
+		return fmt.Errorf("unsupported account document type %T", doc)
+	}
+	c := *a
+	c.PendingTransactions = nil
+	if c.Status == "" {
+		c.Status = StatusOpen
+	}
+	item, err := h.marshal(&c)
+	if err != nil {
+		return err
+	}
+	in := &dynamodb.PutItemInput{
+		TableName:                 aws.String(h.cfg.TableName),
+		Item:                      item,
+		ConditionExpression:       aws.String("attribute_not_exists(#st) OR #st <> :closed"),
+		ExpressionAttributeNames:  map[string]*string{"#st": aws.String(h.cfg.Attributes.Status)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":closed": {S: aws.String(string(StatusClosed))}},
+	}
+	if h.cfg.JournalTableName != "" {
+		return h.putJournal(ctx, &c, in, ErrAccountClosed)
+	}
+	if _, err := h.db.PutItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("account %s: %w", c.ID, ErrAccountClosed)
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// Update applies a transaction to an account and adds the transaction to its pending transactions.
+// The source account is decremented and the destination account is incremented by the amounts of the items
+// of an Item or a Basket, or by the debited and credited items of an Exchange.
+// Debits of frozen accounts, credits of accounts frozen with credits and all updates of closed accounts fail with
+// ErrAccountFrozen or ErrAccountClosed, and the update is conditioned on the status of the account.
+func (h *Handler) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	allowed := statuses(accountID, tr)
+	if err := h.applyUnread(ctx, accountID, transactionID, tr, false, allowed); err != errVersionMismatch {
+		return err
+	}
+	apply, err := h.leg(accountID, transactionID, tr, false)
+	if err != nil {
+		return err
+	}
+	return h.retry(ctx, "update of transaction "+transactionID, accountID, func(a *Account) error {
+		if a.pending(transactionID) {
+			return nil
+		}
+		u := h.update(a)
+		if err := u.requireStatus(a, allowed...); err != nil {
+			return err
+		}
+		u.transactionID = transactionID
+		u.addPending(transactionID)
+		if err := apply(a, u); err != nil {
+			return err
+		}
+		return h.write(ctx, a, u)
+	})
+}
+
+// Commit removes a transaction from the pending transactions of an account.
+func (h *Handler) Commit(ctx context.Context, accountID, transactionID string) error {
+	if err := h.commit(ctx, accountID, transactionID); err != errVersionMismatch {
+		return err
+	}
+	// The transaction is not pending, the account does not exist or its document has been written before schema
+	// version 4, in which case the pending transactions are converted into a map.
+	return h.retry(ctx, "commit of transaction "+transactionID, accountID, func(a *Account) error {
+		if !a.pending(transactionID) {
+			return nil
+		}
+		u := h.update(a)
+		u.removePending(transactionID)
+		return h.write(ctx, a, u)
+	})
+}
+
+// commit removes a transaction from the pending transactions of an account of SchemaVersion without reading it, and
+// fails with errVersionMismatch if the transaction is not pending or the account has another schema version.
+func (h *Handler) commit(ctx context.Context, accountID, transactionID string) error {
+	attrs := h.cfg.Attributes
+	in := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(h.cfg.TableName),
+		Key:                 h.key(accountID),
+		UpdateExpression:    aws.String("SET #ve = #ve + :one REMOVE #pt.#tid"),
+		ConditionExpression: aws.String("#sv = :sv AND attribute_exists(#pt.#tid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#sv":  aws.String(attrs.SchemaVersion),
+			"#ve":  aws.String(attrs.Version),
+			"#pt":  aws.String(attrs.Pending),
+			"#tid": aws.String(transactionID),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sv":  number(SchemaVersion),
+			":one": number(1),
+		},
+	}
+	if _, err := h.db.UpdateItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return errVersionMismatch
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// applyUnread applies a transaction to an account of SchemaVersion, or rolls it back, with a single write without
+// reading the account. The write is conditioned on the pending transactions and on the account having one of the
+// allowed statuses unless allowed is empty. A debited item must have no policy and its balance must stay above zero,
+// or at or above zero for a rollback, and credits must keep balances in the range of a Decimal. It fails with
+// errVersionMismatch if a condition fails, and without writing for hold transactions or if a journal table is
+// configured, since their outcome depends on the account.
+func (h *Handler) applyUnread(ctx context.Context, accountID, transactionID string, tr dtpc.Request, rollback bool, allowed []Status) error {
+	if h.cfg.JournalTableName != "" {
+		return errVersionMismatch
+	}
+	if data, err := holdFromData(tr.Data); err != nil || data != nil {
+		return errVersionMismatch
+	}
+	items, decrement, err := h.legItems(accountID, tr, rollback)
+	if err != nil {
+		return err
+	}
+	attrs := h.cfg.Attributes
+	u := &update{
+		attrs: attrs,
+		set:   []string{"#ve = #ve + :one"},
+		conds: []string{"#sv = :sv"},
+		names: map[string]*string{
+			"#sv": aws.String(attrs.SchemaVersion),
+			"#ve": aws.String(attrs.Version),
+		},
+		values: map[string]*dynamodb.AttributeValue{
+			":sv":  number(SchemaVersion),
+			":one": number(1),
+		},
+	}
+	if rollback {
+		u.removePending(transactionID)
+	} else {
+		u.addPending(transactionID)
+	}
+	if len(allowed) > 0 {
+		u.conditionStatus(allowed, false)
+	}
+	if err := h.addUnread(u, items, decrement, rollback); err != nil {
+		return err
+	}
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.cfg.TableName),
+		Key:                       h.key(accountID),
+		UpdateExpression:          aws.String(u.expression()),
+		ConditionExpression:       aws.String(u.condition()),
+		ExpressionAttributeNames:  u.names,
+		ExpressionAttributeValues: u.values,
+	}
+	if _, err := h.db.UpdateItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return errVersionMismatch
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// Rollback reverts a transaction applied by Update and removes it from the pending transactions of an account.
+// The rollback of a destination account whose policy does not allow the transferred amount to be taken back fails
+// with an *InsufficientFundsError.
+func (h *Handler) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	if err := h.applyUnread(ctx, accountID, transactionID, tr, true, nil); err != errVersionMismatch {
+		return err
+	}
+	revert, err := h.leg(accountID, transactionID, tr, true)
+	if err != nil {
+		return err
+	}
+	return h.retry(ctx, "rollback of transaction "+transactionID, accountID, func(a *Account) error {
+		if !a.pending(transactionID) {
+			return fmt.Errorf("account %s, transaction %s: %w", accountID, transactionID, ErrPendingTransactionIDNotFound)
+		}
+		u := h.update(a)
+		u.transactionID, u.contra = transactionID, true
+		u.removePending(transactionID)
+		if err := revert(a, u); err != nil {
+			return err
+		}
+		return h.write(ctx, a, u)
+	})
+}
+
+// SetPolicy changes the policy of an item of an account, or the policy of all items without a policy of their own
+// if itemID is empty. The policy only applies to later debits.
+func (h *Handler) SetPolicy(ctx context.Context, accountID, itemID string, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return h.retry(ctx, "policy change", accountID, func(a *Account) error {
+		u := h.update(a)
+		if itemID == "" {
+			u.setPolicy(p)
+		} else {
+			policies := make(map[string]Policy, len(a.Policies)+1)
+			for id, ip := range a.Policies {
+				policies[id] = ip
+			}
+			policies[itemID] = p
+			u.setPolicies(policies)
+		}
+		return h.write(ctx, a, u)
+	})
+}
+
+// Exchange returns the data of a transaction that debits an item from the source account and credits the amount
+// it is worth in another item to the destination account at the current rate of Config.Rates. The credited amount
+// is rounded to the scale of its item with its rounding mode.
+func (h *Handler) Exchange(ctx context.Context, debit Item, creditItemID string) (Exchange, error) {
+	if h.cfg.Rates == nil {
+		return Exchange{}, fmt.Errorf("exchange of %s for %s: no rate provider configured", debit.ID, creditItemID)
+	}
+	if err := debit.Validate(); err != nil {
+		return Exchange{}, err
+	}
+	debit, err := h.rounded(debit)
+	if err != nil {
+		return Exchange{}, err
+	}
+	r, err := h.cfg.Rates.Rate(ctx, debit.ID, creditItemID)
+	if err != nil {
+		return Exchange{}, err
+	}
+	ic := h.cfg.Items[creditItemID]
+	amount, err := debit.Amount.Mul(r.Value, ic.Scale, ic.Rounding)
+	if err != nil {
+		return Exchange{}, fmt.Errorf("exchange of %s %s for %s: %w", debit.Amount, debit.ID, creditItemID, err)
+	}
+	e := Exchange{Debit: debit, Credit: Item{ID: creditItemID, Amount: amount}, Rate: r}
+	return e, e.Validate()
+}
+
+// IsErrorPendingTransactionIDNotFound checks if a given error matches ErrPendingTransactionIDNotFound.
+func (h *Handler) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return errors.Is(err, ErrPendingTransactionIDNotFound)
+}
+
+// IsErrorInsufficientFunds checks if a given error matches dtpc.ErrInsufficientFunds.
+func (h *Handler) IsErrorInsufficientFunds(err error) bool {
+	return errors.Is(err, dtpc.ErrInsufficientFunds)
+}
+
+// leg returns the change of an account by a transaction, or by its rollback. Amounts are rounded to the scale of
+// their item.
+func (h *Handler) leg(accountID, transactionID string, tr dtpc.Request, rollback bool) (func(a *Account, u *update) error, error) {
+	if f, ok, err := h.holdLeg(accountID, transactionID, tr, rollback); ok {
+		return f, err
+	}
+	items, decrement, err := h.legItems(accountID, tr, rollback)
+	if err != nil {
+		return nil, err
+	}
+	return func(a *Account, u *update) error {
+		return u.add(a, items, decrement, rollback)
+	}, nil
+}
+
+// legItems returns the items by which an account is changed by a transaction with Item, Basket or Exchange data, or
+// by its rollback, and whether they are decremented. Amounts are rounded to the scale of their item.
+func (h *Handler) legItems(accountID string, tr dtpc.Request, rollback bool) (Basket, bool, error) {
+	debit, credit, err := legsFromData(tr.Data)
+	if err != nil {
+		return nil, false, err
+	}
+	destination := accountID == tr.Destination
+	items := debit
+	if destination {
+		items = credit
+	}
+	if items, err = h.roundedAll(items); err != nil {
+		return nil, false, err
+	}
+	// The source is decremented and the destination incremented, and the other way round by a rollback.
+	return items, destination == rollback, nil
+}
+
+// roundedAll returns items with their amounts rounded to the scale of their item.
+func (h *Handler) roundedAll(items Basket) (Basket, error) {
+	rounded := make(Basket, len(items))
+	for i, item := range items {
+		var err error
+		if rounded[i], err = h.rounded(item); err != nil {
+			return nil, err
+		}
+	}
+	return rounded, nil
+}
+
+// rounded returns an item with its amount rounded to the scale of the item.
+func (h *Handler) rounded(item Item) (Item, error) {
+	ic := h.cfg.Items[item.ID]
+	amount, err := item.Amount.Round(ic.Scale, ic.Rounding)
+	if err != nil {
+		return Item{}, fmt.Errorf("amount of item %s: %w", item.ID, err)
+	}
+	item.Amount = amount
+	return item, item.Validate()
+}
+
+// scaled returns a balance with the scale of its item. Balances that would require rounding are rejected.
+func (h *Handler) scaled(itemID string, d Decimal) (Decimal, error) {
+	return d.Round(h.cfg.Items[itemID].Scale, RoundExact)
+}
+
+// retry reads an account and calls f with it until f does not fail with errVersionMismatch.
+func (h *Handler) retry(ctx context.Context, op, accountID string, f func(a *Account) error) error {
+	for i := 0; i < h.cfg.MaxAttempts; i++ {
+		if i > 0 {
+			if err := sleep(ctx, h.cfg.RetryInterval); err != nil {
+				return err
+			}
+		}
+		a, err := h.Account(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		if err := f(a); err != errVersionMismatch {
+			return err
+		}
+	}
+	return fmt.Errorf("%s of account %s failed after %d attempts: %w", op, accountID, h.cfg.MaxAttempts, dtpc.ErrConflict)
+}
+
+// write applies an update to an account if it has not been modified since it was read, together with its postings
+// if a journal table is configured.
+func (h *Handler) write(ctx context.Context, a *Account, u *update) error {
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.cfg.TableName),
+		Key:                       h.key(a.ID),
+		UpdateExpression:          aws.String(u.expression()),
+		ConditionExpression:       aws.String(u.condition()),
+		ExpressionAttributeNames:  u.names,
+		ExpressionAttributeValues: u.values,
+	}
+	if h.cfg.JournalTableName != "" && len(u.postings) > 0 {
+		return h.writeJournal(ctx, a, u, in)
+	}
+	if _, err := h.db.UpdateItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return errVersionMismatch
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+func (h *Handler) key(accountID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		h.cfg.Attributes.ID: {S: aws.String(accountID)},
+	}
+}
+
+// marshal returns the item of an account in the storage format of SchemaVersion.
+func (h *Handler) marshal(a *Account) (map[string]*dynamodb.AttributeValue, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	balances := make(map[string]*dynamodb.AttributeValue, len(a.Balances))
+	for id, b := range a.Balances {
+		b, err := h.scaled(id, b)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: balance of item %s: %w", a.ID, id, err)
+		}
+		balances[id] = decimalNumber(b)
+	}
+	attrs := h.cfg.Attributes
+	item := map[string]*dynamodb.AttributeValue{
+		attrs.ID:            {S: aws.String(a.ID)},
+		attrs.SchemaVersion: number(SchemaVersion),
+		attrs.Balances:      {M: balances},
+		attrs.Pending:       {M: marshalPending(a.PendingTransactions)},
+		attrs.Version:       number(int64(a.Version)),
+		attrs.Status:        {S: aws.String(string(a.Status))},
+	}
+	if !a.Policy.isZero() {
+		item[attrs.Policy] = marshalPolicy(a.Policy)
+	}
+	if len(a.Policies) > 0 {
+		item[attrs.Policies] = marshalPolicies(a.Policies)
+	}
+	if len(a.Holds) > 0 {
+		item[attrs.Holds] = marshalHolds(a.Holds)
+	}
+	return item, nil
+}
+
+// unmarshal returns the account of an item in the storage format of SchemaVersion or of an earlier schema version.
+func (h *Handler) unmarshal(item map[string]*dynamodb.AttributeValue) (*Account, error) {
+	attrs := h.cfg.Attributes
+	a := &Account{
+		ID:       aws.StringValue(item[attrs.ID].S),
+		Balances: make(map[string]Decimal),
+		Status:   StatusOpen,
+	}
+	v, err := parseNumber(item[attrs.SchemaVersion])
+	if err != nil || v < 1 || v > SchemaVersion {
+		return nil, fmt.Errorf("account %s has schema version %s: %w", a.ID, numberString(item[attrs.SchemaVersion]), ErrUnsupportedSchemaVersion)
+	}
+	if item[attrs.Balances] == nil || item[attrs.Pending] == nil {
+		return nil, fmt.Errorf("account %s: missing attribute %s or %s", a.ID, attrs.Balances, attrs.Pending)
+	}
+	for id, v := range item[attrs.Balances].M {
+		b, err := parseDecimal(v)
+		if err == nil {
+			b, err = h.scaled(id, b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("account %s: balance of item %s: %w", a.ID, id, err)
+		}
+		a.Balances[id] = b
+	}
+	a.schemaVersion = v
+	if v < 4 {
+		for _, p := range item[attrs.Pending].L {
+			a.PendingTransactions = append(a.PendingTransactions, aws.StringValue(p.S))
+		}
+	} else {
+		for id := range item[attrs.Pending].M {
+			a.PendingTransactions = append(a.PendingTransactions, id)
+		}
+		sort.Strings(a.PendingTransactions)
+	}
+	version, err := parseNumber(item[attrs.Version])
+	if err != nil {
+		return nil, fmt.Errorf("account %s: version: %v", a.ID, err)
+	}
+	a.Version = int(version)
+	if v := item[attrs.Policy]; v != nil {
+		if a.Policy, err = unmarshalPolicy(v); err != nil {
+			return nil, fmt.Errorf("account %s: policy: %v", a.ID, err)
+		}
+	}
+	if v := item[attrs.Policies]; v != nil {
+		a.Policies = make(map[string]Policy, len(v.M))
+		for id, p := range v.M {
+			if a.Policies[id], err = unmarshalPolicy(p); err != nil {
+				return nil, fmt.Errorf("account %s: policy of item %s: %v", a.ID, id, err)
+			}
+		}
+	}
+	if v := item[attrs.Status]; v != nil {
+		if a.Status = Status(aws.StringValue(v.S)); !a.Status.valid() {
+			return nil, fmt.Errorf("account %s: unknown status %q", a.ID, a.Status)
+		}
+	}
+	if v := item[attrs.Holds]; v != nil {
+		a.Holds = make(map[string]Hold, len(v.M))
+		for id, hv := range v.M {
+			hold, err := unmarshalHold(hv)
+			if err != nil {
+				return nil, fmt.Errorf("account %s: hold %s: %v", a.ID, id, err)
+			}
+			for item, amount := range hold.Items {
+				if hold.Items[item], err = h.scaled(item, amount); err != nil {
+					return nil, fmt.Errorf("account %s: hold %s: item %s: %w", a.ID, id, item, err)
+				}
+			}
+			a.Holds[id] = hold
+		}
+	}
+	return a, nil
+}
+
+// marshalPending returns the map of pending transactions of SchemaVersion.
+func marshalPending(transactionIDs []string) map[string]*dynamodb.AttributeValue {
+	pending := make(map[string]*dynamodb.AttributeValue, len(transactionIDs))
+	for _, id := range transactionIDs {
+		pending[id] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	return pending
+}
+
+func marshalPolicy(p Policy) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		"min_balance":         decimalNumber(p.MinBalance),
+		"credit_limit":        decimalNumber(p.CreditLimit),
+		"allow_exact_minimum": {BOOL: aws.Bool(p.AllowExactMinimum)},
+	}}
+}
+
+func marshalPolicies(policies map[string]Policy) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(policies))
+	for id, p := range policies {
+		m[id] = marshalPolicy(p)
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func unmarshalPolicy(v *dynamodb.AttributeValue) (Policy, error) {
+	var p Policy
+	var err error
+	if p.MinBalance, err = parseDecimal(v.M["min_balance"]); err != nil {
+		return Policy{}, err
+	}
+	if p.CreditLimit, err = parseDecimal(v.M["credit_limit"]); err != nil {
+		return Policy{}, err
+	}
+	if e := v.M["allow_exact_minimum"]; e != nil {
+		p.AllowExactMinimum = aws.BoolValue(e.BOOL)
+	}
+	return p, nil
+}
+
+func marshalHolds(holds map[string]Hold) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(holds))
+	for id, h := range holds {
+		items := make(map[string]*dynamodb.AttributeValue, len(h.Items))
+		for item, amount := range h.Items {
+			items[item] = decimalNumber(amount)
+		}
+		hold := map[string]*dynamodb.AttributeValue{
+			"items": {M: items},
+			"payee": {S: aws.String(h.Payee)},
+		}
+		if !h.ExpiresAt.IsZero() {
+			hold["expires_at"] = &dynamodb.AttributeValue{S: aws.String(h.ExpiresAt.UTC().Format(time.RFC3339Nano))}
+		}
+		m[id] = &dynamodb.AttributeValue{M: hold}
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func unmarshalHold(v *dynamodb.AttributeValue) (Hold, error) {
+	items, payee := v.M["items"], v.M["payee"]
+	if items == nil || payee == nil {
+		return Hold{}, fmt.Errorf("missing items or payee")
+	}
+	h := Hold{
+		Items: make(map[string]Decimal, len(items.M)),
+		Payee: aws.StringValue(payee.S),
+	}
+	for item, amount := range items.M {
+		d, err := parseDecimal(amount)
+		if err != nil {
+			return Hold{}, fmt.Errorf("item %s: %v", item, err)
+		}
+		h.Items[item] = d
+	}
+	if e := v.M["expires_at"]; e != nil {
+		t, err := time.Parse(time.RFC3339Nano, aws.StringValue(e.S))
+		if err != nil {
+			return Hold{}, err
+		}
+		h.ExpiresAt = t
+	}
+	return h, nil
+}
+
+// update builds the expressions of a conditional update of an account.
+type update struct {
+	attrs  Attributes
+	set    []string
+	remove []string
+	conds  []string
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	// Transaction of the update and whether the update rolls it back
+	transactionID string
+	contra        bool
+	// Changes of balances to write to the journal
+	postings []Posting
+	// Pending transactions replacing the list of a document written before schema version 4
+	pending map[string]*dynamodb.AttributeValue
+}
+
+// update starts an update of an account that requires the account to be unmodified since it was read
+// and increments its version. The update upgrades documents of earlier schema versions to SchemaVersion.
+func (h *Handler) update(a *Account) *update {
+	attrs := h.cfg.Attributes
+	u := &update{
+		attrs: attrs,
+		set:   []string{"#ve = :newve", "#sv = :sv"},
+		conds: []string{"#sv <= :sv", "#ve = :ve"},
+		names: map[string]*string{
+			"#sv": aws.String(attrs.SchemaVersion),
+			"#ve": aws.String(attrs.Version),
+		},
+		values: map[string]*dynamodb.AttributeValue{
+			":sv":    number(SchemaVersion),
+			":ve":    number(int64(a.Version)),
+			":newve": number(int64(a.Version) + 1),
+		},
+	}
+	if a.schemaVersion < 4 {
+		u.pending = marshalPending(a.PendingTransactions)
+		u.names["#pt"] = aws.String(attrs.Pending)
+		u.values[":pt"] = &dynamodb.AttributeValue{M: u.pending}
+		u.set = append(u.set, "#pt = :pt")
+	}
+	return u
+}
+
+// addPending adds a transaction to the pending transactions and conditions the update on the transaction not being
+// pending.
+func (u *update) addPending(transactionID string) {
+	if u.pending != nil {
+		u.pending[transactionID] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+		return
+	}
+	u.names["#pt"] = aws.String(u.attrs.Pending)
+	u.names["#tid"] = aws.String(transactionID)
+	u.values[":true"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	u.set = append(u.set, "#pt.#tid = :true")
+	u.conds = append(u.conds, "attribute_not_exists(#pt.#tid)")
+}
+
+// removePending removes a transaction from the pending transactions and conditions the update on the transaction
+// being pending.
+func (u *update) removePending(transactionID string) {
+	if u.pending != nil {
+		delete(u.pending, transactionID)
+		return
+	}
+	u.names["#pt"] = aws.String(u.attrs.Pending)
+	u.names["#tid"] = aws.String(transactionID)
+	u.remove = append(u.remove, "#pt.#tid")
+	u.conds = append(u.conds, "attribute_exists(#pt.#tid)")
+}
+
+// add increments or decrements the balances of items of an account.
+// A decrement fails with an *InsufficientFundsError if it violates the policy of any of the items, and the update is
+// conditioned on the balances so that the policies also hold for concurrent modifications. The decrement of a
+// rollback only has to keep the balances at or above zero, or the floor of their policy if it is lower.
+func (u *update) add(a *Account, items []Item, decrement, rollback bool) error {
+	u.names["#bal"] = aws.String(u.attrs.Balances)
+	u.values[":zero"] = number(0)
+	op := "+"
+	if decrement {
+		op = "-"
+	}
+	for i, item := range items {
+		name, q := fmt.Sprintf("#i%d", i), fmt.Sprintf(":q%d", i)
+		u.names[name] = aws.String(item.ID)
+		u.values[q] = decimalNumber(item.Amount)
+		u.set = append(u.set, fmt.Sprintf("#bal.%s = if_not_exists(#bal.%s, :zero) %s %s", name, name, op, q))
+
+		balance, ok := a.Balances[item.ID]
+		if !decrement {
+			after, err := balance.Add(item.Amount)
+			if err != nil {
+				return fmt.Errorf("account %s, item %s: %w", a.ID, item.ID, err)
+			}
+			u.post(item.ID, Credit, item.Amount, after, false)
+			continue
+		}
+		p := a.PolicyOf(item.ID)
+		if rollback {
+			var err error
+			if p, err = p.reverting(); err != nil {
+				return err
+			}
+		}
+		if !p.allows(balance, item.Amount) {
+			return &InsufficientFundsError{AccountID: a.ID, ItemID: item.ID, Balance: balance, Amount: item.Amount, Policy: p}
+		}
+		after, err := balance.Sub(item.Amount)
+		if err != nil {
+			return fmt.Errorf("account %s, item %s: %w", a.ID, item.ID, err)
+		}
+		u.post(item.ID, Debit, item.Amount, after, false)
+		if !ok {
+			u.conds = append(u.conds, fmt.Sprintf("attribute_not_exists(#bal.%s)", name))
+			continue
+		}
+		// The balance after the decrement must stay above the floor: balance - amount > floor.
+		floor, err := p.Floor()
+		if err != nil {
+			return err
+		}
+		limit, err := floor.Add(item.Amount)
+		if err != nil {
+			return fmt.Errorf("account %s, item %s: %w", a.ID, item.ID, err)
+		}
+		cmp := ">"
+		if p.AllowExactMinimum {
+			cmp = ">="
+		}
+		l := fmt.Sprintf(":limit%d", i)
+		u.values[l] = decimalNumber(limit)
+		u.conds = append(u.conds, fmt.Sprintf("#bal.%s %s %s", name, cmp, l))
+	}
+	return nil
+}
+
+// addUnread increments or decrements the balances of items of an account that has not been read. A decrement is
+// conditioned on the item having no policy, and on its balance staying above zero, or at or above zero for a rollback
+// as allowed by the reverting zero Policy. An increment is conditioned on the balance staying in the range of a
+// Decimal with the scale of the item.
+func (h *Handler) addUnread(u *update, items []Item, decrement, rollback bool) error {
+	u.names["#bal"] = aws.String(u.attrs.Balances)
+	u.values[":zero"] = number(0)
+	op := "+"
+	if decrement {
+		op = "-"
+		u.names["#pol"] = aws.String(u.attrs.Policy)
+		u.names["#pols"] = aws.String(u.attrs.Policies)
+		u.conds = append(u.conds, "attribute_not_exists(#pol)")
+	}
+	for i, item := range items {
+		name, q := fmt.Sprintf("#i%d", i), fmt.Sprintf(":q%d", i)
+		u.names[name] = aws.String(item.ID)
+		u.values[q] = decimalNumber(item.Amount)
+		u.set = append(u.set, fmt.Sprintf("#bal.%s = if_not_exists(#bal.%s, :zero) %s %s", name, name, op, q))
+		if decrement {
+			cmp := ">"
+			if rollback {
+				cmp = ">="
+			}
+			u.conds = append(u.conds, fmt.Sprintf("attribute_not_exists(#pols.%s)", name), fmt.Sprintf("#bal.%s %s %s", name, cmp, q))
+			continue
+		}
+		limit, err := NewDecimal(math.MaxInt64, h.cfg.Items[item.ID].Scale).Sub(item.Amount)
+		if err != nil {
+			return fmt.Errorf("item %s: %w", item.ID, err)
+		}
+		l := fmt.Sprintf(":limit%d", i)
+		u.values[l] = decimalNumber(limit)
+		u.conds = append(u.conds, fmt.Sprintf("(attribute_not_exists(#bal.%s) OR #bal.%s <= %s)", name, name, l))
+	}
+	return nil
+}
+
+func (u *update) setPolicy(p Policy) {
+	u.names["#pol"] = aws.String(u.attrs.Policy)
+	u.values[":pol"] = marshalPolicy(p)
+	u.set = append(u.set, "#pol = :pol")
+}
+
+func (u *update) setPolicies(policies map[string]Policy) {
+	u.names["#pols"] = aws.String(u.attrs.Policies)
+	u.values[":pols"] = marshalPolicies(policies)
+	u.set = append(u.set, "#pols = :pols")
+}
+
+// setHolds replaces the holds of an account and removes the attribute when no holds are left.
+func (u *update) setHolds(a *Account, holds map[string]Hold) error {
+	if err := u.postHolds(a, holds); err != nil {
+		return err
+	}
+	u.names["#hol"] = aws.String(u.attrs.Holds)
+	if len(holds) == 0 {
+		u.remove = append(u.remove, "#hol")
+		return nil
+	}
+	u.values[":hol"] = marshalHolds(holds)
+	u.set = append(u.set, "#hol = :hol")
+	return nil
+}
+
+func (u *update) expression() string {
+	e := "SET " + strings.Join(u.set, ", ")
+	if len(u.remove) > 0 {
+		e += " REMOVE " + strings.Join(u.remove, ", ")
+	}
+	return e
+}
+
+func (u *update) condition() string {
+	return strings.Join(u.conds, " AND ")
+}
+
+func number(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+func decimalNumber(d Decimal) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(d.String())}
+}
+
+func parseDecimal(v *dynamodb.AttributeValue) (Decimal, error) {
+	if v == nil || v.N == nil {
+		return Decimal{}, fmt.Errorf("not a number")
+	}
+	return ParseDecimal(*v.N)
+}
+
+func numberString(v *dynamodb.AttributeValue) string {
+	if v == nil || v.N == nil {
+		return "none"
+	}
+	return *v.N
+}
+
+func parseNumber(v *dynamodb.AttributeValue) (int64, error) {
+	if v == nil || v.N == nil {
+		return 0, fmt.Errorf("not a number")
+	}
+	return strconv.ParseInt(*v.N, 10, 64)
+}
+
+// isConditionalCheckFailed checks if a given error matches dynamodb.ErrCodeConditionalCheckFailedException.
+func isConditionalCheckFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// sleep pauses the current goroutine for the duration d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
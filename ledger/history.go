@@ -0,0 +1,237 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"dtpc"
+)
+
+// Attribute names of snapshots in the journal table.
+const (
+	snapshotBalances = "balances"
+	snapshotInFlight = "in_flight"
+)
+
+// snapshotPrefix starts the IDs of snapshots, which sort after the IDs of postings.
+const snapshotPrefix = "snapshot#"
+
+// History reconstructs past balances of accounts of a Handler from its journal and the states of the transactions in
+// a transaction log.
+type History struct {
+	ts dtpc.TransactionHandler
+	h  *Handler
+}
+
+// NewHistory initialises History for the transaction log of the transactions applied to the accounts of h, usually
+// the TransactionHandler of the Service.
+func NewHistory(ts dtpc.TransactionHandler, h *Handler) *History {
+	return &History{
+		ts: ts,
+		h:  h,
+	}
+}
+
+// snapshot holds the balances of an account at a point in time.
+type snapshot struct {
+	Time time.Time
+	// Balances of the transactions committed until Time by item ID
+	Balances map[string]Decimal
+	// Amounts by item ID of the transactions applied until Time but neither committed nor cancelled by then, by
+	// transaction ID
+	InFlight map[string]map[string]Decimal
+}
+
+// BalanceAt returns the balance of an item of an account at time t. It replays the postings from the latest snapshot
+// at or before t and only counts transactions that have been committed by t, i.e. that are done and have not been
+// modified after t. Cancelled transactions and transactions still in flight at t are excluded. Held amounts are not
+// part of the balance, and accounts without a snapshot before t, e.g. created after t, have zero balances.
+func (hs *History) BalanceAt(ctx context.Context, accountID, itemID string, t time.Time) (Decimal, error) {
+	s, err := hs.replay(ctx, accountID, t)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return hs.h.scaled(itemID, s.Balances[itemID])
+}
+
+// Snapshot stores the balances of an account at time t in the journal, so that BalanceAt only replays the postings
+// after t for later times. Snapshots are typically taken periodically, with a time far enough in the past that no
+// postings up to it are still being written.
+func (hs *History) Snapshot(ctx context.Context, accountID string, t time.Time) error {
+	s, err := hs.replay(ctx, accountID, t)
+	if err != nil {
+		return err
+	}
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(hs.h.cfg.JournalTableName),
+		Item:      marshalSnapshot(accountID, s),
+	}
+	if _, err := hs.h.db.PutItemWithContext(ctx, in); err != nil {
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// replay returns the balances of an account at time t.
+func (hs *History) replay(ctx context.Context, accountID string, t time.Time) (*snapshot, error) {
+	s, err := hs.h.snapshot(ctx, accountID, t)
+	if err != nil {
+		return nil, err
+	}
+	postings, err := hs.h.postings(ctx, accountID, s.Time, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sum up the transactions in flight at the time of the snapshot and the postings after it by transaction.
+	amounts := make(map[string]map[string]Decimal, len(s.InFlight))
+	for id, items := range s.InFlight {
+		amounts[id] = items
+	}
+	for _, p := range postings {
+		if p.Held || !p.Time.After(s.Time) {
+			continue
+		}
+		items, ok := amounts[p.TransactionID]
+		if !ok {
+			items = make(map[string]Decimal)
+			amounts[p.TransactionID] = items
+		}
+		amount := p.Amount
+		if p.Side == Debit {
+			amount = amount.Neg()
+		}
+		if items[p.ItemID], err = items[p.ItemID].Add(amount); err != nil {
+			return nil, fmt.Errorf("account %s, transaction %s, item %s: %w", accountID, p.TransactionID, p.ItemID, err)
+		}
+	}
+
+	ids := make([]string, 0, len(amounts))
+	for id := range amounts {
+		ids = append(ids, id)
+	}
+	trs, err := transactions(ctx, hs.ts, ids)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", accountID, err)
+	}
+	next := &snapshot{Time: t, Balances: s.Balances, InFlight: make(map[string]map[string]Decimal)}
+	for id, items := range amounts {
+		tr, ok := trs[id]
+		if !ok {
+			return nil, fmt.Errorf("account %s: transaction %s: %w", accountID, id, dtpc.ErrTransactionNotFound)
+		}
+		switch {
+		case tr.TransactionState == dtpc.Cancelled:
+		case tr.TransactionState == dtpc.Done && !tr.LastModified.After(t):
+			for itemID, amount := range items {
+				if next.Balances[itemID], err = next.Balances[itemID].Add(amount); err != nil {
+					return nil, fmt.Errorf("account %s, transaction %s, item %s: %w", accountID, id, itemID, err)
+				}
+			}
+		default:
+			next.InFlight[id] = items
+		}
+	}
+	return next, nil
+}
+
+// snapshot returns the latest snapshot of an account at or before time t, or an empty snapshot at the zero time if
+// there is none.
+func (h *Handler) snapshot(ctx context.Context, accountID string, t time.Time) (*snapshot, error) {
+	if h.cfg.JournalTableName == "" {
+		return nil, fmt.Errorf("no journal table configured")
+	}
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(h.cfg.JournalTableName),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#aid = :aid AND #pid BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{
+			"#aid": aws.String(journalAccountID),
+			"#pid": aws.String(journalPostingID),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":aid":  {S: aws.String(accountID)},
+			":from": {S: aws.String(snapshotPrefix)},
+			":to":   {S: aws.String(snapshotPrefix + t.UTC().Format(postingTimeFormat))},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+	}
+	res, err := h.db.QueryWithContext(ctx, in)
+	if err != nil {
+		return nil, dtpc.WrapDynamoDBError(err)
+	}
+	if len(res.Items) == 0 {
+		return &snapshot{Balances: make(map[string]Decimal)}, nil
+	}
+	s, err := unmarshalSnapshot(res.Items[0])
+	if err != nil {
+		return nil, fmt.Errorf("account %s: snapshot %s: %v", accountID, aws.StringValue(res.Items[0][journalPostingID].S), err)
+	}
+	return s, nil
+}
+
+func marshalSnapshot(accountID string, s *snapshot) map[string]*dynamodb.AttributeValue {
+	t := s.Time.UTC()
+	item := map[string]*dynamodb.AttributeValue{
+		journalAccountID: {S: aws.String(accountID)},
+		journalPostingID: {S: aws.String(snapshotPrefix + t.Format(postingTimeFormat))},
+		journalTime:      {S: aws.String(t.Format(time.RFC3339Nano))},
+		snapshotBalances: marshalAmounts(s.Balances),
+	}
+	if len(s.InFlight) > 0 {
+		inFlight := make(map[string]*dynamodb.AttributeValue, len(s.InFlight))
+		for id, items := range s.InFlight {
+			inFlight[id] = marshalAmounts(items)
+		}
+		item[snapshotInFlight] = &dynamodb.AttributeValue{M: inFlight}
+	}
+	return item
+}
+
+func unmarshalSnapshot(item map[string]*dynamodb.AttributeValue) (*snapshot, error) {
+	s := &snapshot{InFlight: make(map[string]map[string]Decimal)}
+	var err error
+	if s.Time, err = time.Parse(time.RFC3339Nano, aws.StringValue(item[journalTime].S)); err != nil {
+		return nil, err
+	}
+	if s.Balances, err = unmarshalAmounts(item[snapshotBalances]); err != nil {
+		return nil, fmt.Errorf("balances: %v", err)
+	}
+	if av, ok := item[snapshotInFlight]; ok {
+		for id, items := range av.M {
+			if s.InFlight[id], err = unmarshalAmounts(items); err != nil {
+				return nil, fmt.Errorf("transaction %s: %v", id, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// marshalAmounts returns a map attribute of amounts by item ID.
+func marshalAmounts(amounts map[string]Decimal) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(amounts))
+	for id, amount := range amounts {
+		m[id] = decimalNumber(amount)
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func unmarshalAmounts(av *dynamodb.AttributeValue) (map[string]Decimal, error) {
+	amounts := make(map[string]Decimal)
+	if av == nil {
+		return amounts, nil
+	}
+	for id, v := range av.M {
+		amount, err := parseDecimal(v)
+		if err != nil {
+			return nil, fmt.Errorf("item %s: %v", id, err)
+		}
+		amounts[id] = amount
+	}
+	return amounts, nil
+}
@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dtpc"
+)
+
+// checkBalanceAt fails unless an account had the given balance of USD at time t.
+func checkBalanceAt(t *testing.T, hs *History, accountID string, at time.Time, expected string) {
+	t.Helper()
+	b, err := hs.BalanceAt(context.Background(), accountID, "usd", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(MustParseDecimal(expected)) {
+		t.Fatalf("expected %s to have %s at %s but got %s", accountID, expected, at, b)
+	}
+}
+
+// applyToSource inserts a transfer of USD from the source to the destination and applies it to the source only.
+func applyToSource(t *testing.T, h *Handler, srv *dtpc.Service, amount int64) (string, dtpc.Request) {
+	t.Helper()
+	ctx := context.Background()
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: Item{ID: "usd", Amount: whole(amount)}}
+	id, err := srv.Ts.Insert(ctx, req.Source, req.Destination, req.Reference, req.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "source", id, req); err != nil {
+		t.Fatal(err)
+	}
+	return id, req
+}
+
+func TestBalanceAt(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+	hs := NewHistory(srv.Ts, h)
+	before := time.Now().Add(-time.Hour)
+	created := time.Now()
+
+	if _, err := srv.StartTransaction(ctx, dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: Item{ID: "usd", Amount: whole(30)}}); err != nil {
+		t.Fatal(err)
+	}
+	transferred := time.Now()
+	checkBalanceAt(t, hs, "source", before, "0")
+	checkBalanceAt(t, hs, "source", created, "100")
+	checkBalanceAt(t, hs, "source", transferred, "70")
+	checkBalanceAt(t, hs, "destination", transferred, "30")
+
+	// A transaction in flight is excluded, and so is a cancelled transaction.
+	applyToSource(t, h, srv, 10)
+	inFlight := time.Now()
+	checkBalanceAt(t, hs, "source", inFlight, "70")
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	checkBalanceAt(t, hs, "source", inFlight, "70")
+	checkBalanceAt(t, hs, "source", time.Now(), "70")
+}
+
+func TestBalanceAtSnapshot(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+	hs := NewHistory(srv.Ts, h)
+
+	// A transaction applied to both accounts before a snapshot and committed after it.
+	id, req := applyToSource(t, h, srv, 10)
+	if err := h.Update(ctx, "destination", id, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Ts.UpdateState(ctx, id, dtpc.Applied); err != nil {
+		t.Fatal(err)
+	}
+	snapshotted := time.Now()
+	if err := hs.Snapshot(ctx, "source", snapshotted); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h.snapshot(ctx, "source", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Time.Equal(snapshotted) || !s.Balances["usd"].Equal(whole(100)) || !s.InFlight[id]["usd"].Equal(whole(-10)) {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+	checkBalanceAt(t, hs, "source", snapshotted, "100")
+
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	committed := time.Now()
+	if _, err := srv.StartTransaction(ctx, dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: Item{ID: "usd", Amount: whole(5)}}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalanceAt(t, hs, "source", snapshotted, "100")
+	checkBalanceAt(t, hs, "source", committed, "90")
+	checkBalanceAt(t, hs, "source", time.Now(), "85")
+
+	if err := hs.Snapshot(ctx, "source", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	checkBalanceAt(t, hs, "source", committed, "90")
+	checkBalanceAt(t, hs, "source", time.Now(), "85")
+}
+
+func TestBalanceAtPut(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+	hs := NewHistory(srv.Ts, h)
+	created := time.Now()
+
+	// An account put without being created starts its history with the balances it is put with, and an account that
+	// is replaced continues it from the balances of the replacement.
+	if err := h.Put(ctx, &Account{ID: "put", Balances: map[string]Decimal{"usd": whole(40)}}); err != nil {
+		t.Fatal(err)
+	}
+	put := time.Now()
+	if err := h.Put(ctx, &Account{ID: "source", Balances: map[string]Decimal{"usd": whole(60)}}); err != nil {
+		t.Fatal(err)
+	}
+	replaced := time.Now()
+	checkBalanceAt(t, hs, "put", created, "0")
+	checkBalanceAt(t, hs, "put", put, "40")
+	checkBalanceAt(t, hs, "source", created, "100")
+	checkBalanceAt(t, hs, "source", replaced, "60")
+
+	if _, err := srv.StartTransaction(ctx, dtpc.Request{Source: "source", Destination: "put", Reference: "source:put", Data: Item{ID: "usd", Amount: whole(10)}}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalanceAt(t, hs, "source", replaced, "60")
+	checkBalanceAt(t, hs, "source", time.Now(), "50")
+	checkBalanceAt(t, hs, "put", time.Now(), "50")
+}
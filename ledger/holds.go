@@ -0,0 +1,457 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"dtpc"
+)
+
+const (
+	// holdReference prefixes the references of the transactions that place holds.
+	holdReference    = "hold:"
+	captureReference = "capture:"
+	releaseReference = "release:"
+	// holdExpiryFormat is the hour of the expiry of a hold in the reference of its transaction, which allows
+	// RecoverHolds to only read the holds expiring in a given hour.
+	holdExpiryFormat = "2006-01-02T15"
+	// noExpiry replaces the expiry hour in the references of holds that do not expire.
+	noExpiry = "never"
+)
+
+var (
+	// ErrHoldNotFound is returned when an account has no hold with the given ID.
+	ErrHoldNotFound = errors.New("hold not found")
+	// ErrHoldExpired is returned by the capture of a hold whose expiry has passed.
+	ErrHoldExpired = errors.New("hold expired")
+)
+
+// Hold is an amount of items reserved on an account for a payee. Held amounts are not part of the balances of the
+// account until the hold is released.
+type Hold struct {
+	// Held amounts by item ID
+	Items map[string]Decimal
+	// ID of the account the held items can be captured by
+	Payee string
+	// Time after which the hold can no longer be captured. A zero value means the hold does not expire.
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the expiry of the hold has passed at the given time.
+func (h Hold) Expired(now time.Time) bool {
+	return !h.ExpiresAt.IsZero() && !now.Before(h.ExpiresAt)
+}
+
+// equal reports whether two holds reserve the same amounts for the same payee until the same time.
+func (h Hold) equal(o Hold) bool {
+	if h.Payee != o.Payee || !h.ExpiresAt.Equal(o.ExpiresAt) || len(h.Items) != len(o.Items) {
+		return false
+	}
+	for id, amount := range h.Items {
+		if other, ok := o.Items[id]; !ok || !amount.Equal(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorization is the data of a transaction that holds items of the source account for the destination account.
+// The ID of the hold is the ID of the transaction.
+type Authorization struct {
+	// Items to hold
+	Items Basket
+	// Expiry of the hold
+	ExpiresAt time.Time
+}
+
+// Capture is the data of a transaction that transfers held items from the source account to the destination account,
+// which must be the payee of the hold. The captured amounts are taken from the hold and the rest stays held.
+type Capture struct {
+	// ID of the hold
+	HoldID string
+	// Items to capture
+	Items Basket
+}
+
+// Release is the data of a transaction that returns the remaining items of a hold to the balances of its account,
+// which is both the source and the destination of the transaction. Hold is a snapshot of the released hold, which
+// is restored when the transaction is rolled back.
+type Release struct {
+	// ID of the hold
+	HoldID string
+	// Snapshot of the hold
+	Hold Hold
+}
+
+// Holds places, captures and releases holds on accounts of a Handler with transactions of a Service, so that every
+// change of a hold is recorded in the transaction log and completed by Service.RecoverTransactions after a failure.
+type Holds struct {
+	srv *dtpc.Service
+	h   *Handler
+}
+
+// NewHolds initialises Holds for a Service whose AccountHandler is h.
+func NewHolds(srv *dtpc.Service, h *Handler) *Holds {
+	return &Holds{
+		srv: srv,
+		h:   h,
+	}
+}
+
+// Hold reserves items of an account for a payee until expiresAt and returns the ID of the hold. The items are
+// debited from the balances of the account subject to their policies. A zero expiresAt holds the items until they
+// are captured or released.
+func (hs *Holds) Hold(ctx context.Context, accountID, payeeID string, items Basket, expiresAt time.Time) (string, error) {
+	if err := items.Validate(); err != nil {
+		return "", err
+	}
+	if accountID == payeeID {
+		return "", fmt.Errorf("account %s cannot hold items for itself", accountID)
+	}
+	req := dtpc.Request{
+		Source:      accountID,
+		Destination: payeeID,
+		Reference:   holdReferencePrefix(expiresAt) + accountID,
+		Data:        Authorization{Items: items, ExpiresAt: expiresAt},
+	}
+	res, err := hs.srv.StartTransaction(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return res.TransactionID, nil
+}
+
+// Capture transfers held items to the payee of a hold before the hold expires. A capture can take less than the
+// held amounts, and the hold is released when nothing remains.
+func (hs *Holds) Capture(ctx context.Context, holdID string, items Basket) error {
+	if err := items.Validate(); err != nil {
+		return err
+	}
+	t, err := hs.authorization(ctx, holdID)
+	if err != nil {
+		return err
+	}
+	req := dtpc.Request{
+		Source:      t.Source,
+		Destination: t.Destination,
+		Reference:   captureReference + holdID,
+		Data:        Capture{HoldID: holdID, Items: items},
+	}
+	if _, err := hs.srv.StartTransaction(ctx, req); err != nil {
+		return err
+	}
+
+	a, err := hs.h.Account(ctx, t.Source)
+	if err != nil {
+		return err
+	}
+	hold, ok := a.Holds[holdID]
+	if !ok {
+		return nil
+	}
+	for _, amount := range hold.Items {
+		if !amount.IsZero() {
+			return nil
+		}
+	}
+	return hs.release(ctx, a.ID, holdID, hold)
+}
+
+// Release returns the remaining items of a hold to the balances of its account.
+func (hs *Holds) Release(ctx context.Context, holdID string) error {
+	t, err := hs.authorization(ctx, holdID)
+	if err != nil {
+		return err
+	}
+	a, err := hs.h.Account(ctx, t.Source)
+	if err != nil {
+		return err
+	}
+	hold, ok := a.Holds[holdID]
+	if !ok {
+		return fmt.Errorf("account %s, hold %s: %w", a.ID, holdID, ErrHoldNotFound)
+	}
+	return hs.release(ctx, a.ID, holdID, hold)
+}
+
+// RecoverHolds releases the holds that expire from from until to without having been released, e.g. because the
+// checkout that placed them has been abandoned. The references of hold transactions start with the hour of their
+// expiry, so that only the holds expiring in the hours from from to to are read, and periodic passes continue from
+// the end of the previous pass. Holds are released once their transaction is done, so incomplete hold transactions
+// should be recovered by Service.RecoverTransactions first.
+func (hs *Holds) RecoverHolds(ctx context.Context, from, to time.Time) error {
+	if from.IsZero() || to.Before(from) {
+		return fmt.Errorf("invalid expiry range from %v to %v", from, to)
+	}
+	for hour := from.UTC().Truncate(time.Hour); !hour.After(to); hour = hour.Add(time.Hour) {
+		ts, err := hs.srv.GetTransactions(ctx, dtpc.Done, holdReferencePrefix(hour))
+		if err != nil {
+			return err
+		}
+		for _, t := range ts {
+			data, err := holdFromData(t.Value)
+			if err != nil {
+				return fmt.Errorf("hold %s: %w", t.ID, err)
+			}
+			auth, ok := data.(Authorization)
+			if !ok || auth.ExpiresAt.IsZero() || auth.ExpiresAt.Before(from) || auth.ExpiresAt.After(to) {
+				continue
+			}
+			a, err := hs.h.Account(ctx, t.Source)
+			if err != nil {
+				return err
+			}
+			hold, ok := a.Holds[t.ID]
+			if !ok {
+				continue
+			}
+			if err := hs.release(ctx, a.ID, t.ID, hold); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// holdReferencePrefix returns the prefix of the references of the transactions of holds expiring in the hour of
+// expiresAt.
+func holdReferencePrefix(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return holdReference + noExpiry + ":"
+	}
+	return holdReference + expiresAt.UTC().Format(holdExpiryFormat) + ":"
+}
+
+// authorization returns the transaction that placed a hold.
+func (hs *Holds) authorization(ctx context.Context, holdID string) (*dtpc.Transaction, error) {
+	t, err := hs.srv.Ts.GetTransaction(ctx, holdID)
+	if errors.Is(err, dtpc.ErrTransactionNotFound) {
+		return nil, fmt.Errorf("hold %s: %w", holdID, ErrHoldNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err := holdFromData(t.Value); err != nil || !isAuthorization(data) {
+		return nil, fmt.Errorf("transaction %s is not a hold: %w", holdID, ErrHoldNotFound)
+	}
+	return t, nil
+}
+
+func (hs *Holds) release(ctx context.Context, accountID, holdID string, hold Hold) error {
+	req := dtpc.Request{
+		Source:      accountID,
+		Destination: accountID,
+		Reference:   releaseReference + holdID,
+		Data:        Release{HoldID: holdID, Hold: hold},
+	}
+	_, err := hs.srv.StartTransaction(ctx, req)
+	return err
+}
+
+// holdLeg returns the change of an account by a transaction with Authorization, Capture or Release data, or by its
+// rollback. It reports false for other data.
+func (h *Handler) holdLeg(accountID, transactionID string, tr dtpc.Request, rollback bool) (func(a *Account, u *update) error, bool, error) {
+	data, err := holdFromData(tr.Data)
+	if err != nil {
+		return nil, true, err
+	}
+	switch d := data.(type) {
+	case Authorization:
+		items, err := h.roundedAll(d.Items)
+		if err != nil || accountID != tr.Source {
+			return noop, true, err
+		}
+		return func(a *Account, u *update) error {
+			holds := a.copyHolds()
+			if rollback {
+				delete(holds, transactionID)
+			} else {
+				hold := Hold{Items: make(map[string]Decimal, len(items)), Payee: tr.Destination, ExpiresAt: d.ExpiresAt}
+				for _, item := range items {
+					hold.Items[item.ID] = item.Amount
+				}
+				holds[transactionID] = hold
+			}
+			if err := u.setHolds(a, holds); err != nil {
+				return err
+			}
+			return u.add(a, items, !rollback, rollback)
+		}, true, nil
+
+	case Capture:
+		c := d
+		items, err := h.roundedAll(c.Items)
+		if err != nil {
+			return nil, true, err
+		}
+		if accountID == tr.Destination {
+			return func(a *Account, u *update) error {
+				return u.add(a, items, rollback, rollback)
+			}, true, nil
+		}
+		return func(a *Account, u *update) error {
+			hold, ok := a.Holds[c.HoldID]
+			if rollback && !ok {
+				// The hold has been released since, so the captured amounts are returned to the balances.
+				return u.add(a, items, false, rollback)
+			}
+			if !ok {
+				return fmt.Errorf("account %s, hold %s: %w", a.ID, c.HoldID, ErrHoldNotFound)
+			}
+			if !rollback && hold.Payee != tr.Destination {
+				return fmt.Errorf("hold %s of account %s cannot be captured by account %s: %w", c.HoldID, a.ID, tr.Destination, ErrHoldNotFound)
+			}
+			if !rollback && hold.Expired(time.Now()) {
+				return fmt.Errorf("account %s, hold %s: %w", a.ID, c.HoldID, ErrHoldExpired)
+			}
+			held := make(map[string]Decimal, len(hold.Items))
+			for id, amount := range hold.Items {
+				held[id] = amount
+			}
+			for _, item := range items {
+				var err error
+				if rollback {
+					held[item.ID], err = held[item.ID].Add(item.Amount)
+				} else if held[item.ID].Cmp(item.Amount) < 0 {
+					return fmt.Errorf("hold %s of account %s has %s of item %s and cannot be captured by %s: %w",
+						c.HoldID, a.ID, held[item.ID], item.ID, item.Amount, dtpc.ErrInsufficientFunds)
+				} else {
+					held[item.ID], err = held[item.ID].Sub(item.Amount)
+				}
+				if err != nil {
+					return fmt.Errorf("account %s, hold %s, item %s: %w", a.ID, c.HoldID, item.ID, err)
+				}
+			}
+			hold.Items = held
+			holds := a.copyHolds()
+			holds[c.HoldID] = hold
+			return u.setHolds(a, holds)
+		}, true, nil
+
+	case Release:
+		r := d
+		var items Basket
+		for id, amount := range r.Hold.Items {
+			if !amount.IsZero() {
+				items = append(items, Item{ID: id, Amount: amount})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+		return func(a *Account, u *update) error {
+			hold, ok := a.Holds[r.HoldID]
+			holds := a.copyHolds()
+			switch {
+			case rollback:
+				holds[r.HoldID] = r.Hold
+			case !ok:
+				return fmt.Errorf("account %s, hold %s: %w", a.ID, r.HoldID, ErrHoldNotFound)
+			case !hold.equal(r.Hold):
+				return fmt.Errorf("hold %s of account %s has changed since its release was requested: %w", r.HoldID, a.ID, dtpc.ErrConflict)
+			default:
+				delete(holds, r.HoldID)
+			}
+			if err := u.setHolds(a, holds); err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			// A rollback takes the released items back from the balances, and fails if they have been spent.
+			return u.add(a, items, rollback, rollback)
+		}, true, nil
+
+	default:
+		return nil, false, nil
+	}
+}
+
+func isAuthorization(data interface{}) bool {
+	_, ok := data.(Authorization)
+	return ok
+}
+
+// noop is the change of an account that is not affected by a transaction besides its pending transactions.
+func noop(a *Account, u *update) error {
+	return nil
+}
+
+// copyHolds returns a copy of the holds of an account that can be modified.
+func (a *Account) copyHolds() map[string]Hold {
+	holds := make(map[string]Hold, len(a.Holds)+1)
+	for id, hold := range a.Holds {
+		holds[id] = hold
+	}
+	return holds
+}
+
+// holdFromData converts the data of a hold transaction into an Authorization, Capture or Release, and returns nil
+// for other data. Generic maps are recognised by the fields that only the respective type has.
+func holdFromData(data interface{}) (interface{}, error) {
+	switch d := data.(type) {
+	case Authorization:
+		return d, d.Items.Validate()
+	case *Authorization:
+		if d != nil {
+			return holdFromData(*d)
+		}
+	case Capture:
+		if d.HoldID == "" {
+			return nil, fmt.Errorf("hold ID is required: %w", ErrInvalidItem)
+		}
+		return d, d.Items.Validate()
+	case *Capture:
+		if d != nil {
+			return holdFromData(*d)
+		}
+	case Release:
+		if d.HoldID == "" {
+			return nil, fmt.Errorf("hold ID is required: %w", ErrInvalidItem)
+		}
+		return d, nil
+	case *Release:
+		if d != nil {
+			return holdFromData(*d)
+		}
+	case map[string]interface{}:
+		_, items := d["Items"]
+		_, holdID := d["HoldID"]
+		_, hold := d["Hold"]
+		switch {
+		case holdID && hold:
+			var r Release
+			if err := decodeMap(d, &r); err != nil {
+				return nil, err
+			}
+			return holdFromData(r)
+		case holdID && items:
+			var c Capture
+			if err := decodeMap(d, &c); err != nil {
+				return nil, err
+			}
+			return holdFromData(c)
+		case items:
+			var auth Authorization
+			if err := decodeMap(d, &auth); err != nil {
+				return nil, err
+			}
+			return holdFromData(auth)
+		}
+	}
+	return nil, nil
+}
+
+// decodeMap decodes the generic map representation of transaction data into v.
+func decodeMap(m map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("transaction data %v: %v: %w", m, err, ErrInvalidItem)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dtpc"
+)
+
+// checkBalances fails unless the customer and the merchant have the given available and held amounts of USD.
+func checkBalances(t *testing.T, h *Handler, customer, held, merchant string) {
+	t.Helper()
+	ctx := context.Background()
+	c, err := h.Account(ctx, "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := h.Account(ctx, "merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := c.Held("usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Balance("usd").Equal(MustParseDecimal(customer)) || !total.Equal(MustParseDecimal(held)) || !m.Balance("usd").Equal(MustParseDecimal(merchant)) {
+		t.Fatalf("expected balances %s (%s held) and %s but got %s (%s held) and %s", customer, held, merchant, c.Balance("usd"), total, m.Balance("usd"))
+	}
+	if len(c.PendingTransactions) != 0 || len(m.PendingTransactions) != 0 {
+		t.Fatalf("expected no pending transactions but got %v and %v", c.PendingTransactions, m.PendingTransactions)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "customer", "merchant", false)
+	hs := NewHolds(srv, h)
+
+	id, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: MustParseDecimal("30")}}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "70", "30", "0")
+	if _, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(70)}}, time.Time{}); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+
+	if err := hs.Capture(ctx, id, Basket{{ID: "usd", Amount: MustParseDecimal("20.50")}}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "70", "9.50", "20.50")
+	if err := hs.Capture(ctx, id, Basket{{ID: "usd", Amount: whole(10)}}); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+
+	if err := hs.Release(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "79.50", "0", "20.50")
+	if err := hs.Release(ctx, id); !errors.Is(err, ErrHoldNotFound) {
+		t.Fatalf("expected %v but got %v", ErrHoldNotFound, err)
+	}
+	if err := hs.Capture(ctx, id, Basket{{ID: "usd", Amount: whole(1)}}); !errors.Is(err, ErrHoldNotFound) {
+		t.Fatalf("expected %v but got %v", ErrHoldNotFound, err)
+	}
+
+	// A hold captured in full is released.
+	id, err = hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(10)}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Capture(ctx, id, Basket{{ID: "usd", Amount: whole(10)}}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "69.50", "0", "30.50")
+	if a, err := h.Account(ctx, "customer"); err != nil || len(a.Holds) != 0 {
+		t.Fatalf("expected no holds but got %+v: %v", a, err)
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "customer", "merchant", false)
+	hs := NewHolds(srv, h)
+
+	expired, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(10)}}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(20)}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	active, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(30)}}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Capture(ctx, expired, Basket{{ID: "usd", Amount: whole(1)}}); !errors.Is(err, ErrHoldExpired) {
+		t.Fatalf("expected %v but got %v", ErrHoldExpired, err)
+	}
+	checkBalances(t, h, "40", "60", "0")
+
+	// A pass only releases the holds expiring in its range.
+	now := time.Now()
+	if err := hs.RecoverHolds(ctx, now.Add(-time.Hour), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "40", "60", "0")
+	if err := hs.RecoverHolds(ctx, now.Add(-time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "50", "50", "0")
+	if err := hs.RecoverHolds(ctx, now, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "80", "20", "0")
+	if err := hs.Capture(ctx, active, Basket{{ID: "usd", Amount: whole(1)}}); !errors.Is(err, ErrHoldNotFound) {
+		t.Fatalf("expected %v but got %v", ErrHoldNotFound, err)
+	}
+}
+
+func TestHoldRollback(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "customer", "merchant", false)
+	hs := NewHolds(srv, h)
+	id, err := hs.Hold(ctx, "customer", "merchant", Basket{{ID: "usd", Amount: whole(30)}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A capture interrupted after the customer has been updated is cancelled by the recovery.
+	capture := dtpc.Request{Source: "customer", Destination: "merchant", Reference: captureReference + id, Data: Capture{HoldID: id, Items: Basket{{ID: "usd", Amount: whole(10)}}}}
+	tid, err := srv.Ts.Insert(ctx, capture.Source, capture.Destination, capture.Reference, capture.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "customer", tid, capture); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "70", "30", "0")
+
+	// The rollback of a release holds the released amount again.
+	a, err := h.Account(ctx, "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := dtpc.Request{Source: "customer", Destination: "customer", Data: Release{HoldID: id, Hold: a.Holds[id]}}
+	if err := h.Update(ctx, "customer", "release", release); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rollback(ctx, "customer", "release", release); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, h, "70", "30", "0")
+
+	// The rollback of a release whose amount has been spent fails.
+	if err := h.Update(ctx, "customer", "release", release); err != nil {
+		t.Fatal(err)
+	}
+	spend := dtpc.Request{Source: "customer", Destination: "merchant", Data: Item{ID: "usd", Amount: whole(90)}}
+	if err := h.Update(ctx, "customer", "spend", spend); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rollback(ctx, "customer", "release", release); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+}
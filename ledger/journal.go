@@ -0,0 +1,361 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"dtpc"
+)
+
+// Attribute names of the journal table.
+const (
+	journalAccountID     = "account_id"
+	journalPostingID     = "posting_id"
+	journalTime          = "time"
+	journalTransactionID = "transaction_id"
+	journalItemID        = "item_id"
+	journalSide          = "side"
+	journalAmount        = "amount"
+	journalBalance       = "balance"
+	journalHeld          = "held"
+	journalContra        = "contra"
+)
+
+// maxTransactItems is the maximum number of writes of a DynamoDB transaction.
+const maxTransactItems = 100
+
+// postingTimeFormat is a fixed width time format, so that posting IDs sort by time.
+const postingTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Side is the side of a posting.
+type Side string
+
+const (
+	// Debit decreases a balance.
+	Debit Side = "debit"
+	// Credit increases a balance.
+	Credit Side = "credit"
+)
+
+// Posting is an immutable record of a change of a balance of an account in the journal. Every update of an account by
+// a transaction writes a posting for each balance it changes, and the rollback of the transaction writes contra
+// postings on the opposite sides.
+type Posting struct {
+	// ID of the account
+	AccountID string
+	// ID of the posting, unique per account and ordered by time
+	ID string
+	// Time of the posting
+	Time time.Time
+	// ID of the transaction
+	TransactionID string
+	// ID of the item
+	ItemID string
+	// Side of the posting
+	Side Side
+	// Amount of the posting, which is always positive
+	Amount Decimal
+	// Held is true for postings to the total amount of the item held by holds of the account instead of its balance
+	Held bool
+	// Balance, or total held amount, of the item after the posting, including the transactions in flight at the time
+	Balance Decimal
+	// Contra is true for postings that reverse the postings of a rolled back transaction
+	Contra bool
+}
+
+// JournalTable returns the input to create a journal table with on-demand capacity.
+func JournalTable(tableName string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(journalAccountID), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String(journalPostingID), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(journalAccountID), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String(journalPostingID), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	}
+}
+
+// Journal lists the postings of the committed transactions of the accounts of a Handler from its journal and the
+// states of the transactions in a transaction log.
+type Journal struct {
+	ts dtpc.TransactionHandler
+	h  *Handler
+}
+
+// NewJournal initialises Journal for the transaction log of the transactions applied to the accounts of h, usually
+// the TransactionHandler of the Service.
+func NewJournal(ts dtpc.TransactionHandler, h *Handler) *Journal {
+	return &Journal{
+		ts: ts,
+		h:  h,
+	}
+}
+
+// Postings returns the postings of the committed transactions of an account from from to to in the order of their
+// time. Zero times do not limit the postings. Postings are written when a transaction is applied, and are listed
+// once the transaction is done. The postings of transactions in flight and of cancelled transactions, including
+// contra postings, are left out. It fails if no journal table is configured.
+func (j *Journal) Postings(ctx context.Context, accountID string, from, to time.Time) ([]Posting, error) {
+	postings, err := j.h.postings(ctx, accountID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, p := range postings {
+		if !seen[p.TransactionID] {
+			seen[p.TransactionID] = true
+			ids = append(ids, p.TransactionID)
+		}
+	}
+	trs, err := transactions(ctx, j.ts, ids)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", accountID, err)
+	}
+	committed := postings[:0]
+	for _, p := range postings {
+		if tr, ok := trs[p.TransactionID]; ok && tr.TransactionState == dtpc.Done {
+			committed = append(committed, p)
+		}
+	}
+	return committed, nil
+}
+
+// postings returns the postings of all transactions of an account from from to to in the order of their time,
+// including the postings of transactions in flight or cancelled. Zero times do not limit the postings. It fails if no
+// journal table is configured.
+func (h *Handler) postings(ctx context.Context, accountID string, from, to time.Time) ([]Posting, error) {
+	if h.cfg.JournalTableName == "" {
+		return nil, fmt.Errorf("no journal table configured")
+	}
+	// Posting IDs start with their time, so they sort before the IDs of snapshots, and "~" sorts after the rest of any
+	// posting ID.
+	lower, upper := "0", "9~"
+	if !from.IsZero() {
+		lower = from.UTC().Format(postingTimeFormat)
+	}
+	if !to.IsZero() {
+		upper = to.UTC().Format(postingTimeFormat) + "~"
+	}
+	in := &dynamodb.QueryInput{
+		TableName:              aws.String(h.cfg.JournalTableName),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#aid = :aid AND #pid BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{
+			"#aid": aws.String(journalAccountID),
+			"#pid": aws.String(journalPostingID),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":aid":  {S: aws.String(accountID)},
+			":from": {S: aws.String(lower)},
+			":to":   {S: aws.String(upper)},
+		},
+	}
+	var postings []Posting
+	for {
+		res, err := h.db.QueryWithContext(ctx, in)
+		if err != nil {
+			return nil, dtpc.WrapDynamoDBError(err)
+		}
+		for _, item := range res.Items {
+			p, err := unmarshalPosting(item)
+			if err != nil {
+				return nil, fmt.Errorf("account %s: posting %s: %v", accountID, aws.StringValue(item[journalPostingID].S), err)
+			}
+			postings = append(postings, p)
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			return postings, nil
+		}
+		in.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+}
+
+// transactions returns transactions by ID. The transactions are read with a single batch if the TransactionHandler
+// is a dtpc.TransactionBatchGetter, and transactions that do not exist are left out.
+func transactions(ctx context.Context, ts dtpc.TransactionHandler, ids []string) (map[string]*dtpc.Transaction, error) {
+	trs := make(map[string]*dtpc.Transaction, len(ids))
+	if bg, ok := ts.(dtpc.TransactionBatchGetter); ok {
+		batch, err := bg.GetTransactionsByID(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, tr := range batch {
+			trs[tr.ID] = tr
+		}
+		return trs, nil
+	}
+	for _, id := range ids {
+		tr, err := ts.GetTransaction(ctx, id)
+		if errors.Is(err, dtpc.ErrTransactionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		trs[id] = tr
+	}
+	return trs, nil
+}
+
+// post records a change of a balance, or of the total held amount, of an item by the update.
+func (u *update) post(itemID string, side Side, amount, balance Decimal, held bool) {
+	u.postings = append(u.postings, Posting{ItemID: itemID, Side: side, Amount: amount, Balance: balance, Held: held})
+}
+
+// postHolds records the changes of the total held amounts of items by replacing the holds of an account.
+func (u *update) postHolds(a *Account, holds map[string]Hold) error {
+	before, after := heldTotals(a.Holds), heldTotals(holds)
+	ids := make([]string, 0, len(before)+len(after))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		diff, err := after[id].Sub(before[id])
+		if err != nil {
+			return fmt.Errorf("account %s, item %s: %w", a.ID, id, err)
+		}
+		switch diff.Sign() {
+		case 1:
+			u.post(id, Credit, diff, after[id], true)
+		case -1:
+			u.post(id, Debit, diff.Neg(), after[id], true)
+		}
+	}
+	return nil
+}
+
+// heldTotals returns the total held amounts by item ID. The totals fit since they are validated when the holds are
+// written.
+func heldTotals(holds map[string]Hold) map[string]Decimal {
+	totals := make(map[string]Decimal)
+	for _, h := range holds {
+		for id, amount := range h.Items {
+			totals[id], _ = totals[id].Add(amount)
+		}
+	}
+	return totals
+}
+
+// writeJournal applies an update to an account and writes its postings to the journal with a single DynamoDB
+// transaction.
+func (h *Handler) writeJournal(ctx context.Context, a *Account, u *update, in *dynamodb.UpdateItemInput) error {
+	if len(u.postings)+1 > maxTransactItems {
+		return fmt.Errorf("account %s: %d postings exceed the limit of a single write", a.ID, len(u.postings))
+	}
+	items := []*dynamodb.TransactWriteItem{{Update: &dynamodb.Update{
+		TableName:                 in.TableName,
+		Key:                       in.Key,
+		UpdateExpression:          in.UpdateExpression,
+		ConditionExpression:       in.ConditionExpression,
+		ExpressionAttributeNames:  in.ExpressionAttributeNames,
+		ExpressionAttributeValues: in.ExpressionAttributeValues,
+	}}}
+	now := time.Now().UTC()
+	for i, p := range u.postings {
+		p.AccountID, p.TransactionID, p.Contra, p.Time = a.ID, u.transactionID, u.contra, now
+		p.ID = fmt.Sprintf("%s#%020d#%03d", now.Format(postingTimeFormat), a.Version+1, i)
+		items = append(items, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			TableName:                aws.String(h.cfg.JournalTableName),
+			Item:                     marshalPosting(p),
+			ConditionExpression:      aws.String("attribute_not_exists(#pid)"),
+			ExpressionAttributeNames: map[string]*string{"#pid": aws.String(journalPostingID)},
+		}})
+	}
+	if _, err := h.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		if isAccountConditionFailed(err) {
+			return errVersionMismatch
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// putJournal puts an account together with a snapshot of its balances in the journal with a single DynamoDB
+// transaction. The snapshot opens the history of a created account, and replaces the history of a replaced account
+// from now on. It fails with conflict if the condition of the account write fails.
+func (h *Handler) putJournal(ctx context.Context, a *Account, in *dynamodb.PutItemInput, conflict error) error {
+	s := &snapshot{Time: time.Now(), Balances: a.Balances}
+	items := []*dynamodb.TransactWriteItem{
+		{Put: &dynamodb.Put{
+			TableName:                 in.TableName,
+			Item:                      in.Item,
+			ConditionExpression:       in.ConditionExpression,
+			ExpressionAttributeNames:  in.ExpressionAttributeNames,
+			ExpressionAttributeValues: in.ExpressionAttributeValues,
+		}},
+		{Put: &dynamodb.Put{
+			TableName: aws.String(h.cfg.JournalTableName),
+			Item:      marshalSnapshot(a.ID, s),
+		}},
+	}
+	if _, err := h.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		if isAccountConditionFailed(err) {
+			return fmt.Errorf("account %s: %w", a.ID, conflict)
+		}
+		return dtpc.WrapDynamoDBError(err)
+	}
+	return nil
+}
+
+// isAccountConditionFailed reports whether a DynamoDB transaction has been cancelled because the condition of its
+// first write, which is the write of the account, failed.
+func isAccountConditionFailed(err error) bool {
+	var tce *dynamodb.TransactionCanceledException
+	return errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+		aws.StringValue(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
+
+func marshalPosting(p Posting) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		journalAccountID:     {S: aws.String(p.AccountID)},
+		journalPostingID:     {S: aws.String(p.ID)},
+		journalTime:          {S: aws.String(p.Time.Format(time.RFC3339Nano))},
+		journalTransactionID: {S: aws.String(p.TransactionID)},
+		journalItemID:        {S: aws.String(p.ItemID)},
+		journalSide:          {S: aws.String(string(p.Side))},
+		journalAmount:        decimalNumber(p.Amount),
+		journalBalance:       decimalNumber(p.Balance),
+		journalHeld:          {BOOL: aws.Bool(p.Held)},
+		journalContra:        {BOOL: aws.Bool(p.Contra)},
+	}
+}
+
+func unmarshalPosting(item map[string]*dynamodb.AttributeValue) (Posting, error) {
+	p := Posting{
+		AccountID:     aws.StringValue(item[journalAccountID].S),
+		ID:            aws.StringValue(item[journalPostingID].S),
+		TransactionID: aws.StringValue(item[journalTransactionID].S),
+		ItemID:        aws.StringValue(item[journalItemID].S),
+		Side:          Side(aws.StringValue(item[journalSide].S)),
+		Held:          aws.BoolValue(item[journalHeld].BOOL),
+		Contra:        aws.BoolValue(item[journalContra].BOOL),
+	}
+	var err error
+	if p.Time, err = time.Parse(time.RFC3339Nano, aws.StringValue(item[journalTime].S)); err != nil {
+		return Posting{}, err
+	}
+	if p.Amount, err = parseDecimal(item[journalAmount]); err != nil {
+		return Posting{}, fmt.Errorf("amount: %v", err)
+	}
+	if p.Balance, err = parseDecimal(item[journalBalance]); err != nil {
+		return Posting{}, fmt.Errorf("balance: %v", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,163 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dtpc"
+	"dtpc/memdynamo"
+)
+
+// checkPostings fails unless the postings of all transactions of an account in the journal have the given sides,
+// amounts and balances.
+func checkPostings(t *testing.T, h *Handler, accountID string, expected []Posting) []Posting {
+	t.Helper()
+	postings, err := h.postings(context.Background(), accountID, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postings) != len(expected) {
+		t.Fatalf("expected %d postings of %s but got %+v", len(expected), accountID, postings)
+	}
+	for i, p := range postings {
+		e := expected[i]
+		if p.AccountID != accountID || p.ItemID != e.ItemID || p.Side != e.Side || !p.Amount.Equal(e.Amount) ||
+			!p.Balance.Equal(e.Balance) || p.Held != e.Held || p.Contra != e.Contra {
+			t.Fatalf("expected posting %d of %s to be %+v but got %+v", i, accountID, e, p)
+		}
+	}
+	return postings
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "payment", Data: Item{ID: "usd", Amount: MustParseDecimal("30.50")}}
+	res, err := srv.StartTransaction(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postings := checkPostings(t, h, "source", []Posting{
+		{ItemID: "usd", Side: Debit, Amount: MustParseDecimal("30.50"), Balance: MustParseDecimal("69.50")},
+	})
+	if postings[0].TransactionID != res.TransactionID {
+		t.Fatalf("expected posting of transaction %s but got %+v", res.TransactionID, postings[0])
+	}
+	checkPostings(t, h, "destination", []Posting{
+		{ItemID: "usd", Side: Credit, Amount: MustParseDecimal("30.50"), Balance: MustParseDecimal("30.50")},
+	})
+
+	// A failed transaction does not post anything, and neither do commits.
+	req.Data = Item{ID: "usd", Amount: whole(100)}
+	if _, err := srv.StartTransaction(ctx, req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+	checkPostings(t, h, "source", postings)
+
+	// The postings of the committed transaction are listed.
+	if got, err := NewJournal(srv.Ts, h).Postings(ctx, "source", time.Time{}, time.Time{}); err != nil || len(got) != 1 || got[0].ID != postings[0].ID {
+		t.Fatalf("expected the posting of the committed transaction but got %+v: %v", got, err)
+	}
+}
+
+func TestJournalCommittedPostings(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+	j := NewJournal(srv.Ts, h)
+
+	// Postings of transactions in flight and of cancelled transactions are written, but not listed.
+	checkCommitted := func() {
+		t.Helper()
+		if got, err := j.Postings(ctx, "source", time.Time{}, time.Time{}); err != nil || len(got) != 0 {
+			t.Fatalf("expected no committed postings but got %+v: %v", got, err)
+		}
+	}
+	errCallback := errors.New("callback failed")
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "payment", Data: Item{ID: "usd", Amount: whole(10)}}
+	_, err := srv.StartTransaction(ctx, req, func() error {
+		checkCommitted()
+		return errCallback
+	})
+	if !errors.Is(err, errCallback) {
+		t.Fatalf("expected %v but got %v", errCallback, err)
+	}
+	checkCommitted()
+	checkPostings(t, h, "source", []Posting{
+		{ItemID: "usd", Side: Debit, Amount: whole(10), Balance: whole(90)},
+		{ItemID: "usd", Side: Credit, Amount: whole(10), Balance: whole(100), Contra: true},
+	})
+}
+
+func TestJournalRollback(t *testing.T) {
+	ctx := context.Background()
+	h, _ := newTestService(t, "source", "destination", true)
+
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Item{ID: "usd", Amount: whole(10)}}
+	if err := h.Update(ctx, "source", "t1", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rollback(ctx, "source", "t1", req); err != nil {
+		t.Fatal(err)
+	}
+	postings := checkPostings(t, h, "source", []Posting{
+		{ItemID: "usd", Side: Debit, Amount: whole(10), Balance: whole(90)},
+		{ItemID: "usd", Side: Credit, Amount: whole(10), Balance: whole(100), Contra: true},
+	})
+	if postings[1].TransactionID != "t1" {
+		t.Fatalf("expected contra posting of transaction t1 but got %+v", postings[1])
+	}
+	if postings[0].ID >= postings[1].ID {
+		t.Fatalf("expected postings in order but got %s and %s", postings[0].ID, postings[1].ID)
+	}
+
+	// Postings are filtered by time.
+	between := postings[1].Time
+	if got, err := h.postings(ctx, "source", between, time.Time{}); err != nil || len(got) != 1 || got[0].ID != postings[1].ID {
+		t.Fatalf("expected the contra posting but got %+v: %v", got, err)
+	}
+	if got, err := h.postings(ctx, "source", time.Time{}, postings[0].Time); err != nil || len(got) == 0 || got[0].ID != postings[0].ID {
+		t.Fatalf("expected the first posting but got %+v: %v", got, err)
+	}
+	if got, err := h.postings(ctx, "source", time.Time{}, postings[0].Time.Add(-time.Nanosecond)); err != nil || len(got) != 0 {
+		t.Fatalf("expected no postings but got %+v: %v", got, err)
+	}
+}
+
+func TestJournalHolds(t *testing.T) {
+	ctx := context.Background()
+	h, srv := newTestService(t, "source", "destination", true)
+	hs := NewHolds(srv, h)
+
+	id, err := hs.Hold(ctx, "source", "destination", Basket{{ID: "usd", Amount: whole(30)}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Capture(ctx, id, Basket{{ID: "usd", Amount: whole(10)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Release(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	checkPostings(t, h, "source", []Posting{
+		{ItemID: "usd", Side: Credit, Amount: whole(30), Balance: whole(30), Held: true},
+		{ItemID: "usd", Side: Debit, Amount: whole(30), Balance: whole(70)},
+		{ItemID: "usd", Side: Debit, Amount: whole(10), Balance: whole(20), Held: true},
+		{ItemID: "usd", Side: Debit, Amount: whole(20), Balance: whole(0), Held: true},
+		{ItemID: "usd", Side: Credit, Amount: whole(20), Balance: whole(90)},
+	})
+	checkPostings(t, h, "destination", []Posting{
+		{ItemID: "usd", Side: Credit, Amount: whole(10), Balance: whole(10)},
+	})
+}
+
+func TestPostingsWithoutJournal(t *testing.T) {
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	j := NewJournal(dtpc.NewTransactionStore(db, "transactions"), h)
+	if _, err := j.Postings(context.Background(), "account", time.Time{}, time.Time{}); err == nil {
+		t.Fatal("expected an error without a journal table")
+	}
+}
@@ -0,0 +1,282 @@
+// Package ledger is a DynamoDB implementation of the dtpc.AccountHandler interface for accounts holding balances
+// of multiple items, e.g. currencies or in-game resources.
+//
+// # Storage format
+//
+// Every account is a single item of the account table. The attribute names below are the defaults of
+// DefaultConfig and can be changed with Config.Attributes:
+//
+//	id              S  partition key, ID of the account
+//	schema_version  N  version of the storage format, currently 4
+//	balances        M  item ID to balance (N)
+//	pending         M  IDs of the transactions applied to the account and not yet committed or rolled back to true (BOOL)
+//	version         N  incremented by every modification for optimistic locking
+//	policy          M  Policy of items without a policy of their own, omitted for the zero Policy
+//	policies        M  item ID to Policy, omitted when empty
+//	holds           M  hold ID to Hold, omitted when empty
+//	status          S  Status of the account, open if missing
+//
+// A Policy is stored as a map of min_balance (N), credit_limit (N) and allow_exact_minimum (BOOL), and a Hold as a
+// map of items (M of item ID to amount (N)), payee (S) and expires_at (S, RFC 3339, omitted if the hold does not
+// expire).
+// Balances are exact decimals with the number of decimal places configured for their item in Config.Items. Trailing
+// zeros may be dropped by DynamoDB and are restored when an account is read.
+//
+// # Schema versions
+//
+// Handlers read documents of their SchemaVersion and of earlier versions, and upgrade a document to their
+// SchemaVersion whenever they modify it. Documents of later versions fail with ErrUnsupportedSchemaVersion, so older
+// handlers stop modifying a document, instead of dropping attributes they do not know, once it has been upgraded,
+// and a table can be migrated to a later format while older handlers are still running:
+//
+//	1  balances, pending transactions, version and policies
+//	2  holds
+//	3  status
+//	4  pending transactions as a map instead of a list (L of S), so that they are added and removed by key
+//
+// # Journal
+//
+// If Config.JournalTableName is set, every update of balances or holds also writes immutable postings to the journal
+// table, created with JournalTable, in the same DynamoDB transaction:
+//
+//	account_id      S     partition key, ID of the account
+//	posting_id      S     sort key, time of the posting followed by the account version and an index
+//	time            S     RFC 3339 time of the posting
+//	transaction_id  S     ID of the transaction
+//	item_id         S     ID of the item
+//	side            S     debit or credit
+//	amount          N     amount of the posting
+//	balance         N     balance of the item after the posting, or the total held amount for held postings
+//	held            BOOL  whether the posting changes the total held amount instead of the balance
+//	contra          BOOL  whether the posting is written by the rollback of the transaction
+//
+// The journal also holds snapshots of the balances of accounts, written by Create and History.Snapshot, whose
+// posting_id is "snapshot#" followed by their time:
+//
+//	time       S  RFC 3339 time of the snapshot
+//	balances   M  item ID to the balance of the committed transactions (N)
+//	in_flight  M  transaction ID to a map of item ID to the amount of a transaction not committed yet (N), omitted
+//	              when empty
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of the storage format written by this package.
+const SchemaVersion = 4
+
+var (
+	// ErrAccountExists is returned by Create when an account with the same ID already exists.
+	ErrAccountExists = errors.New("account already exists")
+	// ErrUnsupportedSchemaVersion is returned when an account document has been written in a storage format later than
+	// SchemaVersion.
+	ErrUnsupportedSchemaVersion = errors.New("unsupported account schema version")
+	// ErrPendingTransactionIDNotFound is returned by Rollback when the account has no such pending transaction.
+	ErrPendingTransactionIDNotFound = errors.New("pending transaction id not found")
+	// ErrInvalidItem is returned when the data of a transaction is not a valid Item.
+	ErrInvalidItem = errors.New("invalid item")
+)
+
+// Account is an account document of the ledger.
+type Account struct {
+	// ID of the account
+	ID string
+	// Balances of the account by item ID
+	Balances map[string]Decimal
+	// IDs of the transactions applied to the account and not yet committed or rolled back
+	PendingTransactions []string
+	// Version number of the account document required for optimistic locking
+	Version int
+	// Policy of items without a policy of their own
+	Policy Policy
+	// Policies by item ID
+	Policies map[string]Policy
+	// Holds by hold ID. Held amounts are not part of Balances.
+	Holds map[string]Hold
+	// Lifecycle status. The zero value is treated as StatusOpen by Put.
+	Status Status
+	// Schema version of the document the account has been read from
+	schemaVersion int64
+}
+
+func (a *Account) GetID() string {
+	return a.ID
+}
+
+func (a *Account) GetPendingTransactions() []string {
+	return a.PendingTransactions
+}
+
+func (a *Account) GetVersion() int {
+	return a.Version
+}
+
+// Balance returns the balance of an item, which is zero for items the account has never held.
+func (a *Account) Balance(itemID string) Decimal {
+	return a.Balances[itemID]
+}
+
+// Held returns the total amount of an item held by the holds of the account.
+func (a *Account) Held(itemID string) (Decimal, error) {
+	var total Decimal
+	for _, h := range a.Holds {
+		var err error
+		if total, err = total.Add(h.Items[itemID]); err != nil {
+			return Decimal{}, fmt.Errorf("account %s, item %s: %w", a.ID, itemID, err)
+		}
+	}
+	return total, nil
+}
+
+// PolicyOf returns the policy of an item.
+func (a *Account) PolicyOf(itemID string) Policy {
+	if p, ok := a.Policies[itemID]; ok {
+		return p
+	}
+	return a.Policy
+}
+
+// validate checks the policies of the account and that negative balances are within the credit limits of their policies.
+func (a *Account) validate() error {
+	if a.ID == "" {
+		return fmt.Errorf("account ID is required")
+	}
+	if !a.Status.valid() {
+		return fmt.Errorf("account %s: unknown status %q", a.ID, a.Status)
+	}
+	if err := a.Policy.Validate(); err != nil {
+		return fmt.Errorf("account %s: %v", a.ID, err)
+	}
+	for id, p := range a.Policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("account %s, item %s: %v", a.ID, id, err)
+		}
+	}
+	for id, b := range a.Balances {
+		p := a.PolicyOf(id)
+		if b.Sign() < 0 && b.Neg().Cmp(p.CreditLimit) > 0 {
+			return fmt.Errorf("balance %s of item %s of account %s exceeds the credit limit %s", b, id, a.ID, p.CreditLimit)
+		}
+	}
+	for hid, h := range a.Holds {
+		for id, amount := range h.Items {
+			if amount.Sign() < 0 {
+				return fmt.Errorf("amount %s of item %s held by hold %s of account %s must not be negative", amount, id, hid, a.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// pending reports whether a transaction has been applied to the account and is not committed or rolled back yet.
+func (a *Account) pending(transactionID string) bool {
+	for _, id := range a.PendingTransactions {
+		if id == transactionID {
+			return true
+		}
+	}
+	return false
+}
+
+// Item is the data of a transaction: the amount of an item transferred from the source to the destination account.
+type Item struct {
+	ID     string
+	Amount Decimal
+}
+
+// Validate checks that the item has an ID and a positive amount.
+func (i Item) Validate() error {
+	if i.ID == "" {
+		return fmt.Errorf("item ID is required: %w", ErrInvalidItem)
+	}
+	if i.Amount.Sign() <= 0 {
+		return fmt.Errorf("amount %s of item %s must be positive: %w", i.Amount, i.ID, ErrInvalidItem)
+	}
+	return nil
+}
+
+// ItemFromData converts the data of a transaction request into a valid Item.
+// Besides Item values, it accepts the generic map representation that transaction stores return
+// when a transaction document is read back, e.g. during RecoverTransactions.
+func ItemFromData(data interface{}) (Item, error) {
+	var item Item
+	switch d := data.(type) {
+	case Item:
+		item = d
+	case *Item:
+		if d == nil {
+			return Item{}, fmt.Errorf("nil transaction data: %w", ErrInvalidItem)
+		}
+		item = *d
+	case map[string]interface{}:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return Item{}, err
+		}
+		if err := json.Unmarshal(b, &item); err != nil {
+			return Item{}, fmt.Errorf("transaction data %v: %v: %w", data, err, ErrInvalidItem)
+		}
+	default:
+		return Item{}, fmt.Errorf("unsupported transaction data %T: %w", data, ErrInvalidItem)
+	}
+	return item, item.Validate()
+}
+
+// Basket is the data of a transaction that transfers several items at once. All items of a basket are applied to an
+// account with a single write and rolled back together, and the transaction fails if any of the items cannot be
+// debited.
+type Basket []Item
+
+// Validate checks that the basket is not empty, that its items are valid and that no item appears twice.
+func (b Basket) Validate() error {
+	if len(b) == 0 {
+		return fmt.Errorf("basket is empty: %w", ErrInvalidItem)
+	}
+	seen := make(map[string]bool, len(b))
+	for _, item := range b {
+		if err := item.Validate(); err != nil {
+			return err
+		}
+		if seen[item.ID] {
+			return fmt.Errorf("item %s appears more than once in the basket: %w", item.ID, ErrInvalidItem)
+		}
+		seen[item.ID] = true
+	}
+	return nil
+}
+
+// ItemsFromData converts the data of a transaction request into the items it transfers.
+// Besides Item and Basket values, it accepts the generic map and slice representations that transaction stores
+// return when a transaction document is read back.
+func ItemsFromData(data interface{}) (Basket, error) {
+	var b Basket
+	switch d := data.(type) {
+	case Basket:
+		b = d
+	case *Basket:
+		if d == nil {
+			return nil, fmt.Errorf("nil transaction data: %w", ErrInvalidItem)
+		}
+		b = *d
+	case []Item:
+		b = d
+	case []interface{}:
+		j, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(j, &b); err != nil {
+			return nil, fmt.Errorf("transaction data %v: %v: %w", data, err, ErrInvalidItem)
+		}
+	default:
+		item, err := ItemFromData(data)
+		if err != nil {
+			return nil, err
+		}
+		b = Basket{item}
+	}
+	return b, b.Validate()
+}
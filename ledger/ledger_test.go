@@ -0,0 +1,902 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"dtpc"
+	"dtpc/conformance"
+	"dtpc/faultdb"
+	"dtpc/memdynamo"
+)
+
+const testItem = "item"
+
+// newTestHandler returns a Handler of a new account table in an in-memory DynamoDB.
+func newTestHandler(t *testing.T, db *memdynamo.DB, cfg Config) *Handler {
+	h, err := New(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = h.Config()
+	_, err = db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.TableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(cfg.Attributes.ID), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(cfg.Attributes.ID), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// newTestService returns a Handler of new account and transaction tables in an in-memory DynamoDB with USD of scale 2,
+// and a Service for them. The funded account holds 100 USD and the empty account has no balances. With journal, a
+// journal table is created and configured as well.
+func newTestService(t *testing.T, funded, empty string, journal bool) (*Handler, *dtpc.Service) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	cfg := DefaultConfig("accounts")
+	cfg.Items = map[string]ItemConfig{"usd": {Scale: 2}}
+	if journal {
+		cfg.JournalTableName = "journal"
+		if _, err := db.CreateTable(JournalTable(cfg.JournalTableName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandler(t, db, cfg)
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, funded, map[string]Decimal{"usd": whole(100)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, empty, nil); err != nil {
+		t.Fatal(err)
+	}
+	return h, dtpc.NewService(dtpc.NewTransactionStore(db, "transactions"), h)
+}
+
+// whole returns a decimal without decimal places.
+func whole(n int64) Decimal {
+	return NewDecimal(n, 0)
+}
+
+func fixture(h *Handler) conformance.AccountFixture {
+	return conformance.AccountFixture{
+		Handler: h,
+		NewAccount: func(id string, balance int) dtpc.Account {
+			return &Account{ID: id, Balances: map[string]Decimal{testItem: whole(int64(balance))}}
+		},
+		EmptyAccount: func() dtpc.Account {
+			return &Account{}
+		},
+		Data: func(amount int) interface{} {
+			return Item{ID: testItem, Amount: whole(int64(amount))}
+		},
+		Balance: func(doc dtpc.Account) int {
+			return int(doc.(*Account).Balance(testItem).Coefficient())
+		},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	db := memdynamo.New()
+	custom := Config{
+		TableName: "custom",
+		Attributes: Attributes{
+			ID:      "pk",
+			Pending: "PendingTransactions",
+		},
+	}
+	for _, cfg := range []Config{DefaultConfig("accounts"), custom} {
+		h := newTestHandler(t, db, cfg)
+		t.Run(cfg.TableName, func(t *testing.T) {
+			conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+				return fixture(h)
+			})
+		})
+	}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"source", "destination"} {
+		if err := h.Create(ctx, id, map[string]Decimal{"gold": whole(100), "silver": whole(5)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := dtpc.NewService(dtpc.NewTransactionStore(db, "transactions"), h)
+
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: Item{ID: "gold", Amount: whole(30)}}
+	if _, err := srv.StartTransaction(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	req.Data = Item{ID: "silver", Amount: whole(5)}
+	if _, err := srv.StartTransaction(ctx, req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+
+	expected := map[string]map[string]Decimal{
+		"source":      {"gold": whole(70), "silver": whole(5)},
+		"destination": {"gold": whole(130), "silver": whole(5)},
+	}
+	for id, balances := range expected {
+		a, err := h.Account(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for item, b := range balances {
+			if a.Balance(item) != b {
+				t.Fatalf("expected account %s to have %s of %s but got %s", id, b, item, a.Balance(item))
+			}
+		}
+		if len(a.PendingTransactions) != 0 {
+			t.Fatalf("expected account %s to have no pending transactions but got %v", id, a.PendingTransactions)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	if err := h.Create(ctx, "account", map[string]Decimal{testItem: whole(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "account", nil); !errors.Is(err, ErrAccountExists) {
+		t.Fatalf("expected %v but got %v", ErrAccountExists, err)
+	}
+	if err := h.Create(ctx, "negative", map[string]Decimal{testItem: whole(-1)}); err == nil {
+		t.Fatal("expected Create with a negative balance to fail")
+	}
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Balance(testItem) != whole(10) || !a.Balance("other").IsZero() || a.Version != 0 {
+		t.Fatalf("unexpected account %+v", a)
+	}
+	if _, err := h.Account(ctx, "unknown"); !errors.Is(err, dtpc.ErrAccountNotFound) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrAccountNotFound, err)
+	}
+}
+
+func TestUpdateIdempotent(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	if err := h.Create(ctx, "source", map[string]Decimal{testItem: whole(100)}); err != nil {
+		t.Fatal(err)
+	}
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Item{ID: testItem, Amount: whole(10)}}
+	for i := 0; i < 2; i++ {
+		if err := h.Update(ctx, "source", "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := h.Account(ctx, "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Balance(testItem) != whole(90) || len(a.PendingTransactions) != 1 || a.Version != 1 {
+		t.Fatalf("expected a single update to be applied but got %+v", a)
+	}
+}
+
+// putSchemaItem stores an account document with a balance of testItem and pending transactions as a handler of the
+// given schema version writes it.
+func putSchemaItem(t *testing.T, db *memdynamo.DB, accountID string, version int64, balance string, pending ...string) {
+	t.Helper()
+	pt := &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+	for _, id := range pending {
+		pt.L = append(pt.L, &dynamodb.AttributeValue{S: aws.String(id)})
+	}
+	if version >= 4 {
+		pt = &dynamodb.AttributeValue{M: marshalPending(pending)}
+	}
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("accounts"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":             {S: aws.String(accountID)},
+			"schema_version": number(version),
+			"balances":       {M: map[string]*dynamodb.AttributeValue{testItem: {N: aws.String(balance)}}},
+			"pending":        pt,
+			"version":        {N: aws.String("0")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeAsVersion modifies an account like a handler of the given schema version, which only modifies documents of its
+// own version.
+func writeAsVersion(db *memdynamo.DB, accountID string, version int64) error {
+	_, err := db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String("accounts"),
+		Key:                       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(accountID)}},
+		UpdateExpression:          aws.String("SET #ve = #ve + :one"),
+		ConditionExpression:       aws.String("#sv = :sv"),
+		ExpressionAttributeNames:  map[string]*string{"#sv": aws.String("schema_version"), "#ve": aws.String("version")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":sv": number(version), ":one": number(1)},
+	})
+	return err
+}
+
+// checkSchemaVersion fails unless an account document has the given schema version.
+func checkSchemaVersion(t *testing.T, db *memdynamo.DB, accountID string, expected int64) {
+	t.Helper()
+	res, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("accounts"),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(accountID)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := parseNumber(res.Item["schema_version"]); err != nil || v != expected {
+		t.Fatalf("expected account %s to have schema version %d but got %s", accountID, expected, numberString(res.Item["schema_version"]))
+	}
+}
+
+func TestSchemaVersion1(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	hs := NewHolds(dtpc.NewService(dtpc.NewTransactionStore(db, "transactions"), h), h)
+	putSchemaItem(t, db, "account", 1, "100")
+	putSchemaItem(t, db, "other", 1, "0")
+
+	// Documents of version 1 are read as accounts without holds, and handlers of version 1 keep modifying them until
+	// they are upgraded by a hold.
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Balance(testItem).Equal(whole(100)) || len(a.Holds) != 0 {
+		t.Fatalf("unexpected account %+v", a)
+	}
+	if err := writeAsVersion(db, "account", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hs.Hold(ctx, "account", "other", Basket{{ID: testItem, Amount: whole(30)}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaVersion(t, db, "account", SchemaVersion)
+	if err := writeAsVersion(db, "account", 1); !isConditionalCheckFailed(err) {
+		t.Fatalf("expected a handler of version 1 to stop modifying the account but got %v", err)
+	}
+	a, err = h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.Held(testItem); err != nil || !a.Balance(testItem).Equal(whole(70)) || !held.Equal(whole(30)) {
+		t.Fatalf("unexpected account %+v: %v", a, err)
+	}
+}
+
+func TestSchemaVersion2(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	putSchemaItem(t, db, "account", 2, "100")
+
+	// Documents of version 2 are read as open accounts, and handlers of version 2, which would debit a frozen account,
+	// stop modifying them once they are upgraded by a change of their status.
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != StatusOpen || !a.Balance(testItem).Equal(whole(100)) {
+		t.Fatalf("unexpected account %+v", a)
+	}
+	if err := writeAsVersion(db, "account", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Freeze(ctx, "account", false); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaVersion(t, db, "account", SchemaVersion)
+	if err := writeAsVersion(db, "account", 2); !isConditionalCheckFailed(err) {
+		t.Fatalf("expected a handler of version 2 to stop modifying the account but got %v", err)
+	}
+	req := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(10)}}
+	if err := h.Update(ctx, "account", "transaction", req); !errors.Is(err, ErrAccountFrozen) {
+		t.Fatalf("expected %v but got %v", ErrAccountFrozen, err)
+	}
+}
+
+func TestSchemaVersion3(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	putSchemaItem(t, db, "account", 3, "100", "t1")
+
+	// The pending transactions of documents of version 3 are a list, which is converted into a map by the first
+	// modification, and handlers of version 3, which would append to the list, stop modifying the document.
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.PendingTransactions, []string{"t1"}) {
+		t.Fatalf("expected pending transaction t1 but got %v", a.PendingTransactions)
+	}
+	if err := writeAsVersion(db, "account", 3); err != nil {
+		t.Fatal(err)
+	}
+	req := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(10)}}
+	if err := h.Update(ctx, "account", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaVersion(t, db, "account", SchemaVersion)
+	if err := writeAsVersion(db, "account", 3); !isConditionalCheckFailed(err) {
+		t.Fatalf("expected a handler of version 3 to stop modifying the account but got %v", err)
+	}
+	res, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("accounts"),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String("account")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := res.Item["pending"].M; len(pending) != 2 || pending["t1"] == nil || pending["t2"] == nil {
+		t.Fatalf("expected pending transactions t1 and t2 in a map but got %v", res.Item["pending"])
+	}
+
+	if err := h.Commit(ctx, "account", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rollback(ctx, "account", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+	if a, err = h.Account(ctx, "account"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.PendingTransactions) != 0 || !a.Balance(testItem).Equal(whole(100)) {
+		t.Fatalf("unexpected account %+v", a)
+	}
+}
+
+func TestSingleWrite(t *testing.T) {
+	ctx := context.Background()
+	mdb := memdynamo.New()
+	newTestHandler(t, mdb, DefaultConfig("accounts"))
+	db := faultdb.New(mdb)
+	h, err := New(db, DefaultConfig("accounts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "account", map[string]Decimal{testItem: whole(100)}); err != nil {
+		t.Fatal(err)
+	}
+	debit := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(10)}}
+	overdraft := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(200)}}
+	credit := dtpc.Request{Source: "other", Destination: "account", Data: Item{ID: testItem, Amount: whole(5)}}
+
+	// Operations whose outcome does not depend on the account write it without reading it. Repeated operations and
+	// failing debits read it once after the conditional write has failed.
+	steps := []struct {
+		name  string
+		op    func() error
+		fails error
+		calls [2]int
+	}{
+		{"update", func() error { return h.Update(ctx, "account", "t1", debit) }, nil, [2]int{0, 1}},
+		{"repeated update", func() error { return h.Update(ctx, "account", "t1", debit) }, nil, [2]int{1, 1}},
+		{"rollback", func() error { return h.Rollback(ctx, "account", "t1", debit) }, nil, [2]int{0, 1}},
+		{"repeated rollback", func() error { return h.Rollback(ctx, "account", "t1", debit) }, ErrPendingTransactionIDNotFound, [2]int{1, 1}},
+		{"insufficient funds", func() error { return h.Update(ctx, "account", "t2", overdraft) }, dtpc.ErrInsufficientFunds, [2]int{1, 1}},
+		{"credit", func() error { return h.Update(ctx, "account", "t3", credit) }, nil, [2]int{0, 1}},
+		{"commit", func() error { return h.Commit(ctx, "account", "t3") }, nil, [2]int{0, 1}},
+		{"repeated commit", func() error { return h.Commit(ctx, "account", "t3") }, nil, [2]int{1, 1}},
+		{"policy", func() error { return h.SetPolicy(ctx, "account", testItem, Policy{CreditLimit: whole(50)}) }, nil, [2]int{1, 1}},
+		{"debit with a policy", func() error { return h.Update(ctx, "account", "t4", debit) }, nil, [2]int{1, 2}},
+	}
+	for _, step := range steps {
+		db.Clear()
+		if err := step.op(); !errors.Is(err, step.fails) || (step.fails == nil && err != nil) {
+			t.Fatalf("%s: expected %v but got %v", step.name, step.fails, err)
+		}
+		if gets, updates := db.Calls(faultdb.OperationGetItem), db.Calls(faultdb.OperationUpdateItem); gets != step.calls[0] || updates != step.calls[1] {
+			t.Fatalf("%s: expected %d reads and %d writes but got %d and %d", step.name, step.calls[0], step.calls[1], gets, updates)
+		}
+	}
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.PendingTransactions, []string{"t4"}) || a.Version != 6 || !a.Balance(testItem).Equal(whole(95)) {
+		t.Fatalf("unexpected account %+v", a)
+	}
+}
+
+func TestUnsupportedSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	putSchemaItem(t, db, "account", SchemaVersion+1, "0")
+
+	if _, err := h.Account(ctx, "account"); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Fatalf("expected %v but got %v", ErrUnsupportedSchemaVersion, err)
+	}
+	req := dtpc.Request{Source: "other", Destination: "account", Data: Item{ID: testItem, Amount: whole(10)}}
+	if err := h.Update(ctx, "account", "transaction", req); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Fatalf("expected %v but got %v", ErrUnsupportedSchemaVersion, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	cfg := Config{TableName: "accounts"}.withDefaults()
+	if !reflect.DeepEqual(cfg, DefaultConfig("accounts")) {
+		t.Fatalf("expected the default config but got %+v", cfg)
+	}
+
+	invalid := []Config{
+		{},
+		{TableName: "accounts", Attributes: Attributes{Pending: "id"}},
+		{TableName: "accounts", MaxAttempts: -1},
+		{TableName: "accounts", RetryInterval: -1},
+	}
+	for _, cfg := range invalid {
+		if _, err := New(memdynamo.New(), cfg); err == nil {
+			t.Fatalf("expected config %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestItemFromData(t *testing.T) {
+	expected := Item{ID: testItem, Amount: whole(10)}
+	for _, d := range []interface{}{expected, &expected, map[string]interface{}{"ID": testItem, "Amount": float64(10)}} {
+		item, err := ItemFromData(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != expected {
+			t.Fatalf("expected %+v but got %+v", expected, item)
+		}
+	}
+
+	for _, d := range []interface{}{nil, "item", Item{ID: testItem}, Item{Amount: whole(1)}, Item{ID: testItem, Amount: whole(-1)}} {
+		if _, err := ItemFromData(d); !errors.Is(err, ErrInvalidItem) {
+			t.Fatalf("expected %v for %v but got %v", ErrInvalidItem, d, err)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []CreateOption
+		balance  int64
+		amount   int64
+		expected int64
+		ok       bool
+	}{
+		{"Default", nil, 10, 9, 1, true},
+		{"DefaultDrain", nil, 10, 10, 10, false},
+		{"AllowExactMinimum", []CreateOption{WithPolicy(Policy{AllowExactMinimum: true})}, 10, 10, 0, true},
+		{"AllowExactMinimumOverdraw", []CreateOption{WithPolicy(Policy{AllowExactMinimum: true})}, 10, 11, 10, false},
+		{"MinBalance", []CreateOption{WithPolicy(Policy{MinBalance: whole(5)})}, 10, 4, 6, true},
+		{"MinBalanceViolated", []CreateOption{WithPolicy(Policy{MinBalance: whole(5)})}, 10, 5, 10, false},
+		{"CreditLimit", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50), AllowExactMinimum: true})}, 10, 60, -50, true},
+		{"CreditLimitExceeded", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50), AllowExactMinimum: true})}, 10, 61, 10, false},
+		{"CreditWithoutBalance", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50)})}, 0, 20, -20, true},
+		{"ItemPolicy", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50)}), WithItemPolicy(testItem, Policy{})}, 10, 20, 10, false},
+	}
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			balances := map[string]Decimal{}
+			if c.balance != 0 {
+				balances[testItem] = whole(c.balance)
+			}
+			if err := h.Create(ctx, c.name, balances, c.opts...); err != nil {
+				t.Fatal(err)
+			}
+			req := dtpc.Request{Source: c.name, Destination: "destination", Data: Item{ID: testItem, Amount: whole(c.amount)}}
+			err := h.Update(ctx, c.name, "transaction", req)
+			var ie *InsufficientFundsError
+			if c.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !c.ok && (!errors.As(err, &ie) || !errors.Is(err, dtpc.ErrInsufficientFunds) || ie.Amount != whole(c.amount) || ie.Balance != whole(c.balance)) {
+				t.Fatalf("expected an insufficient funds error but got %v", err)
+			}
+			a, err := h.Account(ctx, c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Balance(testItem) != whole(c.expected) {
+				t.Fatalf("expected a balance of %d but got %s", c.expected, a.Balance(testItem))
+			}
+		})
+	}
+}
+
+func TestRollbackPolicies(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []CreateOption
+		spent    int64
+		expected int64
+		ok       bool
+	}{
+		{"Default", nil, 0, 0, true},
+		{"DefaultSpent", nil, 5, 5, false},
+		{"MinBalance", []CreateOption{WithPolicy(Policy{MinBalance: whole(5)})}, 0, 0, true},
+		{"CreditLimit", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50)})}, 40, -40, true},
+		{"CreditLimitSpent", []CreateOption{WithPolicy(Policy{CreditLimit: whole(50)})}, 55, -45, false},
+	}
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := h.Create(ctx, c.name, nil, c.opts...); err != nil {
+				t.Fatal(err)
+			}
+			// The rollback of a credit of 10 only fails if the credited amount has been spent.
+			req := dtpc.Request{Source: "source", Destination: c.name, Data: Item{ID: testItem, Amount: whole(10)}}
+			if err := h.Update(ctx, c.name, "transaction", req); err != nil {
+				t.Fatal(err)
+			}
+			if c.spent != 0 {
+				spend := dtpc.Request{Source: c.name, Destination: "destination", Data: Item{ID: testItem, Amount: whole(c.spent)}}
+				if err := h.Update(ctx, c.name, "spend", spend); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := h.Rollback(ctx, c.name, "transaction", req)
+			if c.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !c.ok && !errors.Is(err, dtpc.ErrInsufficientFunds) {
+				t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+			}
+			a, err := h.Account(ctx, c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Balance(testItem) != whole(c.expected) {
+				t.Fatalf("expected a balance of %d but got %s", c.expected, a.Balance(testItem))
+			}
+		})
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	if err := h.Create(ctx, "account", map[string]Decimal{testItem: whole(10), "other": whole(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPolicy(ctx, "account", "", Policy{CreditLimit: whole(100)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPolicy(ctx, "account", testItem, Policy{MinBalance: whole(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetPolicy(ctx, "account", testItem, Policy{CreditLimit: whole(-1)}); err == nil {
+		t.Fatal("expected a negative credit limit to be rejected")
+	}
+
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PolicyOf("other") != (Policy{CreditLimit: whole(100)}) || a.PolicyOf(testItem) != (Policy{MinBalance: whole(5)}) {
+		t.Fatalf("unexpected policies %+v and %+v", a.Policy, a.Policies)
+	}
+
+	req := dtpc.Request{Source: "account", Destination: "destination", Data: Item{ID: "other", Amount: whole(50)}}
+	if err := h.Update(ctx, "account", "transaction1", req); err != nil {
+		t.Fatal(err)
+	}
+	req.Data = Item{ID: testItem, Amount: whole(6)}
+	if err := h.Update(ctx, "account", "transaction2", req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+}
+
+func TestBasket(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "source", map[string]Decimal{"wood": whole(10), "stone": whole(10), "iron": whole(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "destination", map[string]Decimal{"gold": whole(10)}); err != nil {
+		t.Fatal(err)
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+	srv := dtpc.NewService(ts, h)
+
+	basket := Basket{{ID: "wood", Amount: whole(3)}, {ID: "stone", Amount: whole(2)}, {ID: "iron", Amount: whole(1)}}
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: basket}
+	res, err := srv.StartTransaction(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ts.GetTransaction(ctx, res.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := ItemsFromData(tr.Value); err != nil || !reflect.DeepEqual(stored, basket) {
+		t.Fatalf("expected the stored basket %v but got %v: %v", basket, stored, err)
+	}
+
+	// The whole leg fails if a single item cannot be debited.
+	req.Data = Basket{{ID: "wood", Amount: whole(1)}, {ID: "stone", Amount: whole(8)}}
+	if _, err := srv.StartTransaction(ctx, req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrInsufficientFunds, err)
+	}
+
+	expected := map[string]map[string]Decimal{
+		"source":      {"wood": whole(7), "stone": whole(8), "iron": whole(9)},
+		"destination": {"wood": whole(3), "stone": whole(2), "iron": whole(1), "gold": whole(10)},
+	}
+	for id, balances := range expected {
+		a, err := h.Account(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(a.Balances, balances) {
+			t.Fatalf("expected account %s to have balances %v but got %v", id, balances, a.Balances)
+		}
+	}
+}
+
+func TestBasketRollback(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	balances := map[string]Decimal{"wood": whole(10), "stone": whole(10)}
+	for _, id := range []string{"source", "destination"} {
+		if err := h.Create(ctx, id, balances); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Basket{{ID: "wood", Amount: whole(3)}, {ID: "stone", Amount: whole(4)}}}
+	for _, id := range []string{"source", "destination"} {
+		if err := h.Update(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"destination", "source"} {
+		if err := h.Rollback(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+		a, err := h.Account(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(a.Balances, balances) || len(a.PendingTransactions) != 0 {
+			t.Fatalf("expected account %s to be rolled back but got %+v", id, a)
+		}
+	}
+}
+
+func TestItemsFromData(t *testing.T) {
+	expected := Basket{{ID: "wood", Amount: whole(3)}, {ID: "stone", Amount: whole(2)}}
+	generic := []interface{}{
+		map[string]interface{}{"ID": "wood", "Amount": float64(3)},
+		map[string]interface{}{"ID": "stone", "Amount": float64(2)},
+	}
+	for _, d := range []interface{}{expected, &expected, []Item(expected), generic} {
+		b, err := ItemsFromData(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b, expected) {
+			t.Fatalf("expected %v but got %v", expected, b)
+		}
+	}
+	if b, err := ItemsFromData(expected[0]); err != nil || !reflect.DeepEqual(b, expected[:1]) {
+		t.Fatalf("expected %v but got %v: %v", expected[:1], b, err)
+	}
+
+	for _, d := range []interface{}{Basket{}, Basket{{ID: "wood", Amount: whole(1)}, {ID: "wood", Amount: whole(2)}}, Basket{{ID: "wood"}}, []interface{}{"wood"}} {
+		if _, err := ItemsFromData(d); !errors.Is(err, ErrInvalidItem) {
+			t.Fatalf("expected %v for %v but got %v", ErrInvalidItem, d, err)
+		}
+	}
+}
+
+func TestDecimalItems(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	cfg := DefaultConfig("accounts")
+	cfg.Items = map[string]ItemConfig{"usd": {Scale: 2, Rounding: RoundHalfEven}, "btc": {Scale: 8}}
+	h := newTestHandler(t, db, cfg)
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "source", map[string]Decimal{"usd": MustParseDecimal("10.5"), "btc": MustParseDecimal("0.3")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "destination", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "invalid", map[string]Decimal{"usd": MustParseDecimal("0.001")}); !errors.Is(err, ErrInexact) {
+		t.Fatalf("expected %v but got %v", ErrInexact, err)
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+	srv := dtpc.NewService(ts, h)
+
+	// 0.105 is rounded half to even to 0.10.
+	basket := Basket{{ID: "usd", Amount: MustParseDecimal("0.105")}, {ID: "btc", Amount: MustParseDecimal("0.1")}}
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: basket}
+	res, err := srv.StartTransaction(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ts.GetTransaction(ctx, res.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := ItemsFromData(tr.Value); err != nil || !reflect.DeepEqual(stored, basket) {
+		t.Fatalf("expected the stored basket %v but got %v: %v", basket, stored, err)
+	}
+	req.Data = Item{ID: "btc", Amount: MustParseDecimal("0.000000001")}
+	if _, err := srv.StartTransaction(ctx, req); !errors.Is(err, ErrInexact) {
+		t.Fatalf("expected %v but got %v", ErrInexact, err)
+	}
+	req.Data = Item{ID: "usd", Amount: MustParseDecimal("0.004")}
+	if _, err := srv.StartTransaction(ctx, req); !errors.Is(err, ErrInvalidItem) {
+		t.Fatalf("expected %v but got %v", ErrInvalidItem, err)
+	}
+
+	expected := map[string]map[string]string{
+		"source":      {"usd": "10.40", "btc": "0.20000000"},
+		"destination": {"usd": "0.10", "btc": "0.10000000"},
+	}
+	for id, balances := range expected {
+		a, err := h.Account(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for item, b := range balances {
+			if a.Balance(item).String() != b {
+				t.Fatalf("expected account %s to have %s of %s but got %s", id, b, item, a.Balance(item))
+			}
+		}
+	}
+
+	// Rollback reverts the rounded amount.
+	req.Data = Item{ID: "usd", Amount: MustParseDecimal("0.015")}
+	if err := h.Update(ctx, "destination", "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rollback(ctx, "destination", "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := h.Account(ctx, "destination"); err != nil || a.Balance("usd").String() != "0.10" {
+		t.Fatalf("expected the rollback to restore 0.10 but got %+v: %v", a, err)
+	}
+
+	max := NewDecimal(math.MaxInt64, 2)
+	if err := h.Create(ctx, "full", map[string]Decimal{"usd": max}); err != nil {
+		t.Fatal(err)
+	}
+	req = dtpc.Request{Source: "source", Destination: "full", Data: Item{ID: "usd", Amount: MustParseDecimal("0.01")}}
+	if err := h.Update(ctx, "full", "transaction", req); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v but got %v", ErrOverflow, err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	rates := StaticRates{"usd": {"eur": MustParseDecimal("0.9235")}}
+	cfg := DefaultConfig("accounts")
+	cfg.Items = map[string]ItemConfig{"usd": {Scale: 2}, "eur": {Scale: 2, Rounding: RoundHalfEven}}
+	cfg.Rates = rates
+	h := newTestHandler(t, db, cfg)
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "source", map[string]Decimal{"usd": MustParseDecimal("100")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(ctx, "destination", nil); err != nil {
+		t.Fatal(err)
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+	srv := dtpc.NewService(ts, h)
+
+	// 10 USD are worth 9.235 EUR, which is rounded half to even.
+	e, err := h.Exchange(ctx, Item{ID: "usd", Amount: MustParseDecimal("10")}, "eur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Debit.Amount.String() != "10.00" || e.Credit.Amount.String() != "9.24" || e.Rate.Value.String() != "0.9235" {
+		t.Fatalf("unexpected exchange %+v", e)
+	}
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "source:destination", Data: e}
+	res, err := srv.StartTransaction(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ts.GetTransaction(ctx, res.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ExchangeFromData(tr.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Debit != e.Debit || stored.Credit != e.Credit || stored.Rate.Value != e.Rate.Value || !stored.Rate.Time.Equal(e.Rate.Time) {
+		t.Fatalf("expected the stored exchange %+v but got %+v", e, stored)
+	}
+
+	// Rollback restores the recorded amounts after the rate has changed.
+	e, err = h.Exchange(ctx, Item{ID: "usd", Amount: MustParseDecimal("20")}, "eur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Data = e
+	for _, id := range []string{"source", "destination"} {
+		if err := h.Update(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rates["usd"]["eur"] = MustParseDecimal("2")
+	for _, id := range []string{"destination", "source"} {
+		if err := h.Rollback(ctx, id, "transaction", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]map[string]string{
+		"source":      {"usd": "90.00"},
+		"destination": {"eur": "9.24"},
+	}
+	for id, balances := range expected {
+		a, err := h.Account(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for item, b := range balances {
+			if a.Balance(item).String() != b {
+				t.Fatalf("expected account %s to have %s of %s but got %s", id, b, item, a.Balance(item))
+			}
+		}
+		if len(a.PendingTransactions) != 0 {
+			t.Fatalf("expected account %s to have no pending transactions but got %v", id, a.PendingTransactions)
+		}
+	}
+
+	if _, err := h.Exchange(ctx, Item{ID: "eur", Amount: whole(1)}, "usd"); !errors.Is(err, ErrRateNotFound) {
+		t.Fatalf("expected %v but got %v", ErrRateNotFound, err)
+	}
+	invalid := []Exchange{
+		{Debit: Item{ID: "usd", Amount: whole(1)}, Credit: Item{ID: "usd", Amount: whole(1)}, Rate: Rate{From: "usd", To: "usd", Value: whole(1)}},
+		{Debit: Item{ID: "usd", Amount: whole(1)}, Credit: Item{ID: "eur", Amount: whole(1)}, Rate: Rate{From: "eur", To: "usd", Value: whole(1)}},
+		{Debit: Item{ID: "usd", Amount: whole(1)}, Credit: Item{ID: "eur", Amount: whole(1)}, Rate: Rate{From: "usd", To: "eur"}},
+	}
+	for _, e := range invalid {
+		if _, err := ExchangeFromData(e); !errors.Is(err, ErrInvalidItem) {
+			t.Fatalf("expected %v for %+v but got %v", ErrInvalidItem, e, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"dtpc"
+)
+
+// Status is the lifecycle status of an account.
+type Status string
+
+const (
+	// StatusOpen allows all transactions. Accounts without a status are open.
+	StatusOpen Status = "open"
+	// StatusFrozen blocks transactions that debit the account.
+	StatusFrozen Status = "frozen"
+	// StatusFrozenAll blocks transactions that debit or credit the account.
+	StatusFrozenAll Status = "frozen_all"
+	// StatusClosed blocks all transactions. Closed accounts cannot be reopened.
+	StatusClosed Status = "closed"
+)
+
+var (
+	// ErrAccountFrozen is returned by Update when a frozen account would be debited or credited.
+	ErrAccountFrozen = errors.New("account frozen")
+	// ErrAccountClosed is returned when a closed account would be modified.
+	ErrAccountClosed = errors.New("account closed")
+	// ErrAccountNotEmpty is returned by Close when an account has balances, holds or pending transactions.
+	ErrAccountNotEmpty = errors.New("account not empty")
+)
+
+var (
+	// debitable are the statuses of accounts that can be debited.
+	debitable = []Status{StatusOpen}
+	// creditable are the statuses of accounts that can be credited.
+	creditable = []Status{StatusOpen, StatusFrozen}
+	// active are the statuses of accounts that can be updated without being debited or credited.
+	active = []Status{StatusOpen, StatusFrozen, StatusFrozenAll}
+)
+
+// valid reports whether s is a known status.
+func (s Status) valid() bool {
+	switch s {
+	case StatusOpen, StatusFrozen, StatusFrozenAll, StatusClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Freeze blocks debits of an account, and credits as well if credits is true. Transactions that have already been
+// applied to the account can still be committed or rolled back.
+func (h *Handler) Freeze(ctx context.Context, accountID string, credits bool) error {
+	status := StatusFrozen
+	if credits {
+		status = StatusFrozenAll
+	}
+	return h.setStatus(ctx, "freeze", accountID, status)
+}
+
+// Unfreeze allows all transactions of a frozen account again.
+func (h *Handler) Unfreeze(ctx context.Context, accountID string) error {
+	return h.setStatus(ctx, "unfreeze", accountID, StatusOpen)
+}
+
+// Close closes an account whose balances are zero and which has no holds and no pending transactions, and fails with
+// ErrAccountNotEmpty otherwise. Closing a closed account succeeds.
+func (h *Handler) Close(ctx context.Context, accountID string) error {
+	return h.retry(ctx, "close", accountID, func(a *Account) error {
+		if a.Status == StatusClosed {
+			return nil
+		}
+		if len(a.PendingTransactions) > 0 {
+			return fmt.Errorf("account %s has pending transactions %v: %w", a.ID, a.PendingTransactions, ErrAccountNotEmpty)
+		}
+		if len(a.Holds) > 0 {
+			return fmt.Errorf("account %s has %d holds: %w", a.ID, len(a.Holds), ErrAccountNotEmpty)
+		}
+		for id, b := range a.Balances {
+			if !b.IsZero() {
+				return fmt.Errorf("account %s has a balance of %s of item %s: %w", a.ID, b, id, ErrAccountNotEmpty)
+			}
+		}
+		u := h.update(a)
+		u.setStatus(StatusClosed)
+		return h.write(ctx, a, u)
+	})
+}
+
+func (h *Handler) setStatus(ctx context.Context, op, accountID string, status Status) error {
+	return h.retry(ctx, op, accountID, func(a *Account) error {
+		if a.Status == StatusClosed {
+			return fmt.Errorf("%s of account %s: %w", op, a.ID, ErrAccountClosed)
+		}
+		if a.Status == status {
+			return nil
+		}
+		u := h.update(a)
+		u.setStatus(status)
+		return h.write(ctx, a, u)
+	})
+}
+
+// statuses returns the statuses of accounts that a transaction can be applied to. The source of a transfer or a
+// capture is debited and the destination is credited. A hold debits its account, and a release moves held amounts
+// back to the balances of the account, which is not blocked by a freeze.
+func statuses(accountID string, tr dtpc.Request) []Status {
+	data, _ := holdFromData(tr.Data)
+	switch data.(type) {
+	case Authorization:
+		if accountID == tr.Source {
+			return debitable
+		}
+		return active
+	case Release:
+		return active
+	}
+	if accountID == tr.Destination {
+		return creditable
+	}
+	return debitable
+}
+
+// requireStatus fails unless the account has one of the given statuses, and conditions the update on the status so
+// that it fails if the status is changed concurrently.
+func (u *update) requireStatus(a *Account, allowed ...Status) error {
+	ok := false
+	for _, s := range allowed {
+		ok = ok || a.Status == s
+	}
+	switch {
+	case ok:
+	case a.Status == StatusClosed:
+		return fmt.Errorf("account %s: %w", a.ID, ErrAccountClosed)
+	default:
+		return fmt.Errorf("account %s has status %s: %w", a.ID, a.Status, ErrAccountFrozen)
+	}
+
+	// Accounts written before statuses were introduced have no status and are open.
+	u.conditionStatus(allowed, a.Status == StatusOpen)
+	return nil
+}
+
+// conditionStatus conditions the update on the account having one of the given statuses, or no status if missing is
+// true.
+func (u *update) conditionStatus(allowed []Status, missing bool) {
+	u.names["#st"] = aws.String(u.attrs.Status)
+	values := make([]string, len(allowed))
+	for i, s := range allowed {
+		values[i] = fmt.Sprintf(":st%d", i)
+		u.values[values[i]] = &dynamodb.AttributeValue{S: aws.String(string(s))}
+	}
+	cond := fmt.Sprintf("#st IN (%s)", strings.Join(values, ", "))
+	if missing {
+		cond = fmt.Sprintf("(attribute_not_exists(#st) OR %s)", cond)
+	}
+	u.conds = append(u.conds, cond)
+}
+
+func (u *update) setStatus(s Status) {
+	u.names["#st"] = aws.String(u.attrs.Status)
+	u.values[":newst"] = &dynamodb.AttributeValue{S: aws.String(string(s))}
+	u.set = append(u.set, "#st = :newst")
+}
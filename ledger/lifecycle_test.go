@@ -0,0 +1,140 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"dtpc"
+	"dtpc/memdynamo"
+)
+
+func TestFreeze(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	if err := h.Create(ctx, "account", map[string]Decimal{testItem: whole(100)}); err != nil {
+		t.Fatal(err)
+	}
+	debit := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(10)}}
+	credit := dtpc.Request{Source: "other", Destination: "account", Data: Item{ID: testItem, Amount: whole(10)}}
+
+	if err := h.Update(ctx, "account", "pending", debit); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Freeze(ctx, "account", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "account", "debit", debit); !errors.Is(err, ErrAccountFrozen) {
+		t.Fatalf("expected %v but got %v", ErrAccountFrozen, err)
+	}
+	if err := h.Update(ctx, "account", "credit", credit); err != nil {
+		t.Fatal(err)
+	}
+	// Transactions applied before the freeze can still be completed.
+	if err := h.Rollback(ctx, "account", "pending", debit); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Freeze(ctx, "account", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "account", "credit2", credit); !errors.Is(err, ErrAccountFrozen) {
+		t.Fatalf("expected %v but got %v", ErrAccountFrozen, err)
+	}
+	if err := h.Commit(ctx, "account", "credit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Unfreeze(ctx, "account"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "account", "debit", debit); err != nil {
+		t.Fatal(err)
+	}
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != StatusOpen || a.Balance(testItem) != whole(100) {
+		t.Fatalf("unexpected account %+v", a)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t, memdynamo.New(), DefaultConfig("accounts"))
+	if err := h.Create(ctx, "account", map[string]Decimal{testItem: whole(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(ctx, "account"); !errors.Is(err, ErrAccountNotEmpty) {
+		t.Fatalf("expected %v but got %v", ErrAccountNotEmpty, err)
+	}
+	drain := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(10)}}
+	if err := h.SetPolicy(ctx, "account", "", Policy{AllowExactMinimum: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(ctx, "account", "drain", drain); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(ctx, "account"); !errors.Is(err, ErrAccountNotEmpty) {
+		t.Fatalf("expected %v with a pending transaction but got %v", ErrAccountNotEmpty, err)
+	}
+	if err := h.Commit(ctx, "account", "drain"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := h.Close(ctx, "account"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	credit := dtpc.Request{Source: "other", Destination: "account", Data: Item{ID: testItem, Amount: whole(1)}}
+	if err := h.Update(ctx, "account", "credit", credit); !errors.Is(err, ErrAccountClosed) {
+		t.Fatalf("expected %v but got %v", ErrAccountClosed, err)
+	}
+	if err := h.Freeze(ctx, "account", false); !errors.Is(err, ErrAccountClosed) {
+		t.Fatalf("expected %v but got %v", ErrAccountClosed, err)
+	}
+	if err := h.Unfreeze(ctx, "account"); !errors.Is(err, ErrAccountClosed) {
+		t.Fatalf("expected %v but got %v", ErrAccountClosed, err)
+	}
+	if err := h.Put(ctx, &Account{ID: "account", Balances: map[string]Decimal{testItem: whole(5)}}); !errors.Is(err, ErrAccountClosed) {
+		t.Fatalf("expected %v but got %v", ErrAccountClosed, err)
+	}
+	if a, err := h.Account(ctx, "account"); err != nil || a.Status != StatusClosed || !a.Balances[testItem].IsZero() {
+		t.Fatalf("expected an empty closed account but got %+v: %v", a, err)
+	}
+}
+
+func TestAccountWithoutStatus(t *testing.T) {
+	ctx := context.Background()
+	db := memdynamo.New()
+	h := newTestHandler(t, db, DefaultConfig("accounts"))
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("accounts"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":             {S: aws.String("account")},
+			"schema_version": {N: aws.String("1")},
+			"balances":       {M: map[string]*dynamodb.AttributeValue{testItem: {N: aws.String("10")}}},
+			"pending":        {L: []*dynamodb.AttributeValue{}},
+			"version":        {N: aws.String("0")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := dtpc.Request{Source: "account", Destination: "other", Data: Item{ID: testItem, Amount: whole(5)}}
+	if err := h.Update(ctx, "account", "transaction", req); err != nil {
+		t.Fatal(err)
+	}
+	a, err := h.Account(ctx, "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != StatusOpen || a.Balance(testItem) != whole(5) {
+		t.Fatalf("unexpected account %+v", a)
+	}
+}
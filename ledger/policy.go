@@ -0,0 +1,112 @@
+package ledger
+
+import (
+	"fmt"
+	"math/big"
+
+	"dtpc"
+)
+
+// Policy limits how far debits may reduce the balance of an item.
+// The zero value requires balances to stay above zero.
+type Policy struct {
+	// Balance that debits must not go below
+	MinBalance Decimal
+	// Amount by which debits may take the balance below zero. It lowers the floor set by MinBalance.
+	CreditLimit Decimal
+	// AllowExactMinimum allows a debit to leave exactly the minimum balance, e.g. to drain an account to zero.
+	AllowExactMinimum bool
+}
+
+// Validate checks that the minimum balance and the credit limit are not negative and that the floor of the policy
+// can be represented.
+func (p Policy) Validate() error {
+	if p.MinBalance.Sign() < 0 {
+		return fmt.Errorf("minimum balance %s must not be negative", p.MinBalance)
+	}
+	if p.CreditLimit.Sign() < 0 {
+		return fmt.Errorf("credit limit %s must not be negative", p.CreditLimit)
+	}
+	_, err := p.Floor()
+	return err
+}
+
+// Floor returns the lowest balance of the policy: the minimum balance less the credit limit.
+func (p Policy) Floor() (Decimal, error) {
+	return p.MinBalance.Sub(p.CreditLimit)
+}
+
+// isZero reports whether the policy has the effect of the zero Policy.
+func (p Policy) isZero() bool {
+	return p.MinBalance.IsZero() && p.CreditLimit.IsZero() && !p.AllowExactMinimum
+}
+
+// allows reports whether a balance can be debited by amount.
+func (p Policy) allows(balance, amount Decimal) bool {
+	available := new(big.Rat).Sub(balance.rat(), p.MinBalance.rat())
+	available.Add(available, p.CreditLimit.rat())
+	c := amount.rat().Cmp(available)
+	if p.AllowExactMinimum {
+		return c <= 0
+	}
+	return c < 0
+}
+
+// reverting returns the policy of the rollback of a credit, which may take the balance down to zero, or to the floor
+// of p if it is lower, so that a credit can be rolled back as long as its amount has not been spent.
+func (p Policy) reverting() (Policy, error) {
+	floor, err := p.Floor()
+	if err != nil {
+		return Policy{}, err
+	}
+	r := Policy{AllowExactMinimum: true}
+	if floor.Sign() < 0 {
+		r.CreditLimit = floor.Neg()
+	}
+	return r, nil
+}
+
+// InsufficientFundsError is returned when a debit would violate the policy of an item.
+// It matches dtpc.ErrInsufficientFunds with errors.Is.
+type InsufficientFundsError struct {
+	// ID of the account
+	AccountID string
+	// ID of the item
+	ItemID string
+	// Balance of the item before the debit
+	Balance Decimal
+	// Amount of the debit
+	Amount Decimal
+	// Policy of the item
+	Policy Policy
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("account %s has a balance of %s of item %s and cannot be debited by %s with a minimum balance of %s and a credit limit of %s: %v",
+		e.AccountID, e.Balance, e.ItemID, e.Amount, e.Policy.MinBalance, e.Policy.CreditLimit, dtpc.ErrInsufficientFunds)
+}
+
+// Unwrap returns dtpc.ErrInsufficientFunds.
+func (e *InsufficientFundsError) Unwrap() error {
+	return dtpc.ErrInsufficientFunds
+}
+
+// CreateOption sets optional fields of an account before it is created.
+type CreateOption func(a *Account)
+
+// WithPolicy sets the policy of all items of an account without a policy of their own.
+func WithPolicy(p Policy) CreateOption {
+	return func(a *Account) {
+		a.Policy = p
+	}
+}
+
+// WithItemPolicy sets the policy of an item of an account.
+func WithItemPolicy(itemID string, p Policy) CreateOption {
+	return func(a *Account) {
+		if a.Policies == nil {
+			a.Policies = make(map[string]Policy)
+		}
+		a.Policies[itemID] = p
+	}
+}
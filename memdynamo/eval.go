@@ -0,0 +1,740 @@
+package memdynamo
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// item is an item of a table, keyed by attribute name.
+type item map[string]*dynamodb.AttributeValue
+
+// Attribute types as used by attribute_type and attribute definitions.
+const (
+	typeS    = "S"
+	typeN    = "N"
+	typeB    = "B"
+	typeSS   = "SS"
+	typeNS   = "NS"
+	typeBS   = "BS"
+	typeM    = "M"
+	typeL    = "L"
+	typeNULL = "NULL"
+	typeBOOL = "BOOL"
+)
+
+// valueTypes returns the types set in an attribute value. A valid attribute value has exactly one type.
+func valueTypes(v *dynamodb.AttributeValue) []string {
+	types := []string{}
+	if v.S != nil {
+		types = append(types, typeS)
+	}
+	if v.N != nil {
+		types = append(types, typeN)
+	}
+	if v.B != nil {
+		types = append(types, typeB)
+	}
+	if v.SS != nil {
+		types = append(types, typeSS)
+	}
+	if v.NS != nil {
+		types = append(types, typeNS)
+	}
+	if v.BS != nil {
+		types = append(types, typeBS)
+	}
+	if v.M != nil {
+		types = append(types, typeM)
+	}
+	if v.L != nil {
+		types = append(types, typeL)
+	}
+	if v.NULL != nil {
+		types = append(types, typeNULL)
+	}
+	if v.BOOL != nil {
+		types = append(types, typeBOOL)
+	}
+	return types
+}
+
+func valueType(v *dynamodb.AttributeValue) string {
+	if types := valueTypes(v); len(types) > 0 {
+		return types[0]
+	}
+	return ""
+}
+
+// validateValue checks that an attribute value and all its nested values are well formed.
+func validateValue(v *dynamodb.AttributeValue) error {
+	if v == nil {
+		return validationError("Supplied AttributeValue is empty, must contain exactly one of the supported datatypes")
+	}
+	types := valueTypes(v)
+	if len(types) != 1 {
+		return validationError("Supplied AttributeValue has %d datatypes, must contain exactly one of the supported datatypes", len(types))
+	}
+	switch types[0] {
+	case typeN:
+		if _, err := parseNumber(aws.StringValue(v.N)); err != nil {
+			return err
+		}
+	case typeNS:
+		for _, n := range v.NS {
+			if _, err := parseNumber(aws.StringValue(n)); err != nil {
+				return err
+			}
+		}
+	case typeSS, typeBS:
+		if len(v.SS) == 0 && len(v.BS) == 0 {
+			return validationError("One or more parameter values were invalid: An string set or binary set may not be empty")
+		}
+	case typeM:
+		for _, e := range v.M {
+			if err := validateValue(e); err != nil {
+				return err
+			}
+		}
+	case typeL:
+		for _, e := range v.L {
+			if err := validateValue(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateItem(it item) error {
+	for _, v := range it {
+		if err := validateValue(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseNumber(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, validationError("A value provided cannot be converted into a number: %q", s)
+	}
+	return r, nil
+}
+
+// formatNumber returns the canonical representation of a number, without trailing zeros.
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := r.FloatString(38)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func copyValue(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	c := &dynamodb.AttributeValue{
+		S:    v.S,
+		N:    v.N,
+		NULL: v.NULL,
+		BOOL: v.BOOL,
+	}
+	if v.B != nil {
+		c.B = append([]byte{}, v.B...)
+	}
+	if v.SS != nil {
+		c.SS = append([]*string{}, v.SS...)
+	}
+	if v.NS != nil {
+		c.NS = append([]*string{}, v.NS...)
+	}
+	if v.BS != nil {
+		c.BS = make([][]byte, len(v.BS))
+		for i, b := range v.BS {
+			c.BS[i] = append([]byte{}, b...)
+		}
+	}
+	if v.M != nil {
+		c.M = copyItem(v.M)
+	}
+	if v.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			c.L[i] = copyValue(e)
+		}
+	}
+	return c
+}
+
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	c := make(item, len(it))
+	for k, v := range it {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+// compareScalars compares two values of the same scalar type S, N or B.
+// ok is false if the values are not comparable.
+func compareScalars(a, b *dynamodb.AttributeValue) (cmp int, ok bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	t := valueType(a)
+	if t != valueType(b) {
+		return 0, false
+	}
+	switch t {
+	case typeS:
+		return strings.Compare(*a.S, *b.S), true
+	case typeN:
+		x, err := parseNumber(*a.N)
+		if err != nil {
+			return 0, false
+		}
+		y, err := parseNumber(*b.N)
+		if err != nil {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case typeB:
+		return bytes.Compare(a.B, b.B), true
+	default:
+		return 0, false
+	}
+}
+
+// equalValues reports whether two values are equal. Numbers are compared numerically and sets regardless of order.
+func equalValues(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	t := valueType(a)
+	if t != valueType(b) {
+		return false
+	}
+	switch t {
+	case typeS, typeN, typeB:
+		cmp, ok := compareScalars(a, b)
+		return ok && cmp == 0
+	case typeBOOL:
+		return *a.BOOL == *b.BOOL
+	case typeNULL:
+		return true
+	case typeSS, typeNS, typeBS:
+		as, bs := setElements(a), setElements(b)
+		if len(as) != len(bs) {
+			return false
+		}
+		for _, e := range as {
+			if !containsValue(bs, e) {
+				return false
+			}
+		}
+		return true
+	case typeL:
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equalValues(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case typeM:
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			if !equalValues(v, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// setElements returns the elements of a set as scalar values.
+func setElements(v *dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	elements := []*dynamodb.AttributeValue{}
+	for _, s := range v.SS {
+		elements = append(elements, &dynamodb.AttributeValue{S: s})
+	}
+	for _, n := range v.NS {
+		elements = append(elements, &dynamodb.AttributeValue{N: n})
+	}
+	for _, b := range v.BS {
+		elements = append(elements, &dynamodb.AttributeValue{B: b})
+	}
+	return elements
+}
+
+// newSet returns a set of the given type with the given scalar elements.
+func newSet(t string, elements []*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	v := &dynamodb.AttributeValue{}
+	for _, e := range elements {
+		switch t {
+		case typeSS:
+			v.SS = append(v.SS, e.S)
+		case typeNS:
+			v.NS = append(v.NS, e.N)
+		case typeBS:
+			v.BS = append(v.BS, e.B)
+		}
+	}
+	return v
+}
+
+func containsValue(vs []*dynamodb.AttributeValue, v *dynamodb.AttributeValue) bool {
+	for _, e := range vs {
+		if equalValues(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the value at a path of a document, or nil if the path does not exist.
+func (p path) get(doc item) *dynamodb.AttributeValue {
+	cur := &dynamodb.AttributeValue{M: doc}
+	for _, e := range p {
+		switch {
+		case e.isIndex:
+			if cur.L == nil || e.index >= len(cur.L) {
+				return nil
+			}
+			cur = cur.L[e.index]
+		default:
+			if cur.M == nil {
+				return nil
+			}
+			v, ok := cur.M[e.name]
+			if !ok {
+				return nil
+			}
+			cur = v
+		}
+	}
+	return cur
+}
+
+// parent returns the container of the last element of a path.
+func (p path) parent(doc item) (*dynamodb.AttributeValue, error) {
+	parent := &dynamodb.AttributeValue{M: doc}
+	if len(p) > 1 {
+		parent = p[:len(p)-1].get(doc)
+	}
+	last := p[len(p)-1]
+	if parent == nil || (last.isIndex && parent.L == nil) || (!last.isIndex && parent.M == nil) {
+		return nil, validationError("The document path provided in the update expression is invalid for update: %s", p)
+	}
+	return parent, nil
+}
+
+// set sets the value at a path. Setting an index past the end of a list appends the value.
+func (p path) set(doc item, v *dynamodb.AttributeValue) error {
+	parent, err := p.parent(doc)
+	if err != nil {
+		return err
+	}
+	last := p[len(p)-1]
+	switch {
+	case !last.isIndex:
+		parent.M[last.name] = v
+	case last.index < len(parent.L):
+		parent.L[last.index] = v
+	default:
+		parent.L = append(parent.L, v)
+	}
+	return nil
+}
+
+// remove removes the value at a path. Removing a path that does not exist has no effect.
+func (p path) remove(doc item) error {
+	parent, err := p.parent(doc)
+	if err != nil {
+		return nil
+	}
+	last := p[len(p)-1]
+	switch {
+	case !last.isIndex:
+		delete(parent.M, last.name)
+	case last.index < len(parent.L):
+		parent.L = append(parent.L[:last.index:last.index], parent.L[last.index+1:]...)
+	}
+	return nil
+}
+
+// project copies the value at a path of a document into another document.
+func (p path) project(from, to item) {
+	v := p.get(from)
+	if v == nil {
+		return
+	}
+	cur := &dynamodb.AttributeValue{M: to}
+	for i, e := range p {
+		last := i == len(p)-1
+		next := p[:i+1].get(from)
+		var child *dynamodb.AttributeValue
+		switch {
+		case last:
+			child = copyValue(v)
+		case next.M != nil:
+			child = &dynamodb.AttributeValue{M: item{}}
+		default:
+			child = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+		}
+		if e.isIndex {
+			// Projected list elements are compacted into a new list in the order of their indexes.
+			cur.L = append(cur.L, child)
+			cur = cur.L[len(cur.L)-1]
+			continue
+		}
+		if existing, ok := cur.M[e.name]; ok && !last {
+			cur = existing
+			continue
+		}
+		cur.M[e.name] = child
+		cur = child
+	}
+}
+
+// project returns a document with the values of the given paths.
+func project(doc item, paths []path) item {
+	if paths == nil {
+		return doc
+	}
+	out := item{}
+	for _, p := range paths {
+		p.project(doc, out)
+	}
+	return out
+}
+
+// eval returns the value of an operand for a document, or nil if it refers to a path that does not exist.
+func (o *operand) eval(doc item) (*dynamodb.AttributeValue, error) {
+	switch o.kind {
+	case operandPath:
+		return o.path.get(doc), nil
+	case operandValue:
+		return o.value, nil
+	case operandSize:
+		v := o.args[0].path.get(doc)
+		if v == nil {
+			return nil, nil
+		}
+		var n int
+		switch valueType(v) {
+		case typeS:
+			n = utf8.RuneCountInString(*v.S)
+		case typeB:
+			n = len(v.B)
+		case typeSS, typeNS, typeBS:
+			n = len(setElements(v))
+		case typeL:
+			n = len(v.L)
+		case typeM:
+			n = len(v.M)
+		default:
+			return nil, validationError("Invalid operand type for function size: %s", valueType(v))
+		}
+		return &dynamodb.AttributeValue{N: aws.String(formatNumber(big.NewRat(int64(n), 1)))}, nil
+	case operandIfNotExists:
+		if v := o.args[0].path.get(doc); v != nil {
+			return v, nil
+		}
+		return o.args[1].eval(doc)
+	case operandListAppend:
+		a, err := o.args[0].evalExisting(doc)
+		if err != nil {
+			return nil, err
+		}
+		b, err := o.args[1].evalExisting(doc)
+		if err != nil {
+			return nil, err
+		}
+		if a.L == nil || b.L == nil {
+			return nil, validationError("An operand in the update expression has an incorrect data type")
+		}
+		return &dynamodb.AttributeValue{L: append(append([]*dynamodb.AttributeValue{}, a.L...), b.L...)}, nil
+	case operandPlus, operandMinus:
+		a, err := o.args[0].evalExisting(doc)
+		if err != nil {
+			return nil, err
+		}
+		b, err := o.args[1].evalExisting(doc)
+		if err != nil {
+			return nil, err
+		}
+		if a.N == nil || b.N == nil {
+			return nil, validationError("An operand in the update expression has an incorrect data type")
+		}
+		x, err := parseNumber(*a.N)
+		if err != nil {
+			return nil, err
+		}
+		y, err := parseNumber(*b.N)
+		if err != nil {
+			return nil, err
+		}
+		if o.kind == operandPlus {
+			x.Add(x, y)
+		} else {
+			x.Sub(x, y)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(formatNumber(x))}, nil
+	default:
+		return nil, validationError("Invalid operand")
+	}
+}
+
+// evalExisting evaluates an operand of an update that must refer to an existing value.
+func (o *operand) evalExisting(doc item) (*dynamodb.AttributeValue, error) {
+	v, err := o.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, validationError("The provided expression refers to an attribute that does not exist in the item")
+	}
+	return v, nil
+}
+
+// eval reports whether a document satisfies a condition.
+func (c *condition) eval(doc item) (bool, error) {
+	switch c.kind {
+	case conditionAnd, conditionOr:
+		left, err := c.children[0].eval(doc)
+		if err != nil {
+			return false, err
+		}
+		right, err := c.children[1].eval(doc)
+		if err != nil {
+			return false, err
+		}
+		if c.kind == conditionAnd {
+			return left && right, nil
+		}
+		return left || right, nil
+	case conditionNot:
+		ok, err := c.children[0].eval(doc)
+		return !ok, err
+	}
+
+	values := make([]*dynamodb.AttributeValue, len(c.operands))
+	for i, o := range c.operands {
+		v, err := o.eval(doc)
+		if err != nil {
+			return false, err
+		}
+		values[i] = v
+	}
+
+	switch c.kind {
+	case conditionCompare:
+		a, b := values[0], values[1]
+		switch c.op {
+		case "=":
+			return equalValues(a, b), nil
+		case "<>":
+			return !equalValues(a, b), nil
+		}
+		cmp, ok := compareScalars(a, b)
+		if !ok {
+			return false, nil
+		}
+		switch c.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case conditionBetween:
+		low, ok := compareScalars(values[1], values[0])
+		if !ok {
+			return false, nil
+		}
+		high, ok := compareScalars(values[0], values[2])
+		return ok && low <= 0 && high <= 0, nil
+	case conditionIn:
+		return containsValue(values[1:], values[0]), nil
+	case conditionFunction:
+		v := values[0]
+		switch c.op {
+		case "attribute_exists":
+			return v != nil, nil
+		case "attribute_not_exists":
+			return v == nil, nil
+		case "attribute_type":
+			t := values[1]
+			return v != nil && t != nil && t.S != nil && valueType(v) == *t.S, nil
+		case "begins_with":
+			prefix := values[1]
+			switch {
+			case v == nil || prefix == nil:
+				return false, nil
+			case v.S != nil && prefix.S != nil:
+				return strings.HasPrefix(*v.S, *prefix.S), nil
+			case v.B != nil && prefix.B != nil:
+				return bytes.HasPrefix(v.B, prefix.B), nil
+			default:
+				return false, nil
+			}
+		case "contains":
+			operand := values[1]
+			switch {
+			case v == nil || operand == nil:
+				return false, nil
+			case v.S != nil && operand.S != nil:
+				return strings.Contains(*v.S, *operand.S), nil
+			case v.B != nil && operand.B != nil:
+				return bytes.Contains(v.B, operand.B), nil
+			case v.SS != nil || v.NS != nil || v.BS != nil:
+				return containsValue(setElements(v), operand), nil
+			case v.L != nil:
+				return containsValue(v.L, operand), nil
+			default:
+				return false, nil
+			}
+		}
+	}
+	return false, validationError("Invalid condition")
+}
+
+// apply applies the actions of an update expression to a document. All operands are evaluated against the document
+// before any action is applied.
+func apply(doc item, actions []action) error {
+	orig := copyItem(doc)
+	values := make([]*dynamodb.AttributeValue, len(actions))
+	for i, a := range actions {
+		if a.value == nil {
+			continue
+		}
+		v, err := a.value.eval(orig)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return validationError("The provided expression refers to an attribute that does not exist in the item")
+		}
+		values[i] = copyValue(v)
+	}
+
+	type listRemoval struct {
+		list  *dynamodb.AttributeValue
+		index int
+	}
+	removals := []listRemoval{}
+	for i, a := range actions {
+		switch a.kind {
+		case actionSet:
+			if err := a.path.set(doc, values[i]); err != nil {
+				return err
+			}
+		case actionRemove:
+			parent, err := a.path.parent(doc)
+			if err != nil {
+				// Removing a path whose parent does not exist has no effect.
+				continue
+			}
+			last := a.path[len(a.path)-1]
+			if last.isIndex {
+				removals = append(removals, listRemoval{parent, last.index})
+			} else {
+				delete(parent.M, last.name)
+			}
+		case actionAdd, actionDelete:
+			if err := addOrDelete(doc, a, values[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// List elements are removed by their index before the update, so the highest index is removed first.
+	sort.SliceStable(removals, func(i, j int) bool {
+		return removals[i].index > removals[j].index
+	})
+	for _, r := range removals {
+		if r.index < len(r.list.L) {
+			r.list.L = append(r.list.L[:r.index:r.index], r.list.L[r.index+1:]...)
+		}
+	}
+	return nil
+}
+
+// addOrDelete applies an ADD or DELETE action.
+func addOrDelete(doc item, a action, v *dynamodb.AttributeValue) error {
+	cur := a.path.get(doc)
+	t := valueType(v)
+	switch {
+	case a.kind == actionAdd && t == typeN:
+		if cur == nil {
+			return a.path.set(doc, v)
+		}
+		if cur.N == nil {
+			return validationError("An operand in the update expression has an incorrect data type")
+		}
+		x, err := parseNumber(*cur.N)
+		if err != nil {
+			return err
+		}
+		y, err := parseNumber(*v.N)
+		if err != nil {
+			return err
+		}
+		return a.path.set(doc, &dynamodb.AttributeValue{N: aws.String(formatNumber(x.Add(x, y)))})
+	case t == typeSS || t == typeNS || t == typeBS:
+		if cur == nil {
+			if a.kind == actionDelete {
+				return nil
+			}
+			return a.path.set(doc, v)
+		}
+		if valueType(cur) != t {
+			return validationError("An operand in the update expression has an incorrect data type")
+		}
+		elements := setElements(cur)
+		if a.kind == actionAdd {
+			for _, e := range setElements(v) {
+				if !containsValue(elements, e) {
+					elements = append(elements, e)
+				}
+			}
+		} else {
+			remove := setElements(v)
+			kept := []*dynamodb.AttributeValue{}
+			for _, e := range elements {
+				if !containsValue(remove, e) {
+					kept = append(kept, e)
+				}
+			}
+			elements = kept
+		}
+		if len(elements) == 0 {
+			// Sets cannot be empty, so deleting all elements removes the attribute.
+			return a.path.remove(doc)
+		}
+		return a.path.set(doc, newSet(t, elements))
+	default:
+		return validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: %s, operand type: %s", map[actionKind]string{actionAdd: "ADD", actionDelete: "DELETE"}[a.kind], t)
+	}
+}
@@ -0,0 +1,661 @@
+package memdynamo
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	// Identifiers, keywords and function names
+	tokenIdent
+	// Expression attribute names such as #name
+	tokenName
+	// Expression attribute values such as :value
+	tokenValue
+	// List indexes
+	tokenNumber
+	// Operators and punctuation
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// symbols are the operators and punctuation of expressions, longest first.
+var symbols = []string{"<>", "<=", ">=", "(", ")", "[", "]", ",", ".", "=", "<", ">", "+", "-"}
+
+func isIdentRune(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+}
+
+// tokenize splits an expression into tokens.
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || r == ':':
+			j := i + 1
+			for j < len(rs) && isIdentRune(rs[j], false) {
+				j++
+			}
+			if j == i+1 {
+				return nil, validationError("Invalid expression: syntax error at %q in %q", string(r), expr)
+			}
+			kind := tokenName
+			if r == ':' {
+				kind = tokenValue
+			}
+			tokens = append(tokens, token{kind, string(rs[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(rs) && unicode.IsDigit(rs[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, string(rs[i:j])})
+			i = j
+		case isIdentRune(r, true):
+			j := i
+			for j < len(rs) && isIdentRune(rs[j], false) {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, string(rs[i:j])})
+			i = j
+		default:
+			found := false
+			for _, s := range symbols {
+				if strings.HasPrefix(string(rs[i:]), s) {
+					tokens = append(tokens, token{tokenSymbol, s})
+					i += len([]rune(s))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, validationError("Invalid expression: syntax error at %q in %q", string(r), expr)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// pathElement is a map key or a list index of a document path.
+type pathElement struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// path is a document path such as Resources.item.Amount or PendingTransactions[0].
+type path []pathElement
+
+func (p path) String() string {
+	b := strings.Builder{}
+	for i, e := range p {
+		switch {
+		case e.isIndex:
+			b.WriteString("[" + strconv.Itoa(e.index) + "]")
+		case i > 0:
+			b.WriteString("." + e.name)
+		default:
+			b.WriteString(e.name)
+		}
+	}
+	return b.String()
+}
+
+// overlaps reports whether one of two paths is a prefix of the other.
+func (p path) overlaps(o path) bool {
+	for i := 0; i < len(p) && i < len(o); i++ {
+		if p[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type operandKind int
+
+const (
+	operandPath operandKind = iota
+	operandValue
+	operandSize
+	operandListAppend
+	operandIfNotExists
+	operandPlus
+	operandMinus
+)
+
+// operand is a value of an expression.
+type operand struct {
+	kind  operandKind
+	path  path
+	value *dynamodb.AttributeValue
+	args  []*operand
+}
+
+type conditionKind int
+
+const (
+	conditionAnd conditionKind = iota
+	conditionOr
+	conditionNot
+	conditionCompare
+	conditionBetween
+	conditionIn
+	conditionFunction
+)
+
+// condition is a condition, filter or key condition expression.
+type condition struct {
+	kind     conditionKind
+	op       string
+	children []*condition
+	operands []*operand
+}
+
+type actionKind int
+
+const (
+	actionSet actionKind = iota
+	actionRemove
+	actionAdd
+	actionDelete
+)
+
+// action is a single action of an update expression.
+type action struct {
+	kind  actionKind
+	path  path
+	value *operand
+}
+
+// parser parses the expressions of a single request. It resolves expression attribute names and values and records
+// which of them are used, since DynamoDB rejects requests with unused names or values.
+type parser struct {
+	tokens []token
+	pos    int
+	expr   string
+
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newParser(names map[string]*string, values map[string]*dynamodb.AttributeValue) *parser {
+	return &parser{
+		names:      names,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}
+}
+
+// checkUnused returns an error if an expression attribute name or value is not used by any parsed expression.
+func (p *parser) checkUnused() error {
+	for n := range p.names {
+		if !p.usedNames[n] {
+			return validationError("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", n)
+		}
+	}
+	for v := range p.values {
+		if !p.usedValues[v] {
+			return validationError("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", v)
+		}
+	}
+	return nil
+}
+
+func (p *parser) reset(expr string) error {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return err
+	}
+	p.tokens, p.pos, p.expr = tokens, 0, expr
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) syntaxError(t token) error {
+	if t.kind == tokenEOF {
+		return validationError("Invalid expression: unexpected end of expression %q", p.expr)
+	}
+	return validationError("Invalid expression: syntax error; token: %q, expression: %q", t.text, p.expr)
+}
+
+func (p *parser) expectSymbol(s string) error {
+	if t := p.next(); t.kind != tokenSymbol || t.text != s {
+		return p.syntaxError(t)
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(s string) bool {
+	if t := p.peek(); t.kind == tokenSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptKeyword(k string) bool {
+	if t := p.peek(); t.kind == tokenIdent && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) end() error {
+	if t := p.peek(); t.kind != tokenEOF {
+		return p.syntaxError(t)
+	}
+	return nil
+}
+
+// parsePathElement parses an attribute name or an expression attribute name.
+func (p *parser) parsePathElement() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		return t.text, nil
+	case tokenName:
+		n, ok := p.names[t.text]
+		if !ok || n == nil {
+			return "", validationError("An expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+		}
+		p.usedNames[t.text] = true
+		return *n, nil
+	default:
+		return "", p.syntaxError(t)
+	}
+}
+
+func (p *parser) parsePath() (path, error) {
+	name, err := p.parsePathElement()
+	if err != nil {
+		return nil, err
+	}
+	pth := path{{name: name}}
+	for {
+		switch {
+		case p.acceptSymbol("."):
+			name, err := p.parsePathElement()
+			if err != nil {
+				return nil, err
+			}
+			pth = append(pth, pathElement{name: name})
+		case p.acceptSymbol("["):
+			t := p.next()
+			if t.kind != tokenNumber {
+				return nil, p.syntaxError(t)
+			}
+			i, err := strconv.Atoi(t.text)
+			if err != nil {
+				return nil, p.syntaxError(t)
+			}
+			if err := p.expectSymbol("]"); err != nil {
+				return nil, err
+			}
+			pth = append(pth, pathElement{index: i, isIndex: true})
+		default:
+			return pth, nil
+		}
+	}
+}
+
+func (p *parser) parseValue() (*operand, error) {
+	t := p.next()
+	v, ok := p.values[t.text]
+	if !ok || v == nil {
+		return nil, validationError("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+	}
+	p.usedValues[t.text] = true
+	return &operand{kind: operandValue, value: v}, nil
+}
+
+// parseArgs parses the parenthesized arguments of a function.
+func (p *parser) parseArgs(parse func() (*operand, error)) ([]*operand, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	args := []*operand{}
+	for {
+		arg, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// parseOperand parses a path, a value or a size function of a condition.
+func (p *parser) parseOperand() (*operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenValue:
+		return p.parseValue()
+	case t.kind == tokenIdent && t.text == "size" && p.tokens[p.pos+1].text == "(":
+		p.next()
+		args, err := p.parseArgs(p.parsePathOperand)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, validationError("Invalid expression: incorrect number of operands for function size")
+		}
+		return &operand{kind: operandSize, args: args}, nil
+	default:
+		return p.parsePathOperand()
+	}
+}
+
+func (p *parser) parsePathOperand() (*operand, error) {
+	pth, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return &operand{kind: operandPath, path: pth}, nil
+}
+
+// parseCondition parses a condition expression.
+func (p *parser) parseCondition(expr string) (*condition, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	return c, p.end()
+}
+
+func (p *parser) parseOr() (*condition, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		c = &condition{kind: conditionOr, children: []*condition{c, right}}
+	}
+	return c, nil
+}
+
+func (p *parser) parseAnd() (*condition, error) {
+	c, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		c = &condition{kind: conditionAnd, children: []*condition{c, right}}
+	}
+	return c, nil
+}
+
+func (p *parser) parseNot() (*condition, error) {
+	if p.acceptKeyword("NOT") {
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: conditionNot, children: []*condition{c}}, nil
+	}
+	return p.parsePrimary()
+}
+
+// conditionFunctions are the functions of conditions with their number of arguments.
+var conditionFunctions = map[string]int{
+	"attribute_exists":     1,
+	"attribute_not_exists": 1,
+	"attribute_type":       2,
+	"begins_with":          2,
+	"contains":             2,
+}
+
+var comparators = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parsePrimary() (*condition, error) {
+	if p.acceptSymbol("(") {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expectSymbol(")")
+	}
+
+	if t := p.peek(); t.kind == tokenIdent && p.tokens[p.pos+1].text == "(" {
+		if n, ok := conditionFunctions[t.text]; ok {
+			p.next()
+			args, err := p.parseArgs(p.parseOperand)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != n {
+				return nil, validationError("Invalid expression: incorrect number of operands for function %s", t.text)
+			}
+			if args[0].kind != operandPath {
+				return nil, validationError("Invalid expression: the first operand of function %s must be a document path", t.text)
+			}
+			return &condition{kind: conditionFunction, op: t.text, operands: args}, nil
+		}
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.peek(); {
+	case t.kind == tokenSymbol && comparators[t.text]:
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: conditionCompare, op: t.text, operands: []*operand{left, right}}, nil
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptKeyword("AND") {
+			return nil, p.syntaxError(p.peek())
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: conditionBetween, operands: []*operand{left, low, high}}, nil
+	case p.acceptKeyword("IN"):
+		args, err := p.parseArgs(p.parseOperand)
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: conditionIn, operands: append([]*operand{left}, args...)}, nil
+	default:
+		return nil, p.syntaxError(t)
+	}
+}
+
+// parseUpdate parses an update expression.
+func (p *parser) parseUpdate(expr string) ([]action, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	clauses := map[string]bool{}
+	actions := []action{}
+	for p.peek().kind != tokenEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokenIdent {
+			return nil, p.syntaxError(t)
+		}
+		if clauses[clause] {
+			return nil, validationError("Invalid UpdateExpression: The \"%s\" section can only be used once in an update expression", clause)
+		}
+		clauses[clause] = true
+
+		for {
+			pth, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			a := action{path: pth}
+			switch clause {
+			case "SET":
+				a.kind = actionSet
+				if err := p.expectSymbol("="); err != nil {
+					return nil, err
+				}
+				if a.value, err = p.parseSetValue(); err != nil {
+					return nil, err
+				}
+			case "REMOVE":
+				a.kind = actionRemove
+			case "ADD", "DELETE":
+				a.kind = actionAdd
+				if clause == "DELETE" {
+					a.kind = actionDelete
+				}
+				if t := p.peek(); t.kind != tokenValue {
+					return nil, p.syntaxError(t)
+				}
+				if a.value, err = p.parseValue(); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, p.syntaxError(t)
+			}
+			actions = append(actions, a)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if len(actions) == 0 {
+		return nil, validationError("Invalid UpdateExpression: The expression can not be empty")
+	}
+	for i := range actions {
+		for j := i + 1; j < len(actions); j++ {
+			if actions[i].path.overlaps(actions[j].path) {
+				return nil, validationError("Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [%s], path two: [%s]", actions[i].path, actions[j].path)
+			}
+		}
+	}
+	return actions, nil
+}
+
+// parseSetValue parses the value of a SET action, which may add or subtract two operands.
+func (p *parser) parseSetValue() (*operand, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.acceptSymbol("+"):
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{kind: operandPlus, args: []*operand{left, right}}, nil
+	case p.acceptSymbol("-"):
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{kind: operandMinus, args: []*operand{left, right}}, nil
+	default:
+		return left, nil
+	}
+}
+
+func (p *parser) parseSetOperand() (*operand, error) {
+	t := p.peek()
+	if t.kind == tokenValue {
+		return p.parseValue()
+	}
+	if t.kind == tokenIdent && p.tokens[p.pos+1].text == "(" {
+		switch t.text {
+		case "list_append":
+			p.next()
+			args, err := p.parseArgs(p.parseSetOperand)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 {
+				return nil, validationError("Invalid UpdateExpression: Incorrect number of operands for operator or function; operator or function: list_append")
+			}
+			return &operand{kind: operandListAppend, args: args}, nil
+		case "if_not_exists":
+			p.next()
+			args, err := p.parseArgs(p.parseSetOperand)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 || args[0].kind != operandPath {
+				return nil, validationError("Invalid UpdateExpression: Incorrect operands for operator or function; operator or function: if_not_exists")
+			}
+			return &operand{kind: operandIfNotExists, args: args}, nil
+		default:
+			return nil, validationError("Invalid UpdateExpression: Invalid function name; function: %s", t.text)
+		}
+	}
+	return p.parsePathOperand()
+}
+
+// parseProjection parses a projection expression.
+func (p *parser) parseProjection(expr string) ([]path, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+	paths := []path{}
+	for {
+		pth, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, pth)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return paths, p.end()
+}
@@ -0,0 +1,811 @@
+package memdynamo
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// errConditionFailed signals a failed condition expression of a write.
+var errConditionFailed = errors.New("memdynamo: condition failed")
+
+// encodeKeyValue returns a string that identifies a key value of type S, N or B.
+func encodeKeyValue(v *dynamodb.AttributeValue) string {
+	switch valueType(v) {
+	case typeS:
+		return typeS + *v.S
+	case typeN:
+		if r, err := parseNumber(*v.N); err == nil {
+			return typeN + formatNumber(r)
+		}
+		return typeN + *v.N
+	default:
+		return typeB + base64.StdEncoding.EncodeToString(v.B)
+	}
+}
+
+// keyValue returns the encoded value of a key attribute of an item.
+func (t *table) keyValue(it item, name string) (string, error) {
+	v, ok := it[name]
+	if !ok || v == nil {
+		return "", validationError("One or more parameter values were invalid: Missing the key %s in the item", name)
+	}
+	if typ := valueType(v); typ != t.attributeDefinitions[name] {
+		return "", validationError("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, t.attributeDefinitions[name], typ)
+	}
+	return encodeKeyValue(v), nil
+}
+
+// itemKey returns the encoded primary key of an item.
+func (t *table) itemKey(it item) (string, error) {
+	h, err := t.keyValue(it, t.hashKey)
+	if err != nil {
+		return "", err
+	}
+	if t.rangeKey == "" {
+		return h, nil
+	}
+	r, err := t.keyValue(it, t.rangeKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s%s", len(h), h, r), nil
+}
+
+// checkKey returns the encoded primary key of a key, which must only contain the key attributes.
+func (t *table) checkKey(key item) (string, error) {
+	n := 1
+	if t.rangeKey != "" {
+		n = 2
+	}
+	if len(key) != n {
+		return "", validationError("The provided key element does not match the schema")
+	}
+	return t.itemKey(key)
+}
+
+// primaryKey returns the key attributes of an item.
+func (t *table) primaryKey(it item) item {
+	key := item{t.hashKey: copyValue(it[t.hashKey])}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = copyValue(it[t.rangeKey])
+	}
+	return key
+}
+
+// validateIndexKeys checks the types of the index keys of an item. Items without the keys of an index are not part
+// of the index.
+func (t *table) validateIndexKeys(it item) error {
+	for _, i := range t.indexes {
+		for _, k := range []string{i.hashKey, i.rangeKey} {
+			v, ok := it[k]
+			if k == "" || !ok {
+				continue
+			}
+			if typ := valueType(v); typ != t.attributeDefinitions[k] {
+				return validationError("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s", k, t.attributeDefinitions[k], typ, i.name)
+			}
+		}
+	}
+	return nil
+}
+
+// write is a single modification of an item that is evaluated before it is stored.
+type write struct {
+	table     *table
+	key       string
+	keyItem   item
+	put       item
+	actions   []action
+	delete    bool
+	condition *condition
+	// Top level attributes modified by the actions
+	updated map[string]bool
+}
+
+// expressions contains the expressions of a write request.
+type expressions struct {
+	condition *string
+	update    *string
+	names     map[string]*string
+	values    map[string]*dynamodb.AttributeValue
+}
+
+func optionalExpression(name string, expr *string) error {
+	if expr != nil && strings.TrimSpace(*expr) == "" {
+		return validationError("Invalid %s: The expression can not be empty", name)
+	}
+	return nil
+}
+
+// parse parses the expressions of a write request.
+func (w *write) parse(e expressions) error {
+	for _, v := range e.values {
+		if err := validateValue(v); err != nil {
+			return err
+		}
+	}
+	if err := optionalExpression("ConditionExpression", e.condition); err != nil {
+		return err
+	}
+	if err := optionalExpression("UpdateExpression", e.update); err != nil {
+		return err
+	}
+
+	p := newParser(e.names, e.values)
+	if e.condition != nil {
+		c, err := p.parseCondition(*e.condition)
+		if err != nil {
+			return err
+		}
+		w.condition = c
+	}
+	if e.update != nil {
+		actions, err := p.parseUpdate(*e.update)
+		if err != nil {
+			return err
+		}
+		w.updated = make(map[string]bool)
+		for _, a := range actions {
+			name := a.path[0].name
+			if name == w.table.hashKey || name == w.table.rangeKey {
+				return validationError("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+			}
+			w.updated[name] = true
+		}
+		w.actions = actions
+	}
+	return p.checkUnused()
+}
+
+// newWrite returns a write of an item of a table.
+func (db *DB) newWrite(tableName *string, key item, e expressions) (*write, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	w := &write{table: t}
+	if w.key, err = t.checkKey(key); err != nil {
+		return nil, err
+	}
+	w.keyItem = t.primaryKey(key)
+	return w, w.parse(e)
+}
+
+func (db *DB) newPut(tableName *string, it item, e expressions) (*write, error) {
+	t, err := db.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateItem(it); err != nil {
+		return nil, err
+	}
+	w := &write{table: t, put: copyItem(it)}
+	if w.key, err = t.itemKey(it); err != nil {
+		return nil, err
+	}
+	if err := t.validateIndexKeys(it); err != nil {
+		return nil, err
+	}
+	return w, w.parse(e)
+}
+
+// evaluate returns the current item and the item after the write, or errConditionFailed.
+func (w *write) evaluate() (old, updated item, err error) {
+	old = w.table.items[w.key]
+	if w.condition != nil {
+		doc := old
+		if doc == nil {
+			doc = item{}
+		}
+		ok, err := w.condition.eval(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return old, nil, errConditionFailed
+		}
+	}
+
+	switch {
+	case w.delete:
+		return old, nil, nil
+	case w.put != nil:
+		return old, w.put, nil
+	case w.updated != nil:
+		// Updates create missing items from their key attributes.
+		updated = copyItem(old)
+		if updated == nil {
+			updated = copyItem(w.keyItem)
+		}
+		if err := apply(updated, w.actions); err != nil {
+			return nil, nil, err
+		}
+		if err := w.table.validateIndexKeys(updated); err != nil {
+			return nil, nil, err
+		}
+		return old, updated, nil
+	default:
+		// Condition checks do not modify the item.
+		return old, old, nil
+	}
+}
+
+// store stores the item after the write.
+func (w *write) store(updated item) {
+	if updated == nil {
+		delete(w.table.items, w.key)
+		return
+	}
+	w.table.items[w.key] = updated
+}
+
+// returnValues returns the attributes selected by the ReturnValues parameter of a write.
+func (w *write) returnValues(returnValues *string, old, updated item) (item, error) {
+	switch aws.StringValue(returnValues) {
+	case "", dynamodb.ReturnValueNone:
+		return nil, nil
+	case dynamodb.ReturnValueAllOld:
+		return copyItem(old), nil
+	case dynamodb.ReturnValueAllNew:
+		if w.updated == nil {
+			break
+		}
+		return copyItem(updated), nil
+	case dynamodb.ReturnValueUpdatedOld, dynamodb.ReturnValueUpdatedNew:
+		if w.updated == nil {
+			break
+		}
+		from := old
+		if aws.StringValue(returnValues) == dynamodb.ReturnValueUpdatedNew {
+			from = updated
+		}
+		out := item{}
+		for name := range w.updated {
+			if v, ok := from[name]; ok {
+				out[name] = copyValue(v)
+			}
+		}
+		return out, nil
+	}
+	return nil, validationError("Return values set to invalid value: %s", aws.StringValue(returnValues))
+}
+
+// PutItemWithContext creates or replaces an item.
+func (db *DB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	w, err := db.newPut(in.TableName, in.Item, expressions{
+		condition: in.ConditionExpression,
+		names:     in.ExpressionAttributeNames,
+		values:    in.ExpressionAttributeValues,
+	})
+	if err != nil {
+		return nil, err
+	}
+	old, updated, err := w.evaluate()
+	if err == errConditionFailed {
+		return nil, conditionalCheckFailed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := w.returnValues(in.ReturnValues, old, updated)
+	if err != nil {
+		return nil, err
+	}
+	w.store(updated)
+	return &dynamodb.PutItemOutput{Attributes: attributes}, nil
+}
+
+// PutItem calls PutItemWithContext with a background context.
+func (db *DB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return db.PutItemWithContext(aws.BackgroundContext(), in)
+}
+
+// GetItemWithContext returns an item. The output has no item if it does not exist.
+func (db *DB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.checkKey(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	var projection []path
+	p := newParser(in.ExpressionAttributeNames, nil)
+	if in.ProjectionExpression != nil {
+		if projection, err = p.parseProjection(*in.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	it, ok := t.items[key]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(project(it, projection))}, nil
+}
+
+// GetItem calls GetItemWithContext with a background context.
+func (db *DB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return db.GetItemWithContext(aws.BackgroundContext(), in)
+}
+
+// maxBatchGetKeys is the maximum number of keys of a BatchGetItem request.
+const maxBatchGetKeys = 100
+
+// BatchGetItemWithContext returns the items of the requested keys of one or more tables. Items that do not exist are
+// left out of the responses, and all keys are processed at once.
+func (db *DB) BatchGetItemWithContext(ctx aws.Context, in *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for _, ka := range in.RequestItems {
+		n += len(ka.Keys)
+	}
+	if n == 0 || n > maxBatchGetKeys {
+		return nil, validationError("a BatchGetItem request must contain between 1 and %d keys, got %d", maxBatchGetKeys, n)
+	}
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue, len(in.RequestItems)),
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}
+	for name, ka := range in.RequestItems {
+		t, err := db.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		var projection []path
+		p := newParser(ka.ExpressionAttributeNames, nil)
+		if ka.ProjectionExpression != nil {
+			if projection, err = p.parseProjection(*ka.ProjectionExpression); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.checkUnused(); err != nil {
+			return nil, err
+		}
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, k := range ka.Keys {
+			key, err := t.checkKey(k)
+			if err != nil {
+				return nil, err
+			}
+			if it, ok := t.items[key]; ok {
+				items = append(items, copyItem(project(it, projection)))
+			}
+		}
+		out.Responses[name] = items
+	}
+	return out, nil
+}
+
+// BatchGetItem calls BatchGetItemWithContext with a background context.
+func (db *DB) BatchGetItem(in *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return db.BatchGetItemWithContext(aws.BackgroundContext(), in)
+}
+
+// UpdateItemWithContext modifies an item, or creates it if it does not exist.
+func (db *DB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	w, err := db.newWrite(in.TableName, in.Key, expressions{
+		condition: in.ConditionExpression,
+		update:    in.UpdateExpression,
+		names:     in.ExpressionAttributeNames,
+		values:    in.ExpressionAttributeValues,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if w.updated == nil {
+		w.updated = make(map[string]bool)
+	}
+	old, updated, err := w.evaluate()
+	if err == errConditionFailed {
+		return nil, conditionalCheckFailed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := w.returnValues(in.ReturnValues, old, updated)
+	if err != nil {
+		return nil, err
+	}
+	w.store(updated)
+	return &dynamodb.UpdateItemOutput{Attributes: attributes}, nil
+}
+
+// UpdateItem calls UpdateItemWithContext with a background context.
+func (db *DB) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return db.UpdateItemWithContext(aws.BackgroundContext(), in)
+}
+
+// DeleteItemWithContext deletes an item. Deleting an item that does not exist succeeds.
+func (db *DB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	w, err := db.newWrite(in.TableName, in.Key, expressions{
+		condition: in.ConditionExpression,
+		names:     in.ExpressionAttributeNames,
+		values:    in.ExpressionAttributeValues,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.delete = true
+	old, _, err := w.evaluate()
+	if err == errConditionFailed {
+		return nil, conditionalCheckFailed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := w.returnValues(in.ReturnValues, old, nil)
+	if err != nil {
+		return nil, err
+	}
+	w.store(nil)
+	return &dynamodb.DeleteItemOutput{Attributes: attributes}, nil
+}
+
+// DeleteItem calls DeleteItemWithContext with a background context.
+func (db *DB) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return db.DeleteItemWithContext(aws.BackgroundContext(), in)
+}
+
+// TransactWriteItemsWithContext applies all writes atomically, or none of them if a condition fails.
+// Calls with a client request token that has already been applied succeed without applying the writes again.
+func (db *DB) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	token := aws.StringValue(in.ClientRequestToken)
+	if token != "" && db.tokens[token] {
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}
+	if len(in.TransactItems) == 0 || len(in.TransactItems) > 100 {
+		return nil, validationError("Member must have length less than or equal to 100 and greater than or equal to 1")
+	}
+
+	writes := make([]*write, len(in.TransactItems))
+	seen := make(map[string]bool)
+	for i, ti := range in.TransactItems {
+		w, err := db.transactWrite(ti)
+		if err != nil {
+			return nil, err
+		}
+		id := w.table.name + "\x00" + w.key
+		if seen[id] {
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[id] = true
+		writes[i] = w
+	}
+
+	updated := make([]item, len(writes))
+	reasons := make([]*dynamodb.CancellationReason, len(writes))
+	codes := make([]string, len(writes))
+	cancelled := false
+	for i, w := range writes {
+		_, u, err := w.evaluate()
+		switch {
+		case err == errConditionFailed:
+			cancelled = true
+			codes[i] = "ConditionalCheckFailed"
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String(codes[i]), Message: aws.String("The conditional request failed")}
+		case err != nil:
+			return nil, err
+		default:
+			codes[i] = "None"
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String(codes[i])}
+		}
+		updated[i] = u
+	}
+	if cancelled {
+		return nil, &dynamodb.TransactionCanceledException{
+			RespMetadata:        responseMetadata(),
+			Message_:            aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for i, w := range writes {
+		w.store(updated[i])
+	}
+	if token != "" {
+		db.tokens[token] = true
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// TransactWriteItems calls TransactWriteItemsWithContext with a background context.
+func (db *DB) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return db.TransactWriteItemsWithContext(aws.BackgroundContext(), in)
+}
+
+func (db *DB) transactWrite(ti *dynamodb.TransactWriteItem) (*write, error) {
+	switch {
+	case ti.ConditionCheck != nil:
+		c := ti.ConditionCheck
+		if c.ConditionExpression == nil {
+			return nil, validationError("ConditionExpression of ConditionCheck must be specified")
+		}
+		return db.newWrite(c.TableName, c.Key, expressions{
+			condition: c.ConditionExpression,
+			names:     c.ExpressionAttributeNames,
+			values:    c.ExpressionAttributeValues,
+		})
+	case ti.Put != nil:
+		return db.newPut(ti.Put.TableName, ti.Put.Item, expressions{
+			condition: ti.Put.ConditionExpression,
+			names:     ti.Put.ExpressionAttributeNames,
+			values:    ti.Put.ExpressionAttributeValues,
+		})
+	case ti.Update != nil:
+		u := ti.Update
+		if u.UpdateExpression == nil {
+			return nil, validationError("UpdateExpression of Update must be specified")
+		}
+		return db.newWrite(u.TableName, u.Key, expressions{
+			condition: u.ConditionExpression,
+			update:    u.UpdateExpression,
+			names:     u.ExpressionAttributeNames,
+			values:    u.ExpressionAttributeValues,
+		})
+	case ti.Delete != nil:
+		w, err := db.newWrite(ti.Delete.TableName, ti.Delete.Key, expressions{
+			condition: ti.Delete.ConditionExpression,
+			names:     ti.Delete.ExpressionAttributeNames,
+			values:    ti.Delete.ExpressionAttributeValues,
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.delete = true
+		return w, nil
+	default:
+		return nil, validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+	}
+}
+
+// QueryWithContext returns the items of a table or a global secondary index that match a key condition,
+// ordered by their range key.
+func (db *DB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	var idx *index
+	hashKey, rangeKey := t.hashKey, t.rangeKey
+	if in.IndexName != nil {
+		if _, idx = t.findIndex(aws.StringValue(in.IndexName)); idx == nil {
+			return nil, validationError("The table does not have the specified index: %s", aws.StringValue(in.IndexName))
+		}
+		hashKey, rangeKey = idx.hashKey, idx.rangeKey
+	}
+
+	if in.KeyConditionExpression == nil {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request")
+	}
+	for _, v := range in.ExpressionAttributeValues {
+		if err := validateValue(v); err != nil {
+			return nil, err
+		}
+	}
+	p := newParser(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	keyCondition, err := p.parseCondition(*in.KeyConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateKeyCondition(keyCondition, hashKey, rangeKey); err != nil {
+		return nil, err
+	}
+	var filter *condition
+	if in.FilterExpression != nil {
+		if filter, err = p.parseCondition(*in.FilterExpression); err != nil {
+			return nil, err
+		}
+	}
+	var projection []path
+	if in.ProjectionExpression != nil {
+		if projection, err = p.parseProjection(*in.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	matches := []item{}
+	for _, it := range t.items {
+		if _, ok := it[hashKey]; !ok {
+			continue
+		}
+		if _, ok := it[rangeKey]; rangeKey != "" && !ok {
+			continue
+		}
+		ok, err := keyCondition.eval(it)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, it)
+		}
+	}
+	before := func(a, b item) bool {
+		if rangeKey != "" {
+			if cmp, _ := compareScalars(a[rangeKey], b[rangeKey]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		ka, _ := t.itemKey(a)
+		kb, _ := t.itemKey(b)
+		return ka < kb
+	}
+	forward := in.ScanIndexForward == nil || *in.ScanIndexForward
+	sort.Slice(matches, func(i, j int) bool {
+		if forward {
+			return before(matches[i], matches[j])
+		}
+		return before(matches[j], matches[i])
+	})
+
+	if len(in.ExclusiveStartKey) > 0 {
+		start := in.ExclusiveStartKey
+		n := sort.Search(len(matches), func(i int) bool {
+			if forward {
+				return before(start, matches[i])
+			}
+			return before(matches[i], start)
+		})
+		matches = matches[n:]
+	}
+
+	out := &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+	limit := len(matches)
+	if in.Limit != nil && int(*in.Limit) < limit {
+		limit = int(*in.Limit)
+	}
+	for _, it := range matches[:limit] {
+		if filter != nil {
+			ok, err := filter.eval(it)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if aws.StringValue(in.Select) != dynamodb.SelectCount {
+			out.Items = append(out.Items, copyItem(project(t.indexProjection(idx, it), projection)))
+		}
+		out.Count = aws.Int64(aws.Int64Value(out.Count) + 1)
+	}
+	out.ScannedCount = aws.Int64(int64(limit))
+	if out.Count == nil {
+		out.Count = aws.Int64(0)
+	}
+	if limit < len(matches) {
+		last := matches[limit-1]
+		out.LastEvaluatedKey = t.primaryKey(last)
+		if idx != nil {
+			out.LastEvaluatedKey[idx.hashKey] = copyValue(last[idx.hashKey])
+			if idx.rangeKey != "" {
+				out.LastEvaluatedKey[idx.rangeKey] = copyValue(last[idx.rangeKey])
+			}
+		}
+	}
+	return out, nil
+}
+
+// Query calls QueryWithContext with a background context.
+func (db *DB) Query(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return db.QueryWithContext(aws.BackgroundContext(), in)
+}
+
+// indexProjection returns the attributes of an item projected into an index.
+func (t *table) indexProjection(idx *index, it item) item {
+	if idx == nil || aws.StringValue(idx.projection.ProjectionType) == dynamodb.ProjectionTypeAll {
+		return it
+	}
+	out := t.primaryKey(it)
+	attributes := []string{idx.hashKey, idx.rangeKey}
+	if aws.StringValue(idx.projection.ProjectionType) == dynamodb.ProjectionTypeInclude {
+		attributes = append(attributes, aws.StringValueSlice(idx.projection.NonKeyAttributes)...)
+	}
+	for _, a := range attributes {
+		if v, ok := it[a]; ok {
+			out[a] = v
+		}
+	}
+	return out
+}
+
+// validateKeyCondition checks that a key condition selects a single partition of the hash key and has at most one
+// condition on the range key.
+func validateKeyCondition(c *condition, hashKey, rangeKey string) error {
+	conditions := []*condition{c}
+	if c.kind == conditionAnd {
+		conditions = c.children
+	}
+	hash, rng := false, false
+	for _, kc := range conditions {
+		name, ok := keyConditionAttribute(kc)
+		switch {
+		case !ok:
+			return validationError("Query key condition not supported")
+		case name == hashKey && !hash && kc.kind == conditionCompare && kc.op == "=":
+			hash = true
+		case name == rangeKey && rangeKey != "" && !rng && kc.kind != conditionIn && kc.op != "<>" && kc.op != "attribute_exists" && kc.op != "attribute_not_exists" && kc.op != "contains" && kc.op != "attribute_type":
+			rng = true
+		default:
+			return validationError("Query key condition not supported")
+		}
+	}
+	if !hash {
+		return validationError("Query condition missed key schema element: %s", hashKey)
+	}
+	return nil
+}
+
+// keyConditionAttribute returns the key attribute of a comparison, BETWEEN or begins_with condition whose other
+// operands are values.
+func keyConditionAttribute(c *condition) (string, bool) {
+	switch c.kind {
+	case conditionCompare, conditionBetween, conditionFunction:
+	default:
+		return "", false
+	}
+	if c.operands[0].kind != operandPath || len(c.operands[0].path) != 1 {
+		return "", false
+	}
+	for _, o := range c.operands[1:] {
+		if o.kind != operandValue {
+			return "", false
+		}
+	}
+	return c.operands[0].path[0].name, true
+}
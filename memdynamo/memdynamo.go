@@ -0,0 +1,466 @@
+// Package memdynamo provides an in-process, in-memory implementation of the DynamoDB API for tests.
+//
+// A DB supports the operations and the expression subset used by dtpc.TransactionStore, dtpc.EnsureTables and
+// example.HandlerImpl:
+//   - CreateTable, DescribeTable, UpdateTable to add or delete global secondary indexes, and DeleteTable;
+//   - PutItem, GetItem, UpdateItem, DeleteItem and TransactWriteItems with condition expressions, and BatchGetItem;
+//   - Query of tables and global secondary indexes with key condition, filter and projection expressions,
+//     Limit, ScanIndexForward and pagination;
+//   - update expressions with SET, including arithmetic, list_append and if_not_exists, REMOVE of attributes
+//     and list elements, ADD and DELETE.
+//
+// Like DynamoDB, a DB rejects literals in expressions, unused expression attribute names and values, and updates of
+// key attributes, and returns the error types of the SDK, e.g. *dynamodb.ConditionalCheckFailedException.
+// Tables are active as soon as they have been created. Reserved words, capacity limits and item size limits are not
+// checked. Other operations of dynamodbiface.DynamoDBAPI are not supported and panic.
+package memdynamo
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// ErrCodeValidationException is the error code of requests rejected as invalid.
+const ErrCodeValidationException = "ValidationException"
+
+// DB is an in-memory DynamoDB. It is safe for concurrent use.
+type DB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]*table
+	// Client request tokens of applied TransactWriteItems calls
+	tokens map[string]bool
+}
+
+// New returns an empty DB.
+func New() *DB {
+	return &DB{
+		tables: make(map[string]*table),
+		tokens: make(map[string]bool),
+	}
+}
+
+// table is a table with its global secondary indexes.
+type table struct {
+	name                 string
+	created              time.Time
+	attributeDefinitions map[string]string
+	keySchema            []*dynamodb.KeySchemaElement
+	hashKey, rangeKey    string
+	billingMode          string
+	throughput           *dynamodb.ProvisionedThroughput
+	indexes              []*index
+	// Items by their encoded primary key
+	items map[string]item
+}
+
+// index is a global secondary index. Its items are derived from the items of the table on every query.
+type index struct {
+	name              string
+	keySchema         []*dynamodb.KeySchemaElement
+	hashKey, rangeKey string
+	projection        *dynamodb.Projection
+	throughput        *dynamodb.ProvisionedThroughput
+}
+
+func validationError(format string, args ...interface{}) error {
+	return awserr.NewRequestFailure(awserr.New(ErrCodeValidationException, fmt.Sprintf(format, args...), nil), http.StatusBadRequest, "")
+}
+
+func responseMetadata() protocol.ResponseMetadata {
+	return protocol.ResponseMetadata{StatusCode: http.StatusBadRequest}
+}
+
+func conditionalCheckFailed() error {
+	return &dynamodb.ConditionalCheckFailedException{
+		RespMetadata: responseMetadata(),
+		Message_:     aws.String("The conditional request failed"),
+	}
+}
+
+func resourceNotFound(tableName string) error {
+	return &dynamodb.ResourceNotFoundException{
+		RespMetadata: responseMetadata(),
+		Message_:     aws.String(fmt.Sprintf("Requested resource not found: Table: %s not found", tableName)),
+	}
+}
+
+func resourceInUse(tableName string) error {
+	return &dynamodb.ResourceInUseException{
+		RespMetadata: responseMetadata(),
+		Message_:     aws.String(fmt.Sprintf("Table already exists: %s", tableName)),
+	}
+}
+
+// table returns the table with the given name. db.mu must be held.
+func (db *DB) table(name *string) (*table, error) {
+	t, ok := db.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, resourceNotFound(aws.StringValue(name))
+	}
+	return t, nil
+}
+
+// keys returns the names of the hash and range key of a key schema.
+func keys(schema []*dynamodb.KeySchemaElement) (hashKey, rangeKey string, err error) {
+	for _, k := range schema {
+		switch aws.StringValue(k.KeyType) {
+		case dynamodb.KeyTypeHash:
+			if hashKey != "" {
+				return "", "", validationError("Invalid KeySchema: Too many hash keys")
+			}
+			hashKey = aws.StringValue(k.AttributeName)
+		case dynamodb.KeyTypeRange:
+			if rangeKey != "" {
+				return "", "", validationError("Invalid KeySchema: Too many range keys")
+			}
+			rangeKey = aws.StringValue(k.AttributeName)
+		default:
+			return "", "", validationError("Invalid KeySchema: Invalid KeyType %q", aws.StringValue(k.KeyType))
+		}
+	}
+	if hashKey == "" {
+		return "", "", validationError("Invalid KeySchema: No Hash Key specified")
+	}
+	return hashKey, rangeKey, nil
+}
+
+func newIndex(name *string, schema []*dynamodb.KeySchemaElement, projection *dynamodb.Projection, throughput *dynamodb.ProvisionedThroughput, attributes map[string]string) (*index, error) {
+	hashKey, rangeKey, err := keys(schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{hashKey, rangeKey} {
+		if _, ok := attributes[k]; k != "" && !ok {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions. Keys: [%s], AttributeDefinitions: %v", k, attributes)
+		}
+	}
+	if projection == nil || projection.ProjectionType == nil {
+		return nil, validationError("One or more parameter values were invalid: Projection of index %s is missing", aws.StringValue(name))
+	}
+	return &index{
+		name:       aws.StringValue(name),
+		keySchema:  schema,
+		hashKey:    hashKey,
+		rangeKey:   rangeKey,
+		projection: projection,
+		throughput: throughput,
+	}, nil
+}
+
+// validateAttributeDefinitions checks that every defined attribute is a key of the table or an index.
+func (t *table) validateAttributeDefinitions() error {
+	used := map[string]bool{t.hashKey: true, t.rangeKey: true}
+	for _, i := range t.indexes {
+		used[i.hashKey], used[i.rangeKey] = true, true
+	}
+	for a := range t.attributeDefinitions {
+		if !used[a] {
+			return validationError("One or more parameter values were invalid: Number of attributes in KeySchema does not exactly match number of attributes defined in AttributeDefinitions")
+		}
+	}
+	return nil
+}
+
+// pruneAttributeDefinitions removes the definitions of attributes that are no longer keys of the table or an index.
+func (t *table) pruneAttributeDefinitions() {
+	for a := range t.attributeDefinitions {
+		used := a == t.hashKey || a == t.rangeKey
+		for _, i := range t.indexes {
+			used = used || a == i.hashKey || a == i.rangeKey
+		}
+		if !used {
+			delete(t.attributeDefinitions, a)
+		}
+	}
+}
+
+func (t *table) findIndex(name string) (int, *index) {
+	for i, idx := range t.indexes {
+		if idx.name == name {
+			return i, idx
+		}
+	}
+	return -1, nil
+}
+
+func attributeDefinitions(defs []*dynamodb.AttributeDefinition) (map[string]string, error) {
+	out := make(map[string]string, len(defs))
+	for _, d := range defs {
+		t := aws.StringValue(d.AttributeType)
+		if t != typeS && t != typeN && t != typeB {
+			return nil, validationError("Invalid AttributeType %q of attribute %s", t, aws.StringValue(d.AttributeName))
+		}
+		out[aws.StringValue(d.AttributeName)] = t
+	}
+	return out, nil
+}
+
+func throughputRequired(billingMode string, throughput *dynamodb.ProvisionedThroughput) error {
+	if billingMode == dynamodb.BillingModeProvisioned && throughput == nil {
+		return validationError("One or more parameter values were invalid: ReadCapacityUnits and WriteCapacityUnits must both be specified when BillingMode is PROVISIONED")
+	}
+	if billingMode == dynamodb.BillingModePayPerRequest && throughput != nil {
+		return validationError("One or more parameter values were invalid: Neither ReadCapacityUnits nor WriteCapacityUnits can be specified when BillingMode is PAY_PER_REQUEST")
+	}
+	return nil
+}
+
+func (t *table) describe() *dynamodb.TableDescription {
+	defs := []*dynamodb.AttributeDefinition{}
+	for name, typ := range t.attributeDefinitions {
+		defs = append(defs, &dynamodb.AttributeDefinition{AttributeName: aws.String(name), AttributeType: aws.String(typ)})
+	}
+	desc := &dynamodb.TableDescription{
+		TableName:            aws.String(t.name),
+		TableArn:             aws.String("arn:aws:dynamodb:memdynamo:000000000000:table/" + t.name),
+		TableStatus:          aws.String(dynamodb.TableStatusActive),
+		CreationDateTime:     aws.Time(t.created),
+		AttributeDefinitions: defs,
+		KeySchema:            t.keySchema,
+		ItemCount:            aws.Int64(int64(len(t.items))),
+		BillingModeSummary:   &dynamodb.BillingModeSummary{BillingMode: aws.String(t.billingMode)},
+	}
+	if t.throughput != nil {
+		desc.ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  t.throughput.ReadCapacityUnits,
+			WriteCapacityUnits: t.throughput.WriteCapacityUnits,
+		}
+	}
+	for _, i := range t.indexes {
+		d := &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   aws.String(i.name),
+			IndexArn:    aws.String(aws.StringValue(desc.TableArn) + "/index/" + i.name),
+			IndexStatus: aws.String(dynamodb.IndexStatusActive),
+			KeySchema:   i.keySchema,
+			Projection:  i.projection,
+		}
+		if i.throughput != nil {
+			d.ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  i.throughput.ReadCapacityUnits,
+				WriteCapacityUnits: i.throughput.WriteCapacityUnits,
+			}
+		}
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, d)
+	}
+	return desc
+}
+
+// CreateTableWithContext creates an active table.
+func (db *DB) CreateTableWithContext(ctx aws.Context, in *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	name := aws.StringValue(in.TableName)
+	if name == "" {
+		return nil, validationError("TableName must not be empty")
+	}
+	if _, ok := db.tables[name]; ok {
+		return nil, resourceInUse(name)
+	}
+	defs, err := attributeDefinitions(in.AttributeDefinitions)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, rangeKey, err := keys(in.KeySchema)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{hashKey, rangeKey} {
+		if _, ok := defs[k]; k != "" && !ok {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions. Keys: [%s]", k)
+		}
+	}
+	billingMode := aws.StringValue(in.BillingMode)
+	if billingMode == "" {
+		billingMode = dynamodb.BillingModeProvisioned
+	}
+	if err := throughputRequired(billingMode, in.ProvisionedThroughput); err != nil {
+		return nil, err
+	}
+
+	t := &table{
+		name:                 name,
+		created:              time.Now(),
+		attributeDefinitions: defs,
+		keySchema:            in.KeySchema,
+		hashKey:              hashKey,
+		rangeKey:             rangeKey,
+		billingMode:          billingMode,
+		throughput:           in.ProvisionedThroughput,
+		items:                make(map[string]item),
+	}
+	for _, g := range in.GlobalSecondaryIndexes {
+		if _, existing := t.findIndex(aws.StringValue(g.IndexName)); existing != nil {
+			return nil, validationError("One or more parameter values were invalid: Duplicate index name: %s", aws.StringValue(g.IndexName))
+		}
+		if err := throughputRequired(billingMode, g.ProvisionedThroughput); err != nil {
+			return nil, err
+		}
+		i, err := newIndex(g.IndexName, g.KeySchema, g.Projection, g.ProvisionedThroughput, defs)
+		if err != nil {
+			return nil, err
+		}
+		t.indexes = append(t.indexes, i)
+	}
+	if err := t.validateAttributeDefinitions(); err != nil {
+		return nil, err
+	}
+
+	db.tables[name] = t
+	desc := t.describe()
+	desc.TableStatus = aws.String(dynamodb.TableStatusCreating)
+	return &dynamodb.CreateTableOutput{TableDescription: desc}, nil
+}
+
+// CreateTable calls CreateTableWithContext with a background context.
+func (db *DB) CreateTable(in *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	return db.CreateTableWithContext(aws.BackgroundContext(), in)
+}
+
+// DescribeTableWithContext describes a table and its indexes.
+func (db *DB) DescribeTableWithContext(ctx aws.Context, in *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: t.describe()}, nil
+}
+
+// DescribeTable calls DescribeTableWithContext with a background context.
+func (db *DB) DescribeTable(in *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return db.DescribeTableWithContext(aws.BackgroundContext(), in)
+}
+
+// UpdateTableWithContext changes the billing mode and the throughput of a table, or creates or deletes a global
+// secondary index. Like DynamoDB, a single call can only create or delete one index.
+func (db *DB) UpdateTableWithContext(ctx aws.Context, in *dynamodb.UpdateTableInput, opts ...request.Option) (*dynamodb.UpdateTableOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := attributeDefinitions(in.AttributeDefinitions)
+	if err != nil {
+		return nil, err
+	}
+	updated := *t
+	updated.attributeDefinitions = make(map[string]string)
+	for k, v := range t.attributeDefinitions {
+		updated.attributeDefinitions[k] = v
+	}
+	for k, v := range defs {
+		if existing, ok := t.attributeDefinitions[k]; ok && existing != v {
+			return nil, validationError("Cannot change the type of attribute %s", k)
+		}
+		updated.attributeDefinitions[k] = v
+	}
+	updated.indexes = append([]*index{}, t.indexes...)
+	if in.BillingMode != nil {
+		updated.billingMode = aws.StringValue(in.BillingMode)
+		updated.throughput = nil
+	}
+	if in.ProvisionedThroughput != nil {
+		updated.throughput = in.ProvisionedThroughput
+	}
+
+	changes := 0
+	for _, u := range in.GlobalSecondaryIndexUpdates {
+		switch {
+		case u.Create != nil:
+			changes++
+			if _, existing := updated.findIndex(aws.StringValue(u.Create.IndexName)); existing != nil {
+				return nil, validationError("Attempting to create an index which already exists: %s", aws.StringValue(u.Create.IndexName))
+			}
+			if err := throughputRequired(updated.billingMode, u.Create.ProvisionedThroughput); err != nil {
+				return nil, err
+			}
+			i, err := newIndex(u.Create.IndexName, u.Create.KeySchema, u.Create.Projection, u.Create.ProvisionedThroughput, updated.attributeDefinitions)
+			if err != nil {
+				return nil, err
+			}
+			updated.indexes = append(updated.indexes, i)
+		case u.Delete != nil:
+			changes++
+			n, _ := updated.findIndex(aws.StringValue(u.Delete.IndexName))
+			if n < 0 {
+				return nil, &dynamodb.ResourceNotFoundException{
+					RespMetadata: responseMetadata(),
+					Message_:     aws.String(fmt.Sprintf("Requested resource not found: Index: %s not found", aws.StringValue(u.Delete.IndexName))),
+				}
+			}
+			updated.indexes = append(updated.indexes[:n:n], updated.indexes[n+1:]...)
+			updated.pruneAttributeDefinitions()
+		case u.Update != nil:
+			_, i := updated.findIndex(aws.StringValue(u.Update.IndexName))
+			if i == nil {
+				return nil, validationError("Index %s does not exist", aws.StringValue(u.Update.IndexName))
+			}
+			c := *i
+			c.throughput = u.Update.ProvisionedThroughput
+			n, _ := updated.findIndex(i.name)
+			updated.indexes[n] = &c
+		}
+	}
+	if changes > 1 {
+		return nil, validationError("Subscriber limit exceeded: Only 1 online index can be created or deleted simultaneously per table")
+	}
+	if err := updated.validateAttributeDefinitions(); err != nil {
+		return nil, err
+	}
+
+	*t = updated
+	return &dynamodb.UpdateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// UpdateTable calls UpdateTableWithContext with a background context.
+func (db *DB) UpdateTable(in *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	return db.UpdateTableWithContext(aws.BackgroundContext(), in)
+}
+
+// DeleteTableWithContext deletes a table and all its items.
+func (db *DB) DeleteTableWithContext(ctx aws.Context, in *dynamodb.DeleteTableInput, opts ...request.Option) (*dynamodb.DeleteTableOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(db.tables, t.name)
+	desc := t.describe()
+	desc.TableStatus = aws.String(dynamodb.TableStatusDeleting)
+	return &dynamodb.DeleteTableOutput{TableDescription: desc}, nil
+}
+
+// DeleteTable calls DeleteTableWithContext with a background context.
+func (db *DB) DeleteTable(in *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	return db.DeleteTableWithContext(aws.BackgroundContext(), in)
+}
@@ -0,0 +1,595 @@
+package memdynamo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"dtpc"
+	"dtpc/conformance"
+	"dtpc/testsuite/example"
+)
+
+const testTable = "items"
+
+// newTestDB returns a DB with a table keyed by ID and a global secondary index of Group and Rank.
+func newTestDB(t *testing.T) *DB {
+	db := New()
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(testTable),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("Group"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("Rank"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("byGroup"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("Group"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("Rank"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func marshal(t *testing.T, v interface{}) map[string]*dynamodb.AttributeValue {
+	m, err := dynamodbattribute.MarshalMap(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func unmarshal(t *testing.T, m map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	v := map[string]interface{}{}
+	if err := dynamodbattribute.UnmarshalMap(m, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func putItem(t *testing.T, db *DB, v interface{}) {
+	if _, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(testTable), Item: marshal(t, v)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestUpdateExpressions(t *testing.T) {
+	cases := []struct {
+		update string
+		values map[string]interface{}
+		expect map[string]interface{}
+	}{
+		{"SET Count = Count + :v", map[string]interface{}{":v": 2}, map[string]interface{}{"Count": 3.0}},
+		{"SET Count = :v - Count", map[string]interface{}{":v": 2}, map[string]interface{}{"Count": 1.0}},
+		{"ADD Count :v", map[string]interface{}{":v": -1}, map[string]interface{}{"Count": 0.0}},
+		{"ADD Missing :v", map[string]interface{}{":v": 5}, map[string]interface{}{"Missing": 5.0}},
+		{"SET List = list_append(:v, List)", map[string]interface{}{":v": []string{"z"}}, map[string]interface{}{"List": []interface{}{"z", "a", "b", "c"}}},
+		{"SET List = list_append(List, :v)", map[string]interface{}{":v": []string{"z"}}, map[string]interface{}{"List": []interface{}{"a", "b", "c", "z"}}},
+		{"REMOVE List[0], List[2]", nil, map[string]interface{}{"List": []interface{}{"b"}}},
+		{"SET Nested.Inner.Amount = Nested.Inner.Amount - :v", map[string]interface{}{":v": 4}, map[string]interface{}{"Nested": map[string]interface{}{"Inner": map[string]interface{}{"Amount": 6.0}}}},
+		{"SET Missing = if_not_exists(Missing, :v)", map[string]interface{}{":v": "x"}, map[string]interface{}{"Missing": "x"}},
+		{"SET Count = if_not_exists(Count, :v)", map[string]interface{}{":v": 7}, map[string]interface{}{"Count": 1.0}},
+		{"REMOVE Count SET Other = :v", map[string]interface{}{":v": true}, map[string]interface{}{"Count": nil, "Other": true}},
+	}
+	for _, c := range cases {
+		db := newTestDB(t)
+		putItem(t, db, map[string]interface{}{
+			"ID":     "a",
+			"Count":  1,
+			"List":   []string{"a", "b", "c"},
+			"Nested": map[string]interface{}{"Inner": map[string]interface{}{"Amount": 10}},
+		})
+		in := &dynamodb.UpdateItemInput{
+			TableName:        aws.String(testTable),
+			Key:              marshal(t, map[string]string{"ID": "a"}),
+			UpdateExpression: aws.String(c.update),
+			ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+		}
+		if c.values != nil {
+			in.ExpressionAttributeValues = marshal(t, c.values)
+		}
+		out, err := db.UpdateItem(in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.update, err)
+		}
+		got := unmarshal(t, out.Attributes)
+		for name, expected := range c.expect {
+			if !reflect.DeepEqual(got[name], expected) {
+				t.Fatalf("%s: expected %s to be %v but got %v", c.update, name, expected, got[name])
+			}
+		}
+	}
+}
+
+func TestConditionExpressions(t *testing.T) {
+	cases := []struct {
+		condition string
+		values    map[string]interface{}
+		ok        bool
+	}{
+		{"attribute_exists(ID)", nil, true},
+		{"attribute_not_exists(ID)", nil, false},
+		{"Nested.Inner.Amount > :v AND Version = :w", map[string]interface{}{":v": 9, ":w": 3}, true},
+		{"Nested.Inner.Amount > :v", map[string]interface{}{":v": 10}, false},
+		{"Missing > :v", map[string]interface{}{":v": 0}, false},
+		{"Version BETWEEN :v AND :w", map[string]interface{}{":v": 1, ":w": 3}, true},
+		{"Name IN (:v, :w)", map[string]interface{}{":v": "x", ":w": "name"}, true},
+		{"begins_with(Name, :v)", map[string]interface{}{":v": "na"}, true},
+		{"contains(List, :v)", map[string]interface{}{":v": "b"}, true},
+		{"size(List) = :v", map[string]interface{}{":v": 3}, true},
+		{"NOT (Version <> :v) OR Name = :w", map[string]interface{}{":v": 1, ":w": "other"}, false},
+		{"attribute_type(List, :v)", map[string]interface{}{":v": "L"}, true},
+	}
+	for _, c := range cases {
+		db := newTestDB(t)
+		putItem(t, db, map[string]interface{}{
+			"ID":      "a",
+			"Name":    "name",
+			"Version": 3,
+			"List":    []string{"a", "b", "c"},
+			"Nested":  map[string]interface{}{"Inner": map[string]interface{}{"Amount": 10}},
+		})
+		in := &dynamodb.UpdateItemInput{
+			TableName:           aws.String(testTable),
+			Key:                 marshal(t, map[string]string{"ID": "a"}),
+			UpdateExpression:    aws.String("REMOVE Other"),
+			ConditionExpression: aws.String(c.condition),
+		}
+		if c.values != nil {
+			in.ExpressionAttributeValues = marshal(t, c.values)
+		}
+		_, err := db.UpdateItem(in)
+		switch {
+		case c.ok && err != nil:
+			t.Fatalf("%s: %v", c.condition, err)
+		case !c.ok && errorCode(err) != dynamodb.ErrCodeConditionalCheckFailedException:
+			t.Fatalf("%s: expected the condition to fail but got %v", c.condition, err)
+		}
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	cases := []struct {
+		name   string
+		update string
+		names  map[string]*string
+		values map[string]interface{}
+	}{
+		{"literal", "ADD Version 1", nil, nil},
+		{"unused name", "SET Version = :v", map[string]*string{"#n": aws.String("Name")}, map[string]interface{}{":v": 1}},
+		{"unused value", "SET Version = :v", nil, map[string]interface{}{":v": 1, ":w": 2}},
+		{"undefined value", "SET Version = :v", nil, nil},
+		{"key attribute", "SET ID = :v", nil, map[string]interface{}{":v": "b"}},
+		{"index key type", "SET Rank = :v", nil, map[string]interface{}{":v": "first"}},
+		{"overlapping paths", "SET Version = :v REMOVE Version", nil, map[string]interface{}{":v": 1}},
+		{"syntax", "SET Version = = :v", nil, map[string]interface{}{":v": 1}},
+	}
+	for _, c := range cases {
+		db := newTestDB(t)
+		putItem(t, db, map[string]interface{}{"ID": "a", "Version": 1})
+		in := &dynamodb.UpdateItemInput{
+			TableName:                aws.String(testTable),
+			Key:                      marshal(t, map[string]string{"ID": "a"}),
+			UpdateExpression:         aws.String(c.update),
+			ExpressionAttributeNames: c.names,
+		}
+		if c.values != nil {
+			in.ExpressionAttributeValues = marshal(t, c.values)
+		}
+		if _, err := db.UpdateItem(in); errorCode(err) != ErrCodeValidationException {
+			t.Fatalf("%s: expected a validation error but got %v", c.name, err)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 5; i++ {
+		putItem(t, db, map[string]interface{}{"ID": fmt.Sprintf("a%d", i), "Group": "a", "Rank": 5 - i, "Other": i})
+	}
+	putItem(t, db, map[string]interface{}{"ID": "b", "Group": "b", "Rank": 1})
+	// Items without the index keys are not part of the index.
+	putItem(t, db, map[string]interface{}{"ID": "c", "Group": "a"})
+
+	query := func(limit int64, start map[string]*dynamodb.AttributeValue) *dynamodb.QueryOutput {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:                 aws.String(testTable),
+			IndexName:                 aws.String("byGroup"),
+			KeyConditionExpression:    aws.String("#g = :g AND Rank >= :r"),
+			ExpressionAttributeNames:  map[string]*string{"#g": aws.String("Group")},
+			ExpressionAttributeValues: marshal(t, map[string]interface{}{":g": "a", ":r": 2}),
+			Limit:                     aws.Int64(limit),
+			ExclusiveStartKey:         start,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	ids := []interface{}{}
+	var start map[string]*dynamodb.AttributeValue
+	for pages := 0; ; pages++ {
+		out := query(3, start)
+		for _, it := range out.Items {
+			v := unmarshal(t, it)
+			if _, ok := v["Other"]; ok {
+				t.Fatalf("expected the keys only projection to omit Other but got %v", v)
+			}
+			ids = append(ids, v["ID"])
+		}
+		if start = out.LastEvaluatedKey; start == nil {
+			if pages != 1 {
+				t.Fatalf("expected 2 pages but got %d", pages+1)
+			}
+			break
+		}
+	}
+	expected := []interface{}{"a3", "a2", "a1", "a0"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected items %v ordered by rank but got %v", expected, ids)
+	}
+
+	_, err := db.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(testTable),
+		IndexName:                 aws.String("byGroup"),
+		KeyConditionExpression:    aws.String("Rank = :r"),
+		ExpressionAttributeValues: marshal(t, map[string]interface{}{":r": 2}),
+	})
+	if errorCode(err) != ErrCodeValidationException {
+		t.Fatalf("expected a query without hash key condition to fail but got %v", err)
+	}
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	db := newTestDB(t)
+	putItem(t, db, map[string]interface{}{"ID": "a", "Version": 1})
+
+	in := func(version int, token string) *dynamodb.TransactWriteItemsInput {
+		return &dynamodb.TransactWriteItemsInput{
+			ClientRequestToken: aws.String(token),
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Update: &dynamodb.Update{
+					TableName:                 aws.String(testTable),
+					Key:                       marshal(t, map[string]string{"ID": "a"}),
+					UpdateExpression:          aws.String("ADD Version :one"),
+					ConditionExpression:       aws.String("Version = :v"),
+					ExpressionAttributeValues: marshal(t, map[string]interface{}{":one": 1, ":v": version}),
+				}},
+				{Put: &dynamodb.Put{
+					TableName:           aws.String(testTable),
+					Item:                marshal(t, map[string]string{"ID": token}),
+					ConditionExpression: aws.String("attribute_not_exists(ID)"),
+				}},
+			},
+		}
+	}
+
+	_, err := db.TransactWriteItems(in(2, "first"))
+	cerr, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		t.Fatalf("expected the transaction to be cancelled but got %v", err)
+	}
+	codes := []string{aws.StringValue(cerr.CancellationReasons[0].Code), aws.StringValue(cerr.CancellationReasons[1].Code)}
+	if !reflect.DeepEqual(codes, []string{"ConditionalCheckFailed", "None"}) {
+		t.Fatalf("unexpected cancellation reasons %v", codes)
+	}
+
+	// Retries with the same client request token are only applied once.
+	for i := 0; i < 2; i++ {
+		if _, err := db.TransactWriteItems(in(1, "second")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testTable),
+		Key:       marshal(t, map[string]string{"ID": "a"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := unmarshal(t, out.Item)["Version"]; v != 2.0 {
+		t.Fatalf("expected version 2 but got %v", v)
+	}
+	out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(testTable),
+		Key:       marshal(t, map[string]string{"ID": "first"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Item != nil {
+		t.Fatalf("expected the cancelled put not to be applied but got %v", out.Item)
+	}
+}
+
+// createStateIndexWithoutExpiry creates a transaction table whose state index has been created before transactions
+// had deadlines.
+func createStateIndexWithoutExpiry(t *testing.T, db *DB) {
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String("transactions"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("transaction_state"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			{AttributeName: aws.String("transaction_reference"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("state-index"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("transaction_state"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("transaction_reference"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+					NonKeyAttributes: aws.StringSlice([]string{"source", "destination", "value", "last_modified"}),
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverExpiredTransactions(t *testing.T) {
+	withoutExpiry := dtpc.DefaultTransactionStoreConfig("transactions")
+	a := withoutExpiry.Attributes
+	withoutExpiry.Projection = []string{a.ID, a.Reference, a.State, a.Source, a.Destination, a.Value, a.LastModified}
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, db *DB)
+		cfg   dtpc.TransactionStoreConfig
+	}{
+		{"DefaultConfig", func(t *testing.T, db *DB) {}, dtpc.DefaultTransactionStoreConfig("transactions")},
+		{"StateIndexWithoutExpiry", createStateIndexWithoutExpiry, withoutExpiry},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := New()
+			c.setup(t, db)
+			if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: c.cfg, AccountsTableName: "accounts", AccountsHashKey: "ID"}); err != nil {
+				t.Fatal(err)
+			}
+			ts, err := dtpc.NewTransactionStoreWithConfig(db, c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ah := example.NewHandlerImpl(db, "accounts", "ID")
+			for _, id := range []string{"source", "destination"} {
+				if err := ah.Put(ctx, example.AccountDoc{ID: id, Resources: map[string]example.Item{"item": {ID: "item", Amount: 100}}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Recovery cancels an expired transaction even if it has been modified after the recover time.
+			expiresAt := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+			id, err := ts.InsertWithExpiry(ctx, "source", "destination", "reference", example.Item{ID: "item", Amount: 10}, expiresAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trs, err := ts.GetAllTransactionsInState(ctx, dtpc.Pending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trs) != 1 || trs[0].ID != id || !trs[0].ExpiresAt.Equal(expiresAt) {
+				t.Fatalf("expected transaction %s with a deadline of %v but got %+v", id, expiresAt, trs)
+			}
+			if err := dtpc.NewService(ts, ah).RecoverTransactions(ctx, expiresAt.Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			tr, err := ts.GetTransaction(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tr.TransactionState != dtpc.Cancelled {
+				t.Fatalf("expected the expired transaction to be cancelled but got state %d", tr.TransactionState)
+			}
+		})
+	}
+}
+
+func TestDeadlinesOfStateIndexWithoutExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := New()
+	createStateIndexWithoutExpiry(t, db)
+	cfg := dtpc.DefaultTransactionStoreConfig("transactions")
+	a := cfg.Attributes
+	cfg.Projection = []string{a.ID, a.Reference, a.State, a.Source, a.Destination, a.Value, a.LastModified}
+	ts, err := dtpc.NewTransactionStoreWithConfig(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More transactions than fit into a single BatchGetItem request.
+	deadlines := make(map[string]time.Time)
+	for i := 0; i < 150; i++ {
+		expiresAt := time.Now().Add(time.Duration(i) * time.Minute).Truncate(time.Millisecond)
+		id, err := ts.InsertWithExpiry(ctx, "source", "destination", fmt.Sprintf("reference%03d", i), nil, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadlines[id] = expiresAt
+	}
+	trs, err := ts.GetAllTransactionsInState(ctx, dtpc.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trs) != len(deadlines) {
+		t.Fatalf("expected %d transactions but got %d", len(deadlines), len(trs))
+	}
+	for _, tr := range trs {
+		if !tr.ExpiresAt.Equal(deadlines[tr.ID]) {
+			t.Fatalf("expected transaction %s to have a deadline of %v but got %v", tr.ID, deadlines[tr.ID], tr.ExpiresAt)
+		}
+	}
+}
+
+func TestGetTransactionsByID(t *testing.T) {
+	ctx := context.Background()
+	db := New()
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+
+	// More transactions than fit into a single BatchGetItem request, and one that does not exist.
+	ids := []string{"missing"}
+	for i := 0; i < 150; i++ {
+		id, err := ts.Insert(ctx, "source", "destination", fmt.Sprintf("reference%03d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	trs, err := ts.GetTransactionsByID(ctx, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trs) != len(ids)-1 {
+		t.Fatalf("expected %d transactions but got %d", len(ids)-1, len(trs))
+	}
+	for _, tr := range trs {
+		if tr.ID == "missing" || tr.TransactionState != dtpc.Pending || tr.Source != "source" {
+			t.Fatalf("unexpected transaction %+v", tr)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	db := New()
+	tablesConfig := dtpc.TablesConfig{
+		Transactions:      dtpc.DefaultTransactionStoreConfig("transactions"),
+		AccountsTableName: "accounts",
+		AccountsHashKey:   "ID",
+	}
+	sharded := dtpc.DefaultTransactionStoreConfig("sharded_transactions")
+	sharded.StateShards = 4
+	for _, cfg := range []dtpc.TablesConfig{tablesConfig, {Transactions: sharded}} {
+		if err := dtpc.EnsureTables(context.Background(), db, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+		return conformance.ExampleAccountFixture(example.NewHandlerImpl(db, "accounts", "ID"))
+	})
+	t.Run("Default", func(t *testing.T) {
+		conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+			return dtpc.NewTransactionStore(db, "transactions")
+		})
+	})
+	t.Run("Sharded", func(t *testing.T) {
+		conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+			ts, err := dtpc.NewTransactionStoreWithConfig(db, sharded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ts
+		})
+	})
+}
+
+func TestBackfillStateShards(t *testing.T) {
+	ctx := context.Background()
+	db := New()
+	unsharded := dtpc.DefaultTransactionStoreConfig("transactions")
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: unsharded}); err != nil {
+		t.Fatal(err)
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+	ids := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		id, err := ts.Insert(ctx, "source", "destination", fmt.Sprintf("reference%03d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = true
+	}
+
+	shardedStore := func(shards int) *dtpc.TransactionStore {
+		cfg := dtpc.DefaultTransactionStoreConfig("transactions")
+		cfg.StateIndexName = "state-shard-index"
+		cfg.StateShards = shards
+		if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: cfg}); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := dtpc.NewTransactionStoreWithConfig(db, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	pending := func(ts *dtpc.TransactionStore) int {
+		trs, err := ts.GetAllTransactionsInState(ctx, dtpc.Pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tr := range trs {
+			if !ids[tr.ID] {
+				t.Fatalf("unexpected transaction %+v", tr)
+			}
+		}
+		return len(trs)
+	}
+
+	// Transactions written before sharding was enabled are missing from the sharded index until they are backfilled.
+	sharded := shardedStore(8)
+	if n := pending(sharded); n != 0 {
+		t.Fatalf("expected no transactions before the backfill but got %d", n)
+	}
+	updated, err := sharded.BackfillStateShards(ctx, unsharded.StateIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != len(ids) || pending(sharded) != len(ids) {
+		t.Fatalf("expected %d backfilled transactions but updated %d", len(ids), updated)
+	}
+	if updated, err := sharded.BackfillStateShards(ctx, unsharded.StateIndexName); err != nil || updated != 0 {
+		t.Fatalf("expected a repeated backfill to update nothing but updated %d: %v", updated, err)
+	}
+
+	// Lowering the number of shards loses the transactions of the higher shards until they are backfilled again.
+	fewer := shardedStore(2)
+	if n := pending(fewer); n == len(ids) {
+		t.Fatal("expected transactions of higher shards to be missing")
+	}
+	if _, err := fewer.BackfillStateShards(ctx, unsharded.StateIndexName); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(fewer); n != len(ids) {
+		t.Fatalf("expected %d transactions after the backfill but got %d", len(ids), n)
+	}
+}
@@ -0,0 +1,95 @@
+package dtpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// NativeTransactor is an optional capability of an AccountHandler whose accounts live in DynamoDB.
+// When both the AccountHandler and the TransactionHandler support native transactions,
+// StartTransaction applies a request with a single TransactWriteItems call instead of the two phase commits.
+type NativeTransactor interface {
+	// CanTransactNatively reports whether req can be applied by TransactNatively.
+	CanTransactNatively(req Request) bool
+	// TransactNatively applies both the source and destination updates of req together with items in a single TransactWriteItems call.
+	// Pending transaction lists are not modified since the transaction is never left half applied.
+	TransactNatively(ctx context.Context, transactionID string, req Request, items ...*dynamodb.TransactWriteItem) error
+}
+
+// NativeStateWriter is an optional capability of a TransactionHandler that stores transactions in DynamoDB.
+// It allows the state change of a transaction document to be part of a native transaction.
+type NativeStateWriter interface {
+	// StateTransitionItem returns a write item that changes the state of a transaction from one state to another.
+	// The write fails if the transaction is not in state from.
+	StateTransitionItem(id string, from, to TransactionState, modified time.Time) (*dynamodb.TransactWriteItem, error)
+}
+
+// nativeTransactor returns the handlers to use for a native transaction, if both of them support it.
+func (s *Service) nativeTransactor(req Request) (NativeTransactor, NativeStateWriter, bool) {
+	nt, ok := s.Ah.(NativeTransactor)
+	if !ok || !nt.CanTransactNatively(req) {
+		return nil, nil, false
+	}
+	sw, ok := s.Ts.(NativeStateWriter)
+	if !ok {
+		return nil, nil, false
+	}
+	return nt, sw, true
+}
+
+// startNativeTransaction applies an inserted transaction with a single native transaction.
+// The transaction document moves from Pending to Done within the same write, so it is still recorded for auditing.
+func (s *Service) startNativeTransaction(ctx context.Context, nt NativeTransactor, sw NativeStateWriter, req Request, transactionID string, callbacks ...func() error) (*Response, error) {
+	for _, f := range callbacks {
+		if err := f(); err != nil {
+			// Nothing has been applied yet, cancelling only updates the transaction state.
+			if err := s.recoverFromError(ctx, transactionID, req, Pending); err != nil {
+				return nil, err
+			}
+			return nil, transactionError(transactionID, PhaseApply, err)
+		}
+	}
+
+	if err := checkExpiry(req); err != nil {
+		if err := s.recoverFromError(ctx, transactionID, req, Pending); err != nil {
+			return nil, err
+		}
+		return nil, transactionError(transactionID, PhaseApply, err)
+	}
+
+	modified := time.Now()
+	item, err := sw.StateTransitionItem(transactionID, Pending, Done, modified)
+	if err != nil {
+		if err := s.recoverFromError(ctx, transactionID, req, Pending); err != nil {
+			return nil, err
+		}
+		return nil, transactionError(transactionID, PhaseApply, err)
+	}
+
+	if err := s.transactNatively(ctx, nt, transactionID, req, item); err != nil {
+		// The outcome of a failed call can be unknown, e.g. on a network error. The transaction is Done if it has been applied.
+		if tr, gerr := s.Ts.GetTransaction(ctx, transactionID); gerr == nil && tr.TransactionState == Done {
+			return &Response{
+				TransactionID: transactionID,
+				LastModified:  tr.LastModified.Unix(),
+			}, nil
+		}
+		if err := s.recoverFromError(ctx, transactionID, req, Pending); err != nil {
+			return nil, err
+		}
+		return nil, transactionError(transactionID, PhaseApply, err)
+	}
+
+	return &Response{
+		TransactionID: transactionID,
+		LastModified:  modified.Unix(),
+	}, nil
+}
+
+func (s *Service) transactNatively(ctx context.Context, nt NativeTransactor, transactionID string, req Request, item *dynamodb.TransactWriteItem) error {
+	ctx, cancel := withTimeout(ctx, s.cfg.ApplyTimeout)
+	defer cancel()
+	return nt.TransactNatively(ctx, transactionID, req, item)
+}
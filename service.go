@@ -1,8 +1,9 @@
 package dtpc
 
 import (
-	"time"
 	"context"
+	"sort"
+	"time"
 )
 
 // AccountHandler defines required methods of account data handling for transaction processes.
@@ -31,9 +32,43 @@ type TransactionHandler interface {
 	GetAllTransactionsInState(ctx context.Context, state TransactionState) ([]*Transaction, error)
 }
 
+// ExpiringInserter is an optional capability of a TransactionHandler that stores the deadline of a transaction, so
+// that RecoverTransactions can cancel the transaction once it has expired. Transactions with a deadline are inserted
+// with Insert by TransactionHandlers without it, and the deadline is only enforced while they are being applied.
+type ExpiringInserter interface {
+	// InsertWithExpiry inserts a transaction like Insert and stores its deadline.
+	InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error)
+}
+
+// TransactionBatchGetter is an optional capability of a TransactionHandler that retrieves several transactions with
+// fewer round trips than one GetTransaction per transaction.
+type TransactionBatchGetter interface {
+	// GetTransactionsByID retrieves the transactions with the given IDs in no particular order. Transactions that do
+	// not exist are left out.
+	GetTransactionsByID(ctx context.Context, ids []string) ([]*Transaction, error)
+}
+
 type Service struct {
-	Ts TransactionHandler
-	Ah AccountHandler
+	Ts  TransactionHandler
+	Ah  AccountHandler
+	cfg ServiceConfig
+}
+
+// ServiceConfig contains optional timeouts of the phases of a transaction.
+// Each phase runs with a context derived from the context of the caller, so deadlines and cancellation of the caller
+// always apply. A zero timeout does not limit a phase any further.
+type ServiceConfig struct {
+	// Timeout of inserting the transaction document
+	InsertTimeout time.Duration
+	// Timeout of updating both accounts and changing the transaction state to Applied
+	ApplyTimeout time.Duration
+	// Timeout of committing both accounts and changing the transaction state to Done
+	CommitTimeout time.Duration
+	// Timeout of rolling back both accounts and changing the transaction state to Cancelled
+	CancelTimeout time.Duration
+	// Default lifetime of a transaction, used when a Request does not set ExpiresAt.
+	// Transactions do not expire when both are zero.
+	TransactionExpiry time.Duration
 }
 
 type Request struct {
@@ -45,6 +80,8 @@ type Request struct {
 	Reference string
 	// the actual data being transferred
 	Data interface{}
+	// Deadline of the transaction, overriding ServiceConfig.TransactionExpiry
+	ExpiresAt time.Time
 }
 
 type Response struct {
@@ -62,20 +99,36 @@ func NewService(th TransactionHandler, ah AccountHandler) *Service {
 	}
 }
 
+// NewServiceWithConfig initialises a new instance of Transaction Service with per-phase timeouts.
+func NewServiceWithConfig(th TransactionHandler, ah AccountHandler, cfg ServiceConfig) *Service {
+	s := NewService(th, ah)
+	s.cfg = cfg
+	return s
+}
+
 // StartTransaction performs a single transaction based on the two phase commits logic.
+// If both handlers support native transactions, the transaction is applied with a single native transaction instead.
+// Errors are returned as *TransactionError with the ID of the transaction and the phase that failed.
 func (s *Service) StartTransaction(ctx context.Context, req Request, callbacks ...func() error) (*Response, error) {
 	// Insert new transaction with initial state
-	transactionID, err := s.Ts.Insert(ctx, req.Source, req.Destination, req.Reference, req.Data)
+	if req.ExpiresAt.IsZero() && s.cfg.TransactionExpiry > 0 {
+		req.ExpiresAt = time.Now().Add(s.cfg.TransactionExpiry)
+	}
+	transactionID, err := s.insertTransaction(ctx, req)
 	if err != nil {
 		// Failed to append transaction, err is returned and no rollback required.
-		return nil, err
+		return nil, transactionError(transactionID, PhaseInsert, err)
+	}
+
+	if nt, sw, ok := s.nativeTransactor(req); ok {
+		return s.startNativeTransaction(ctx, nt, sw, req, transactionID, callbacks...)
 	}
 
 	if err := s.applyTransaction(ctx, req, transactionID, callbacks...); err != nil {
 		if err := s.recoverFromError(ctx, transactionID, req, Pending); err != nil {
 			return nil, err
 		}
-		return nil, err
+		return nil, transactionError(transactionID, PhaseApply, err)
 	}
 
 	tr, err := s.commitTransaction(ctx, req, transactionID)
@@ -83,7 +136,7 @@ func (s *Service) StartTransaction(ctx context.Context, req Request, callbacks .
 		if err := s.recoverFromError(ctx, transactionID, req, Applied); err != nil {
 			return nil, err
 		}
-		return nil, err
+		return nil, transactionError(transactionID, PhaseCommit, err)
 	}
 
 	return &Response{
@@ -99,14 +152,25 @@ func (s *Service) GetTransactions(ctx context.Context, state TransactionState, q
 // RecoverTransactions provides an option to correct failed or incomplete transaction due to extreme situations such as Network outage or Database outage.
 // RecoverTransactions retrieve all incomplete transactions from the transaction table within a given timeframe and recover those transactions in sequence.
 // recoverTime is used to ensure the newly added transactions are not picked up by the recovery process.
+// A transaction that cannot be recovered does not stop the recovery of the others, and the first failure is returned
+// as *TransactionError once all transactions have been tried.
 func (s *Service) RecoverTransactions(ctx context.Context, recoverTime time.Time) error {
+	// Cancelling transactions in Pending state that expired before recoverTime, regardless of their last
+	// modification, earliest deadline first
+	pts, err := s.Ts.GetAllTransactionsInState(ctx, Pending)
+	if err != nil {
+		return err
+	}
+	expired, active := splitExpired(pts, recoverTime)
+	failed := s.cancelExpiredTransactions(ctx, expired)
+
 	// Recovering transactions in Cancelling state
 	cts, err := s.Ts.GetAllTransactionsInState(ctx, Canceling)
 	if err != nil {
 		return err
 	}
-	if err := s.recoverTransactions(ctx, cts, recoverTime, Canceling); err != nil {
-		return err
+	if err := s.recoverTransactions(ctx, cts, recoverTime, Canceling); failed == nil {
+		failed = err
 	}
 
 	// Recovering transactions in Applied state
@@ -114,44 +178,116 @@ func (s *Service) RecoverTransactions(ctx context.Context, recoverTime time.Time
 	if err != nil {
 		return err
 	}
-	if err := s.recoverTransactions(ctx, ats, recoverTime, Applied); err != nil {
-		return err
+	if err := s.recoverTransactions(ctx, ats, recoverTime, Applied); failed == nil {
+		failed = err
 	}
 
-	// Recovering transactions in Pending state
-	pts, err := s.Ts.GetAllTransactionsInState(ctx, Pending)
-	if err != nil {
-		return err
+	// Recovering transactions in Pending state that have not expired
+	if err := s.recoverTransactions(ctx, active, recoverTime, Pending); failed == nil {
+		failed = err
 	}
-	return s.recoverTransactions(ctx, pts, recoverTime, Pending)
+	return failed
 }
 
+// recoverTransactions recovers the transactions in the given state last modified before recoverTime and returns the
+// first failure.
 func (s *Service) recoverTransactions(ctx context.Context, ts []*Transaction, recoverTime time.Time, state TransactionState) error {
-	if len(ts) > 0 {
-		for _, t := range ts {
-			if recoverTime.After(t.LastModified) {
-				req := Request{
-					Source:      t.Source,
-					Destination: t.Destination,
-					Data:        t.Value,
-				}
-				if err := s.recoverFromError(ctx, t.ID, req, state); err != nil {
-					return err
-				}
+	var failed error
+	for _, t := range ts {
+		if recoverTime.After(t.LastModified) {
+			req := Request{
+				Source:      t.Source,
+				Destination: t.Destination,
+				Data:        t.Value,
+				ExpiresAt:   t.ExpiresAt,
+			}
+			if err := s.recoverFromError(ctx, t.ID, req, state); err != nil && failed == nil {
+				failed = err
 			}
 		}
 	}
+	return failed
+}
+
+// withTimeout returns a context for a phase of a transaction limited by the given timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (s *Service) insertTransaction(ctx context.Context, req Request) (string, error) {
+	ctx, cancel := withTimeout(ctx, s.cfg.InsertTimeout)
+	defer cancel()
+	if ei, ok := s.Ts.(ExpiringInserter); ok && !req.ExpiresAt.IsZero() {
+		return ei.InsertWithExpiry(ctx, req.Source, req.Destination, req.Reference, req.Data, req.ExpiresAt)
+	}
+	return s.Ts.Insert(ctx, req.Source, req.Destination, req.Reference, req.Data)
+}
+
+// checkExpiry returns ErrTransactionExpired when the deadline of a request has passed.
+func checkExpiry(req Request) error {
+	if !req.ExpiresAt.IsZero() && !time.Now().Before(req.ExpiresAt) {
+		return ErrTransactionExpired
+	}
 	return nil
 }
 
+// splitExpired splits transactions into the transactions that expired before recoverTime and the others.
+func splitExpired(ts []*Transaction, recoverTime time.Time) (expired, active []*Transaction) {
+	for _, t := range ts {
+		if t.Expired(recoverTime) {
+			expired = append(expired, t)
+		} else {
+			active = append(active, t)
+		}
+	}
+	return expired, active
+}
+
+// cancelExpiredTransactions cancels expired transactions in Pending state and returns the first failure. Transactions
+// are cancelled in the order of their deadline and ID so that recovery is deterministic.
+func (s *Service) cancelExpiredTransactions(ctx context.Context, expired []*Transaction) error {
+	sort.Slice(expired, func(i, j int) bool {
+		if !expired[i].ExpiresAt.Equal(expired[j].ExpiresAt) {
+			return expired[i].ExpiresAt.Before(expired[j].ExpiresAt)
+		}
+		return expired[i].ID < expired[j].ID
+	})
+
+	var failed error
+	for _, t := range expired {
+		req := Request{
+			Source:      t.Source,
+			Destination: t.Destination,
+			Data:        t.Value,
+			ExpiresAt:   t.ExpiresAt,
+		}
+		if err := s.recoverFromError(ctx, t.ID, req, Pending); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
 func (s *Service) applyTransaction(ctx context.Context, req Request, transactionID string, callbacks ...func() error) error {
+	ctx, cancel := withTimeout(ctx, s.cfg.ApplyTimeout)
+	defer cancel()
+
 	// Attempt to update the source account
+	if err := checkExpiry(req); err != nil {
+		return err
+	}
 	if err := s.Ah.Update(ctx, req.Source, transactionID, req); err != nil {
 		// Failed to update source account, cancel transaction.
 		return err
 	}
 
 	// Attempt to update the destination account
+	if err := checkExpiry(req); err != nil {
+		return err
+	}
 	if err := s.Ah.Update(ctx, req.Destination, transactionID, req); err != nil {
 		// Failed to update destination account, cancel transaction
 		return err
@@ -165,7 +301,11 @@ func (s *Service) applyTransaction(ctx context.Context, req Request, transaction
 		}
 	}
 
-	// Upon success of both updates, change transaction state to applied
+	// Upon success of both updates, change transaction state to applied.
+	// An expired transaction is cancelled instead, since Applied transactions are always committed.
+	if err := checkExpiry(req); err != nil {
+		return err
+	}
 	if _, err := s.Ts.UpdateState(ctx, transactionID, Applied); err != nil {
 		// Failed to update state to Applied, cancel transaction
 		return err
@@ -175,6 +315,9 @@ func (s *Service) applyTransaction(ctx context.Context, req Request, transaction
 }
 
 func (s *Service) commitTransaction(ctx context.Context, req Request, transactionID string) (*Transaction, error) {
+	ctx, cancel := withTimeout(ctx, s.cfg.CommitTimeout)
+	defer cancel()
+
 	// Commit transactions by updating the pending transaction list of both accounts
 	if err := s.Ah.Commit(ctx, req.Source, transactionID); err != nil {
 		// Failed to commit transaction, retry commit transaction
@@ -197,6 +340,9 @@ func (s *Service) commitTransaction(ctx context.Context, req Request, transactio
 }
 
 func (s *Service) cancelTransaction(ctx context.Context, req Request, transactionID string) error {
+	ctx, cancel := withTimeout(ctx, s.cfg.CancelTimeout)
+	defer cancel()
+
 	// Attempt to rollback the destination account
 	if err := s.Ah.Rollback(ctx, req.Destination, transactionID, req); err != nil {
 		if !s.Ah.IsErrorPendingTransactionIDNotFound(err) {
@@ -219,14 +365,16 @@ func (s *Service) cancelTransaction(ctx context.Context, req Request, transactio
 	return nil
 }
 
+// recoverFromError brings a transaction in the given state to a final state.
+// Errors are returned as *TransactionError of the phase that failed.
 func (s *Service) recoverFromError(ctx context.Context, transactionID string, req Request, state TransactionState) error {
 	switch state {
 	case Pending:
-		return s.recoverFromPendingState(ctx, transactionID, req)
+		return transactionError(transactionID, PhaseCancel, s.recoverFromPendingState(ctx, transactionID, req))
 	case Applied:
-		return s.recoverFromAppliedState(ctx, transactionID, req)
+		return transactionError(transactionID, PhaseCommit, s.recoverFromAppliedState(ctx, transactionID, req))
 	case Canceling:
-		return s.recoverFromCancellingState(ctx, transactionID, req)
+		return transactionError(transactionID, PhaseCancel, s.recoverFromCancellingState(ctx, transactionID, req))
 	default:
 		return nil
 	}
@@ -234,7 +382,7 @@ func (s *Service) recoverFromError(ctx context.Context, transactionID string, re
 
 func (s *Service) recoverFromPendingState(ctx context.Context, transactionID string, req Request) error {
 	// Update transaction state to canceling
-	if _, err := s.Ts.UpdateState(ctx, transactionID, Canceling); err != nil {
+	if err := s.markCanceling(ctx, transactionID); err != nil {
 		return err
 	}
 	// Actually canceling the transaction
@@ -251,3 +399,10 @@ func (s *Service) recoverFromAppliedState(ctx context.Context, transactionID str
 func (s *Service) recoverFromCancellingState(ctx context.Context, transactionID string, req Request) error {
 	return s.cancelTransaction(ctx, req, transactionID)
 }
+
+func (s *Service) markCanceling(ctx context.Context, transactionID string) error {
+	ctx, cancel := withTimeout(ctx, s.cfg.CancelTimeout)
+	defer cancel()
+	_, err := s.Ts.UpdateState(ctx, transactionID, Canceling)
+	return err
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/google/uuid"
 	"context"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
 )
 
 type FakeTransactionStore struct {
@@ -24,17 +28,13 @@ func NewFakeTransactionStore() *FakeTransactionStore {
 
 // Insert simulates the insert behaviour and stores a transaction in map.
 func (fts *FakeTransactionStore) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
+	return fts.InsertWithExpiry(ctx, source, destination, reference, data, time.Time{})
+}
+
+// InsertWithExpiry stores a transaction with a deadline in map.
+func (fts *FakeTransactionStore) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
 	id := uuid.New().String()
-	t := Transaction{
-		ID:                   id,
-		TransactionReference: reference,
-		Source:               source,
-		Destination:          destination,
-		Value:                data,
-		TransactionState:     Pending,
-		LastModified:         time.Now(),
-	}
-	fts.store[id] = &t
+	fts.store[id] = NewTransaction(id, source, destination, reference, data, expiresAt)
 	return id, nil
 }
 
@@ -154,7 +154,7 @@ func (fas *FakeAccountStore) Update(ctx context.Context, accountID, transactionI
 		resource.Amount = resource.Amount + reqData.Amount
 	case Decrement:
 		if resource.Amount < reqData.Amount {
-			return fmt.Errorf("insufficient amount for resource %s", reqData.ID)
+			return fmt.Errorf("insufficient amount for resource %s: %w", reqData.ID, ErrInsufficientFunds)
 		}
 		resource.Amount = resource.Amount - reqData.Amount
 	}
@@ -215,7 +215,7 @@ func (fas *FakeAccountStore) Rollback(ctx context.Context, accountID, transactio
 		resource.Amount = resource.Amount + reqData.Amount
 	case Decrement:
 		if resource.Amount < reqData.Amount {
-			return fmt.Errorf("insufficient amount for resource %s", reqData.ID)
+			return fmt.Errorf("insufficient amount for resource %s: %w", reqData.ID, ErrInsufficientFunds)
 		}
 		resource.Amount = resource.Amount - reqData.Amount
 	}
@@ -352,6 +352,146 @@ func TestRecoverTransactions(t *testing.T) {
 	}
 }
 
+// FakeNativeTransactionStore adds native transaction support to FakeTransactionStore.
+type FakeNativeTransactionStore struct {
+	*FakeTransactionStore
+}
+
+func (fts *FakeNativeTransactionStore) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
+	doc, ok := fts.store[id]
+	if !ok {
+		return nil, fmt.Errorf("transaction with id %s does not exist", id)
+	}
+	return doc, nil
+}
+
+func (fts *FakeNativeTransactionStore) StateTransitionItem(id string, from, to TransactionState, modified time.Time) (*dynamodb.TransactWriteItem, error) {
+	vals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":v":    to,
+		":from": from,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			Key:                       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+			ExpressionAttributeValues: vals,
+		},
+	}, nil
+}
+
+// FakeNativeAccountStore adds native transaction support to FakeAccountStore.
+// It applies the state transition items of FakeNativeTransactionStore directly to the fake transaction store.
+type FakeNativeAccountStore struct {
+	*FakeAccountStore
+	fts *FakeTransactionStore
+	err error
+}
+
+func (fas *FakeNativeAccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return err == errPendingTransactionIDNotFound
+}
+
+func (fas *FakeNativeAccountStore) CanTransactNatively(req Request) bool {
+	_, ok := req.Data.(MockItem)
+	return ok
+}
+
+func (fas *FakeNativeAccountStore) TransactNatively(ctx context.Context, transactionID string, req Request, items ...*dynamodb.TransactWriteItem) error {
+	if fas.err != nil {
+		return fas.err
+	}
+	reqData := req.Data.(MockItem)
+	src := fas.store[req.Source]
+	dst := fas.store[req.Destination]
+	if src.Resources[reqData.ID].Amount < reqData.Amount {
+		return fmt.Errorf("insufficient amount for resource %s", reqData.ID)
+	}
+	src.Resources[reqData.ID] = MockItem{ID: reqData.ID, Amount: src.Resources[reqData.ID].Amount - reqData.Amount}
+	dst.Resources[reqData.ID] = MockItem{ID: reqData.ID, Amount: dst.Resources[reqData.ID].Amount + reqData.Amount}
+
+	for _, item := range items {
+		var to TransactionState
+		if err := dynamodbattribute.Unmarshal(item.Update.ExpressionAttributeValues[":v"], &to); err != nil {
+			return err
+		}
+		fas.fts.store[*item.Update.Key["id"].S].TransactionState = to
+	}
+	return nil
+}
+
+func setupNativeService(t *testing.T, err error) (*Service, *FakeTransactionStore, *FakeAccountStore) {
+	fts := NewFakeTransactionStore()
+	fas := NewFakeAccountStore()
+	for _, id := range []string{"mock_account_id_1", "mock_account_id_2"} {
+		doc := MockAccountDoc{
+			ID:                  id,
+			Resources:           map[string]MockItem{"mock_item_id": {ID: "mock_item_id", Amount: 30}},
+			PendingTransactions: []string{},
+		}
+		if err := fas.Put(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := NewService(&FakeNativeTransactionStore{fts}, &FakeNativeAccountStore{fas, fts, err})
+	return service, fts, fas
+}
+
+func TestStartNativeTransaction(t *testing.T) {
+	ctx := context.Background()
+	service, fts, fas := setupNativeService(t, nil)
+
+	mockReq := Request{
+		Source:      "mock_account_id_1",
+		Destination: "mock_account_id_2",
+		Data:        MockItem{ID: "mock_item_id", Amount: 10},
+	}
+	res, err := service.StartTransaction(ctx, mockReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fts.store[res.TransactionID].TransactionState != Done {
+		t.Fatalf("expected transaction state to be %d but got %d", Done, fts.store[res.TransactionID].TransactionState)
+	}
+	if fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount != 20 {
+		t.Fatalf("expected account 1 amount to be 20 but got %d", fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount)
+	}
+	if fas.store["mock_account_id_2"].Resources["mock_item_id"].Amount != 40 {
+		t.Fatalf("expected account 2 amount to be 40 but got %d", fas.store["mock_account_id_2"].Resources["mock_item_id"].Amount)
+	}
+	if fas.store["mock_account_id_1"].Version != 0 {
+		t.Fatal("expected the two phase commits to be skipped")
+	}
+}
+
+func TestStartNativeTransactionFailure(t *testing.T) {
+	ctx := context.Background()
+	mockErr := errors.New("mock transaction cancelled")
+	service, fts, fas := setupNativeService(t, mockErr)
+
+	mockReq := Request{
+		Source:      "mock_account_id_1",
+		Destination: "mock_account_id_2",
+		Data:        MockItem{ID: "mock_item_id", Amount: 10},
+	}
+	if _, err := service.StartTransaction(ctx, mockReq); !errors.Is(err, mockErr) {
+		t.Fatalf("expected %v but got %v", mockErr, err)
+	}
+
+	cancelled, err := fts.GetAllTransactionsInState(ctx, Cancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 1 {
+		t.Fatalf("expected 1 cancelled transaction but got %d", len(cancelled))
+	}
+	if fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount != 30 {
+		t.Fatalf("expected account 1 amount to be unchanged but got %d", fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount)
+	}
+}
+
 func getPendingTransactionIndex(pts []string, st string) (int, error) {
 	for i, pt := range pts {
 		if pt == st {
@@ -360,3 +500,293 @@ func getPendingTransactionIndex(pts []string, st string) (int, error) {
 	}
 	return 0, errPendingTransactionIDNotFound
 }
+
+// BlockingAccountStore blocks updates of the destination account until the context is done.
+type BlockingAccountStore struct {
+	*FakeAccountStore
+}
+
+func (fas *BlockingAccountStore) Update(ctx context.Context, accountID, transactionID string, tr Request) error {
+	if accountID == tr.Destination {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return fas.FakeAccountStore.Update(ctx, accountID, transactionID, tr)
+}
+
+func (fas *BlockingAccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return err == errPendingTransactionIDNotFound
+}
+
+func TestStartTransactionApplyTimeout(t *testing.T) {
+	ctx := context.Background()
+	fts := NewFakeTransactionStore()
+	fas := NewFakeAccountStore()
+	for _, id := range []string{"mock_account_id_1", "mock_account_id_2"} {
+		doc := MockAccountDoc{
+			ID:                  id,
+			Resources:           map[string]MockItem{"mock_item_id": {ID: "mock_item_id", Amount: 30}},
+			PendingTransactions: []string{},
+		}
+		if err := fas.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := NewServiceWithConfig(fts, &BlockingAccountStore{fas}, ServiceConfig{
+		ApplyTimeout:  20 * time.Millisecond,
+		CancelTimeout: time.Second,
+	})
+
+	req := Request{
+		Source:      "mock_account_id_1",
+		Destination: "mock_account_id_2",
+		Data:        MockItem{ID: "mock_item_id", Amount: 10},
+	}
+	if _, err := service.StartTransaction(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error but got %v", err)
+	}
+
+	// The cancel phase has its own timeout and rolls back the source account.
+	for _, tr := range fts.store {
+		if tr.TransactionState != Cancelled {
+			t.Fatalf("expected transaction to be cancelled but got state %d", tr.TransactionState)
+		}
+	}
+	if fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount != 30 {
+		t.Fatalf("expected account 1 amount to be restored but got %d", fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount)
+	}
+}
+
+// RecordingTransactionStore records the IDs of transactions moved to Canceling and the states that have been queried.
+type RecordingTransactionStore struct {
+	*FakeTransactionStore
+	canceling []string
+	queried   []TransactionState
+}
+
+func (fts *RecordingTransactionStore) GetAllTransactionsInState(ctx context.Context, state TransactionState) ([]*Transaction, error) {
+	fts.queried = append(fts.queried, state)
+	return fts.FakeTransactionStore.GetAllTransactionsInState(ctx, state)
+}
+
+func (fts *RecordingTransactionStore) UpdateState(ctx context.Context, id string, newState TransactionState) (*Transaction, error) {
+	if newState == Canceling {
+		fts.canceling = append(fts.canceling, id)
+	}
+	return fts.FakeTransactionStore.UpdateState(ctx, id, newState)
+}
+
+func setupExpiryAccounts(t *testing.T, fas *FakeAccountStore, pending ...string) {
+	for _, id := range []string{"mock_account_id_1", "mock_account_id_2"} {
+		doc := MockAccountDoc{
+			ID:                  id,
+			Resources:           map[string]MockItem{"mock_item_id": {ID: "mock_item_id", Amount: 30}},
+			PendingTransactions: append([]string{}, pending...),
+		}
+		if err := fas.Put(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStartTransactionExpired(t *testing.T) {
+	ctx := context.Background()
+	fts := NewFakeTransactionStore()
+	fas := NewFakeAccountStore()
+	setupExpiryAccounts(t, fas)
+	service := NewServiceWithConfig(fts, &BlockingAccountStore{fas}, ServiceConfig{
+		TransactionExpiry: time.Minute,
+	})
+
+	req := Request{
+		Source:      "mock_account_id_1",
+		Destination: "mock_account_id_2",
+		Data:        MockItem{ID: "mock_item_id", Amount: 10},
+		ExpiresAt:   time.Now().Add(-time.Second),
+	}
+	if _, err := service.StartTransaction(ctx, req); !errors.Is(err, ErrTransactionExpired) {
+		t.Fatalf("expected %v but got %v", ErrTransactionExpired, err)
+	}
+	for _, tr := range fts.store {
+		if tr.TransactionState != Cancelled || !tr.ExpiresAt.Equal(req.ExpiresAt) {
+			t.Fatalf("expected expired transaction to be cancelled but got %+v", tr)
+		}
+	}
+	if fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount != 30 {
+		t.Fatalf("expected account 1 amount to be unchanged but got %d", fas.store["mock_account_id_1"].Resources["mock_item_id"].Amount)
+	}
+
+	// The default expiry of the service applies when the request has no deadline.
+	fts = NewFakeTransactionStore()
+	service = NewServiceWithConfig(fts, fas, ServiceConfig{
+		TransactionExpiry: time.Minute,
+	})
+	req.ExpiresAt = time.Time{}
+	res, err := service.StartTransaction(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := fts.store[res.TransactionID]
+	if tr.ExpiresAt.IsZero() || tr.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected transaction to expire within a minute but got %v", tr.ExpiresAt)
+	}
+
+	// Transaction handlers that cannot store the deadline still have it enforced while the transaction is applied.
+	fts = NewFakeTransactionStore()
+	service = NewService(&PlainTransactionStore{fts}, &BlockingAccountStore{fas})
+	req.ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := service.StartTransaction(ctx, req); !errors.Is(err, ErrTransactionExpired) {
+		t.Fatalf("expected %v but got %v", ErrTransactionExpired, err)
+	}
+	for _, tr := range fts.store {
+		if tr.TransactionState != Cancelled || !tr.ExpiresAt.IsZero() {
+			t.Fatalf("expected expired transaction to be cancelled without a stored deadline but got %+v", tr)
+		}
+	}
+}
+
+// PlainTransactionStore hides the optional capabilities of a TransactionHandler.
+type PlainTransactionStore struct {
+	TransactionHandler
+}
+
+func TestRecoverExpiredTransactions(t *testing.T) {
+	ctx := context.Background()
+	fts := &RecordingTransactionStore{FakeTransactionStore: NewFakeTransactionStore()}
+	fas := NewFakeAccountStore()
+	service := NewService(fts, fas)
+
+	now := time.Now()
+	data := MockItem{ID: "mock_item_id", Amount: 10}
+	expired := []string{}
+	for _, d := range []time.Duration{-time.Minute, -time.Hour, -2 * time.Hour} {
+		id, err := fts.InsertWithExpiry(ctx, "mock_account_id_1", "mock_account_id_2", "mock_reference", data, now.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired = append([]string{id}, expired...)
+	}
+	active := []string{}
+	for _, d := range []time.Duration{-time.Second, time.Hour} {
+		id, err := fts.InsertWithExpiry(ctx, "mock_account_id_1", "mock_account_id_2", "mock_reference", data, now.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		active = append(active, id)
+	}
+	setupExpiryAccounts(t, fas, expired...)
+
+	// Transactions that expired before recoverTime are cancelled even though they were modified after it, while
+	// transactions that expired after recoverTime are left to their processes.
+	if err := service.RecoverTransactions(ctx, now.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fts.canceling, ",") != strings.Join(expired, ",") {
+		t.Fatalf("expected transactions %v to be cancelled in order of their deadline but got %v", expired, fts.canceling)
+	}
+	if fmt.Sprint(fts.queried) != fmt.Sprint([]TransactionState{Pending, Canceling, Applied}) {
+		t.Fatalf("expected every state to be queried once but got %v", fts.queried)
+	}
+	for _, id := range expired {
+		if fts.store[id].TransactionState != Cancelled {
+			t.Fatalf("expected transaction %s to be cancelled but got state %d", id, fts.store[id].TransactionState)
+		}
+	}
+	for _, id := range active {
+		if fts.store[id].TransactionState != Pending {
+			t.Fatalf("expected transaction %s to be pending but got state %d", id, fts.store[id].TransactionState)
+		}
+	}
+}
+
+var errMockInsufficientFunds = errors.New("insufficient funds")
+
+// SpentAccountStore fails the rollback of destination accounts as if they had spent the transferred amount.
+type SpentAccountStore struct {
+	*FakeAccountStore
+}
+
+func (fas *SpentAccountStore) Rollback(ctx context.Context, accountID, transactionID string, tr Request) error {
+	if accountID == tr.Destination {
+		return errMockInsufficientFunds
+	}
+	return fas.FakeAccountStore.Rollback(ctx, accountID, transactionID, tr)
+}
+
+func (fas *SpentAccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return false
+}
+
+func TestRecoverSpentTransaction(t *testing.T) {
+	ctx := context.Background()
+	fts := NewFakeTransactionStore()
+	fas := NewFakeAccountStore()
+	service := NewService(fts, &SpentAccountStore{fas})
+
+	data := MockItem{ID: "mock_item_id", Amount: 10}
+	id, err := fts.Insert(ctx, "mock_account_id_1", "mock_account_id_2", "mock_reference", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fts.UpdateState(ctx, id, Canceling); err != nil {
+		t.Fatal(err)
+	}
+	fts.store[id].LastModified = time.Now().Add(-time.Hour)
+	applied, err := fts.Insert(ctx, "mock_account_id_1", "mock_account_id_2", "mock_reference", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fts.UpdateState(ctx, applied, Applied); err != nil {
+		t.Fatal(err)
+	}
+	fts.store[applied].LastModified = time.Now().Add(-time.Hour)
+	setupExpiryAccounts(t, fas, id, applied)
+
+	// The transaction cannot be cancelled and stays in Canceling state until the destination account is funded again.
+	// The recovery of other transactions continues.
+	if err := service.RecoverTransactions(ctx, time.Now()); !errors.Is(err, errMockInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", errMockInsufficientFunds, err)
+	}
+	if fts.store[id].TransactionState != Canceling {
+		t.Fatalf("expected transaction %s to be canceling but got state %d", id, fts.store[id].TransactionState)
+	}
+	if fts.store[applied].TransactionState != Done {
+		t.Fatalf("expected transaction %s to be done but got state %d", applied, fts.store[applied].TransactionState)
+	}
+	for _, accountID := range []string{"mock_account_id_1", "mock_account_id_2"} {
+		ad := fas.store[accountID]
+		if len(ad.PendingTransactions) != 1 || ad.Resources["mock_item_id"].Amount != 30 {
+			t.Fatalf("expected account %s to be neither committed nor rolled back but got %+v", accountID, ad)
+		}
+	}
+}
+
+func TestStartTransactionError(t *testing.T) {
+	ctx := context.Background()
+	fts := NewFakeTransactionStore()
+	fas := NewFakeAccountStore()
+	setupExpiryAccounts(t, fas)
+	// The source account has insufficient funds, so the destination account is never updated.
+	service := NewService(fts, &BlockingAccountStore{fas})
+
+	req := Request{
+		Source:      "mock_account_id_1",
+		Destination: "mock_account_id_2",
+		Data:        MockItem{ID: "mock_item_id", Amount: 50},
+	}
+	_, err := service.StartTransaction(ctx, req)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", ErrInsufficientFunds, err)
+	}
+	var te *TransactionError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected a transaction error but got %T", err)
+	}
+	tr, ok := fts.store[te.ID]
+	if !ok || te.Phase != PhaseApply {
+		t.Fatalf("expected an apply error of an inserted transaction but got %v", te)
+	}
+	if tr.TransactionState != Cancelled {
+		t.Fatalf("expected the transaction to be cancelled but got state %d", tr.TransactionState)
+	}
+}
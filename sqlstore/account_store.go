@@ -0,0 +1,426 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"dtpc"
+	"dtpc/testsuite/example"
+)
+
+const updateRetryInterval = 100 * time.Millisecond
+
+var (
+	// ErrInsufficientFunds is returned when a decrement would not leave a positive balance.
+	ErrInsufficientFunds = dtpc.ErrInsufficientFunds
+	// ErrPendingTransactionIDNotFound is returned by Rollback when the account has no such pending transaction.
+	ErrPendingTransactionIDNotFound = errors.New("pending transaction id not found")
+
+	// errVersionMismatch signals that the account row was modified concurrently and the operation must be retried.
+	errVersionMismatch = errors.New("version mismatch")
+	// errAlreadyPending rolls back an Update of an account that already holds the transaction.
+	errAlreadyPending = errors.New("transaction already pending")
+	// errNotPending rolls back a Commit of a transaction that is not pending.
+	errNotPending = errors.New("transaction not pending")
+)
+
+type statement struct {
+	query string
+	args  []interface{}
+}
+
+// AccountStoreConfig contains the settings of an AccountStore.
+type AccountStoreConfig struct {
+	// Prefix of the account tables: <TablePrefix>, <TablePrefix>_items and <TablePrefix>_pending_transactions.
+	TablePrefix string
+	// Bind parameter syntax of the SQL driver.
+	Placeholder Placeholder
+}
+
+// AccountStore is a database/sql implementation of the dtpc.AccountHandler interface and the relational counterpart of example.HandlerImpl.
+// Accounts, per-item balances and pending transaction IDs are stored in normalized tables.
+// Every modification increments the version of the account row with a version checked UPDATE
+// and is retried when the account has been modified concurrently.
+//
+// AccountStore stores example.AccountDoc documents, expects example.Item transaction data and mirrors the semantics of example.HandlerImpl:
+//   - a decrement requires the balance to stay above zero;
+//   - Put replaces an account and clears its pending transactions;
+//   - Update of a transaction that is already pending succeeds without applying it again;
+//   - Commit of an unknown transaction ID succeeds;
+//   - Rollback of an unknown transaction ID returns ErrPendingTransactionIDNotFound.
+type AccountStore struct {
+	db                  *sql.DB
+	ph                  Placeholder
+	accountsTable       string
+	itemsTable          string
+	pendingTransactions string
+}
+
+// NewAccountStore initialises a new AccountStore with a given sql instance.
+// Migrate must be called before the store is used for the first time.
+func NewAccountStore(db *sql.DB, cfg AccountStoreConfig) (*AccountStore, error) {
+	if !identifierPattern.MatchString(cfg.TablePrefix) {
+		return nil, fmt.Errorf("invalid table prefix %q", cfg.TablePrefix)
+	}
+	return &AccountStore{
+		db:                  db,
+		ph:                  cfg.Placeholder,
+		accountsTable:       cfg.TablePrefix,
+		itemsTable:          cfg.TablePrefix + "_items",
+		pendingTransactions: cfg.TablePrefix + "_pending_transactions",
+	}, nil
+}
+
+// Migrate creates or upgrades the account tables.
+func (as *AccountStore) Migrate(ctx context.Context) error {
+	return migrate(ctx, as.db, as.ph, "accounts:"+as.accountsTable, []migration{
+		{
+			version: 1,
+			statements: []string{
+				fmt.Sprintf(`CREATE TABLE %s (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	version BIGINT NOT NULL
+)`, as.accountsTable),
+				fmt.Sprintf(`CREATE TABLE %s (
+	account_id VARCHAR(255) NOT NULL REFERENCES %s (id),
+	item_id VARCHAR(255) NOT NULL,
+	amount BIGINT NOT NULL,
+	PRIMARY KEY (account_id, item_id)
+)`, as.itemsTable, as.accountsTable),
+				fmt.Sprintf(`CREATE TABLE %s (
+	account_id VARCHAR(255) NOT NULL REFERENCES %s (id),
+	transaction_id VARCHAR(64) NOT NULL,
+	seq BIGINT NOT NULL,
+	PRIMARY KEY (account_id, transaction_id)
+)`, as.pendingTransactions, as.accountsTable),
+			},
+		},
+	})
+}
+
+// Get retrieves an account into retval, which must be an *example.AccountDoc.
+func (as *AccountStore) Get(ctx context.Context, accountID string, retval dtpc.Account) error {
+	doc, ok := retval.(*example.AccountDoc)
+	if !ok {
+		return fmt.Errorf("unsupported account type %T", retval)
+	}
+
+	tx, err := as.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ad, err := as.get(ctx, tx, accountID)
+	if err != nil {
+		return err
+	}
+	*doc = *ad
+	return tx.Commit()
+}
+
+// Put inserts an example.AccountDoc, replacing any account with the same ID.
+func (as *AccountStore) Put(ctx context.Context, doc dtpc.Account) error {
+	var ad example.AccountDoc
+	switch d := doc.(type) {
+	case example.AccountDoc:
+		ad = d
+	case *example.AccountDoc:
+		ad = *d
+	default:
+		return fmt.Errorf("unsupported account type %T", doc)
+	}
+
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []statement{
+		{fmt.Sprintf("DELETE FROM %s WHERE account_id = ?", as.pendingTransactions), []interface{}{ad.ID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE account_id = ?", as.itemsTable), []interface{}{ad.ID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE id = ?", as.accountsTable), []interface{}{ad.ID}},
+		{fmt.Sprintf("INSERT INTO %s (id, version) VALUES (?, ?)", as.accountsTable), []interface{}{ad.ID, ad.Version}},
+	}
+	for _, item := range ad.Resources {
+		q := fmt.Sprintf("INSERT INTO %s (account_id, item_id, amount) VALUES (?, ?, ?)", as.itemsTable)
+		stmts = append(stmts, statement{q, []interface{}{ad.ID, item.ID, item.Amount}})
+	}
+	for _, s := range stmts {
+		if _, err := tx.ExecContext(ctx, rebind(as.ph, s.query), s.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Update updates an account by applying a transaction and adding the ID of the transaction to its pending transactions.
+// Optimistic locking is applied to support concurrent updates to a single account.
+func (as *AccountStore) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	item, err := example.ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := example.Decrement
+	if accountID == tr.Destination {
+		method = example.Increment
+	}
+
+	err = as.retry(ctx, "Update", accountID, transactionID, func(tx *sql.Tx) error {
+		version, err := as.lock(ctx, tx, accountID)
+		if err != nil {
+			return err
+		}
+		// The pending transactions are checked after the lock, so that a concurrent Update of the same transaction
+		// either has committed its row or fails the version check.
+		pending, err := as.isPending(ctx, tx, accountID, transactionID)
+		if err != nil {
+			return err
+		}
+		if pending {
+			return errAlreadyPending
+		}
+		if err := as.modify(ctx, tx, accountID, item, method, false); err != nil {
+			return err
+		}
+		q := fmt.Sprintf("INSERT INTO %s (account_id, transaction_id, seq) VALUES (?, ?, ?)", as.pendingTransactions)
+		_, err = tx.ExecContext(ctx, rebind(as.ph, q), accountID, transactionID, version+1)
+		return err
+	})
+	if err == errAlreadyPending {
+		return nil
+	}
+	return err
+}
+
+// Commit removes a transaction ID from the pending transactions of an account.
+// Optimistic locking is applied to support concurrent updates to a single account.
+func (as *AccountStore) Commit(ctx context.Context, accountID, transactionID string) error {
+	err := as.retry(ctx, "Commit", accountID, transactionID, func(tx *sql.Tx) error {
+		if _, err := as.lock(ctx, tx, accountID); err != nil {
+			return err
+		}
+		// The pending transactions are checked after the lock, like in Update.
+		pending, err := as.isPending(ctx, tx, accountID, transactionID)
+		if err != nil {
+			return err
+		}
+		if !pending {
+			return errNotPending
+		}
+		return as.removePending(ctx, tx, accountID, transactionID)
+	})
+	if err == errNotPending {
+		return nil
+	}
+	return err
+}
+
+// Rollback recovers a failed transaction by applying the opposite logic of Update
+// and removes the transaction ID from the pending transactions of an account.
+// Optimistic locking is applied to support concurrent updates to a single account.
+func (as *AccountStore) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
+	item, err := example.ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+	method := example.Increment
+	if accountID == tr.Destination {
+		method = example.Decrement
+	}
+
+	return as.retry(ctx, "Rollback", accountID, transactionID, func(tx *sql.Tx) error {
+		if _, err := as.lock(ctx, tx, accountID); err != nil {
+			return err
+		}
+		// The pending transactions are checked after the lock, so that a concurrent Rollback of the same transaction
+		// either has committed the removal or fails the version check, like in Update.
+		pending, err := as.isPending(ctx, tx, accountID, transactionID)
+		if err != nil {
+			return err
+		}
+		if !pending {
+			return ErrPendingTransactionIDNotFound
+		}
+		if err := as.modify(ctx, tx, accountID, item, method, true); err != nil {
+			return err
+		}
+		return as.removePending(ctx, tx, accountID, transactionID)
+	})
+}
+
+// IsErrorPendingTransactionIDNotFound checks if a given error matches ErrPendingTransactionIDNotFound.
+func (as *AccountStore) IsErrorPendingTransactionIDNotFound(err error) bool {
+	return err == ErrPendingTransactionIDNotFound
+}
+
+// IsErrorInsufficientFunds checks if a given error matches ErrInsufficientFunds.
+func (as *AccountStore) IsErrorInsufficientFunds(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds)
+}
+
+// retry runs f in a database transaction until it succeeds without a version mismatch or the maximum number of attempts is reached.
+func (as *AccountStore) retry(ctx context.Context, op, accountID, transactionID string, f func(tx *sql.Tx) error) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := as.inTx(ctx, f)
+		if err != errVersionMismatch {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(updateRetryInterval):
+		}
+	}
+	return fmt.Errorf("%s failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s: %w", op, transactionID, accountID, ErrConflict)
+}
+
+func (as *AccountStore) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lock increments the version of an account row if it still matches the version read at the start of the operation.
+// It returns the version read.
+func (as *AccountStore) lock(ctx context.Context, tx *sql.Tx, accountID string) (int, error) {
+	var version int
+	q := fmt.Sprintf("SELECT version FROM %s WHERE id = ?", as.accountsTable)
+	if err := tx.QueryRowContext(ctx, rebind(as.ph, q), accountID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errAccountNotFound
+		}
+		return 0, err
+	}
+
+	q = fmt.Sprintf("UPDATE %s SET version = ? WHERE id = ? AND version = ?", as.accountsTable)
+	res, err := tx.ExecContext(ctx, rebind(as.ph, q), version+1, accountID, version)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return 0, errVersionMismatch
+	}
+	return version, nil
+}
+
+// modify applies an item to an account. A decrement must leave a positive balance, except for the rollback of a
+// credit, which may take the balance down to zero.
+func (as *AccountStore) modify(ctx context.Context, tx *sql.Tx, accountID string, item example.Item, method example.TransactionMethod, rollback bool) error {
+	var q string
+	switch {
+	case method == example.Increment:
+		q = fmt.Sprintf("UPDATE %s SET amount = amount + ? WHERE account_id = ? AND item_id = ?", as.itemsTable)
+	case method == example.Decrement && rollback:
+		q = fmt.Sprintf("UPDATE %s SET amount = amount - ? WHERE account_id = ? AND item_id = ? AND amount >= ?", as.itemsTable)
+	case method == example.Decrement:
+		q = fmt.Sprintf("UPDATE %s SET amount = amount - ? WHERE account_id = ? AND item_id = ? AND amount > ?", as.itemsTable)
+	default:
+		return fmt.Errorf("unsupported transaction method %d", method)
+	}
+
+	args := []interface{}{item.Amount, accountID, item.ID}
+	if method == example.Decrement {
+		args = append(args, item.Amount)
+	}
+	res, err := tx.ExecContext(ctx, rebind(as.ph, q), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+
+	var amount int
+	q = fmt.Sprintf("SELECT amount FROM %s WHERE account_id = ? AND item_id = ?", as.itemsTable)
+	if err := tx.QueryRowContext(ctx, rebind(as.ph, q), accountID, item.ID).Scan(&amount); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account %s has no resource with ID %s", accountID, item.ID)
+		}
+		return err
+	}
+	return ErrInsufficientFunds
+}
+
+func (as *AccountStore) isPending(ctx context.Context, tx *sql.Tx, accountID, transactionID string) (bool, error) {
+	var n int
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE account_id = ? AND transaction_id = ?", as.pendingTransactions)
+	if err := tx.QueryRowContext(ctx, rebind(as.ph, q), accountID, transactionID).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (as *AccountStore) removePending(ctx context.Context, tx *sql.Tx, accountID, transactionID string) error {
+	q := fmt.Sprintf("DELETE FROM %s WHERE account_id = ? AND transaction_id = ?", as.pendingTransactions)
+	_, err := tx.ExecContext(ctx, rebind(as.ph, q), accountID, transactionID)
+	return err
+}
+
+func (as *AccountStore) get(ctx context.Context, tx *sql.Tx, accountID string) (*example.AccountDoc, error) {
+	ad := &example.AccountDoc{
+		ID:                  accountID,
+		Resources:           make(map[string]example.Item),
+		PendingTransactions: []string{},
+	}
+
+	q := fmt.Sprintf("SELECT version FROM %s WHERE id = ?", as.accountsTable)
+	if err := tx.QueryRowContext(ctx, rebind(as.ph, q), accountID).Scan(&ad.Version); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errAccountNotFound
+		}
+		return nil, err
+	}
+
+	q = fmt.Sprintf("SELECT item_id, amount FROM %s WHERE account_id = ?", as.itemsTable)
+	rows, err := tx.QueryContext(ctx, rebind(as.ph, q), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item := example.Item{}
+		if err := rows.Scan(&item.ID, &item.Amount); err != nil {
+			return nil, err
+		}
+		ad.Resources[item.ID] = item
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first, like the list_append of example.HandlerImpl.
+	q = fmt.Sprintf("SELECT transaction_id FROM %s WHERE account_id = ? ORDER BY seq DESC", as.pendingTransactions)
+	prows, err := tx.QueryContext(ctx, rebind(as.ph, q), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var id string
+		if err := prows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ad.PendingTransactions = append(ad.PendingTransactions, id)
+	}
+	return ad, prows.Err()
+}
@@ -0,0 +1,272 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dtpc"
+	"dtpc/testsuite/example"
+)
+
+func newTestAccountStore(t *testing.T, db *sql.DB, amount int, ids ...string) *AccountStore {
+	ctx := context.Background()
+	as, err := NewAccountStore(db, AccountStoreConfig{
+		TablePrefix: "accounts",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		doc := example.AccountDoc{
+			ID: id,
+			Resources: map[string]example.Item{
+				"item1": {ID: "item1", Amount: amount},
+				"item2": {ID: "item2", Amount: amount},
+			},
+		}
+		if err := as.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return as
+}
+
+func getAccount(t *testing.T, as *AccountStore, accountID string) example.AccountDoc {
+	ad := example.AccountDoc{}
+	if err := as.Get(context.Background(), accountID, &ad); err != nil {
+		t.Fatal(err)
+	}
+	return ad
+}
+
+func getTransactionRequest(source, destination string, amount int) dtpc.Request {
+	return dtpc.Request{
+		Source:      source,
+		Destination: destination,
+		Reference:   source + ":" + destination,
+		Data:        example.Item{ID: "item1", Amount: amount},
+	}
+}
+
+func TestAccountStoreGetAndPut(t *testing.T) {
+	as := newTestAccountStore(t, newTestDB(t), 100, "account1")
+
+	ad := getAccount(t, as, "account1")
+	if ad.ID != "account1" || len(ad.Resources) != 2 || ad.Resources["item2"].Amount != 100 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+
+	if err := as.Get(context.Background(), "unknown", &example.AccountDoc{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+}
+
+func TestAccountStoreUpdateCommitRollback(t *testing.T) {
+	ctx := context.Background()
+	as := newTestAccountStore(t, newTestDB(t), 100, "account1", "account2")
+	req := getTransactionRequest("account1", "account2", 10)
+
+	for _, id := range []string{"account1", "account2"} {
+		if err := as.Update(ctx, id, "transaction1", req); err != nil {
+			t.Fatal(err)
+		}
+		if err := as.Update(ctx, id, "transaction2", req); err != nil {
+			t.Fatal(err)
+		}
+		// Updating twice is a no-op.
+		if err := as.Update(ctx, id, "transaction2", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ad := getAccount(t, as, "account1")
+	if ad.Resources["item1"].Amount != 80 {
+		t.Fatalf("expected account1 balance to be 80 but got %d", ad.Resources["item1"].Amount)
+	}
+	if len(ad.PendingTransactions) != 2 || ad.PendingTransactions[0] != "transaction2" {
+		t.Fatalf("unexpected pending transactions %v", ad.PendingTransactions)
+	}
+	if ad.Version != 2 {
+		t.Fatalf("expected version to be 2 but got %d", ad.Version)
+	}
+
+	for _, id := range []string{"account1", "account2"} {
+		if err := as.Commit(ctx, id, "transaction1"); err != nil {
+			t.Fatal(err)
+		}
+		// Committing twice is a no-op.
+		if err := as.Commit(ctx, id, "transaction1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := as.Rollback(ctx, id, "transaction2", req); err != nil {
+			t.Fatal(err)
+		}
+		if err := as.Rollback(ctx, id, "transaction2", req); !as.IsErrorPendingTransactionIDNotFound(err) {
+			t.Fatalf("expected %v but got %v", ErrPendingTransactionIDNotFound, err)
+		}
+	}
+
+	if ad := getAccount(t, as, "account1"); ad.Resources["item1"].Amount != 90 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+	if ad := getAccount(t, as, "account2"); ad.Resources["item1"].Amount != 110 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
+
+func TestAccountStoreInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	as := newTestAccountStore(t, newTestDB(t), 10, "account1", "account2")
+
+	// Like example.HandlerImpl, a decrement must leave a positive balance.
+	if err := as.Update(ctx, "account1", "transaction1", getTransactionRequest("account1", "account2", 10)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", ErrInsufficientFunds, err)
+	}
+	ad := getAccount(t, as, "account1")
+	if ad.Resources["item1"].Amount != 10 || len(ad.PendingTransactions) > 0 || ad.Version != 0 {
+		t.Fatalf("expected account to be unchanged but got %+v", ad)
+	}
+
+	req := getTransactionRequest("account1", "account2", 1)
+	req.Data = example.Item{ID: "unknown", Amount: 1}
+	if err := as.Update(ctx, "account2", "transaction1", req); err == nil {
+		t.Fatal("expected error for unknown resource")
+	}
+}
+
+func TestAccountStoreConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	as := newTestAccountStore(t, newTestDB(t), 100, "account1", "account2")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := as.Update(ctx, "account2", string(rune('a'+i)), getTransactionRequest("account1", "account2", 1)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ad := getAccount(t, as, "account2")
+	if ad.Resources["item1"].Amount != 120 || len(ad.PendingTransactions) != 20 || ad.Version != 20 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
+
+func TestAccountStoreConcurrentRollbacks(t *testing.T) {
+	ctx := context.Background()
+	as := newTestAccountStore(t, newTestDB(t), 100, "account1", "account2")
+	req := getTransactionRequest("account1", "account2", 10)
+	if err := as.Update(ctx, "account1", "transaction1", req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rollback retried concurrently is applied once, and the other attempts find the transaction not pending.
+	var mu sync.Mutex
+	applied := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := as.Rollback(ctx, "account1", "transaction1", req)
+			if err != nil && !as.IsErrorPendingTransactionIDNotFound(err) {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				applied++
+			}
+		}()
+	}
+	wg.Wait()
+
+	ad := getAccount(t, as, "account1")
+	if applied != 1 || ad.Resources["item1"].Amount != 100 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("expected a single rollback but got %d and %+v", applied, ad)
+	}
+}
+
+func TestServiceWithSQLStores(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	ts := newTestTransactionStore(t, db, 0)
+	as := newTestAccountStore(t, db, 100, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	if _, err := srv.StartTransaction(ctx, getTransactionRequest("account1", "account2", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.StartTransaction(ctx, getTransactionRequest("account1", "account2", 100)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected %v but got %v", ErrInsufficientFunds, err)
+	}
+
+	if ad := getAccount(t, as, "account1"); ad.Resources["item1"].Amount != 90 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+	if ad := getAccount(t, as, "account2"); ad.Resources["item1"].Amount != 110 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
+
+func TestRecoverTransactionsWithSQLStores(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	ts := newTestTransactionStore(t, db, 0)
+	as := newTestAccountStore(t, db, 30, "account1", "account2")
+	srv := dtpc.NewService(ts, as)
+
+	req := getTransactionRequest("account1", "account2", 10)
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		id, err := ts.Insert(ctx, req.Source, req.Destination, req.Reference, req.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, accountID := range []string{"account1", "account2"} {
+			if err := as.Update(ctx, accountID, id, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, id)
+	}
+	if _, err := ts.UpdateState(ctx, ids[0], dtpc.Applied); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.RecoverTransactions(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]dtpc.TransactionState{
+		ids[0]: dtpc.Done,
+		ids[1]: dtpc.Cancelled,
+	}
+	for id, state := range expected {
+		tr, err := ts.GetTransaction(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.TransactionState != state {
+			t.Fatalf("expected transaction state to be %d but got %d", state, tr.TransactionState)
+		}
+	}
+	if ad := getAccount(t, as, "account1"); ad.Resources["item1"].Amount != 20 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+	if ad := getAccount(t, as, "account2"); ad.Resources["item1"].Amount != 40 || len(ad.PendingTransactions) > 0 {
+		t.Fatalf("unexpected account %+v", ad)
+	}
+}
@@ -0,0 +1,17 @@
+package sqlstore
+
+import (
+	"testing"
+
+	"dtpc"
+	"dtpc/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunAccountHandlerSuite(t, func(t *testing.T) conformance.AccountFixture {
+		return conformance.ExampleAccountFixture(newTestAccountStore(t, newTestDB(t), 0))
+	})
+	conformance.RunTransactionHandlerSuite(t, func(t *testing.T) dtpc.TransactionHandler {
+		return newTestTransactionStore(t, newTestDB(t), 0)
+	})
+}
@@ -0,0 +1,91 @@
+// Package sqlstore provides database/sql backed implementations of the dtpc handler interfaces.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholder defines the bind parameter syntax of the underlying SQL driver.
+type Placeholder int
+
+const (
+	// Question uses ? placeholders, as expected by SQLite and MySQL drivers.
+	Question Placeholder = iota
+	// Dollar uses $1, $2, ... placeholders, as expected by PostgreSQL drivers.
+	Dollar
+)
+
+const migrationsTableName = "dtpc_schema_migrations"
+
+// migration is a single schema change of a component. Statements are executed in order within one transaction.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrate applies all migrations of a component that have not been recorded in the migrations table yet.
+func migrate(ctx context.Context, db *sql.DB, ph Placeholder, component string, migrations []migration) error {
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (component VARCHAR(255) NOT NULL, version INTEGER NOT NULL, applied_at BIGINT NOT NULL, PRIMARY KEY (component, version))", migrationsTableName)
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := applyMigration(ctx, db, ph, component, m); err != nil {
+			return fmt.Errorf("failed to apply migration %d of %s: %w", m.version, component, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, ph Placeholder, component string, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	q := rebind(ph, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE component = ? AND version = ?", migrationsTableName))
+	if err := tx.QueryRowContext(ctx, q, component, m.version).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	for _, s := range m.statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	q = rebind(ph, fmt.Sprintf("INSERT INTO %s (component, version, applied_at) VALUES (?, ?, ?)", migrationsTableName))
+	if _, err := tx.ExecContext(ctx, q, component, m.version, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind converts a query written with ? placeholders into the syntax of ph.
+func rebind(ph Placeholder, query string) string {
+	if ph != Dollar {
+		return query
+	}
+	b := strings.Builder{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
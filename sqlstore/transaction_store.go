@@ -0,0 +1,332 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"dtpc"
+)
+
+const (
+	maxUpdateAttempts = 10
+	defaultPageSize   = 100
+)
+
+var (
+	// ErrNotFound is returned when a requested row does not exist.
+	// The errors also match dtpc.ErrTransactionNotFound or dtpc.ErrAccountNotFound.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a version checked update kept failing because of concurrent modifications.
+	ErrConflict = dtpc.ErrConflict
+	// ErrInvalidCursor is returned when a page cursor cannot be decoded.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	errTransactionNotFound = dtpc.WrapError(dtpc.ErrTransactionNotFound, ErrNotFound)
+	errAccountNotFound     = dtpc.WrapError(dtpc.ErrAccountNotFound, ErrNotFound)
+)
+
+// TransactionStoreConfig contains the settings of a TransactionStore.
+type TransactionStoreConfig struct {
+	// Name of the transaction table. The state index is named <TableName>_state_index.
+	TableName string
+	// Bind parameter syntax of the SQL driver.
+	Placeholder Placeholder
+	// Number of rows fetched per query by GetTransactionsInState and GetAllTransactionsInState. Defaults to 100.
+	PageSize int
+}
+
+// TransactionStore is a database/sql implementation of the dtpc.TransactionHandler interface.
+// Every row carries a version number which is checked by UpdateState to detect concurrent modifications.
+type TransactionStore struct {
+	db        *sql.DB
+	tableName string
+	ph        Placeholder
+	pageSize  int
+}
+
+// Page contains a single page of transactions returned by GetTransactionsInStatePage.
+type Page struct {
+	Transactions []*dtpc.Transaction
+	// NextCursor is passed to the next call to continue the query. It is empty on the last page.
+	NextCursor string
+}
+
+// NewTransactionStore initialises a new TransactionStore with a given sql instance.
+// Migrate must be called before the store is used for the first time.
+func NewTransactionStore(db *sql.DB, cfg TransactionStoreConfig) (*TransactionStore, error) {
+	if !identifierPattern.MatchString(cfg.TableName) {
+		return nil, fmt.Errorf("invalid table name %q", cfg.TableName)
+	}
+	if cfg.PageSize < 0 {
+		return nil, fmt.Errorf("invalid page size %d", cfg.PageSize)
+	}
+	if cfg.PageSize == 0 {
+		cfg.PageSize = defaultPageSize
+	}
+	return &TransactionStore{
+		db:        db,
+		tableName: cfg.TableName,
+		ph:        cfg.Placeholder,
+		pageSize:  cfg.PageSize,
+	}, nil
+}
+
+// Migrate creates or upgrades the transaction table and its state index.
+func (ts *TransactionStore) Migrate(ctx context.Context) error {
+	return migrate(ctx, ts.db, ts.ph, "transactions:"+ts.tableName, []migration{
+		{
+			version: 1,
+			statements: []string{
+				fmt.Sprintf(`CREATE TABLE %s (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	transaction_reference VARCHAR(255) NOT NULL,
+	transaction_state INTEGER NOT NULL,
+	source VARCHAR(255) NOT NULL,
+	destination VARCHAR(255) NOT NULL,
+	value TEXT NOT NULL,
+	last_modified BIGINT NOT NULL,
+	version BIGINT NOT NULL
+)`, ts.tableName),
+				// Equivalent of the state-index GSI of the DynamoDB TransactionStore.
+				fmt.Sprintf("CREATE INDEX %s_state_index ON %s (transaction_state, transaction_reference, id)", ts.tableName, ts.tableName),
+			},
+		},
+		{
+			version: 2,
+			statements: []string{
+				// Deadline of a transaction in unix nanoseconds, 0 if the transaction does not expire.
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0", ts.tableName),
+			},
+		},
+	})
+}
+
+// Insert adds a transaction row in Pending state to the transaction table.
+func (ts *TransactionStore) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
+	return ts.InsertWithExpiry(ctx, source, destination, reference, data, time.Time{})
+}
+
+// InsertWithExpiry adds a transaction row with a deadline in Pending state to the transaction table.
+func (ts *TransactionStore) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
+	id := uuid.New().String()
+	t := dtpc.NewTransaction(id, source, destination, reference, data, expiresAt)
+
+	value, err := json.Marshal(t.Value)
+	if err != nil {
+		return id, err
+	}
+
+	q := fmt.Sprintf("INSERT INTO %s (id, transaction_reference, transaction_state, source, destination, value, last_modified, expires_at, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)", ts.tableName)
+	if _, err := ts.db.ExecContext(ctx, rebind(ts.ph, q), id, t.TransactionReference, t.TransactionState, t.Source, t.Destination, string(value), t.LastModified.UnixNano(), encodeTime(t.ExpiresAt)); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// UpdateState updates the state of a transaction row.
+// The update is conditional on the row version read beforehand and is retried on concurrent modifications.
+// The state of a finished transaction can only be set again to the same state, and the new state must be able to
+// follow the current state.
+func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState dtpc.TransactionState) (*dtpc.Transaction, error) {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		tr, version, err := ts.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !tr.TransactionState.CanChangeTo(newState) {
+			return nil, dtpc.TransitionError(id, tr.TransactionState, newState)
+		}
+
+		tr.TransactionState = newState
+		tr.LastModified = time.Now()
+
+		q := fmt.Sprintf("UPDATE %s SET transaction_state = ?, last_modified = ?, version = ? WHERE id = ? AND version = ?", ts.tableName)
+		res, err := ts.db.ExecContext(ctx, rebind(ts.ph, q), newState, tr.LastModified.UnixNano(), version+1, id, version)
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return tr, nil
+		}
+	}
+	return nil, fmt.Errorf("UpdateState failed after %d attempts. transactionID: %s: %w", maxUpdateAttempts, id, ErrConflict)
+}
+
+// GetTransaction retrieves a transaction row by its ID value.
+func (ts *TransactionStore) GetTransaction(ctx context.Context, id string) (*dtpc.Transaction, error) {
+	tr, _, err := ts.get(ctx, id)
+	return tr, err
+}
+
+// GetTransactionsInState gets all transactions of a given state whose reference starts with query.
+func (ts *TransactionStore) GetTransactionsInState(ctx context.Context, state dtpc.TransactionState, query string) ([]*dtpc.Transaction, error) {
+	return ts.getAllPages(ctx, state, query)
+}
+
+// GetAllTransactionsInState gets all transactions of a given state.
+// GetAllTransactionsInState is used for recovering all incomplete/failed transactions.
+func (ts *TransactionStore) GetAllTransactionsInState(ctx context.Context, state dtpc.TransactionState) ([]*dtpc.Transaction, error) {
+	return ts.getAllPages(ctx, state, "")
+}
+
+// GetTransactionsInStatePage gets up to limit transactions of a given state whose reference starts with query,
+// ordered by reference and ID. An empty cursor starts from the first page.
+func (ts *TransactionStore) GetTransactionsInStatePage(ctx context.Context, state dtpc.TransactionState, query, cursor string, limit int) (*Page, error) {
+	if limit <= 0 {
+		limit = ts.pageSize
+	}
+
+	conds := []string{"transaction_state = ?"}
+	args := []interface{}{state}
+	if query != "" {
+		// A range of the reference can use the index on state and reference, unlike a function of the reference.
+		conds = append(conds, "transaction_reference >= ?")
+		args = append(args, query)
+		if end, ok := prefixEnd(query); ok {
+			conds = append(conds, "transaction_reference < ?")
+			args = append(args, end)
+		}
+	}
+	if cursor != "" {
+		ref, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, "(transaction_reference > ? OR (transaction_reference = ? AND id > ?))")
+		args = append(args, ref, ref, id)
+	}
+	args = append(args, limit)
+
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY transaction_reference, id LIMIT ?", transactionColumns, ts.tableName, strings.Join(conds, " AND "))
+	rows, err := ts.db.QueryContext(ctx, rebind(ts.ph, q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page{
+		Transactions: []*dtpc.Transaction{},
+	}
+	for rows.Next() {
+		tr, _, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Transactions = append(page.Transactions, tr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Transactions) == limit {
+		last := page.Transactions[len(page.Transactions)-1]
+		page.NextCursor = encodeCursor(last.TransactionReference, last.ID)
+	}
+	return page, nil
+}
+
+func (ts *TransactionStore) getAllPages(ctx context.Context, state dtpc.TransactionState, query string) ([]*dtpc.Transaction, error) {
+	transactions := []*dtpc.Transaction{}
+	cursor := ""
+	for {
+		page, err := ts.GetTransactionsInStatePage(ctx, state, query, cursor, ts.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, page.Transactions...)
+		if page.NextCursor == "" {
+			return transactions, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+const transactionColumns = "id, transaction_reference, transaction_state, source, destination, value, last_modified, expires_at, version"
+
+func (ts *TransactionStore) get(ctx context.Context, id string) (*dtpc.Transaction, int64, error) {
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", transactionColumns, ts.tableName)
+	tr, version, err := scanTransaction(ts.db.QueryRowContext(ctx, rebind(ts.ph, q), id))
+	if err == sql.ErrNoRows {
+		return nil, 0, errTransactionNotFound
+	}
+	return tr, version, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(s scanner) (*dtpc.Transaction, int64, error) {
+	tr := &dtpc.Transaction{}
+	var value string
+	var lastModified, expiresAt, version int64
+	if err := s.Scan(&tr.ID, &tr.TransactionReference, &tr.TransactionState, &tr.Source, &tr.Destination, &value, &lastModified, &expiresAt, &version); err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal([]byte(value), &tr.Value); err != nil {
+		return nil, 0, err
+	}
+	tr.LastModified = time.Unix(0, lastModified)
+	if expiresAt != 0 {
+		tr.ExpiresAt = time.Unix(0, expiresAt)
+	}
+	return tr, version, nil
+}
+
+// prefixEnd returns the smallest string greater than all strings starting with prefix, in the binary order of
+// their UTF-8 encoding. It reports false if there is none, i.e. all runes of prefix are utf8.MaxRune.
+func prefixEnd(prefix string) (string, bool) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == utf8.MaxRune {
+			continue
+		}
+		next := runes[i] + 1
+		if next == 0xD800 {
+			// Surrogates cannot be encoded in UTF-8.
+			next = 0xE000
+		}
+		return string(append(runes[:i], next)), true
+	}
+	return "", false
+}
+
+// encodeTime returns t in unix nanoseconds, or 0 for the zero time.
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func encodeCursor(reference, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(reference + "\x00" + id))
+}
+
+func decodeCursor(cursor string) (string, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", ErrInvalidCursor
+	}
+	return parts[0], parts[1], nil
+}
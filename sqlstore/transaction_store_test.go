@@ -0,0 +1,290 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"dtpc"
+	"dtpc/dtpctest"
+	"dtpc/testsuite/example"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "dtpc.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite allows a single writer at a time.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func newTestTransactionStore(t *testing.T, db *sql.DB, pageSize int) *TransactionStore {
+	ts, err := NewTransactionStore(db, TransactionStoreConfig{
+		TableName: "transactions",
+		PageSize:  pageSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestNewTransactionStoreInvalidConfig(t *testing.T) {
+	configs := []TransactionStoreConfig{
+		{TableName: ""},
+		{TableName: "transactions; DROP TABLE accounts"},
+		{TableName: "transactions", PageSize: -1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewTransactionStore(nil, cfg); err == nil {
+			t.Fatalf("expected error for config %+v", cfg)
+		}
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	ts := newTestTransactionStore(t, db, 0)
+	if err := ts.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertAndGetTransaction(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestTransactionStore(t, newTestDB(t), 0)
+
+	id, err := ts.Insert(ctx, "account1", "account2", "account1:account2", example.Item{ID: "item1", Amount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := ts.GetTransaction(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.ID != id || tr.Source != "account1" || tr.Destination != "account2" || tr.TransactionReference != "account1:account2" {
+		t.Fatalf("unexpected transaction %+v", tr)
+	}
+	if tr.TransactionState != dtpc.Pending {
+		t.Fatalf("expected transaction state to be %d but got %d", dtpc.Pending, tr.TransactionState)
+	}
+	value, ok := tr.Value.(map[string]interface{})
+	if !ok || value["ID"] != "item1" || value["Amount"] != float64(10) {
+		t.Fatalf("unexpected transaction value %v", tr.Value)
+	}
+
+	if !tr.ExpiresAt.IsZero() {
+		t.Fatalf("expected transaction without deadline but got %v", tr.ExpiresAt)
+	}
+
+	if _, err := ts.GetTransaction(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+}
+
+func TestInsertWithExpiry(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestTransactionStore(t, newTestDB(t), 0)
+
+	expiresAt := time.Now().Add(time.Minute)
+	id, err := ts.InsertWithExpiry(ctx, "account1", "account2", "account1:account2", example.Item{ID: "item1", Amount: 10}, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := ts.GetTransaction(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected deadline %v but got %v", expiresAt, tr.ExpiresAt)
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestTransactionStore(t, newTestDB(t), 0)
+
+	id, err := ts.Insert(ctx, "account1", "account2", "account1:account2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := []dtpc.TransactionState{
+		dtpc.Canceling,
+		dtpc.Canceling,
+		dtpc.Cancelled,
+		dtpc.Cancelled,
+	}
+	for _, s := range states {
+		tr, err := ts.UpdateState(ctx, id, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.TransactionState != s {
+			t.Fatalf("expected transaction state to be %d but got %d", s, tr.TransactionState)
+		}
+	}
+
+	if _, err := ts.UpdateState(ctx, id, dtpc.Done); !errors.Is(err, dtpc.ErrTransactionFinished) {
+		t.Fatalf("expected %v but got %v", dtpc.ErrTransactionFinished, err)
+	}
+	if _, err := ts.UpdateState(ctx, "unknown", dtpc.Done); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+}
+
+func TestConcurrentUpdateState(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	ts := newTestTransactionStore(t, db, 0)
+
+	id, err := ts.Insert(ctx, "account1", "account2", "account1:account2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ts.UpdateState(ctx, id, dtpc.Applied); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var version int
+	if err := db.QueryRow("SELECT version FROM transactions WHERE id = ?", id).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 6 {
+		t.Fatalf("expected version to be 6 but got %d", version)
+	}
+}
+
+func TestGetTransactionsInStatePagination(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestTransactionStore(t, newTestDB(t), 2)
+
+	for i := 0; i < 5; i++ {
+		if _, err := ts.Insert(ctx, "account1", "account2", fmt.Sprintf("account1:account2:%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.Insert(ctx, "account3", "account2", "account3:account2:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The successor of the query prefix is not part of its range.
+	if _, err := ts.Insert(ctx, "account1", "account2", "account1;", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := ts.GetTransactionsInState(ctx, dtpc.Pending, "account1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 5 {
+		t.Fatalf("expected 5 transactions but got %d", len(transactions))
+	}
+	for i, tr := range transactions {
+		if ref := fmt.Sprintf("account1:account2:%d", i); tr.TransactionReference != ref {
+			t.Fatalf("expected reference %s but got %s", ref, tr.TransactionReference)
+		}
+	}
+
+	page, err := ts.GetTransactionsInStatePage(ctx, dtpc.Pending, "", "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 4 || page.NextCursor == "" {
+		t.Fatalf("expected a full first page but got %d transactions", len(page.Transactions))
+	}
+	page, err = ts.GetTransactionsInStatePage(ctx, dtpc.Pending, "", page.NextCursor, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 3 || page.NextCursor != "" {
+		t.Fatalf("expected a last page of 3 transactions but got %d", len(page.Transactions))
+	}
+
+	all, err := ts.GetAllTransactionsInState(ctx, dtpc.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 7 {
+		t.Fatalf("expected 7 transactions but got %d", len(all))
+	}
+
+	if _, err := ts.GetTransactionsInStatePage(ctx, dtpc.Pending, "", "%%%", 4); err != ErrInvalidCursor {
+		t.Fatalf("expected %v but got %v", ErrInvalidCursor, err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := []struct {
+		prefix, end string
+		ok          bool
+	}{
+		{"account1:", "account1;", true},
+		{"a\U0010FFFF", "b", true},
+		{"\uD7FF", "\uE000", true},
+		{"\U0010FFFF", "", false},
+	}
+	for _, c := range cases {
+		if end, ok := prefixEnd(c.prefix); end != c.end || ok != c.ok {
+			t.Fatalf("expected the end of %q to be %q, %v but got %q, %v", c.prefix, c.end, c.ok, end, ok)
+		}
+	}
+}
+
+func TestServiceWithTransactionStore(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestTransactionStore(t, newTestDB(t), 0)
+	as := dtpctest.NewAccountStore()
+	for _, id := range []string{"account1", "account2"} {
+		doc := dtpctest.AccountDoc{
+			ID:        id,
+			Resources: map[string]dtpctest.Item{"item1": {ID: "item1", Amount: 100}},
+		}
+		if err := as.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := dtpc.NewService(ts, as)
+
+	req := dtpc.Request{
+		Source:      "account1",
+		Destination: "account2",
+		Reference:   "account1:account2",
+		Data:        dtpctest.Item{ID: "item1", Amount: 10},
+	}
+	if _, err := srv.StartTransaction(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := srv.GetTransactions(ctx, dtpc.Done, "account1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 {
+		t.Fatalf("expected 1 done transaction but got %d", len(done))
+	}
+}
@@ -0,0 +1,346 @@
+package dtpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const defaultTablePollInterval = time.Second
+
+// TablesConfig describes the tables provisioned by EnsureTables.
+type TablesConfig struct {
+	// Schema of the transaction table and its state index
+	Transactions TransactionStoreConfig
+	// Name of the account table used by ledger.Handler or example.HandlerImpl. The account table is skipped when empty.
+	AccountsTableName string
+	// Name of the partition key of the account table
+	AccountsHashKey string
+	// dynamodb.BillingModePayPerRequest (default) or dynamodb.BillingModeProvisioned
+	BillingMode string
+	// Read and write capacity units of tables and indexes with provisioned billing
+	ReadCapacityUnits  int64
+	WriteCapacityUnits int64
+	// Interval between two checks of the table status. Defaults to one second.
+	PollInterval time.Duration
+}
+
+// tableSpec is the expected schema of a single table.
+type tableSpec struct {
+	name    string
+	hashKey string
+	attrs   map[string]string
+	indexes []indexSpec
+}
+
+// indexSpec is the expected schema of a global secondary index.
+type indexSpec struct {
+	name     string
+	hashKey  string
+	rangeKey string
+	// Non-key attributes that must be projected into the index
+	include []string
+}
+
+// EnsureTables creates the transaction table, its state index and the account table if they do not exist,
+// adds missing indexes to existing tables and waits until all of them are active.
+// Existing tables and indexes are verified against the expected key schema and an error is returned on mismatch.
+func EnsureTables(ctx context.Context, db dynamodbiface.DynamoDBAPI, cfg TablesConfig) error {
+	tcfg := cfg.Transactions.withDefaults()
+	if err := tcfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.BillingMode == "" {
+		cfg.BillingMode = dynamodb.BillingModePayPerRequest
+	}
+	if cfg.BillingMode != dynamodb.BillingModePayPerRequest && cfg.BillingMode != dynamodb.BillingModeProvisioned {
+		return fmt.Errorf("unsupported billing mode %s", cfg.BillingMode)
+	}
+	if cfg.BillingMode == dynamodb.BillingModeProvisioned && (cfg.ReadCapacityUnits <= 0 || cfg.WriteCapacityUnits <= 0) {
+		return fmt.Errorf("read and write capacity units are required with provisioned billing")
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultTablePollInterval
+	}
+
+	specs := []tableSpec{transactionTableSpec(tcfg)}
+	if cfg.AccountsTableName != "" {
+		if cfg.AccountsHashKey == "" {
+			return fmt.Errorf("account table hash key is required")
+		}
+		specs = append(specs, tableSpec{
+			name:    cfg.AccountsTableName,
+			hashKey: cfg.AccountsHashKey,
+			attrs:   map[string]string{cfg.AccountsHashKey: dynamodb.ScalarAttributeTypeS},
+		})
+	}
+
+	for _, spec := range specs {
+		if err := ensureTable(ctx, db, cfg, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func transactionTableSpec(cfg TransactionStoreConfig) tableSpec {
+	a := cfg.Attributes
+	stateKey := cfg.stateIndexHashKey()
+	keys := map[string]bool{a.ID: true, stateKey: true, a.Reference: true}
+	include := []string{}
+	for _, p := range cfg.Projection {
+		if !keys[p] {
+			include = append(include, p)
+		}
+	}
+	stateKeyType := dynamodb.ScalarAttributeTypeN
+	if cfg.sharded() {
+		stateKeyType = dynamodb.ScalarAttributeTypeS
+	}
+	return tableSpec{
+		name:    cfg.TableName,
+		hashKey: a.ID,
+		attrs: map[string]string{
+			a.ID:        dynamodb.ScalarAttributeTypeS,
+			stateKey:    stateKeyType,
+			a.Reference: dynamodb.ScalarAttributeTypeS,
+		},
+		indexes: []indexSpec{
+			{
+				name:     cfg.StateIndexName,
+				hashKey:  stateKey,
+				rangeKey: a.Reference,
+				include:  include,
+			},
+		},
+	}
+}
+
+func ensureTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, cfg TablesConfig, spec tableSpec) error {
+	desc, err := describeTable(ctx, db, spec.name)
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		if _, err := db.CreateTableWithContext(ctx, createTableInput(cfg, spec)); err != nil {
+			return err
+		}
+		_, err := waitForTable(ctx, db, cfg, spec.name)
+		return err
+	}
+
+	if err := verifyKeySchema(desc.KeySchema, spec.hashKey, ""); err != nil {
+		return fmt.Errorf("table %s: %w", spec.name, err)
+	}
+	for _, index := range spec.indexes {
+		existing := findIndex(desc, index.name)
+		if existing != nil {
+			if err := verifyIndex(existing, index); err != nil {
+				return fmt.Errorf("index %s of table %s: %w", index.name, spec.name, err)
+			}
+			continue
+		}
+		// DynamoDB only allows a single index to be created per UpdateTable call.
+		in := &dynamodb.UpdateTableInput{
+			TableName:            aws.String(spec.name),
+			AttributeDefinitions: attributeDefinitions(spec, index),
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+				{Create: createIndexAction(cfg, index)},
+			},
+		}
+		if _, err := db.UpdateTableWithContext(ctx, in); err != nil {
+			return err
+		}
+		if desc, err = waitForTable(ctx, db, cfg, spec.name); err != nil {
+			return err
+		}
+	}
+	_, err = waitForTable(ctx, db, cfg, spec.name)
+	return err
+}
+
+// describeTable returns the description of a table, or nil if the table does not exist.
+func describeTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, name string) (*dynamodb.TableDescription, error) {
+	res, err := db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return res.Table, nil
+}
+
+// waitForTable polls the table description until the table and all its indexes are active.
+func waitForTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, cfg TablesConfig, name string) (*dynamodb.TableDescription, error) {
+	for {
+		desc, err := describeTable(ctx, db, name)
+		if err != nil {
+			return nil, err
+		}
+		if desc != nil && isTableActive(desc) {
+			return desc, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+func isTableActive(desc *dynamodb.TableDescription) bool {
+	if aws.StringValue(desc.TableStatus) != dynamodb.TableStatusActive {
+		return false
+	}
+	for _, index := range desc.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexStatus) != dynamodb.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+func findIndex(desc *dynamodb.TableDescription, name string) *dynamodb.GlobalSecondaryIndexDescription {
+	for _, index := range desc.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == name {
+			return index
+		}
+	}
+	return nil
+}
+
+func verifyKeySchema(schema []*dynamodb.KeySchemaElement, hashKey, rangeKey string) error {
+	var hash, rng string
+	for _, k := range schema {
+		switch aws.StringValue(k.KeyType) {
+		case dynamodb.KeyTypeHash:
+			hash = aws.StringValue(k.AttributeName)
+		case dynamodb.KeyTypeRange:
+			rng = aws.StringValue(k.AttributeName)
+		}
+	}
+	if hash != hashKey || rng != rangeKey {
+		return fmt.Errorf("expected key schema (%s, %s) but found (%s, %s)", hashKey, rangeKey, hash, rng)
+	}
+	return nil
+}
+
+func verifyIndex(desc *dynamodb.GlobalSecondaryIndexDescription, index indexSpec) error {
+	if err := verifyKeySchema(desc.KeySchema, index.hashKey, index.rangeKey); err != nil {
+		return err
+	}
+	if desc.Projection == nil {
+		return fmt.Errorf("missing projection")
+	}
+	switch aws.StringValue(desc.Projection.ProjectionType) {
+	case dynamodb.ProjectionTypeAll:
+		return nil
+	case dynamodb.ProjectionTypeInclude:
+		projected := make(map[string]bool)
+		for _, a := range desc.Projection.NonKeyAttributes {
+			projected[aws.StringValue(a)] = true
+		}
+		for _, a := range index.include {
+			if !projected[a] {
+				return fmt.Errorf("attribute %s is not projected", a)
+			}
+		}
+		return nil
+	default:
+		if len(index.include) > 0 {
+			return fmt.Errorf("attributes %v are not projected", index.include)
+		}
+		return nil
+	}
+}
+
+func createTableInput(cfg TablesConfig, spec tableSpec) *dynamodb.CreateTableInput {
+	in := &dynamodb.CreateTableInput{
+		TableName:            aws.String(spec.name),
+		AttributeDefinitions: attributeDefinitions(spec, spec.indexes...),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(spec.hashKey),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+		BillingMode:           aws.String(cfg.BillingMode),
+		ProvisionedThroughput: provisionedThroughput(cfg),
+	}
+	for _, index := range spec.indexes {
+		action := createIndexAction(cfg, index)
+		in.GlobalSecondaryIndexes = append(in.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             action.IndexName,
+			KeySchema:             action.KeySchema,
+			Projection:            action.Projection,
+			ProvisionedThroughput: action.ProvisionedThroughput,
+		})
+	}
+	return in
+}
+
+func createIndexAction(cfg TablesConfig, index indexSpec) *dynamodb.CreateGlobalSecondaryIndexAction {
+	projection := &dynamodb.Projection{
+		ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly),
+	}
+	if len(index.include) > 0 {
+		projection = &dynamodb.Projection{
+			ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+			NonKeyAttributes: aws.StringSlice(index.include),
+		}
+	}
+	return &dynamodb.CreateGlobalSecondaryIndexAction{
+		IndexName: aws.String(index.name),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(index.hashKey),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+			{
+				AttributeName: aws.String(index.rangeKey),
+				KeyType:       aws.String(dynamodb.KeyTypeRange),
+			},
+		},
+		Projection:            projection,
+		ProvisionedThroughput: provisionedThroughput(cfg),
+	}
+}
+
+// attributeDefinitions returns the definitions of the table key and the keys of the given indexes.
+func attributeDefinitions(spec tableSpec, indexes ...indexSpec) []*dynamodb.AttributeDefinition {
+	names := []string{spec.hashKey}
+	for _, index := range indexes {
+		names = append(names, index.hashKey, index.rangeKey)
+	}
+	defs := []*dynamodb.AttributeDefinition{}
+	seen := make(map[string]bool)
+	for _, n := range names {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		defs = append(defs, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(n),
+			AttributeType: aws.String(spec.attrs[n]),
+		})
+	}
+	return defs
+}
+
+func provisionedThroughput(cfg TablesConfig) *dynamodb.ProvisionedThroughput {
+	if cfg.BillingMode != dynamodb.BillingModeProvisioned {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(cfg.ReadCapacityUnits),
+		WriteCapacityUnits: aws.Int64(cfg.WriteCapacityUnits),
+	}
+}
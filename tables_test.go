@@ -0,0 +1,273 @@
+package dtpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// TablesFakeDynamoDB keeps table descriptions in memory.
+// New tables and indexes are reported as CREATING by the first DescribeTable call.
+type TablesFakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	tables       map[string]*dynamodb.TableDescription
+	createInputs []*dynamodb.CreateTableInput
+	updateInputs []*dynamodb.UpdateTableInput
+}
+
+func NewTablesFakeDynamoDB() *TablesFakeDynamoDB {
+	return &TablesFakeDynamoDB{
+		tables: make(map[string]*dynamodb.TableDescription),
+	}
+}
+
+func (db *TablesFakeDynamoDB) CreateTableWithContext(ctx aws.Context, in *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	db.createInputs = append(db.createInputs, in)
+	desc := &dynamodb.TableDescription{
+		TableName:   in.TableName,
+		TableStatus: aws.String(dynamodb.TableStatusCreating),
+		KeySchema:   in.KeySchema,
+	}
+	for _, gsi := range in.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			IndexStatus: aws.String(dynamodb.IndexStatusCreating),
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+		})
+	}
+	db.tables[*in.TableName] = desc
+	return &dynamodb.CreateTableOutput{TableDescription: desc}, nil
+}
+
+func (db *TablesFakeDynamoDB) UpdateTableWithContext(ctx aws.Context, in *dynamodb.UpdateTableInput, opts ...request.Option) (*dynamodb.UpdateTableOutput, error) {
+	db.updateInputs = append(db.updateInputs, in)
+	desc := db.tables[*in.TableName]
+	for _, u := range in.GlobalSecondaryIndexUpdates {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   u.Create.IndexName,
+			IndexStatus: aws.String(dynamodb.IndexStatusCreating),
+			KeySchema:   u.Create.KeySchema,
+			Projection:  u.Create.Projection,
+		})
+	}
+	return &dynamodb.UpdateTableOutput{TableDescription: desc}, nil
+}
+
+func (db *TablesFakeDynamoDB) DescribeTableWithContext(ctx aws.Context, in *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	desc, ok := db.tables[*in.TableName]
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)
+	}
+	c := *desc
+	c.GlobalSecondaryIndexes = nil
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		g := *gsi
+		c.GlobalSecondaryIndexes = append(c.GlobalSecondaryIndexes, &g)
+		gsi.IndexStatus = aws.String(dynamodb.IndexStatusActive)
+	}
+	desc.TableStatus = aws.String(dynamodb.TableStatusActive)
+	return &dynamodb.DescribeTableOutput{Table: &c}, nil
+}
+
+func getTablesConfig() TablesConfig {
+	return TablesConfig{
+		Transactions:      DefaultTransactionStoreConfig("transactions"),
+		AccountsTableName: "accounts",
+		AccountsHashKey:   "ID",
+		PollInterval:      time.Millisecond,
+	}
+}
+
+func TestEnsureTablesCreatesTables(t *testing.T) {
+	db := NewTablesFakeDynamoDB()
+	if err := EnsureTables(context.Background(), db, getTablesConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.createInputs) != 2 {
+		t.Fatal(fmt.Errorf("expected 2 tables to be created but got %d", len(db.createInputs)))
+	}
+	in := db.createInputs[0]
+	if *in.BillingMode != dynamodb.BillingModePayPerRequest || in.ProvisionedThroughput != nil {
+		t.Fatal(fmt.Errorf("expected on-demand billing but got %v", in))
+	}
+	if len(in.GlobalSecondaryIndexes) != 1 || *in.GlobalSecondaryIndexes[0].IndexName != "state-index" {
+		t.Fatal(fmt.Errorf("expected state index to be created but got %v", in.GlobalSecondaryIndexes))
+	}
+	projection := in.GlobalSecondaryIndexes[0].Projection
+	if *projection.ProjectionType != dynamodb.ProjectionTypeInclude || len(projection.NonKeyAttributes) != 5 {
+		t.Fatal(fmt.Errorf("unexpected projection %v", projection))
+	}
+	for name, desc := range db.tables {
+		if !isTableActive(desc) {
+			t.Fatal(fmt.Errorf("expected table %s to be active", name))
+		}
+	}
+
+	// Existing tables are left untouched.
+	if err := EnsureTables(context.Background(), db, getTablesConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.createInputs) != 2 || len(db.updateInputs) != 0 {
+		t.Fatal(fmt.Errorf("expected no further changes"))
+	}
+}
+
+func TestEnsureTablesProvisionedBilling(t *testing.T) {
+	db := NewTablesFakeDynamoDB()
+	cfg := getTablesConfig()
+	cfg.BillingMode = dynamodb.BillingModeProvisioned
+	if err := EnsureTables(context.Background(), db, cfg); err == nil {
+		t.Fatal(fmt.Errorf("expected error without capacity units"))
+	}
+
+	cfg.ReadCapacityUnits = 5
+	cfg.WriteCapacityUnits = 10
+	if err := EnsureTables(context.Background(), db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	in := db.createInputs[0]
+	if *in.ProvisionedThroughput.WriteCapacityUnits != 10 || *in.GlobalSecondaryIndexes[0].ProvisionedThroughput.ReadCapacityUnits != 5 {
+		t.Fatal(fmt.Errorf("unexpected throughput %v", in))
+	}
+}
+
+func TestEnsureTablesAddsMissingIndex(t *testing.T) {
+	db := NewTablesFakeDynamoDB()
+	db.tables["transactions"] = &dynamodb.TableDescription{
+		TableName:   aws.String("transactions"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	}
+
+	cfg := getTablesConfig()
+	cfg.AccountsTableName = ""
+	if err := EnsureTables(context.Background(), db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.createInputs) != 0 || len(db.updateInputs) != 1 {
+		t.Fatal(fmt.Errorf("expected the state index to be added to the existing table"))
+	}
+	if findIndex(db.tables["transactions"], "state-index") == nil {
+		t.Fatal(fmt.Errorf("expected state index to exist"))
+	}
+}
+
+func TestEnsureTablesVerifiesSchema(t *testing.T) {
+	db := NewTablesFakeDynamoDB()
+	db.tables["accounts"] = &dynamodb.TableDescription{
+		TableName:   aws.String("accounts"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("AccountID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	}
+	if err := EnsureTables(context.Background(), db, getTablesConfig()); err == nil {
+		t.Fatal(fmt.Errorf("expected error for mismatching key schema"))
+	}
+
+	db = NewTablesFakeDynamoDB()
+	db.tables["transactions"] = &dynamodb.TableDescription{
+		TableName:   aws.String("transactions"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{
+			{
+				IndexName:   aws.String("state-index"),
+				IndexStatus: aws.String(dynamodb.IndexStatusActive),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("transaction_state"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("transaction_reference"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+					NonKeyAttributes: aws.StringSlice([]string{"ID"}),
+				},
+			},
+		},
+	}
+	if err := EnsureTables(context.Background(), db, getTablesConfig()); err == nil {
+		t.Fatal(fmt.Errorf("expected error for missing projected attributes"))
+	}
+}
+
+func TestEnsureTablesStateIndexWithoutExpiry(t *testing.T) {
+	// A state index created before transactions had deadlines does not project expires_at.
+	db := NewTablesFakeDynamoDB()
+	db.tables["transactions"] = &dynamodb.TableDescription{
+		TableName:   aws.String("transactions"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{
+			{
+				IndexName:   aws.String("state-index"),
+				IndexStatus: aws.String(dynamodb.IndexStatusActive),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("transaction_state"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("transaction_reference"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+					NonKeyAttributes: aws.StringSlice([]string{"source", "destination", "value", "last_modified"}),
+				},
+			},
+		},
+	}
+
+	// The default projection requires a state index that projects the deadline.
+	cfg := getTablesConfig()
+	cfg.AccountsTableName = ""
+	if err := EnsureTables(context.Background(), db, cfg); err == nil {
+		t.Fatal(fmt.Errorf("expected error for the deadline not being projected"))
+	}
+
+	// The existing state index is used if the deadline is left out of the projection.
+	a := cfg.Transactions.Attributes
+	cfg.Transactions.Projection = []string{a.ID, a.Reference, a.State, a.Source, a.Destination, a.Value, a.LastModified}
+	if err := EnsureTables(context.Background(), db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.createInputs) != 0 || len(db.updateInputs) != 0 {
+		t.Fatal(fmt.Errorf("expected the existing state index to be used"))
+	}
+}
+
+func TestEnsureTablesShardedStateIndex(t *testing.T) {
+	db := NewTablesFakeDynamoDB()
+	cfg := getTablesConfig()
+	cfg.Transactions.StateShards = 8
+	if err := EnsureTables(context.Background(), db, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	index := db.createInputs[0].GlobalSecondaryIndexes[0]
+	if *index.KeySchema[0].AttributeName != "transaction_state_shard" {
+		t.Fatal(fmt.Errorf("expected the state index to be partitioned by the state shard but got %v", index.KeySchema))
+	}
+	projected := map[string]bool{}
+	for _, a := range index.Projection.NonKeyAttributes {
+		projected[*a] = true
+	}
+	if !projected["transaction_state"] {
+		t.Fatal(fmt.Errorf("expected the state to be projected into the state index"))
+	}
+	for _, def := range db.createInputs[0].AttributeDefinitions {
+		if *def.AttributeName == "transaction_state_shard" && *def.AttributeType != dynamodb.ScalarAttributeTypeS {
+			t.Fatal(fmt.Errorf("expected the state shard to be a string attribute"))
+		}
+	}
+}
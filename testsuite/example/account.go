@@ -1,8 +1,14 @@
+// Package example contains a sample AccountHandler that transfers single items between accounts stored in DynamoDB.
+//
+// Deprecated: use package dtpc/ledger, which supports configurable attribute names, idempotent updates and a
+// versioned storage format. The example is kept for existing tables and as a reference for custom AccountHandlers.
 package example
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,6 +34,9 @@ const (
 
 var (
 	errPendingTransactionIDNotFound = errors.New("pending transaction id not found")
+	// errRetry signals that an account document has been modified concurrently, or migrated, since the operation
+	// started, so that the operation must be retried.
+	errRetry = errors.New("account document modified concurrently")
 )
 
 // AccountDoc contains required data of account documents
@@ -36,9 +45,12 @@ type AccountDoc struct {
 	ID string
 	// A map of itemID to item data
 	Resources map[string]Item
-	// A list of pending transactions for an account
-	PendingTransactions []string
-	// Version number of an account document required for Optimistic Locking
+	// The IDs of the pending transactions of an account
+	Pending map[string]bool
+	// The pending transactions of documents written by earlier versions of the handler, which do not have Pending
+	// until they are migrated with HandlerImpl.Migrate
+	PendingTransactions []string `dynamodbav:",omitempty"`
+	// Version number of an account document, incremented by every modification
 	Version int
 }
 
@@ -46,7 +58,12 @@ func (a AccountDoc) GetID() string {
 	return a.ID
 }
 func (a AccountDoc) GetPendingTransactions() []string {
-	return a.PendingTransactions
+	pts := append([]string(nil), a.PendingTransactions...)
+	for id := range a.Pending {
+		pts = append(pts, id)
+	}
+	sort.Strings(pts[len(a.PendingTransactions):])
+	return pts
 }
 func (a AccountDoc) GetVersion() int {
 	return a.Version
@@ -58,14 +75,46 @@ type Item struct {
 	Amount int
 }
 
+// ItemFromData converts the data of a transaction request into an Item.
+// Besides Item values, it accepts the generic map representation that transaction stores return
+// when a transaction document is read back, e.g. during RecoverTransactions.
+func ItemFromData(data interface{}) (Item, error) {
+	switch d := data.(type) {
+	case Item:
+		return d, nil
+	case *Item:
+		return *d, nil
+	case map[string]interface{}:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return Item{}, err
+		}
+		item := Item{}
+		if err := json.Unmarshal(b, &item); err != nil {
+			return Item{}, fmt.Errorf("failed to unmarshalling transaction data %v into type Item: %w", data, err)
+		}
+		return item, nil
+	default:
+		return Item{}, fmt.Errorf("failed to unmarshalling transaction data %v into type Item", data)
+	}
+}
+
 // HandlerImpl is an implementation of the AccountHandler interface required by Transaction Services.
+//
+// Deprecated: use ledger.Handler.
 type HandlerImpl struct {
 	db          dynamodbiface.DynamoDBAPI
 	tableName   string
 	hashKeyName string
+	// native indicates whether the handler exposes native transactions to Transaction Services.
+	native bool
+	// pendingMap indicates whether account documents are expected to have the Pending map, see EnablePendingMap.
+	pendingMap bool
 }
 
 // NewHandlerImpl initialises a new instance of an Account Handler implementation
+//
+// Deprecated: use ledger.New.
 func NewHandlerImpl(db dynamodbiface.DynamoDBAPI, tableName, hashKeyName string) *HandlerImpl {
 	return &HandlerImpl{
 		db:          db,
@@ -86,18 +135,25 @@ func (h *HandlerImpl) Get(ctx context.Context, accountID string, retval dtpc.Acc
 	}
 
 	in := &dynamodb.GetItemInput{
-		TableName: aws.String(h.tableName),
-		Key:       key,
+		TableName:      aws.String(h.tableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
 	}
-	res, err := h.db.GetItem(in)
+	res, err := h.db.GetItemWithContext(ctx, in)
 	if err != nil {
-		return err
+		return dtpc.WrapDynamoDBError(err)
+	}
+	if len(res.Item) == 0 {
+		return fmt.Errorf("account %s: %w", accountID, dtpc.ErrAccountNotFound)
 	}
 
 	return dynamodbattribute.UnmarshalMap(res.Item, retval)
 }
 
-// Put inserts a new Account document to the sql
+// Put inserts or replaces an account document. With EnablePendingMap, documents are written with the Pending map.
+// Otherwise they are written in the format of the stored document: new documents and documents that have not been
+// migrated with the PendingTransactions list of earlier versions of the handler, so that earlier versions can still
+// update them, and documents migrated with Migrate with the Pending map.
 func (h *HandlerImpl) Put(ctx context.Context, doc dtpc.Account) error {
 	item, err := dynamodbattribute.MarshalMap(doc)
 	if err != nil {
@@ -108,26 +164,86 @@ func (h *HandlerImpl) Put(ctx context.Context, doc dtpc.Account) error {
 	if item["Resources"] == nil {
 		item["Resources"] = &dynamodb.AttributeValue{M: make(map[string]*dynamodb.AttributeValue)}
 	}
-	item["PendingTransactions"] = &dynamodb.AttributeValue{L: make([]*dynamodb.AttributeValue, 0)}
+
+	if h.pendingMap {
+		item["Pending"] = &dynamodb.AttributeValue{M: make(map[string]*dynamodb.AttributeValue)}
+		delete(item, "PendingTransactions")
+		in := &dynamodb.PutItemInput{
+			TableName: aws.String(h.tableName),
+			Item:      item,
+		}
+		if _, err := h.db.PutItemWithContext(ctx, in); err != nil {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		return nil
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := h.put(ctx, item, false)
+		if err == errRetry {
+			err = h.put(ctx, item, true)
+		}
+		if err == nil {
+			// Operation succeeded
+			return nil
+		}
+		if err != errRetry {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		if err := sleep(ctx, UpdateRetryInterval*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Put failed because the process has reached the maximum number of retry attempts. accountID: %s: %w", doc.GetID(), dtpc.ErrConflict)
+}
+
+// put writes an account document without pending transactions, with the Pending map if migrated is true and with the
+// PendingTransactions list otherwise. The write is conditioned on the stored document having the same format, if it
+// exists, and returns errRetry if it has the other format.
+func (h *HandlerImpl) put(ctx context.Context, item map[string]*dynamodb.AttributeValue, migrated bool) error {
+	item = copyItem(item)
+	ce := "attribute_not_exists(#pm)"
+	if migrated {
+		item["Pending"] = &dynamodb.AttributeValue{M: make(map[string]*dynamodb.AttributeValue)}
+		delete(item, "PendingTransactions")
+		ce = "attribute_exists(#pm)"
+	} else {
+		item["PendingTransactions"] = &dynamodb.AttributeValue{L: make([]*dynamodb.AttributeValue, 0)}
+		delete(item, "Pending")
+	}
 
 	in := &dynamodb.PutItemInput{
-		TableName: aws.String(h.tableName),
-		Item:      item,
+		TableName:                aws.String(h.tableName),
+		Item:                     item,
+		ConditionExpression:      aws.String(ce),
+		ExpressionAttributeNames: map[string]*string{"#pm": aws.String("Pending")},
 	}
 
-	if _, err := h.db.PutItem(in); err != nil {
-		return err
+	_, err := h.db.PutItemWithContext(ctx, in)
+	if h.isAWSErrorConditionalCheckFailed(err) {
+		return errRetry
 	}
+	return err
+}
 
-	return nil
+// copyItem returns a shallow copy of an item.
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	c := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		c[k] = v
+	}
+	return c
 }
 
-// Update updates account documents by applying a transaction and appending the ID of the transaction to the pendingTransaction list.
-// Optimistic locking is applied to support concurrent updates to a single account doccument.
+// Update applies a transaction to an account document and adds the ID of the transaction to its pending transactions
+// with a single conditional write. An Update of a transaction that is already pending succeeds without applying it
+// again. With EnablePendingMap, the document is read only when the write fails, to find out why, and otherwise it is
+// read before the write. Documents that have not been migrated are updated like earlier versions of the handler did,
+// by writing the document read with optimistic locking.
 func (h *HandlerImpl) Update(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
-	reqData, ok := tr.Data.(Item)
-	if !ok {
-		return fmt.Errorf("failed to unmarshalling transaction request %s into type Item", tr)
+	reqData, err := ItemFromData(tr.Data)
+	if err != nil {
+		return err
 	}
 	method := Decrement
 	if accountID == tr.Destination {
@@ -135,40 +251,40 @@ func (h *HandlerImpl) Update(ctx context.Context, accountID, transactionID strin
 	}
 
 	for i := 0; i < maxUpdateAttempts; i++ {
-		err := h.findAndModify(ctx, accountID, transactionID, reqData, method)
+		err := h.modify(ctx, accountID, transactionID, reqData, method)
 		if err == nil {
 			// Operation succeeded
 			return nil
 		}
-		if !h.isAWSErrorConditionalCheckFailed(err) {
+		if err != errRetry {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		if err := sleep(ctx, UpdateRetryInterval*time.Millisecond); err != nil {
 			return err
 		}
-		time.Sleep(UpdateRetryInterval * time.Millisecond)
 	}
-	return fmt.Errorf("Update failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s", transactionID, accountID)
+	return fmt.Errorf("Update failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s: %w", transactionID, accountID, dtpc.ErrConflict)
 }
 
-func (h *HandlerImpl) findAndModify(ctx context.Context, accountID, transactionID string, tr Item, method TransactionMethod) error {
-	accountDoc := AccountDoc{}
-	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
-		return err
-	}
-	currentVersion := accountDoc.GetVersion()
-
-	pk := map[string]string{
-		h.hashKeyName: accountID,
+func (h *HandlerImpl) modify(ctx context.Context, accountID, transactionID string, tr Item, method TransactionMethod) error {
+	if !h.pendingMap {
+		accountDoc, err := h.unmigrated(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		if accountDoc != nil {
+			return h.legacyModify(ctx, *accountDoc, transactionID, tr, method)
+		}
 	}
-
-	key, err := dynamodbattribute.MarshalMap(pk)
+	key, err := h.key(accountID)
 	if err != nil {
 		return err
 	}
 
 	valMap := map[string]interface{}{
-		":tid":    []string{transactionID},
-		":q":      tr.Amount,
-		":cas":    currentVersion,
-		":newcas": currentVersion + 1,
+		":true": true,
+		":q":    tr.Amount,
+		":one":  1,
 	}
 
 	vals, err := dynamodbattribute.MarshalMap(valMap)
@@ -177,10 +293,11 @@ func (h *HandlerImpl) findAndModify(ctx context.Context, accountID, transactionI
 	}
 
 	namMap := map[string]*string{
-		"#pt": aws.String("PendingTransactions"),
-		"#ii": aws.String(tr.ID),
-		"#ia": aws.String("Amount"),
-		"#ve": aws.String("Version"),
+		"#pm":  aws.String("Pending"),
+		"#tid": aws.String(transactionID),
+		"#ii":  aws.String(tr.ID),
+		"#ia":  aws.String("Amount"),
+		"#ve":  aws.String("Version"),
 	}
 
 	// method string
@@ -191,15 +308,17 @@ func (h *HandlerImpl) findAndModify(ctx context.Context, accountID, transactionI
 	switch method {
 	case Increment:
 		m = "+"
-		ce = fmt.Sprintf("#ve = :cas")
+		ce = "attribute_exists(#pm) AND attribute_not_exists(#pm.#tid)"
 	case Decrement:
 		m = "-"
-		ce = fmt.Sprintf("Resources.#ii.#ia > :q AND #ve = :cas")
+		ce = "attribute_exists(#pm) AND attribute_not_exists(#pm.#tid) AND Resources.#ii.#ia > :q"
 	default:
 		return fmt.Errorf("unsupported transaction method %d", method)
 	}
 
-	ue := aws.String(fmt.Sprintf("SET #ve = :newcas, #pt = list_append (:tid, #pt), Resources.#ii.#ia = Resources.#ii.#ia %s :q", m))
+	// The version is incremented so that account documents can still be modified with optimistic locking, e.g. by
+	// Migrate.
+	ue := aws.String(fmt.Sprintf("SET #pm.#tid = :true, Resources.#ii.#ia = Resources.#ii.#ia %s :q ADD #ve :one", m))
 
 	in := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(h.tableName),
@@ -210,51 +329,173 @@ func (h *HandlerImpl) findAndModify(ctx context.Context, accountID, transactionI
 		ConditionExpression:       aws.String(ce),
 	}
 
-	if _, err := h.db.UpdateItem(in); err != nil {
+	_, err = h.db.UpdateItemWithContext(ctx, in)
+	if !h.isAWSErrorConditionalCheckFailed(err) {
 		return err
 	}
-	return nil
+
+	// The transaction is already pending, the funds are insufficient, the document has not been migrated or it has
+	// been modified concurrently, in which case the update is retried.
+	accountDoc := AccountDoc{}
+	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+		return err
+	}
+	if accountDoc.Pending == nil {
+		return h.legacyModify(ctx, accountDoc, transactionID, tr, method)
+	}
+	if accountDoc.Pending[transactionID] {
+		return nil
+	}
+	if err := checkFunds(accountDoc, tr, method, false); err != nil {
+		return err
+	}
+	return errRetry
+}
+
+// unmigrated reads an account document and returns it if it has not been migrated, or nil if it has been migrated.
+// It is called before the single writes without EnablePendingMap, when documents are unlikely to be migrated.
+func (h *HandlerImpl) unmigrated(ctx context.Context, accountID string) (*AccountDoc, error) {
+	accountDoc := AccountDoc{}
+	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+		return nil, err
+	}
+	if accountDoc.Pending != nil {
+		return nil, nil
+	}
+	return &accountDoc, nil
+}
+
+// legacyModify applies a transaction to an account document that has not been migrated and appends the ID of the
+// transaction to its PendingTransactions, if the document has not been modified since it was read.
+func (h *HandlerImpl) legacyModify(ctx context.Context, accountDoc AccountDoc, transactionID string, tr Item, method TransactionMethod) error {
+	if indexOf(accountDoc.PendingTransactions, transactionID) >= 0 {
+		return nil
+	}
+	if err := checkFunds(accountDoc, tr, method, false); err != nil {
+		return err
+	}
+	key, err := h.key(accountDoc.ID)
+	if err != nil {
+		return err
+	}
+
+	valMap := map[string]interface{}{
+		":tid":    []string{transactionID},
+		":q":      tr.Amount,
+		":cas":    accountDoc.GetVersion(),
+		":newcas": accountDoc.GetVersion() + 1,
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(valMap)
+	if err != nil {
+		return err
+	}
+
+	namMap := map[string]*string{
+		"#pt": aws.String("PendingTransactions"),
+		"#ii": aws.String(tr.ID),
+		"#ia": aws.String("Amount"),
+		"#ve": aws.String("Version"),
+	}
+
+	m := "+"
+	if method == Decrement {
+		m = "-"
+	}
+	ue := aws.String(fmt.Sprintf("SET #ve = :newcas, #pt = list_append(if_not_exists(#pt, :empty), :tid), Resources.#ii.#ia = Resources.#ii.#ia %s :q", m))
+	vals[":empty"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName),
+		Key:                       key,
+		UpdateExpression:          ue,
+		ExpressionAttributeValues: vals,
+		ExpressionAttributeNames:  namMap,
+		ConditionExpression:       aws.String("#ve = :cas"),
+	}
+
+	return h.write(ctx, in)
 }
 
-// Commit updates an account document by removing a transaction ID from its PendingTransaction list.
-// Optimistic locking is applied to support concurrent updates to a single account doccument.
+// Commit removes the ID of a transaction from the pending transactions of an account document with a single
+// conditional write, which is preceded by a read without EnablePendingMap like in Update. Commit of a transaction
+// that is not pending succeeds.
 func (h *HandlerImpl) Commit(ctx context.Context, accountID, transactionID string) error {
-	//加入了重试机制
 	for i := 0; i < maxUpdateAttempts; i++ {
 		err := h.commit(ctx, accountID, transactionID)
 		if err == nil {
 			// Operation succeeded
 			return nil
 		}
-		if !h.isAWSErrorConditionalCheckFailed(err) {
+		if err != errRetry {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		if err := sleep(ctx, UpdateRetryInterval*time.Millisecond); err != nil {
 			return err
 		}
-		time.Sleep(UpdateRetryInterval * time.Millisecond)
 	}
-	return fmt.Errorf("Commit failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s", transactionID, accountID)
+	return fmt.Errorf("Commit failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s: %w", transactionID, accountID, dtpc.ErrConflict)
 }
 
 func (h *HandlerImpl) commit(ctx context.Context, accountID, transactionID string) error {
-	accountDoc := AccountDoc{}
-	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+	if !h.pendingMap {
+		accountDoc, err := h.unmigrated(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		if accountDoc != nil {
+			return h.legacyCommit(ctx, *accountDoc, transactionID)
+		}
+	}
+	key, err := h.key(accountID)
+	if err != nil {
 		return err
 	}
-	currentVersion := accountDoc.GetVersion()
 
-	pts := accountDoc.GetPendingTransactions()
-	pendingTransactionIndex, err := getPendingTransactionIndex(pts, transactionID)
-	if h.IsErrorPendingTransactionIDNotFound(err) {
-		return nil
+	namMap := map[string]*string{
+		"#pm":  aws.String("Pending"),
+		"#tid": aws.String(transactionID),
+		"#ve":  aws.String("Version"),
 	}
+
+	vals, err := dynamodbattribute.MarshalMap(map[string]interface{}{":one": 1})
 	if err != nil {
 		return err
 	}
 
-	pk := map[string]string{
-		h.hashKeyName: accountID,
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName),
+		Key:                       key,
+		UpdateExpression:          aws.String("REMOVE #pm.#tid ADD #ve :one"),
+		ExpressionAttributeValues: vals,
+		ExpressionAttributeNames:  namMap,
+		ConditionExpression:       aws.String("attribute_exists(#pm.#tid)"),
 	}
 
-	key, err := dynamodbattribute.MarshalMap(pk)
+	_, err = h.db.UpdateItemWithContext(ctx, in)
+	if !h.isAWSErrorConditionalCheckFailed(err) {
+		return err
+	}
+
+	// The transaction is not pending, unless the document has not been migrated.
+	accountDoc := AccountDoc{}
+	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+		return err
+	}
+	if accountDoc.Pending == nil {
+		return h.legacyCommit(ctx, accountDoc, transactionID)
+	}
+	return nil
+}
+
+// legacyCommit removes the ID of a transaction from the PendingTransactions of an account document that has not been
+// migrated, if the document has not been modified since it was read.
+func (h *HandlerImpl) legacyCommit(ctx context.Context, accountDoc AccountDoc, transactionID string) error {
+	i := indexOf(accountDoc.PendingTransactions, transactionID)
+	if i < 0 {
+		return nil
+	}
+	key, err := h.key(accountDoc.ID)
 	if err != nil {
 		return err
 	}
@@ -265,38 +506,33 @@ func (h *HandlerImpl) commit(ctx context.Context, accountID, transactionID strin
 	}
 
 	valMap := map[string]interface{}{
-		":cas":    currentVersion,
-		":newcas": currentVersion + 1,
+		":cas":    accountDoc.GetVersion(),
+		":newcas": accountDoc.GetVersion() + 1,
 	}
 	vals, err := dynamodbattribute.MarshalMap(valMap)
 	if err != nil {
 		return err
 	}
 
-	ce := fmt.Sprintf("#ve = :cas")
-
 	in := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(h.tableName),
 		Key:                       key,
-		UpdateExpression:          aws.String(fmt.Sprintf("SET #ve = :newcas REMOVE #pt[%d]", pendingTransactionIndex)),
+		UpdateExpression:          aws.String(fmt.Sprintf("SET #ve = :newcas REMOVE #pt[%d]", i)),
 		ExpressionAttributeValues: vals,
 		ExpressionAttributeNames:  namMap,
-		ConditionExpression:       aws.String(ce),
+		ConditionExpression:       aws.String("#ve = :cas"),
 	}
 
-	if _, err := h.db.UpdateItem(in); err != nil {
-		return err
-	}
-	return nil
+	return h.write(ctx, in)
 }
 
-// Rollback recovers a failed transaction by applying the opposite logic of currency transfer
-// and removes a transaction ID from its PendingTransaction list.
-// Optimistic locking is applied to support concurrent updates to a single account doccument.
+// Rollback reverts a transaction applied by Update and removes the ID of the transaction from the pending
+// transactions of an account document with a single conditional write, which is preceded by a read without
+// EnablePendingMap like in Update.
 func (h *HandlerImpl) Rollback(ctx context.Context, accountID, transactionID string, tr dtpc.Request) error {
-	reqData, ok := tr.Data.(Item)
-	if !ok {
-		return fmt.Errorf("failed to unmarshalling transaction request %s into type Item", tr)
+	reqData, err := ItemFromData(tr.Data)
+	if err != nil {
+		return err
 	}
 	method := Increment
 	if accountID == tr.Destination {
@@ -309,39 +545,34 @@ func (h *HandlerImpl) Rollback(ctx context.Context, accountID, transactionID str
 			// Operation succeeded
 			return nil
 		}
-		if !h.isAWSErrorConditionalCheckFailed(err) {
+		if err != errRetry {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		if err := sleep(ctx, UpdateRetryInterval*time.Millisecond); err != nil {
 			return err
 		}
-		time.Sleep(UpdateRetryInterval * time.Millisecond)
 	}
-	return fmt.Errorf("Rollback failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s", transactionID, accountID)
+	return fmt.Errorf("Rollback failed because the process has reached the maximum number of retry attempts. transactionID: %s, accountID: %s: %w", transactionID, accountID, dtpc.ErrConflict)
 }
 
 func (h *HandlerImpl) rollback(ctx context.Context, accountID, transactionID string, tr Item, method TransactionMethod) error {
-	accountDoc := AccountDoc{}
-	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
-		return err
-	}
-	currentVersion := accountDoc.GetVersion()
-
-	pts := accountDoc.GetPendingTransactions()
-	pendingTransactionIndex, err := getPendingTransactionIndex(pts, transactionID)
-	if err != nil {
-		return err
-	}
-
-	pk := map[string]string{
-		h.hashKeyName: accountID,
+	if !h.pendingMap {
+		accountDoc, err := h.unmigrated(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		if accountDoc != nil {
+			return h.legacyRollback(ctx, *accountDoc, transactionID, tr, method)
+		}
 	}
-
-	key, err := dynamodbattribute.MarshalMap(pk)
+	key, err := h.key(accountID)
 	if err != nil {
 		return err
 	}
 
 	valMap := map[string]interface{}{
 		":q":   tr.Amount,
-		":cas": currentVersion,
+		":one": 1,
 	}
 
 	vals, err := dynamodbattribute.MarshalMap(valMap)
@@ -350,10 +581,11 @@ func (h *HandlerImpl) rollback(ctx context.Context, accountID, transactionID str
 	}
 
 	namMap := map[string]*string{
-		"#pt": aws.String("PendingTransactions"),
-		"#ii": aws.String(tr.ID),
-		"#ia": aws.String("Amount"),
-		"#ve": aws.String("Version"),
+		"#pm":  aws.String("Pending"),
+		"#tid": aws.String(transactionID),
+		"#ii":  aws.String(tr.ID),
+		"#ia":  aws.String("Amount"),
+		"#ve":  aws.String("Version"),
 	}
 
 	// method string
@@ -364,15 +596,15 @@ func (h *HandlerImpl) rollback(ctx context.Context, accountID, transactionID str
 	switch method {
 	case Increment:
 		m = "+"
-		ce = fmt.Sprintf("#ve = :cas")
+		ce = "attribute_exists(#pm.#tid)"
 	case Decrement:
 		m = "-"
-		ce = fmt.Sprintf("Resources.#ii.#ia > :q AND #ve = :cas")
+		ce = "attribute_exists(#pm.#tid) AND Resources.#ii.#ia >= :q"
 	default:
 		return fmt.Errorf("unsupported transaction method %d", method)
 	}
 
-	ue := aws.String(fmt.Sprintf("ADD #ve 1 REMOVE #pt[%d] SET Resources.#ii.#ia = Resources.#ii.#ia %s :q", pendingTransactionIndex, m))
+	ue := aws.String(fmt.Sprintf("REMOVE #pm.#tid SET Resources.#ii.#ia = Resources.#ii.#ia %s :q ADD #ve :one", m))
 
 	in := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(h.tableName),
@@ -383,13 +615,311 @@ func (h *HandlerImpl) rollback(ctx context.Context, accountID, transactionID str
 		ConditionExpression:       aws.String(ce),
 	}
 
-	if _, err := h.db.UpdateItem(in); err != nil {
+	_, err = h.db.UpdateItemWithContext(ctx, in)
+	if !h.isAWSErrorConditionalCheckFailed(err) {
 		return err
 	}
 
+	// The transaction is not pending, the funds are insufficient, the document has not been migrated or it has been
+	// modified concurrently, in which case the rollback is retried.
+	accountDoc := AccountDoc{}
+	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+		return err
+	}
+	if accountDoc.Pending == nil {
+		return h.legacyRollback(ctx, accountDoc, transactionID, tr, method)
+	}
+	if !accountDoc.Pending[transactionID] {
+		return errPendingTransactionIDNotFound
+	}
+	if err := checkFunds(accountDoc, tr, method, true); err != nil {
+		return err
+	}
+	return errRetry
+}
+
+// legacyRollback reverts a transaction applied to an account document that has not been migrated and removes the ID
+// of the transaction from its PendingTransactions, if the document has not been modified since it was read.
+func (h *HandlerImpl) legacyRollback(ctx context.Context, accountDoc AccountDoc, transactionID string, tr Item, method TransactionMethod) error {
+	i := indexOf(accountDoc.PendingTransactions, transactionID)
+	if i < 0 {
+		return errPendingTransactionIDNotFound
+	}
+	if err := checkFunds(accountDoc, tr, method, true); err != nil {
+		return err
+	}
+	key, err := h.key(accountDoc.ID)
+	if err != nil {
+		return err
+	}
+
+	valMap := map[string]interface{}{
+		":q":      tr.Amount,
+		":cas":    accountDoc.GetVersion(),
+		":newcas": accountDoc.GetVersion() + 1,
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(valMap)
+	if err != nil {
+		return err
+	}
+
+	namMap := map[string]*string{
+		"#pt": aws.String("PendingTransactions"),
+		"#ii": aws.String(tr.ID),
+		"#ia": aws.String("Amount"),
+		"#ve": aws.String("Version"),
+	}
+
+	m := "+"
+	if method == Decrement {
+		m = "-"
+	}
+	ue := aws.String(fmt.Sprintf("SET #ve = :newcas, Resources.#ii.#ia = Resources.#ii.#ia %s :q REMOVE #pt[%d]", m, i))
+
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName),
+		Key:                       key,
+		UpdateExpression:          ue,
+		ExpressionAttributeValues: vals,
+		ExpressionAttributeNames:  namMap,
+		ConditionExpression:       aws.String("#ve = :cas"),
+	}
+
+	return h.write(ctx, in)
+}
+
+// Migrate moves the pending transactions of an account document written by an earlier version of the handler from
+// its PendingTransactions list to the Pending map, so that the document is updated with single writes. Earlier
+// versions cannot update migrated documents, so they must be stopped before the first document is migrated.
+// Migrating a migrated document succeeds.
+func (h *HandlerImpl) Migrate(ctx context.Context, accountID string) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := h.migrate(ctx, accountID)
+		if err == nil {
+			// Operation succeeded
+			return nil
+		}
+		if err != errRetry {
+			return dtpc.WrapDynamoDBError(err)
+		}
+		if err := sleep(ctx, UpdateRetryInterval*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Migrate failed because the process has reached the maximum number of retry attempts. accountID: %s: %w", accountID, dtpc.ErrConflict)
+}
+
+// migrate reads an account document and migrates it with optimistic locking if it has been written by an earlier
+// version of the handler.
+func (h *HandlerImpl) migrate(ctx context.Context, accountID string) error {
+	accountDoc := AccountDoc{}
+	if err := h.Get(ctx, accountID, &accountDoc); err != nil {
+		return err
+	}
+	if accountDoc.Pending != nil && len(accountDoc.PendingTransactions) == 0 {
+		return nil
+	}
+
+	pending := make(map[string]bool, len(accountDoc.Pending)+len(accountDoc.PendingTransactions))
+	for id := range accountDoc.Pending {
+		pending[id] = true
+	}
+	for _, id := range accountDoc.PendingTransactions {
+		pending[id] = true
+	}
+
+	key, err := h.key(accountID)
+	if err != nil {
+		return err
+	}
+
+	valMap := map[string]interface{}{
+		":pm":     pending,
+		":cas":    accountDoc.GetVersion(),
+		":newcas": accountDoc.GetVersion() + 1,
+	}
+	vals, err := dynamodbattribute.MarshalMap(valMap)
+	if err != nil {
+		return err
+	}
+	// dynamodbattribute marshals an empty map as NULL.
+	if len(pending) == 0 {
+		vals[":pm"] = &dynamodb.AttributeValue{M: make(map[string]*dynamodb.AttributeValue)}
+	}
+
+	namMap := map[string]*string{
+		"#pm": aws.String("Pending"),
+		"#pt": aws.String("PendingTransactions"),
+		"#ve": aws.String("Version"),
+	}
+
+	in := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.tableName),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #pm = :pm, #ve = :newcas REMOVE #pt"),
+		ExpressionAttributeValues: vals,
+		ExpressionAttributeNames:  namMap,
+		ConditionExpression:       aws.String("#ve = :cas"),
+	}
+
+	return h.write(ctx, in)
+}
+
+// write applies an update to an account document with optimistic locking and returns errRetry if the document has
+// been modified since it was read.
+func (h *HandlerImpl) write(ctx context.Context, in *dynamodb.UpdateItemInput) error {
+	_, err := h.db.UpdateItemWithContext(ctx, in)
+	if h.isAWSErrorConditionalCheckFailed(err) {
+		return errRetry
+	}
+	return err
+}
+
+func (h *HandlerImpl) key(accountID string) (map[string]*dynamodb.AttributeValue, error) {
+	pk := map[string]string{
+		h.hashKeyName: accountID,
+	}
+	return dynamodbattribute.MarshalMap(pk)
+}
+
+// EnablePendingMap makes the handler create account documents with the Pending map and update them with single
+// writes first. It must only be enabled once no earlier versions of the handler are running, since they cannot update
+// documents with the Pending map. Without it, Put keeps the format of the stored document and creates documents with
+// the PendingTransactions list, and every update reads the document first, so that documents that have not been
+// migrated are updated with two calls like earlier versions did.
+func (h *HandlerImpl) EnablePendingMap() *HandlerImpl {
+	h.pendingMap = true
+	return h
+}
+
+// EnableNativeTransactions makes the handler apply transactions with a single TransactWriteItems call
+// instead of the two phase commits, see dtpc.NativeTransactor.
+// It must only be enabled when the transaction table is accessible with the same DynamoDB client as the account table.
+func (h *HandlerImpl) EnableNativeTransactions() *HandlerImpl {
+	h.native = true
+	return h
+}
+
+// CanTransactNatively reports whether native transactions are enabled and tr can be applied natively.
+func (h *HandlerImpl) CanTransactNatively(tr dtpc.Request) bool {
+	if !h.native || tr.Source == tr.Destination {
+		return false
+	}
+	_, err := ItemFromData(tr.Data)
+	return err == nil
+}
+
+// TransactNatively decrements the source account, increments the destination account
+// and writes the given items within a single TransactWriteItems call.
+// The transaction ID is used as client request token, so retries of the same transaction are idempotent.
+func (h *HandlerImpl) TransactNatively(ctx context.Context, transactionID string, tr dtpc.Request, items ...*dynamodb.TransactWriteItem) error {
+	reqData, err := ItemFromData(tr.Data)
+	if err != nil {
+		return err
+	}
+
+	source, err := h.nativeUpdate(tr.Source, reqData, Decrement)
+	if err != nil {
+		return err
+	}
+	destination, err := h.nativeUpdate(tr.Destination, reqData, Increment)
+	if err != nil {
+		return err
+	}
+
+	in := &dynamodb.TransactWriteItemsInput{
+		ClientRequestToken: aws.String(transactionID),
+		TransactItems:      append([]*dynamodb.TransactWriteItem{source, destination}, items...),
+	}
+	if _, err := h.db.TransactWriteItemsWithContext(ctx, in); err != nil {
+		return nativeError(err)
+	}
 	return nil
 }
 
+// nativeError classifies a cancelled native transaction by the write whose condition failed: the source account
+// holds too few items, the destination account does not exist or the transaction is not in the expected state.
+func nativeError(err error) error {
+	tce, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return dtpc.WrapDynamoDBError(err)
+	}
+	for i, reason := range tce.CancellationReasons {
+		switch code := aws.StringValue(reason.Code); {
+		case code == "TransactionConflict":
+			return dtpc.WrapError(dtpc.ErrConflict, err)
+		case code != "ConditionalCheckFailed":
+			continue
+		case i == 0:
+			return dtpc.WrapError(dtpc.ErrInsufficientFunds, err)
+		case i == 1:
+			return dtpc.WrapError(dtpc.ErrAccountNotFound, err)
+		default:
+			return dtpc.WrapError(dtpc.ErrInvalidTransition, err)
+		}
+	}
+	return dtpc.WrapDynamoDBError(err)
+}
+
+func (h *HandlerImpl) nativeUpdate(accountID string, tr Item, method TransactionMethod) (*dynamodb.TransactWriteItem, error) {
+	pk := map[string]string{
+		h.hashKeyName: accountID,
+	}
+
+	key, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	valMap := map[string]interface{}{
+		":q":   tr.Amount,
+		":one": 1,
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(valMap)
+	if err != nil {
+		return nil, err
+	}
+
+	namMap := map[string]*string{
+		"#pk": aws.String(h.hashKeyName),
+		"#ii": aws.String(tr.ID),
+		"#ia": aws.String("Amount"),
+		"#ve": aws.String("Version"),
+	}
+
+	// method string
+	var m string
+	// condition expression string
+	var ce string
+
+	switch method {
+	case Increment:
+		m = "+"
+		ce = "attribute_exists(#pk)"
+	case Decrement:
+		m = "-"
+		ce = "attribute_exists(#pk) AND Resources.#ii.#ia > :q"
+	default:
+		return nil, fmt.Errorf("unsupported transaction method %d", method)
+	}
+
+	// The version is incremented so that concurrent two phase commits updates of the account retry.
+	ue := aws.String(fmt.Sprintf("SET Resources.#ii.#ia = Resources.#ii.#ia %s :q ADD #ve :one", m))
+
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:                 aws.String(h.tableName),
+			Key:                       key,
+			UpdateExpression:          ue,
+			ExpressionAttributeValues: vals,
+			ExpressionAttributeNames:  namMap,
+			ConditionExpression:       aws.String(ce),
+		},
+	}, nil
+}
+
 // IsErrorPendingTransactionIDNotFound checks if a given error matches errPendingTransactionIDNotFound.
 func (h *HandlerImpl) IsErrorPendingTransactionIDNotFound(err error) bool {
 	return err == errPendingTransactionIDNotFound
@@ -404,11 +934,35 @@ func (h *HandlerImpl) isAWSErrorConditionalCheckFailed(err error) bool {
 	return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
 }
 
-func getPendingTransactionIndex(pts []string, st string) (int, error) {
-	for i, pt := range pts {
-		if pt == st {
-			return i, nil
+// indexOf returns the index of a transaction ID in a list of pending transactions, or -1 if it is not pending.
+func indexOf(pts []string, transactionID string) int {
+	for i, id := range pts {
+		if id == transactionID {
+			return i
 		}
 	}
-	return 0, errPendingTransactionIDNotFound
+	return -1
+}
+
+// sleep pauses the current goroutine for the duration d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// checkFunds returns an error matching dtpc.ErrInsufficientFunds if a decrement would not leave a positive balance,
+// or a negative balance for the rollback of a credit. The condition expression of the update still guards against
+// concurrent decrements.
+func checkFunds(doc AccountDoc, tr Item, method TransactionMethod, rollback bool) error {
+	amount := doc.Resources[tr.ID].Amount
+	if method == Decrement && (amount < tr.Amount || amount == tr.Amount && !rollback) {
+		return fmt.Errorf("account %s has %d of resource %s: %w", doc.ID, amount, tr.ID, dtpc.ErrInsufficientFunds)
+	}
+	return nil
 }
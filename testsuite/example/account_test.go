@@ -1,16 +1,23 @@
 package example
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 
 	"dtpc"
+	"dtpc/faultdb"
+	"dtpc/memdynamo"
 )
 
 var (
@@ -20,19 +27,23 @@ var (
 
 type AccountFakeDynamoDB struct {
 	dynamodbiface.DynamoDBAPI
+	transactWriteItemsInput *dynamodb.TransactWriteItemsInput
 }
 
 func NewAccountFakeDynamoDB() *AccountFakeDynamoDB {
 	return &AccountFakeDynamoDB{}
 }
 
-func (db *AccountFakeDynamoDB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+func (db *AccountFakeDynamoDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
 	out := make(map[string]string)
 	if err := dynamodbattribute.UnmarshalMap(in.Key, &out); err != nil {
 		return nil, err
 	}
 	mockAccountDoc := AccountDoc{
-		ID:                  out["id"],
+		ID: out["id"],
+		Resources: map[string]Item{
+			"mock_transfer_request_id": {ID: "mock_transfer_request_id", Amount: 100},
+		},
 		PendingTransactions: []string{"mock_transaction_id"},
 	}
 	item, err := dynamodbattribute.MarshalMap(mockAccountDoc)
@@ -45,14 +56,19 @@ func (db *AccountFakeDynamoDB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.Get
 	return res, nil
 }
 
-func (db *AccountFakeDynamoDB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+func (db *AccountFakeDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
 	return &dynamodb.PutItemOutput{}, nil
 }
 
-func (db *AccountFakeDynamoDB) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+func (db *AccountFakeDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
 	return &dynamodb.UpdateItemOutput{}, nil
 }
 
+func (db *AccountFakeDynamoDB) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.transactWriteItemsInput = in
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
 func TestGet(t *testing.T) {
 	accountHandler := NewHandlerImpl(NewAccountFakeDynamoDB(), tableName, hashKeyName)
 	retval := &AccountDoc{}
@@ -135,3 +151,436 @@ func TestRollback(t *testing.T) {
 		}
 	}
 }
+
+func TestItemFromData(t *testing.T) {
+	expected := Item{
+		ID:     "mock_item_id",
+		Amount: 10,
+	}
+	data := []interface{}{
+		expected,
+		&expected,
+		map[string]interface{}{"ID": "mock_item_id", "Amount": float64(10)},
+	}
+	for _, d := range data {
+		item, err := ItemFromData(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != expected {
+			t.Fatal(fmt.Errorf("expected %v but received %v", expected, item))
+		}
+	}
+
+	if _, err := ItemFromData("mock_item_id"); err == nil {
+		t.Fatal(fmt.Errorf("expected error for unsupported data"))
+	}
+}
+
+func TestTransactNatively(t *testing.T) {
+	db := NewAccountFakeDynamoDB()
+	accountHandler := NewHandlerImpl(db, tableName, hashKeyName)
+	mockTransactionID := "mock_transaction_id"
+	mockTransferReq := dtpc.Request{
+		Source:      "mock_source_account_id",
+		Destination: "mock_destination_account_id",
+		Data: Item{
+			ID:     "mock_transfer_request_id",
+			Amount: 10,
+		},
+	}
+
+	if accountHandler.CanTransactNatively(mockTransferReq) {
+		t.Fatal(fmt.Errorf("expected native transactions to be disabled by default"))
+	}
+	accountHandler.EnableNativeTransactions()
+	if !accountHandler.CanTransactNatively(mockTransferReq) {
+		t.Fatal(fmt.Errorf("expected native transactions to be enabled"))
+	}
+
+	mockItem := &dynamodb.TransactWriteItem{Update: &dynamodb.Update{}}
+	if err := accountHandler.TransactNatively(context.Background(), mockTransactionID, mockTransferReq, mockItem); err != nil {
+		t.Fatal(err)
+	}
+
+	in := db.transactWriteItemsInput
+	if in == nil || *in.ClientRequestToken != mockTransactionID {
+		t.Fatal(fmt.Errorf("expected TransactWriteItems to be called with client request token %s", mockTransactionID))
+	}
+	if len(in.TransactItems) != 3 || in.TransactItems[2] != mockItem {
+		t.Fatal(fmt.Errorf("expected source, destination and transaction items but received %v", in.TransactItems))
+	}
+	if *in.TransactItems[0].Update.ConditionExpression != "attribute_exists(#pk) AND Resources.#ii.#ia > :q" {
+		t.Fatal(fmt.Errorf("unexpected source condition %s", *in.TransactItems[0].Update.ConditionExpression))
+	}
+}
+
+func TestStartNativeTransactionInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	db := newAccountTable(t, "ID")
+	if err := dtpc.EnsureTables(ctx, db, dtpc.TablesConfig{Transactions: dtpc.DefaultTransactionStoreConfig("transactions")}); err != nil {
+		t.Fatal(err)
+	}
+	accountHandler := NewHandlerImpl(db, tableName, "ID").EnablePendingMap().EnableNativeTransactions()
+	for _, doc := range []*AccountDoc{
+		{ID: "source", Resources: map[string]Item{"gem": {ID: "gem", Amount: 5}}},
+		{ID: "destination", Resources: map[string]Item{"gem": {ID: "gem"}}},
+	} {
+		if err := accountHandler.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := dtpc.NewTransactionStore(db, "transactions")
+	service := dtpc.NewService(ts, accountHandler)
+
+	req := dtpc.Request{Source: "source", Destination: "destination", Reference: "trade", Data: Item{ID: "gem", Amount: 10}}
+	_, err := service.StartTransaction(ctx, req)
+	if !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatal(fmt.Errorf("expected insufficient funds but received %v", err))
+	}
+	var te *dtpc.TransactionError
+	if !errors.As(err, &te) {
+		t.Fatal(fmt.Errorf("expected a transaction error but received %v", err))
+	}
+	tr, err := ts.GetTransaction(ctx, te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.TransactionState != dtpc.Cancelled {
+		t.Fatal(fmt.Errorf("expected the transaction to be cancelled but it is %v", tr.TransactionState))
+	}
+
+	// The state item of a cancelled transaction no longer matches its expected state.
+	item, err := ts.StateTransitionItem(te.ID, dtpc.Pending, dtpc.Done, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Data = Item{ID: "gem", Amount: 1}
+	err = accountHandler.TransactNatively(ctx, te.ID+"-retry", req, item)
+	if !errors.Is(err, dtpc.ErrInvalidTransition) {
+		t.Fatal(fmt.Errorf("expected an invalid transition but received %v", err))
+	}
+}
+
+// ConflictingFakeDynamoDB fails every update with a version conflict.
+type ConflictingFakeDynamoDB struct {
+	*AccountFakeDynamoDB
+	updates int
+}
+
+func (db *ConflictingFakeDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	db.updates++
+	return nil, awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "version conflict", nil), 400, "mock_request_id")
+}
+
+func TestUpdateHonoursContext(t *testing.T) {
+	db := &ConflictingFakeDynamoDB{AccountFakeDynamoDB: NewAccountFakeDynamoDB()}
+	accountHandler := NewHandlerImpl(db, tableName, hashKeyName)
+	mockTransferReq := dtpc.Request{
+		Source:      "mock_source_account_id",
+		Destination: "mock_destination_account_id",
+		Data: Item{
+			ID:     "mock_transfer_request_id",
+			Amount: 10,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	err := accountHandler.Update(ctx, "mock_destination_account_id", "mock_other_transaction_id", mockTransferReq)
+	if err != context.DeadlineExceeded {
+		t.Fatal(fmt.Errorf("expected deadline exceeded error but got %v", err))
+	}
+	if db.updates >= maxUpdateAttempts {
+		t.Fatal(fmt.Errorf("expected retries to stop at the deadline but got %d updates", db.updates))
+	}
+}
+
+// newMemoryHandler returns a handler of an in-memory account table whose calls are counted.
+func newMemoryHandler(t testing.TB) (*HandlerImpl, *faultdb.DB) {
+	db := faultdb.New(newAccountTable(t, "ID"))
+	return NewHandlerImpl(db, tableName, "ID"), db
+}
+
+// newAccountTable returns an in-memory DynamoDB with an account table.
+func newAccountTable(t testing.TB, hashKey string) *memdynamo.DB {
+	db := memdynamo.New()
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(hashKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(hashKey), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSingleWrite(t *testing.T) {
+	ctx := context.Background()
+	accountHandler, db := newMemoryHandler(t)
+	accountHandler.EnablePendingMap()
+	for _, id := range []string{"source", "destination"} {
+		doc := AccountDoc{ID: id, Resources: map[string]Item{"item": {ID: "item", Amount: 100}}}
+		if err := accountHandler.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Item{ID: "item", Amount: 10}}
+
+	db.Clear()
+	for _, id := range []string{"source", "destination"} {
+		if err := accountHandler.Update(ctx, id, "t1", req); err != nil {
+			t.Fatal(err)
+		}
+		if err := accountHandler.Commit(ctx, id, "t1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := accountHandler.Update(ctx, "source", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Rollback(ctx, "source", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Calls(""); n != 6 || db.Calls(faultdb.OperationUpdateItem) != 6 {
+		t.Fatal(fmt.Errorf("expected 6 updates but received %d calls", n))
+	}
+
+	// Retries and failures read the account to find out why the write failed.
+	if err := accountHandler.Update(ctx, "source", "t3", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Update(ctx, "source", "t3", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Rollback(ctx, "source", "t2", req); !accountHandler.IsErrorPendingTransactionIDNotFound(err) {
+		t.Fatal(fmt.Errorf("expected %v but received %v", errPendingTransactionIDNotFound, err))
+	}
+	req.Data = Item{ID: "item", Amount: 100}
+	if err := accountHandler.Update(ctx, "source", "t4", req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatal(fmt.Errorf("expected %v but received %v", dtpc.ErrInsufficientFunds, err))
+	}
+
+	doc := AccountDoc{}
+	if err := accountHandler.Get(ctx, "source", &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Resources["item"].Amount != 80 || len(doc.GetPendingTransactions()) != 1 || !doc.Pending["t3"] {
+		t.Fatal(fmt.Errorf("unexpected account %+v", doc))
+	}
+}
+
+// putLegacyAccount stores an account document as earlier versions of the handler wrote it, with a list of pending
+// transactions and no map.
+func putLegacyAccount(t testing.TB, db *faultdb.DB, id string, amount int, pending ...string) {
+	item, err := dynamodbattribute.MarshalMap(AccountDoc{
+		ID:                  id,
+		Resources:           map[string]Item{"item": {ID: "item", Amount: amount}},
+		PendingTransactions: pending,
+		Version:             3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(item, "Pending")
+	item["PendingTransactions"] = &dynamodb.AttributeValue{L: make([]*dynamodb.AttributeValue, 0)}
+	for _, id := range pending {
+		item["PendingTransactions"].L = append(item["PendingTransactions"].L, &dynamodb.AttributeValue{S: aws.String(id)})
+	}
+	if _, err := db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	accountHandler, db := newMemoryHandler(t)
+	for _, id := range []string{"source", "destination"} {
+		putLegacyAccount(t, db, id, 100, "t1", "t2")
+	}
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Item{ID: "item", Amount: 10}}
+
+	// Documents that have not been migrated keep their list of pending transactions, so that earlier versions of the
+	// handler can still update them.
+	if err := accountHandler.Commit(ctx, "source", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Rollback(ctx, "source", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := accountHandler.Update(ctx, "source", "t3", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := accountHandler.Rollback(ctx, "source", "t2", req); !accountHandler.IsErrorPendingTransactionIDNotFound(err) {
+		t.Fatal(fmt.Errorf("expected %v but received %v", errPendingTransactionIDNotFound, err))
+	}
+	req.Data = Item{ID: "item", Amount: 100}
+	if err := accountHandler.Update(ctx, "source", "t4", req); !errors.Is(err, dtpc.ErrInsufficientFunds) {
+		t.Fatal(fmt.Errorf("expected %v but received %v", dtpc.ErrInsufficientFunds, err))
+	}
+	for i := 0; i < 2; i++ {
+		if err := accountHandler.Migrate(ctx, "destination"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]struct {
+		amount   int
+		pending  []string
+		migrated bool
+	}{
+		"source":      {amount: 100, pending: []string{"t3"}},
+		"destination": {amount: 100, pending: []string{"t1", "t2"}, migrated: true},
+	}
+	for id, e := range expected {
+		doc := AccountDoc{}
+		if err := accountHandler.Get(ctx, id, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Resources["item"].Amount != e.amount || fmt.Sprint(doc.GetPendingTransactions()) != fmt.Sprint(e.pending) || (doc.Pending != nil) != e.migrated || (len(doc.PendingTransactions) == 0) != e.migrated {
+			t.Fatal(fmt.Errorf("expected account %s to have %d and pending transactions %v but received %+v", id, e.amount, e.pending, doc))
+		}
+	}
+}
+
+// oldUpdate applies a transaction to an account document like earlier versions of the handler did, by reading the
+// document and writing it with optimistic locking, and fails on documents that have been migrated.
+func oldUpdate(ctx context.Context, accountHandler *HandlerImpl, accountID, transactionID string, tr Item, method TransactionMethod) error {
+	accountDoc := AccountDoc{}
+	if err := accountHandler.Get(ctx, accountID, &accountDoc); err != nil {
+		return err
+	}
+	if accountDoc.Pending != nil {
+		return fmt.Errorf("account %s has been migrated", accountID)
+	}
+	return accountHandler.legacyModify(ctx, accountDoc, transactionID, tr, method)
+}
+
+func TestPutKeepsFormat(t *testing.T) {
+	ctx := context.Background()
+	accountHandler, db := newMemoryHandler(t)
+	for _, id := range []string{"source", "destination"} {
+		doc := AccountDoc{ID: id, Resources: map[string]Item{"item": {ID: "item", Amount: 100}}}
+		if err := accountHandler.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item := Item{ID: "item", Amount: 10}
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: item}
+
+	// Accounts created with Put are not migrated, so earlier versions of the handler can update them next to the
+	// current version during a rolling deploy.
+	if err := oldUpdate(ctx, accountHandler, "source", "t1", item, Decrement); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Update(ctx, "destination", "t1", req); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Commit(ctx, "source", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldUpdate(ctx, accountHandler, "source", "t2", item, Decrement); err != nil {
+		t.Fatal(err)
+	}
+	if err := accountHandler.Rollback(ctx, "source", "t2", req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing an account keeps its format: the unmigrated destination stays unmigrated and the migrated source
+	// stays migrated.
+	if err := accountHandler.Migrate(ctx, "source"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"source", "destination"} {
+		doc := AccountDoc{ID: id, Resources: map[string]Item{"item": {ID: "item", Amount: 50}}}
+		if err := accountHandler.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := oldUpdate(ctx, accountHandler, "destination", "t3", item, Increment); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldUpdate(ctx, accountHandler, "source", "t3", item, Decrement); err == nil {
+		t.Fatal(errors.New("expected the update of a migrated account by an earlier version to fail"))
+	}
+	db.Clear()
+	if err := accountHandler.Update(ctx, "source", "t3", req); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Calls(""); n != 2 {
+		t.Fatal(fmt.Errorf("expected a read and a write of the migrated account but received %d calls", n))
+	}
+
+	expected := map[string]struct {
+		amount   int
+		migrated bool
+	}{
+		"source":      {amount: 40, migrated: true},
+		"destination": {amount: 60},
+	}
+	for id, e := range expected {
+		doc := AccountDoc{}
+		if err := accountHandler.Get(ctx, id, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Resources["item"].Amount != e.amount || fmt.Sprint(doc.GetPendingTransactions()) != "[t3]" || (doc.Pending != nil) != e.migrated {
+			t.Fatal(fmt.Errorf("expected account %s to have %d and the pending transaction t3 but received %+v", id, e.amount, doc))
+		}
+	}
+}
+
+// BenchmarkTransfer measures the updates and commits of the source and the destination of a transfer on a DynamoDB
+// with a latency of one millisecond, for accounts with the Pending map after EnablePendingMap, which are updated with
+// single writes, and for accounts that have not been migrated, which are read before every write like earlier
+// versions of the handler did.
+func BenchmarkTransfer(b *testing.B) {
+	b.Run("migrated", func(b *testing.B) {
+		accountHandler, db := newMemoryHandler(b)
+		accountHandler.EnablePendingMap()
+		for _, id := range []string{"source", "destination"} {
+			doc := AccountDoc{ID: id, Resources: map[string]Item{"item": {ID: "item", Amount: 1 << 40}}}
+			if err := accountHandler.Put(context.Background(), doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+		benchmarkTransfer(b, accountHandler, db)
+	})
+	b.Run("unmigrated", func(b *testing.B) {
+		accountHandler, db := newMemoryHandler(b)
+		for _, id := range []string{"source", "destination"} {
+			putLegacyAccount(b, db, id, 1<<40)
+		}
+		benchmarkTransfer(b, accountHandler, db)
+	})
+}
+
+func benchmarkTransfer(b *testing.B, accountHandler *HandlerImpl, db *faultdb.DB) {
+	ctx := context.Background()
+	req := dtpc.Request{Source: "source", Destination: "destination", Data: Item{ID: "item", Amount: 1}}
+	db.Clear()
+	db.Inject(faultdb.Rule{Fault: faultdb.Delay, Delay: time.Millisecond})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transactionID := fmt.Sprintf("t%d", i)
+		for _, id := range []string{"source", "destination"} {
+			if err := accountHandler.Update(ctx, id, transactionID, req); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for _, id := range []string{"source", "destination"} {
+			if err := accountHandler.Commit(ctx, id, transactionID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(db.Calls(""))/float64(b.N), "calls/op")
+}
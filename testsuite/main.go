@@ -5,11 +5,12 @@ import (
 	"time"
 
 	"dtpc"
-	"dtpc/testsuite/example"
+	"dtpc/ledger"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"golang.org/x/net/context"
 )
 
@@ -23,74 +24,66 @@ func main() {
 		panic(err.Error())
 	}
 
+	if err := run(dynamodbCli); err != nil {
+		panic(err.Error())
+	}
+
+	log.Println("All tests passed")
+}
+
+// run executes the test scenarios against a DynamoDB instance. The scenarios also run against an in-memory
+// DynamoDB with go test.
+func run(db dynamodbiface.DynamoDBAPI) error {
 	// initialize database tables
-	err = setup(dynamodbCli)
-	defer teardown(dynamodbCli)
+	err := setup(db)
+	defer teardown(db)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// Setup Account Handler
-	accountHandler := example.NewHandlerImpl(dynamodbCli, "accounts", "ID")
+	accountHandler, err := ledger.New(db, ledger.DefaultConfig(tablesConfig.AccountsTableName))
+	if err != nil {
+		return err
+	}
 	if err := setupAccounts(accountHandler); err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// Setup Transaction Store
-	transactionStore := dtpc.NewTransactionStore(dynamodbCli, "transactions")
+	transactionStore := dtpc.NewTransactionStore(db, "transactions")
 
 	// Setup Transaction Service
 	srv := dtpc.NewService(transactionStore, accountHandler)
 	ctx := context.Background()
 	if err := testSingleTransaction(ctx, srv); err != nil {
-		panic(err.Error())
-	}
-
-	if err := testRecoverTransactions(ctx, srv); err != nil {
-		panic(err.Error())
+		return err
 	}
 
-	log.Println("All tests passed")
+	return testRecoverTransactions(ctx, srv)
 }
 
-func setup(db *dynamodb.DynamoDB) error {
-	for _, table := range tables {
-		if _, err := db.CreateTable(createTableInput(table)); err != nil {
-			return err
-		}
-	}
-	return nil
+func setup(db dynamodbiface.DynamoDBAPI) error {
+	return dtpc.EnsureTables(context.Background(), db, tablesConfig)
 }
 
-func teardown(db *dynamodb.DynamoDB) error {
-	for _, table := range tables {
-		if _, err := db.DeleteTable(deleteTableInput(table.TableName)); err != nil {
+func teardown(db dynamodbiface.DynamoDBAPI) error {
+	for _, table := range []string{tablesConfig.Transactions.TableName, tablesConfig.AccountsTableName} {
+		if _, err := db.DeleteTable(deleteTableInput(table)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func setupAccounts(ah dtpc.AccountHandler) error {
-	resources := make(map[string]example.Item)
-	resources["item1"] = example.Item{
-		ID:     "item1",
-		Amount: 100,
-	}
-	resources["item2"] = example.Item{
-		ID:     "item2",
-		Amount: 100,
-	}
-
-	accounts := []*example.AccountDoc{
-		getAccountDoc("account1", resources),
-		getAccountDoc("account2", resources),
-		getAccountDoc("account3", resources),
-		getAccountDoc("account4", resources),
+func setupAccounts(ah *ledger.Handler) error {
+	balances := map[string]ledger.Decimal{
+		"item1": ledger.NewDecimal(100, 0),
+		"item2": ledger.NewDecimal(100, 0),
 	}
 
-	for _, account := range accounts {
-		if err := ah.Put(context.Background(), account); err != nil {
+	for _, id := range []string{"account1", "account2", "account3", "account4"} {
+		if err := ah.Create(context.Background(), id, balances); err != nil {
 			return err
 		}
 	}
@@ -143,132 +136,25 @@ func getStaticAwsCredentials() (*credentials.Credentials, error) {
 	return awsCreds, nil
 }
 
-func getTransactionRequest(source, destination, itemID string, itemQuantity int) dtpc.Request {
+func getTransactionRequest(source, destination, itemID string, itemQuantity int64) dtpc.Request {
 	return dtpc.Request{
 		Source:      source,
 		Destination: destination,
-		Data: example.Item{
+		// The reference is the range key of the state index, which does not accept empty strings.
+		Reference: source + ":" + destination,
+		Data: ledger.Item{
 			ID:     itemID,
-			Amount: itemQuantity,
+			Amount: ledger.NewDecimal(itemQuantity, 0),
 		}}
 }
 
-func getAccountDoc(accountID string, resources map[string]example.Item) *example.AccountDoc {
-	return &example.AccountDoc{
-		ID:                  accountID,
-		Resources:           resources,
-		PendingTransactions: []string{},
-		Version:             0,
-	}
-}
-
-type TableInfo struct {
-	TableName       string
-	PrimaryKey      string
-	SortKey         string
-	SortKeyType     string
-	ReadThroughput  int64
-	WriteThroughput int64
-	Indexes         []IndexInfo
-}
-
-type IndexInfo struct {
-	IndexName       string
-	PrimaryKey      string
-	PrimaryKeyType  string
-	SortKey         string
-	SortKeyType     string
-	ReadThroughput  int64
-	WriteThroughput int64
-}
-
-var tables = []TableInfo{
-	TableInfo{"accounts", "ID", "", "", 5, 5, nil},
-	TableInfo{"transactions", "id", "", "S", 5, 5, []IndexInfo{
-		IndexInfo{"state-index", "transaction_state", "N", "transaction_reference", "S", 5, 5},
-	}},
-}
-
-func createTableInput(table TableInfo) *dynamodb.CreateTableInput {
-	input := &dynamodb.CreateTableInput{
-		TableName: aws.String(table.TableName),
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String(table.PrimaryKey),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String(table.PrimaryKey),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(table.ReadThroughput),
-			WriteCapacityUnits: aws.Int64(table.WriteThroughput),
-		},
-	}
-	if table.SortKey != "" {
-		input.AttributeDefinitions = append(input.AttributeDefinitions,
-			&dynamodb.AttributeDefinition{
-				AttributeName: aws.String(table.SortKey),
-				AttributeType: aws.String(table.SortKeyType),
-			},
-		)
-
-		input.KeySchema = append(input.KeySchema,
-			&dynamodb.KeySchemaElement{
-				AttributeName: aws.String(table.SortKey),
-				KeyType:       aws.String("RANGE"),
-			},
-		)
-	}
-	if len(table.Indexes) > 0 {
-		gsi := []*dynamodb.GlobalSecondaryIndex{}
-		for _, index := range table.Indexes {
-			gsi = append(gsi, newGlobalSecondaryIndex(index))
-			input.AttributeDefinitions = append(input.AttributeDefinitions,
-				&dynamodb.AttributeDefinition{
-					AttributeName: aws.String(index.PrimaryKey),
-					AttributeType: aws.String(index.PrimaryKeyType),
-				},
-				&dynamodb.AttributeDefinition{
-					AttributeName: aws.String(index.SortKey),
-					AttributeType: aws.String(index.SortKeyType),
-				})
-		}
-		input.GlobalSecondaryIndexes = gsi
-	}
-
-	return input
-}
-
-func newGlobalSecondaryIndex(index IndexInfo) *dynamodb.GlobalSecondaryIndex {
-	input := &dynamodb.GlobalSecondaryIndex{
-		IndexName: aws.String(index.IndexName),
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String(index.PrimaryKey),
-				KeyType:       aws.String("HASH"),
-			},
-			{
-				AttributeName: aws.String(index.SortKey),
-				KeyType:       aws.String("RANGE"),
-			},
-		},
-		Projection: &dynamodb.Projection{
-			NonKeyAttributes: []*string{
-				aws.String("ID"),
-			},
-			ProjectionType: aws.String(dynamodb.ProjectionTypeInclude),
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(index.ReadThroughput),
-			WriteCapacityUnits: aws.Int64(index.WriteThroughput),
-		},
-	}
-	return input
+var tablesConfig = dtpc.TablesConfig{
+	Transactions:       dtpc.DefaultTransactionStoreConfig("transactions"),
+	AccountsTableName:  "accounts",
+	AccountsHashKey:    "id",
+	BillingMode:        dynamodb.BillingModeProvisioned,
+	ReadCapacityUnits:  5,
+	WriteCapacityUnits: 5,
 }
 
 func deleteTableInput(tableName string) *dynamodb.DeleteTableInput {
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"dtpc/memdynamo"
+)
+
+func TestScenarios(t *testing.T) {
+	if err := run(memdynamo.New()); err != nil {
+		t.Fatal(err)
+	}
+}
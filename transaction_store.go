@@ -1,17 +1,25 @@
 package dtpc
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/net/context"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
+// maxBatchGetKeys is the maximum number of keys of a BatchGetItem request.
+const maxBatchGetKeys = 100
+
 // TransactionState indicates the current state of a transaction.
 type TransactionState int
 
@@ -23,10 +31,49 @@ const (
 	Cancelled
 )
 
+// Final reports whether the state is final, i.e. Done or Cancelled.
+func (s TransactionState) Final() bool {
+	return s == Done || s == Cancelled
+}
+
+// previousStates are the states from which a transaction can change to a state. Applied transactions are always
+// committed and Canceling transactions are always cancelled. Pending transactions change to Done directly when they
+// are applied with a native transaction.
+var previousStates = map[TransactionState][]TransactionState{
+	Applied:   {Pending},
+	Done:      {Pending, Applied},
+	Canceling: {Pending},
+	Cancelled: {Canceling},
+}
+
+// CanChangeTo reports whether a transaction in state s can change to state to. Setting the current state again is
+// allowed, so that state changes can be retried after a lost response.
+func (s TransactionState) CanChangeTo(to TransactionState) bool {
+	if s == to {
+		return true
+	}
+	for _, from := range previousStates[to] {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError returns the error of a refused change of a transaction in state s to state to for
+// TransactionHandler implementations: ErrTransactionFinished if s is final, ErrInvalidTransition otherwise.
+func TransitionError(id string, s, to TransactionState) error {
+	if s.Final() {
+		return fmt.Errorf("transaction %s is in state %d: %w", id, s, ErrTransactionFinished)
+	}
+	return fmt.Errorf("transaction %s cannot change from state %d to %d: %w", id, s, to, ErrInvalidTransition)
+}
+
 // TransactionStore contains required dependencies of TransactionStore
 type TransactionStore struct {
 	db        dynamodbiface.DynamoDBAPI
 	tableName string
+	cfg       TransactionStoreConfig
 }
 
 // Transaction contains data that will be stored in the sql.
@@ -45,53 +92,96 @@ type Transaction struct {
 	Value interface{} `json:"value"`
 	// Time of the latest modification to the transaction document
 	LastModified time.Time `json:"last_modified"`
+	// Deadline of the transaction. A zero value means the transaction does not expire.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the deadline of the transaction has passed at the given time.
+func (t *Transaction) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// NewTransaction returns a transaction document in Pending state. A zero expiresAt means the transaction does not
+// expire. NewTransaction allows TransactionHandler implementations to build new transactions consistently.
+func NewTransaction(id, source, destination, reference string, data interface{}, expiresAt time.Time) *Transaction {
+	return &Transaction{
+		ID:                   id,
+		TransactionReference: reference,
+		Source:               source,
+		Destination:          destination,
+		Value:                data,
+		TransactionState:     Pending,
+		LastModified:         time.Now(),
+		ExpiresAt:            expiresAt,
+	}
 }
 
 // NewTransactionStore initialises a new TransactionStore instance with a given sql instance.
+// The table follows the schema of DefaultTransactionStoreConfig.
 func NewTransactionStore(db dynamodbiface.DynamoDBAPI, tableName string) *TransactionStore {
 	return &TransactionStore{
 		db:        db,
 		tableName: tableName,
+		cfg:       DefaultTransactionStoreConfig(tableName),
+	}
+}
+
+// NewTransactionStoreWithConfig initialises a new TransactionStore instance for a table with a custom schema.
+func NewTransactionStoreWithConfig(db dynamodbiface.DynamoDBAPI, cfg TransactionStoreConfig) (*TransactionStore, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+	return &TransactionStore{
+		db:        db,
+		tableName: cfg.TableName,
+		cfg:       cfg,
+	}, nil
+}
+
+// Config returns the table schema used by the TransactionStore.
+func (ts *TransactionStore) Config() TransactionStoreConfig {
+	return ts.cfg
 }
 
 // Insert adds transaction document to the transaction table.
 // source and destination are ID values of the accounts that will be updated.
 // data contains information of a transaction such as the currencyID and the amount to be transferred between two accounts.
 func (ts *TransactionStore) Insert(ctx context.Context, source, destination, reference string, data interface{}) (string, error) {
-	id := uuid.New().String()
+	return ts.InsertWithExpiry(ctx, source, destination, reference, data, time.Time{})
+}
 
-	t := Transaction{
-		ID:                   id,
-		TransactionReference: reference,
-		Source:               source,
-		Destination:          destination,
-		Value:                data,
-		TransactionState:     Pending,
-		LastModified:         time.Now(),
-	}
+// InsertWithExpiry adds a transaction document with a deadline to the transaction table.
+func (ts *TransactionStore) InsertWithExpiry(ctx context.Context, source, destination, reference string, data interface{}, expiresAt time.Time) (string, error) {
+	id := uuid.New().String()
+	t := NewTransaction(id, source, destination, reference, data, expiresAt)
 
-	item, err := dynamodbattribute.MarshalMap(t)
+	item, err := ts.marshalTransaction(*t)
 	if err != nil {
 		return id, err
 	}
+	if ts.cfg.sharded() {
+		item[ts.cfg.Attributes.StateShard] = &dynamodb.AttributeValue{
+			S: aws.String(stateShardKey(Pending, ts.cfg.stateShard(id))),
+		}
+	}
 
 	in := &dynamodb.PutItemInput{
 		TableName: aws.String(ts.tableName),
 		Item:      item,
 	}
-	if _, err := ts.db.PutItem(in); err != nil {
-		return id, err
+	if _, err := ts.db.PutItemWithContext(ctx, in); err != nil {
+		return id, WrapDynamoDBError(err)
 	}
 	return id, nil
 }
 
 // UpdateState updates the state of a transaction document.
+// The update is conditioned on the states the new state can follow. The state of a Done or Cancelled transaction can
+// only be set again to the same state, other changes fail with ErrTransactionFinished, and changes to a state that
+// cannot follow the current state fail with ErrInvalidTransition.
 func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState TransactionState) (*Transaction, error) {
-	pk := map[string]string{
-		"id": id,
-	}
-	key, err := dynamodbattribute.MarshalMap(pk)
+	key, err := ts.key(id)
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +190,18 @@ func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState
 		":v": newState,
 		":t": time.Now(),
 	}
+	namMap := map[string]*string{
+		"#id": aws.String(ts.cfg.Attributes.ID),
+		"#st": aws.String(ts.cfg.Attributes.State),
+		"#lm": aws.String(ts.cfg.Attributes.LastModified),
+	}
+	from := []string{":v"}
+	for i, s := range previousStates[newState] {
+		name := fmt.Sprintf(":from%d", i)
+		valMap[name] = s
+		from = append(from, name)
+	}
+	update := ts.stateUpdate(id, newState, valMap, namMap)
 	vals, err := dynamodbattribute.MarshalMap(valMap)
 	if err != nil {
 		return nil, err
@@ -108,30 +210,80 @@ func (ts *TransactionStore) UpdateState(ctx context.Context, id string, newState
 	in := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(ts.tableName),
 		Key:                       key,
-		UpdateExpression:          aws.String("SET transaction_state = :v, last_modified = :t"),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(fmt.Sprintf("attribute_exists(#id) AND #st IN (%s)", strings.Join(from, ", "))),
 		ExpressionAttributeValues: vals,
+		ExpressionAttributeNames:  namMap,
 		ReturnValues:              aws.String("ALL_NEW"),
 	}
 
-	res, err := ts.db.UpdateItem(in)
+	res, err := ts.db.UpdateItemWithContext(ctx, in)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, ts.stateUpdateError(ctx, id, newState)
+		}
+		return nil, WrapDynamoDBError(err)
+	}
+
+	return ts.unmarshalTransaction(res.Attributes)
+}
+
+// stateUpdateError returns the reason of a rejected state update: the transaction does not exist, is finished or is
+// in a state the new state cannot follow.
+func (ts *TransactionStore) stateUpdateError(ctx context.Context, id string, newState TransactionState) error {
+	t, err := ts.GetTransaction(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t.TransactionState.CanChangeTo(newState) {
+		return fmt.Errorf("transaction %s changed state concurrently: %w", id, ErrConflict)
+	}
+	return TransitionError(id, t.TransactionState, newState)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// StateTransitionItem returns a write item that changes the state of a transaction document from one state to another.
+// StateTransitionItem allows the state change to be part of a native transaction of a NativeTransactor.
+func (ts *TransactionStore) StateTransitionItem(id string, from, to TransactionState, modified time.Time) (*dynamodb.TransactWriteItem, error) {
+	key, err := ts.key(id)
 	if err != nil {
 		return nil, err
 	}
 
-	tr := &Transaction{}
-	if err := dynamodbattribute.UnmarshalMap(res.Attributes, tr); err != nil {
+	valMap := map[string]interface{}{
+		":v":    to,
+		":t":    modified,
+		":from": from,
+	}
+	namMap := map[string]*string{
+		"#st": aws.String(ts.cfg.Attributes.State),
+		"#lm": aws.String(ts.cfg.Attributes.LastModified),
+	}
+	update := ts.stateUpdate(id, to, valMap, namMap)
+	vals, err := dynamodbattribute.MarshalMap(valMap)
+	if err != nil {
 		return nil, err
 	}
 
-	return tr, nil
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:                 aws.String(ts.tableName),
+			Key:                       key,
+			UpdateExpression:          aws.String(update),
+			ConditionExpression:       aws.String("#st = :from"),
+			ExpressionAttributeValues: vals,
+			ExpressionAttributeNames:  namMap,
+		},
+	}, nil
 }
 
 // GetTransaction retrieves a transaction document by its ID value.
 func (ts *TransactionStore) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
-	pk := map[string]string{
-		"id": id,
-	}
-	key, err := dynamodbattribute.MarshalMap(pk)
+	key, err := ts.key(id)
 	if err != nil {
 		return nil, err
 	}
@@ -141,85 +293,352 @@ func (ts *TransactionStore) GetTransaction(ctx context.Context, id string) (*Tra
 		Key:       key,
 	}
 
-	res, err := ts.db.GetItem(in)
+	res, err := ts.db.GetItemWithContext(ctx, in)
 	if err != nil {
-		return nil, err
+		return nil, WrapDynamoDBError(err)
 	}
-
-	t := &Transaction{}
-	if err := dynamodbattribute.UnmarshalMap(res.Item, t); err != nil {
-		return nil, err
+	if len(res.Item) == 0 {
+		return nil, fmt.Errorf("transaction %s: %w", id, ErrTransactionNotFound)
 	}
 
-	return t, nil
+	return ts.unmarshalTransaction(res.Item)
 }
 
 // GetTransactionsInState gets all transaction documents of given state, source and destination accounts.
+// Transactions are returned in the order of their transaction reference.
 func (ts *TransactionStore) GetTransactionsInState(ctx context.Context, state TransactionState, query string) ([]*Transaction, error) {
-	valMap := map[string]interface{}{
-		":st": state,
-		":tr": query,
+	items, err := ts.queryStateIndex(ctx, state, func(in *dynamodb.QueryInput, vals map[string]interface{}) {
+		vals[":tr"] = query
+		in.ExpressionAttributeNames["#tr"] = aws.String(ts.cfg.Attributes.Reference)
+		in.KeyConditionExpression = aws.String("#st = :st and begins_with (#tr, :tr)")
+	})
+	if err != nil {
+		return nil, err
 	}
-	vals, err := dynamodbattribute.MarshalMap(valMap)
+
+	return ts.unmarshalTransactions(items)
+}
+
+// GetAllTransactionsInState gets all transcation documents of a given state.
+// GetAllTransactionsInState is used for recovering all incomplete/failed transactions.
+// If the projection does not contain ExpiresAt, the deadlines of Pending transactions are read from the table with
+// BatchGetItem requests.
+func (ts *TransactionStore) GetAllTransactionsInState(ctx context.Context, state TransactionState) ([]*Transaction, error) {
+	items, err := ts.queryStateIndex(ctx, state, func(in *dynamodb.QueryInput, vals map[string]interface{}) {
+		// Attribute names are used for all projected attributes since some defaults such as source and value are reserved words.
+		projection := make([]string, 0, len(ts.cfg.Projection))
+		for i, p := range ts.cfg.Projection {
+			n := fmt.Sprintf("#p%d", i)
+			in.ExpressionAttributeNames[n] = aws.String(p)
+			projection = append(projection, n)
+		}
+		in.KeyConditionExpression = aws.String("#st = :st")
+		in.ProjectionExpression = aws.String(strings.Join(projection, ", "))
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	in := &dynamodb.QueryInput{
-		TableName:                 aws.String(ts.tableName),
-		IndexName:                 aws.String("state-index"),
-		KeyConditionExpression:    aws.String("transaction_state = :st and begins_with (transaction_reference, :tr)"),
-		ExpressionAttributeValues: vals,
+	trs, err := ts.unmarshalTransactions(items)
+	if err != nil || state != Pending || ts.cfg.projects(ts.cfg.Attributes.ExpiresAt) {
+		return trs, err
 	}
+	if err := ts.readDeadlines(ctx, trs); err != nil {
+		return nil, err
+	}
+	return trs, nil
+}
 
-	res, err := ts.db.Query(in)
+// GetTransactionsByID retrieves the transaction documents of the given IDs with BatchGetItem requests of up to
+// maxBatchGetKeys transactions each. Transactions that do not exist are left out, and the transactions are returned
+// in no particular order.
+func (ts *TransactionStore) GetTransactionsByID(ctx context.Context, ids []string) ([]*Transaction, error) {
+	var trs []*Transaction
+	err := ts.batchGet(ctx, ids, nil, func(t *Transaction) {
+		trs = append(trs, t)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return trs, nil
+}
 
-	transactions := []*Transaction{}
-	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &transactions); err != nil {
-		return nil, err
+// readDeadlines reads the deadlines of transactions from the table with BatchGetItem requests.
+func (ts *TransactionStore) readDeadlines(ctx context.Context, trs []*Transaction) error {
+	byID := make(map[string]*Transaction, len(trs))
+	ids := make([]string, 0, len(trs))
+	for _, t := range trs {
+		byID[t.ID] = t
+		ids = append(ids, t.ID)
+	}
+	projection := &dynamodb.KeysAndAttributes{
+		ProjectionExpression: aws.String("#id, #ea"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String(ts.cfg.Attributes.ID),
+			"#ea": aws.String(ts.cfg.Attributes.ExpiresAt),
+		},
 	}
+	return ts.batchGet(ctx, ids, projection, func(full *Transaction) {
+		if t, ok := byID[full.ID]; ok {
+			t.ExpiresAt = full.ExpiresAt
+		}
+	})
+}
 
-	return transactions, nil
+// batchGet reads transactions with BatchGetItem requests of up to maxBatchGetKeys transactions each and calls f with
+// every transaction read. The projection of the requests is taken from projection unless it is nil.
+func (ts *TransactionStore) batchGet(ctx context.Context, ids []string, projection *dynamodb.KeysAndAttributes, f func(t *Transaction)) error {
+	for start := 0; start < len(ids); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+		for _, id := range ids[start:end] {
+			key, err := ts.key(id)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		ka := &dynamodb.KeysAndAttributes{Keys: keys}
+		if projection != nil {
+			ka.ProjectionExpression = projection.ProjectionExpression
+			ka.ExpressionAttributeNames = projection.ExpressionAttributeNames
+		}
+		requests := map[string]*dynamodb.KeysAndAttributes{ts.tableName: ka}
+		// Keys that have not been processed, e.g. because of throttling, are requested again.
+		for len(requests) > 0 {
+			res, err := ts.db.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: requests})
+			if err != nil {
+				return WrapDynamoDBError(err)
+			}
+			for _, item := range res.Responses[ts.tableName] {
+				t, err := ts.unmarshalTransaction(item)
+				if err != nil {
+					return err
+				}
+				f(t)
+			}
+			requests = res.UnprocessedKeys
+		}
+	}
+	return nil
 }
 
-// GetAllTransactionsInState gets all transcation documents of a given state.
-// GetAllTransactionsInState is used for recovering all incomplete/failed transactions.
-func (ts *TransactionStore) GetAllTransactionsInState(ctx context.Context, state TransactionState) ([]*Transaction, error) {
-	valMap := map[string]interface{}{
-		":st": state,
+// queryStateIndex queries the state index for all items of a given state.
+// build completes the query input and the expression attribute values of the query. The partition key of the
+// state index is bound to #st and :st.
+// With a sharded state index, all shards are queried in parallel and the results are merged in the order of their
+// transaction reference.
+func (ts *TransactionStore) queryStateIndex(ctx context.Context, state TransactionState, build func(in *dynamodb.QueryInput, vals map[string]interface{})) ([]map[string]*dynamodb.AttributeValue, error) {
+	newInput := func(key interface{}) (*dynamodb.QueryInput, error) {
+		in := &dynamodb.QueryInput{
+			TableName: aws.String(ts.tableName),
+			IndexName: aws.String(ts.cfg.StateIndexName),
+			ExpressionAttributeNames: map[string]*string{
+				"#st": aws.String(ts.cfg.stateIndexHashKey()),
+			},
+		}
+		valMap := map[string]interface{}{
+			":st": key,
+		}
+		build(in, valMap)
+		vals, err := dynamodbattribute.MarshalMap(valMap)
+		if err != nil {
+			return nil, err
+		}
+		in.ExpressionAttributeValues = vals
+		return in, nil
 	}
 
-	vals, err := dynamodbattribute.MarshalMap(valMap)
-	if err != nil {
-		return nil, err
+	if !ts.cfg.sharded() {
+		in, err := newInput(state)
+		if err != nil {
+			return nil, err
+		}
+		return ts.query(ctx, in)
 	}
 
-	namMap := map[string]*string{
-		"#s": aws.String("Source"),
-		"#v": aws.String("Value"),
+	type result struct {
+		items []map[string]*dynamodb.AttributeValue
+		err   error
 	}
+	results := make([]result, ts.cfg.StateShards)
+	var wg sync.WaitGroup
+	for shard := 0; shard < ts.cfg.StateShards; shard++ {
+		in, err := newInput(stateShardKey(state, shard))
+		if err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func(shard int, in *dynamodb.QueryInput) {
+			defer wg.Done()
+			items, err := ts.query(ctx, in)
+			results[shard] = result{items, err}
+		}(shard, in)
+	}
+	wg.Wait()
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		items = append(items, r.items...)
+	}
+	ref, id := ts.cfg.Attributes.Reference, ts.cfg.Attributes.ID
+	sort.SliceStable(items, func(i, j int) bool {
+		ri, rj := aws.StringValue(items[i][ref].S), aws.StringValue(items[j][ref].S)
+		if ri != rj {
+			return ri < rj
+		}
+		return aws.StringValue(items[i][id].S) < aws.StringValue(items[j][id].S)
+	})
+	return items, nil
+}
 
-	in := &dynamodb.QueryInput{
-		TableName:                 aws.String(ts.tableName),
-		IndexName:                 aws.String("state-index"),
-		KeyConditionExpression:    aws.String("transaction_state = :st"),
+// query returns all items matching a query by following LastEvaluatedKey.
+func (ts *TransactionStore) query(ctx context.Context, in *dynamodb.QueryInput) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := []map[string]*dynamodb.AttributeValue{}
+	for {
+		res, err := ts.db.QueryWithContext(ctx, in)
+		if err != nil {
+			return nil, WrapDynamoDBError(err)
+		}
+		items = append(items, res.Items...)
+		if len(res.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		next := *in
+		next.ExclusiveStartKey = res.LastEvaluatedKey
+		in = &next
+	}
+}
+
+// stateUpdate returns the update expression that sets the state of a transaction, including the state shard of a
+// sharded state index. The values and names of the expression are added to valMap and namMap.
+func (ts *TransactionStore) stateUpdate(id string, state TransactionState, valMap map[string]interface{}, namMap map[string]*string) string {
+	if !ts.cfg.sharded() {
+		return "SET #st = :v, #lm = :t"
+	}
+	valMap[":ss"] = stateShardKey(state, ts.cfg.stateShard(id))
+	namMap["#ss"] = aws.String(ts.cfg.Attributes.StateShard)
+	return "SET #st = :v, #ss = :ss, #lm = :t"
+}
+
+// BackfillStateShards writes the state shard of all transactions that are not final, reading them from indexName, a
+// state index partitioned by the State attribute such as the index used before StateShards was set. Transactions only
+// get a shard when their state changes, so transactions written before sharding was enabled are missing from the
+// sharded index and RecoverTransactions does not find them until they are backfilled. Transactions also keep the shard
+// of an earlier StateShards until their state changes, so the backfill must be repeated when StateShards is changed.
+// Transactions whose shard is current or whose state changes concurrently are skipped.
+// BackfillStateShards returns the number of transactions updated.
+func (ts *TransactionStore) BackfillStateShards(ctx context.Context, indexName string) (int, error) {
+	if !ts.cfg.sharded() {
+		return 0, nil
+	}
+	updated := 0
+	for _, state := range []TransactionState{Pending, Applied, Canceling} {
+		vals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+			":st": state,
+		})
+		if err != nil {
+			return updated, err
+		}
+		items, err := ts.query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(ts.tableName),
+			IndexName:              aws.String(indexName),
+			KeyConditionExpression: aws.String("#st = :st"),
+			ProjectionExpression:   aws.String("#id"),
+			ExpressionAttributeNames: map[string]*string{
+				"#st": aws.String(ts.cfg.Attributes.State),
+				"#id": aws.String(ts.cfg.Attributes.ID),
+			},
+			ExpressionAttributeValues: vals,
+		})
+		if err != nil {
+			return updated, err
+		}
+		for _, item := range items {
+			ok, err := ts.backfillStateShard(ctx, aws.StringValue(item[ts.cfg.Attributes.ID].S), state)
+			if err != nil {
+				return updated, err
+			}
+			if ok {
+				updated++
+			}
+		}
+	}
+	return updated, nil
+}
+
+// backfillStateShard sets the state shard of a transaction in the given state. It reports false if the shard is
+// already current or the state of the transaction has changed.
+func (ts *TransactionStore) backfillStateShard(ctx context.Context, id string, state TransactionState) (bool, error) {
+	key, err := ts.key(id)
+	if err != nil {
+		return false, err
+	}
+	vals, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":v":  state,
+		":ss": stateShardKey(state, ts.cfg.stateShard(id)),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	in := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(ts.tableName),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET #ss = :ss"),
+		ConditionExpression: aws.String("#st = :v AND (attribute_not_exists(#ss) OR #ss <> :ss)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#st": aws.String(ts.cfg.Attributes.State),
+			"#ss": aws.String(ts.cfg.Attributes.StateShard),
+		},
 		ExpressionAttributeValues: vals,
-		ExpressionAttributeNames:  namMap,
-		ProjectionExpression:      aws.String("ID, #s, destination, #v, last_modified"),
 	}
+	if _, err := ts.db.UpdateItemWithContext(ctx, in); err != nil {
+		if isConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, WrapDynamoDBError(err)
+	}
+	return true, nil
+}
+
+func (ts *TransactionStore) key(id string) (map[string]*dynamodb.AttributeValue, error) {
+	pk := map[string]string{
+		ts.cfg.Attributes.ID: id,
+	}
+	return dynamodbattribute.MarshalMap(pk)
+}
 
-	res, err := ts.db.Query(in)
+func (ts *TransactionStore) marshalTransaction(t Transaction) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(t)
 	if err != nil {
 		return nil, err
 	}
+	return ts.cfg.Attributes.toItem(item), nil
+}
 
-	transactions := []*Transaction{}
-	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &transactions); err != nil {
+func (ts *TransactionStore) unmarshalTransaction(item map[string]*dynamodb.AttributeValue) (*Transaction, error) {
+	t := &Transaction{}
+	if err := dynamodbattribute.UnmarshalMap(ts.cfg.Attributes.fromItem(item), t); err != nil {
 		return nil, err
 	}
+	return t, nil
+}
 
+func (ts *TransactionStore) unmarshalTransactions(items []map[string]*dynamodb.AttributeValue) ([]*Transaction, error) {
+	transactions := []*Transaction{}
+	for _, item := range items {
+		t, err := ts.unmarshalTransaction(item)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
 	return transactions, nil
 }
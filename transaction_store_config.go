@@ -0,0 +1,223 @@
+package dtpc
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TransactionAttributes contains the attribute names of transaction documents.
+type TransactionAttributes struct {
+	// Partition key of the transaction table
+	ID string
+	// Range key of the state index
+	Reference string
+	// Partition key of the state index
+	State string
+	// ID of the source account
+	Source string
+	// ID of the destination account
+	Destination string
+	// Data of a transaction
+	Value string
+	// Time of the latest modification
+	LastModified string
+	// Deadline of a transaction
+	ExpiresAt string
+	// Partition key of the state index when the state index is sharded.
+	// It holds the transaction state and the shard number of the transaction separated by '#'.
+	StateShard string
+}
+
+// TransactionStoreConfig contains the table schema used by a TransactionStore.
+// Zero values are replaced by the defaults of DefaultTransactionStoreConfig.
+type TransactionStoreConfig struct {
+	// Name of the transaction table
+	TableName string
+	// Name of the GSI partitioned by transaction state and sorted by transaction reference
+	StateIndexName string
+	// Attribute names of transaction documents
+	Attributes TransactionAttributes
+	// Number of write shards of the state index. The state index is partitioned by the StateShard attribute instead of
+	// the State attribute when StateShards is greater than one, and queries fan out across all shards. Transactions
+	// written with a different number of shards must be backfilled with BackfillStateShards.
+	StateShards int
+	// Attributes returned by GetAllTransactionsInState. It must contain the ID, Source, Destination, Value and LastModified
+	// attributes, which are required to recover transactions, and can only contain attributes projected into the state index.
+	// State indexes created before transactions had deadlines do not project ExpiresAt. Leave it out of the projection
+	// of such an index, and GetAllTransactionsInState reads the deadlines of Pending transactions from the table instead,
+	// with one BatchGetItem request per 100 transactions.
+	Projection []string
+}
+
+// DefaultTransactionStoreConfig returns the table schema used by NewTransactionStore.
+func DefaultTransactionStoreConfig(tableName string) TransactionStoreConfig {
+	attrs := TransactionAttributes{
+		ID:           "id",
+		Reference:    "transaction_reference",
+		State:        "transaction_state",
+		Source:       "source",
+		Destination:  "destination",
+		Value:        "value",
+		LastModified: "last_modified",
+		ExpiresAt:    "expires_at",
+		StateShard:   "transaction_state_shard",
+	}
+	return TransactionStoreConfig{
+		TableName:      tableName,
+		StateIndexName: "state-index",
+		Attributes:     attrs,
+		Projection:     attrs.all(),
+	}
+}
+
+// withDefaults returns a copy of cfg with zero values replaced by defaults.
+func (cfg TransactionStoreConfig) withDefaults() TransactionStoreConfig {
+	def := DefaultTransactionStoreConfig(cfg.TableName)
+	if cfg.StateIndexName == "" {
+		cfg.StateIndexName = def.StateIndexName
+	}
+	attrs := []*string{
+		&cfg.Attributes.ID,
+		&cfg.Attributes.Reference,
+		&cfg.Attributes.State,
+		&cfg.Attributes.Source,
+		&cfg.Attributes.Destination,
+		&cfg.Attributes.Value,
+		&cfg.Attributes.LastModified,
+		&cfg.Attributes.ExpiresAt,
+	}
+	for i, d := range def.Attributes.all() {
+		if *attrs[i] == "" {
+			*attrs[i] = d
+		}
+	}
+	if cfg.Attributes.StateShard == "" {
+		cfg.Attributes.StateShard = def.Attributes.StateShard
+	}
+	if len(cfg.Projection) == 0 {
+		cfg.Projection = cfg.Attributes.all()
+	}
+	return cfg
+}
+
+// Validate checks that the table schema is complete and consistent.
+func (cfg TransactionStoreConfig) Validate() error {
+	if cfg.TableName == "" {
+		return fmt.Errorf("transaction table name is required")
+	}
+	if cfg.StateIndexName == "" {
+		return fmt.Errorf("state index name is required")
+	}
+
+	if cfg.StateShards < 0 {
+		return fmt.Errorf("number of state shards must not be negative")
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range cfg.Attributes.all() {
+		if a == "" {
+			return fmt.Errorf("transaction attribute names must not be empty: %+v", cfg.Attributes)
+		}
+		if seen[a] {
+			return fmt.Errorf("transaction attribute name %s is used more than once", a)
+		}
+		seen[a] = true
+	}
+	if cfg.sharded() {
+		if cfg.Attributes.StateShard == "" {
+			return fmt.Errorf("state shard attribute name is required with a sharded state index")
+		}
+		if seen[cfg.Attributes.StateShard] {
+			return fmt.Errorf("transaction attribute name %s is used more than once", cfg.Attributes.StateShard)
+		}
+	}
+
+	projected := make(map[string]bool)
+	for _, p := range cfg.Projection {
+		if !seen[p] {
+			return fmt.Errorf("projected attribute %s is not a transaction attribute", p)
+		}
+		projected[p] = true
+	}
+	a := cfg.Attributes
+	for _, r := range []string{a.ID, a.Source, a.Destination, a.Value, a.LastModified} {
+		if !projected[r] {
+			return fmt.Errorf("projection must contain attribute %s to recover transactions", r)
+		}
+	}
+	return nil
+}
+
+// sharded reports whether the state index is partitioned by the StateShard attribute.
+func (cfg TransactionStoreConfig) sharded() bool {
+	return cfg.StateShards > 1
+}
+
+// stateIndexHashKey returns the partition key of the state index.
+func (cfg TransactionStoreConfig) stateIndexHashKey() string {
+	if cfg.sharded() {
+		return cfg.Attributes.StateShard
+	}
+	return cfg.Attributes.State
+}
+
+// stateShard returns the shard of a transaction. The shard only depends on the transaction ID
+// so that state updates do not need to read the transaction document.
+func (cfg TransactionStoreConfig) stateShard(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(cfg.StateShards))
+}
+
+// stateShardKey returns the value of the StateShard attribute of a transaction in the given state and shard.
+func stateShardKey(state TransactionState, shard int) string {
+	return fmt.Sprintf("%d#%d", state, shard)
+}
+
+// all returns the attribute names in the order of the Transaction fields.
+func (a TransactionAttributes) all() []string {
+	return []string{a.ID, a.Reference, a.State, a.Source, a.Destination, a.Value, a.LastModified, a.ExpiresAt}
+}
+
+// projects reports whether GetAllTransactionsInState returns the given attribute.
+func (cfg TransactionStoreConfig) projects(attr string) bool {
+	for _, p := range cfg.Projection {
+		if p == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTransactionAttributes are the attribute names produced by marshalling a Transaction.
+var defaultTransactionAttributes = DefaultTransactionStoreConfig("").Attributes
+
+// toItem renames the attributes of a marshalled Transaction to the configured attribute names.
+func (a TransactionAttributes) toItem(m map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	return renameAttributes(m, defaultTransactionAttributes.all(), a.all())
+}
+
+// fromItem renames the configured attribute names of an item to the attributes of a marshalled Transaction.
+func (a TransactionAttributes) fromItem(m map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	return renameAttributes(m, a.all(), defaultTransactionAttributes.all())
+}
+
+func renameAttributes(m map[string]*dynamodb.AttributeValue, from, to []string) map[string]*dynamodb.AttributeValue {
+	if m == nil {
+		return nil
+	}
+	names := make(map[string]string, len(from))
+	for i := range from {
+		names[from[i]] = to[i]
+	}
+	out := make(map[string]*dynamodb.AttributeValue, len(m))
+	for k, v := range m {
+		if n, ok := names[k]; ok {
+			k = n
+		}
+		out[k] = v
+	}
+	return out
+}
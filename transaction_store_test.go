@@ -2,10 +2,15 @@ package dtpc
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
@@ -13,21 +18,24 @@ import (
 
 type TransactioStoreFakeDynamoDB struct {
 	dynamodbiface.DynamoDBAPI
+	putItemInput *dynamodb.PutItemInput
+	queryInput   *dynamodb.QueryInput
 }
 
 func NewTransactioStoreFakeDynamoDB() *TransactioStoreFakeDynamoDB {
 	return &TransactioStoreFakeDynamoDB{}
 }
 
-func (db *TransactioStoreFakeDynamoDB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+func (db *TransactioStoreFakeDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.putItemInput = in
 	return &dynamodb.PutItemOutput{}, nil
 }
 
-func (db *TransactioStoreFakeDynamoDB) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+func (db *TransactioStoreFakeDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
 	return &dynamodb.UpdateItemOutput{}, nil
 }
 
-func (db *TransactioStoreFakeDynamoDB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+func (db *TransactioStoreFakeDynamoDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
 	out := make(map[string]string)
 	if err := dynamodbattribute.UnmarshalMap(in.Key, &out); err != nil {
 		return nil, err
@@ -45,7 +53,8 @@ func (db *TransactioStoreFakeDynamoDB) GetItem(in *dynamodb.GetItemInput) (*dyna
 	return res, nil
 }
 
-func (db *TransactioStoreFakeDynamoDB) Query(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+func (db *TransactioStoreFakeDynamoDB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	db.queryInput = in
 	t1, err := dynamodbattribute.MarshalMap(Transaction{
 		ID: "mock_transaction_id_1",
 	})
@@ -155,3 +164,202 @@ func TestGetAllTransactionsInState(t *testing.T) {
 		}
 	}
 }
+
+func TestStateTransitionItem(t *testing.T) {
+	store := NewTransactionStore(NewTransactioStoreFakeDynamoDB(), "transactions")
+
+	item, err := store.StateTransitionItem("mock_transaction_id", Pending, Done, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Update == nil || *item.Update.TableName != "transactions" || *item.Update.Key["id"].S != "mock_transaction_id" {
+		t.Fatal(fmt.Errorf("unexpected write item %v", item))
+	}
+	if *item.Update.ConditionExpression != "#st = :from" || *item.Update.ExpressionAttributeNames["#st"] != "transaction_state" {
+		t.Fatal(fmt.Errorf("unexpected condition expression %s", *item.Update.ConditionExpression))
+	}
+}
+
+func TestTransactionStoreConfigValidate(t *testing.T) {
+	if err := DefaultTransactionStoreConfig("transactions").Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	duplicate := DefaultTransactionStoreConfig("transactions")
+	duplicate.Attributes.Source = "destination"
+	missing := DefaultTransactionStoreConfig("transactions")
+	missing.Projection = []string{"id", "source", "destination", "value"}
+	unknown := DefaultTransactionStoreConfig("transactions")
+	unknown.Projection = append(unknown.Projection, "unknown")
+	noTable := DefaultTransactionStoreConfig("")
+	negativeShards := DefaultTransactionStoreConfig("transactions")
+	negativeShards.StateShards = -1
+	shardAttribute := DefaultTransactionStoreConfig("transactions")
+	shardAttribute.StateShards = 4
+	shardAttribute.Attributes.StateShard = "transaction_state"
+
+	for _, cfg := range []TransactionStoreConfig{duplicate, missing, unknown, noTable, negativeShards, shardAttribute} {
+		if _, err := NewTransactionStoreWithConfig(NewTransactioStoreFakeDynamoDB(), cfg); err == nil {
+			t.Fatal(fmt.Errorf("expected config %+v to be invalid", cfg))
+		}
+	}
+}
+
+func TestTransactionStoreWithConfig(t *testing.T) {
+	ctx := context.Background()
+	db := NewTransactioStoreFakeDynamoDB()
+	store, err := NewTransactionStoreWithConfig(db, TransactionStoreConfig{
+		TableName:      "transactions",
+		StateIndexName: "by-state",
+		Attributes: TransactionAttributes{
+			ID:    "pk",
+			State: "status",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Insert(ctx, "mock_source_account_id", "mock_destination_account_id", "mock_reference", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"pk", "status", "transaction_reference", "source"} {
+		if _, ok := db.putItemInput.Item[a]; !ok {
+			t.Fatal(fmt.Errorf("expected attribute %s in item %v", a, db.putItemInput.Item))
+		}
+	}
+	if _, ok := db.putItemInput.Item["id"]; ok {
+		t.Fatal(fmt.Errorf("expected attribute id to be renamed"))
+	}
+
+	if _, err := store.GetAllTransactionsInState(ctx, Pending); err != nil {
+		t.Fatal(err)
+	}
+	if *db.queryInput.IndexName != "by-state" || *db.queryInput.ExpressionAttributeNames["#st"] != "status" {
+		t.Fatal(fmt.Errorf("unexpected query %v", db.queryInput))
+	}
+	projected := map[string]bool{}
+	for _, n := range db.queryInput.ExpressionAttributeNames {
+		projected[*n] = true
+	}
+	for _, a := range []string{"pk", "source", "destination", "value", "last_modified"} {
+		if !projected[a] {
+			t.Fatal(fmt.Errorf("expected attribute %s to be projected", a))
+		}
+	}
+}
+
+// ShardedFakeDynamoDB serves state index queries from items keyed by their state shard.
+// Each shard is returned in pages of a single item.
+type ShardedFakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mu          sync.Mutex
+	shards      map[string][]map[string]*dynamodb.AttributeValue
+	queries     int
+	updateInput *dynamodb.UpdateItemInput
+}
+
+func (db *ShardedFakeDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	shard := *in.Item["transaction_state_shard"].S
+	db.shards[shard] = append(db.shards[shard], in.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *ShardedFakeDynamoDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.updateInput = in
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (db *ShardedFakeDynamoDB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries++
+	items := db.shards[*in.ExpressionAttributeValues[":st"].S]
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		fmt.Sscan(*in.ExclusiveStartKey["offset"].N, &start)
+	}
+	if start >= len(items) {
+		return &dynamodb.QueryOutput{}, nil
+	}
+	res := &dynamodb.QueryOutput{
+		Items: items[start : start+1],
+	}
+	if start+1 < len(items) {
+		res.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+			"offset": {N: aws.String(fmt.Sprint(start + 1))},
+		}
+	}
+	return res, nil
+}
+
+func TestShardedStateIndex(t *testing.T) {
+	ctx := context.Background()
+	db := &ShardedFakeDynamoDB{shards: make(map[string][]map[string]*dynamodb.AttributeValue)}
+	cfg := DefaultTransactionStoreConfig("transactions")
+	cfg.StateShards = 4
+	store, err := NewTransactionStoreWithConfig(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		id, err := store.Insert(ctx, "mock_source_account_id", "mock_destination_account_id", fmt.Sprintf("mock_reference_%02d", 19-i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = true
+	}
+	if len(db.shards) < 2 {
+		t.Fatal(fmt.Errorf("expected transactions to be spread across shards but got %d shards", len(db.shards)))
+	}
+	for shard := range db.shards {
+		if !strings.HasPrefix(shard, "0#") {
+			t.Fatal(fmt.Errorf("unexpected shard key %s", shard))
+		}
+	}
+
+	transactions, err := store.GetAllTransactionsInState(ctx, Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 20 {
+		t.Fatal(fmt.Errorf("expected 20 transactions but got %d", len(transactions)))
+	}
+	for i, tr := range transactions {
+		if !ids[tr.ID] || tr.TransactionReference != fmt.Sprintf("mock_reference_%02d", i) {
+			t.Fatal(fmt.Errorf("unexpected transaction %d %v", i, tr))
+		}
+	}
+	if db.queries < 20 {
+		t.Fatal(fmt.Errorf("expected all pages of all shards to be queried but got %d queries", db.queries))
+	}
+
+	if _, err := store.GetTransactionsInState(ctx, Done, "mock_reference"); err != nil {
+		t.Fatal(err)
+	}
+
+	var id string
+	for id = range ids {
+		break
+	}
+	if _, err := store.UpdateState(ctx, id, Done); err != nil {
+		t.Fatal(err)
+	}
+	shard := *db.updateInput.ExpressionAttributeValues[":ss"].S
+	if !strings.HasPrefix(shard, "2#") || *db.updateInput.UpdateExpression != "SET #st = :v, #ss = :ss, #lm = :t" {
+		t.Fatal(fmt.Errorf("unexpected update %v", db.updateInput))
+	}
+	item, err := store.StateTransitionItem(id, Pending, Done, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *item.Update.ExpressionAttributeValues[":ss"].S != shard {
+		t.Fatal(fmt.Errorf("expected the shard of a transaction to be stable"))
+	}
+}